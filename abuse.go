@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRobotsTag keeps search engines from indexing hosted bundles,
+	// which are code rather than pages.
+	defaultRobotsTag = "noindex, nofollow"
+	// abuseReportsPerMinute limits how often one client may report.
+	abuseReportsPerMinute = 5
+	maxAbuseReasonBytes   = 2000
+)
+
+// hostingConfig applies to the named bundles served at /bundles/, which may
+// be code submitted by third parties.
+type hostingConfig struct {
+	// RobotsTag is sent as the X-Robots-Tag header of hosted bundles.
+	RobotsTag string `json:"robotsTag"`
+	// QuarantineAfter quarantines a bundle as soon as this many reports
+	// about it are awaiting review, rather than waiting for an admin. Zero
+	// leaves every report to an admin.
+	QuarantineAfter int `json:"quarantineAfter"`
+}
+
+func (h hostingConfig) robotsTag() string {
+	if h.RobotsTag == "" {
+		return defaultRobotsTag
+	}
+	return h.RobotsTag
+}
+
+// Statuses of abuse reports.
+const (
+	reportOpen        = "open"
+	reportQuarantined = "quarantined"
+	reportDismissed   = "dismissed"
+)
+
+// abuseReport is a complaint about a hosted bundle, awaiting or after
+// review by an admin.
+type abuseReport struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Bundle  string    `json:"bundle"`
+	// Version is the version reported, when the report was about one.
+	Version  string     `json:"version,omitempty"`
+	Reason   string     `json:"reason"`
+	Reporter string     `json:"reporter"`
+	Status   string     `json:"status"`
+	Resolved *time.Time `json:"resolved,omitempty"`
+}
+
+var errReportNotFound = errors.New("report not found")
+
+// abuseQueue stores reports in the data directory, or in memory when there
+// isn't one.
+type abuseQueue struct {
+	mu      sync.Mutex
+	loaded  bool
+	reports []*abuseReport
+}
+
+var abuseReports = &abuseQueue{}
+
+func (q *abuseQueue) path() string {
+	return filepath.Join(cfg.DataDir, "abuse-reports.json")
+}
+
+func (q *abuseQueue) load() {
+	if q.loaded || cfg.DataDir == "" {
+		return
+	}
+	q.loaded = true
+	data, err := os.ReadFile(q.path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("loading abuse reports:", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &q.reports); err != nil {
+		log.Println("loading abuse reports:", err)
+	}
+}
+
+func (q *abuseQueue) save() error {
+	if cfg.DataDir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(q.reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path(), data)
+}
+
+// add stores a new report, returning how many reports about the same
+// bundle are now open.
+func (q *abuseQueue) add(rep *abuseReport) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.load()
+	q.reports = append(q.reports, rep)
+	open := 0
+	for _, other := range q.reports {
+		if other.Status == reportOpen && other.Tenant == rep.Tenant && other.Bundle == rep.Bundle {
+			open++
+		}
+	}
+	return open, q.save()
+}
+
+// list returns the reports with status, or every report when it is empty,
+// oldest first.
+func (q *abuseQueue) list(status string) []abuseReport {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.load()
+	reports := []abuseReport{}
+	for _, rep := range q.reports {
+		if status == "" || rep.Status == status {
+			reports = append(reports, *rep)
+		}
+	}
+	return reports
+}
+
+// resolve closes the report with id, along with every other open report
+// about the same bundle, returning the report.
+func (q *abuseQueue) resolve(id, status string) (abuseReport, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.load()
+	var found *abuseReport
+	for _, rep := range q.reports {
+		if rep.ID == id {
+			found = rep
+		}
+	}
+	if found == nil {
+		return abuseReport{}, errReportNotFound
+	}
+	now := time.Now().UTC()
+	for _, rep := range q.reports {
+		if rep == found || (rep.Status == reportOpen && rep.Tenant == found.Tenant && rep.Bundle == found.Bundle) {
+			rep.Status = status
+			rep.Resolved = &now
+		}
+	}
+	return *found, q.save()
+}
+
+// handleAbuseReport lets anyone report a hosted bundle:
+//
+//	POST /v1/abuse-reports  {"url": "<bundle URL>", "reason": "..."}
+func handleAbuseReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "reporting requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	reporter := callerKey(r, nil)
+	if ok, wait := rates.take("abuse-report:"+reporter, abuseReportsPerMinute, 0); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		http.Error(w, "too many reports", http.StatusTooManyRequests)
+		return
+	}
+	var body struct {
+		URL    string `json:"url"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&body); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" || len(body.Reason) > maxAbuseReasonBytes {
+		http.Error(w, "a reason of up to "+strconv.Itoa(maxAbuseReasonBytes)+" bytes is required", http.StatusBadRequest)
+		return
+	}
+	u, err := neturl.Parse(body.URL)
+	if err != nil {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	tenant, name, version, ok := parseBundlePath(u.Path)
+	if !ok {
+		http.Error(w, "url must be a bundle hosted here", http.StatusBadRequest)
+		return
+	}
+	if _, err := bundles.get(tenant, name); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	rep := &abuseReport{
+		ID:       newBuildID(),
+		Created:  time.Now().UTC(),
+		Tenant:   tenant,
+		Bundle:   name,
+		Version:  version,
+		Reason:   body.Reason,
+		Reporter: reporter,
+		Status:   reportOpen,
+	}
+	open, err := abuseReports.add(rep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if threshold := cfg.Hosting.QuarantineAfter; threshold > 0 && open >= threshold {
+		err := bundles.quarantine(tenant, name, &bundleQuarantine{
+			Since:  time.Now().UTC(),
+			Reason: strconv.Itoa(open) + " abuse reports awaiting review",
+		})
+		if err != nil {
+			log.Println("quarantining bundle:", err)
+		}
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"id": rep.ID, "status": rep.Status})
+}
+
+// handleAbuseReview is the admins' queue of reports:
+//
+//	GET  /v1/admin/abuse-reports?status=open     reports awaiting review
+//	POST /v1/admin/abuse-reports/<id>/quarantine  take the bundle down
+//	POST /v1/admin/abuse-reports/<id>/dismiss     serve the bundle again
+//
+// Either action closes every open report about the same bundle.
+func handleAbuseReview(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/admin/abuse-reports"), "/")
+	if rest == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "":
+			status = reportOpen
+		case "all":
+			status = ""
+		}
+		writeJSON(w, http.StatusOK, abuseReports.list(status))
+		return
+	}
+
+	id, action := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		id, action = rest[:i], rest[i+1:]
+	}
+	if r.Method != "POST" || (action != "quarantine" && action != "dismiss") {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := reportDismissed
+	if action == "quarantine" {
+		status = reportQuarantined
+	}
+	rep, err := abuseReports.resolve(id, status)
+	if err == errReportNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var q *bundleQuarantine
+	if action == "quarantine" {
+		q = &bundleQuarantine{Since: time.Now().UTC(), Reason: rep.Reason}
+	}
+	if err := bundles.quarantine(rep.Tenant, rep.Bundle, q); err != nil && err != errBundleNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
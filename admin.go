@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+)
+
+// isAdmin reports whether the request carries one of the configured admin
+// keys, which grant access to reports spanning every tenant.
+func isAdmin(r *http.Request) bool {
+	key := bearerToken(r)
+	if key == "" {
+		return false
+	}
+	for _, k := range cfg.AdminKeys {
+		if subtle.ConstantTimeCompare([]byte(os.ExpandEnv(k)), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin rejects requests that aren't from an admin, reporting
+// whether the request may go ahead.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !isAdmin(r) {
+		http.Error(w, "an admin key is required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
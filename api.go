@@ -0,0 +1,53 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiVersion is the version of the API served under /v1.
+const apiVersion = "1"
+
+// apiVersionHeader lets callers state which API version they were written
+// against. Requests for a version this server doesn't speak are refused
+// instead of being answered in a shape the caller can't read.
+const apiVersionHeader = "Conifer-API-Version"
+
+// withAPIVersion checks the version a request asks for and reports the
+// version that answered it.
+func withAPIVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(apiVersionHeader, apiVersion)
+		if v := strings.TrimPrefix(r.Header.Get(apiVersionHeader), "v"); v != "" && v != apiVersion {
+			http.Error(w, "unsupported API version "+v+", this server speaks version "+apiVersion, http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecateLegacyRoute marks a response from one of the unversioned routes
+// kept for existing callers, pointing them at the route replacing it.
+func deprecateLegacyRoute(w http.ResponseWriter, successor string) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Add("Link", "<"+cfg.PublicURL+successor+`>; rel="successor-version"`)
+	if sunset, err := time.Parse("2006-01-02", cfg.LegacySunset); err == nil {
+		w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+}
+
+// openAPISpec describes the /v1 API. The Go client in client/ and the
+// TypeScript client in clients/typescript are written against it, so all
+// three change whenever the API does.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// handleOpenAPI serves the API description.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxArchiveFiles limits how many files a project archive may unpack to.
+const maxArchiveFiles = 2000
+
+// archiveTypes are the content types of project archives, and whether they
+// are zip files rather than tarballs.
+var archiveTypes = map[string]bool{
+	"application/gzip":             false,
+	"application/x-gzip":           false,
+	"application/x-tar":            false,
+	"application/zip":              true,
+	"application/x-zip-compressed": true,
+}
+
+// isArchive reports whether a content type is that of a project archive.
+func isArchive(contentType string) bool {
+	_, ok := archiveTypes[strings.TrimSpace(strings.Split(contentType, ";")[0])]
+	return ok
+}
+
+// archiveFiles collects the files unpacked from an archive, keeping only
+// those a build can load.
+type archiveFiles struct {
+	files    map[string]string
+	bytes    int64
+	maxBytes int64
+}
+
+func (a *archiveFiles) add(name string, r io.Reader) error {
+	if _, ok := loadersByExtension[path.Ext(name)]; !ok {
+		return nil
+	}
+	if len(a.files) >= maxArchiveFiles {
+		return errors.New("the archive has too many files")
+	}
+	contents, err := io.ReadAll(io.LimitReader(r, a.maxBytes-a.bytes+1))
+	if err != nil {
+		return err
+	}
+	a.bytes += int64(len(contents))
+	if a.bytes > a.maxBytes {
+		return errors.New("the archive unpacks to too many bytes")
+	}
+	a.files[path.Clean("/"+name)] = string(contents)
+	return nil
+}
+
+// stripTopDirectory removes a directory every file is in, like the
+// "package" directory of npm tarballs or the one git archive --prefix adds.
+func (a *archiveFiles) stripTopDirectory() {
+	top := ""
+	for name := range a.files {
+		parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)
+		if len(parts) == 1 || (top != "" && parts[0] != top) {
+			return
+		}
+		top = parts[0]
+	}
+	if top == "" {
+		return
+	}
+	stripped := make(map[string]string, len(a.files))
+	for name, contents := range a.files {
+		stripped[strings.TrimPrefix(name, "/"+top)] = contents
+	}
+	a.files = stripped
+}
+
+func unpackTar(r io.Reader, a *archiveFiles) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := a.add(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func unpackZip(data []byte, a *archiveFiles) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = a.add(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackArchive returns the files of a project archive of the content type
+// given, keyed by their paths inside it, refusing to unpack more than
+// maxBytes.
+func unpackArchive(contentType string, data []byte, maxBytes int64) (map[string]string, error) {
+	a := &archiveFiles{files: make(map[string]string), maxBytes: maxBytes}
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	var err error
+	switch {
+	case archiveTypes[mediaType]:
+		err = unpackZip(data, a)
+	case mediaType == "application/x-tar":
+		err = unpackTar(bytes.NewReader(data), a)
+	default:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			err = unpackTar(zr, a)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.stripTopDirectory()
+	return a.files, nil
+}
+
+// serveArchiveBuild builds a project sent as a gzipped tarball, tarball or
+// zip file, starting from the entry query parameter, which defaults to an
+// index file at the project's root. Files the build can't load are left
+// out, and a directory containing everything, like the "package" directory
+// of npm tarballs, is removed from paths. The options query parameter holds
+// the other options of a JSON build request:
+//
+//	tar -cz src package.json | curl --data-binary @- -H 'Content-Type: application/gzip' '.../v1/build?entry=src/index.ts'
+func serveArchiveBuild(w http.ResponseWriter, r *http.Request) {
+	body, ok := readArchiveBuild(w, r)
+	if !ok {
+		return
+	}
+	serveBuildBody(w, r, body)
+}
+
+// readArchiveBuild reads the build a project archive describes, see
+// serveArchiveBuild. When it can't, the error is written and false is
+// returned.
+func readArchiveBuild(w http.ResponseWriter, r *http.Request) (jsonBuildRequest, bool) {
+	var body jsonBuildRequest
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBuildRequestBytes))
+	if err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return body, false
+	}
+	q := r.URL.Query()
+	if options := q.Get("options"); options != "" {
+		if err := json.Unmarshal([]byte(options), &body); err != nil {
+			http.Error(w, "invalid options: "+err.Error(), http.StatusBadRequest)
+			return body, false
+		}
+	}
+	if entry := q.Get("entry"); entry != "" {
+		body.Entry = entry
+	}
+	body.Files, err = unpackArchive(r.Header.Get("Content-Type"), data, maxBuildRequestBytes)
+	if err != nil {
+		http.Error(w, "invalid archive: "+err.Error(), http.StatusBadRequest)
+		return body, false
+	}
+	if len(body.Files) == 0 {
+		http.Error(w, "the archive has no files to build", http.StatusBadRequest)
+		return body, false
+	}
+	return body, true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// artifactStore keeps finished builds in object storage, making conifer a
+// durable store of build artifacts. Outputs are stored as
+// outputs/<artifact>.js, where the artifact ID hashes the request along
+// with the hash of every module that went into it. Each request also has
+// an index object recording its latest artifact, so a request can be
+// answered from storage once its modules are confirmed unchanged.
+type artifactStore struct {
+	objects *objectStore
+}
+
+var artifacts *artifactStore
+
+// artifactIndex is stored as requests/<request key>.json.
+type artifactIndex struct {
+	Artifact string        `json:"artifact"`
+	Manifest buildManifest `json:"manifest"`
+	Metafile *metafile     `json:"metafile"`
+	Graph    []importEdge  `json:"graph,omitempty"`
+}
+
+// artifactID hashes a build request's key with its dependencies' hashes.
+func artifactID(requestKey string, manifest buildManifest) string {
+	lines := []string{requestKey}
+	for _, m := range manifest.Modules {
+		lines = append(lines, m.URL+" "+m.SHA256)
+	}
+	sort.Strings(lines[1:])
+	return sha256Hex([]byte(strings.Join(lines, "\n")))
+}
+
+// lookup returns the stored output for the request when every module it
+// was built from still has the same contents.
+func (a *artifactStore) lookup(requestKey string) (*buildResult, bool) {
+	data, err := a.objects.get("requests/" + requestKey + ".json")
+	if err != nil {
+		if err != errObjectNotFound {
+			log.Println("artifacts:", err)
+		}
+		return nil, false
+	}
+	var index artifactIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, false
+	}
+
+	f := newFetcher()
+	for _, m := range index.Manifest.Modules {
+		mod, err := f.fetch(m.URL)
+		if err != nil || mod.SHA256 != m.SHA256 {
+			return nil, false
+		}
+	}
+	code, err := a.objects.get("outputs/" + index.Artifact + ".js")
+	if err != nil {
+		if err != errObjectNotFound {
+			log.Println("artifacts:", err)
+		}
+		return nil, false
+	}
+	return &buildResult{Code: code, Manifest: index.Manifest, Metafile: index.Metafile, Graph: index.Graph, Artifact: index.Artifact, Reused: true}, true
+}
+
+// store saves a finished build, returning its artifact ID.
+func (a *artifactStore) store(requestKey string, result *buildResult) (string, error) {
+	id := artifactID(requestKey, result.Manifest)
+	if err := a.objects.put("outputs/"+id+".js", result.Code, "text/javascript;charset=UTF-8"); err != nil {
+		return "", err
+	}
+	index, err := json.Marshal(artifactIndex{Artifact: id, Manifest: result.Manifest, Metafile: result.Metafile, Graph: result.Graph})
+	if err != nil {
+		return "", err
+	}
+	return id, a.objects.put("requests/"+requestKey+".json", index, "application/json")
+}
+
+// handleArtifact serves stored outputs at /v1/artifacts/<artifact>.js.
+// An artifact never changes, so it can be cached forever.
+func handleArtifact(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/artifacts/"), ".js")
+	if artifacts == nil || len(id) != 64 || strings.Trim(id, "0123456789abcdef") != "" {
+		http.NotFound(w, r)
+		return
+	}
+	code, err := artifacts.objects.get("outputs/" + id + ".js")
+	if err == errObjectNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	allowCrossOrigin(w, r, false)
+	writeJavaScript(w, r, code, "public, max-age=31536000, immutable")
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentBuildRecords is how many build records are kept when there is no
+// data directory to store them in.
+const recentBuildRecords = 1000
+
+// defaultBuildRetention is how long build records are kept in the data
+// directory, unless the config sets buildRetention. Records hold the
+// caller's source, so aren't kept forever.
+const defaultBuildRetention = 30 * 24 * time.Hour
+
+// buildPruneInterval is how often old build records are looked for.
+const buildPruneInterval = time.Hour
+
+// buildRecord is what is remembered about a finished build, enough to run
+// it again and check the output is unchanged.
+type buildRecord struct {
+	ID       string        `json:"id"`
+	Created  time.Time     `json:"created"`
+	Tenant   string        `json:"tenant,omitempty"`
+	Request  buildRequest  `json:"request"`
+	Manifest buildManifest `json:"manifest"`
+	// OutputSHA256 is the hex encoded hash of the output.
+	OutputSHA256 string `json:"outputSha256"`
+}
+
+var errBuildNotFound = errors.New("build not found")
+
+// buildLog stores build records in the data directory, or keeps the most
+// recent ones in memory when there isn't one.
+type buildLog struct {
+	mu      sync.Mutex
+	records map[string]*buildRecord
+	order   []string
+	// pruned is when records past their retention were last removed from
+	// the data directory.
+	pruned time.Time
+}
+
+var builds = &buildLog{records: make(map[string]*buildRecord)}
+
+func newBuildID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validBuildID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// record stores a successful build, returning its ID.
+func (l *buildLog) record(req buildRequest, result *buildResult) string {
+	// The request's context and progress reports end with its response,
+	// so a replay mustn't inherit them.
+	req.Context, req.OnModule = nil, nil
+	rec := &buildRecord{
+		ID:           newBuildID(),
+		Created:      time.Now().UTC(),
+		Tenant:       req.Tenant,
+		Request:      req,
+		Manifest:     result.Manifest,
+		OutputSHA256: sha256Hex(result.Code),
+	}
+	if cfg.DataDir != "" {
+		data, err := json.MarshalIndent(rec, "", "  ")
+		if err == nil {
+			err = writeFileAtomic(filepath.Join(cfg.DataDir, "builds", rec.ID+".json"), data)
+		}
+		if err != nil {
+			log.Println("recording build:", err)
+		}
+		l.mu.Lock()
+		if time.Since(l.pruned) > buildPruneInterval {
+			l.pruned = time.Now()
+			go pruneBuildRecords()
+		}
+		l.mu.Unlock()
+		return rec.ID
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records[rec.ID] = rec
+	l.order = append(l.order, rec.ID)
+	if len(l.order) > recentBuildRecords {
+		delete(l.records, l.order[0])
+		l.order = l.order[1:]
+	}
+	return rec.ID
+}
+
+// pruneBuildRecords removes the records in the data directory older than
+// their retention.
+func pruneBuildRecords() {
+	retention := time.Duration(cfg.BuildRetention)
+	if retention <= 0 {
+		retention = defaultBuildRetention
+	}
+	dir := filepath.Join(cfg.DataDir, "builds")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println("pruning build records:", err)
+		return
+	}
+	cutoff := time.Now().Add(-retention)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			log.Println("pruning build records:", err)
+		}
+	}
+}
+
+func (l *buildLog) get(id string) (*buildRecord, error) {
+	if !validBuildID(id) {
+		return nil, errBuildNotFound
+	}
+	if cfg.DataDir == "" {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		rec, ok := l.records[id]
+		if !ok {
+			return nil, errBuildNotFound
+		}
+		return rec, nil
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.DataDir, "builds", id+".json"))
+	if os.IsNotExist(err) {
+		return nil, errBuildNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var rec buildRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// moduleChange is a module whose contents differ between a build and its
+// replay. An empty hash means the module wasn't part of that build.
+type moduleChange struct {
+	URL    string `json:"url"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+type replayReport struct {
+	ID            string         `json:"id"`
+	OutputMatches bool           `json:"outputMatches"`
+	OutputSHA256  string         `json:"outputSha256"`
+	ReplaySHA256  string         `json:"replaySha256,omitempty"`
+	Changed       []moduleChange `json:"changed"`
+	Errors        []string       `json:"errors,omitempty"`
+	Engine        engineInfo     `json:"engine"`
+}
+
+// replay builds a recorded request again, downloading every module afresh
+// rather than from the cache, and reports what differs. Changed modules
+// point at upstream drift, while an unchanged graph with different output
+// points at the engine or at a corrupted cache.
+func replay(rec *buildRecord) replayReport {
+	req := rec.Request
+	req.Tenant = rec.Tenant
+	req.BypassCache = true
+	result := runBuild(req)
+
+	report := replayReport{ID: rec.ID, OutputSHA256: rec.OutputSHA256, Changed: []moduleChange{}, Engine: engine}
+	for _, msg := range result.Errors {
+		report.Errors = append(report.Errors, msg.Text)
+	}
+	if len(result.Errors) == 0 {
+		report.ReplaySHA256 = sha256Hex(result.Code)
+		report.OutputMatches = report.ReplaySHA256 == rec.OutputSHA256
+	}
+
+	before := make(map[string]string)
+	for _, m := range rec.Manifest.Modules {
+		before[m.URL] = m.SHA256
+	}
+	for _, m := range result.Manifest.Modules {
+		if before[m.URL] != m.SHA256 {
+			report.Changed = append(report.Changed, moduleChange{URL: m.URL, Before: before[m.URL], After: m.SHA256})
+		}
+		delete(before, m.URL)
+	}
+	for url, sum := range before {
+		report.Changed = append(report.Changed, moduleChange{URL: url, Before: sum})
+	}
+	return report
+}
+
+// handleBuildAPI looks up the caller's past builds:
+//
+//	GET  /v1/builds/<id>             the build's record
+//	GET  /v1/builds/<id>/provenance  an in-toto attestation of how it was built
+//	POST /v1/builds/<id>/replay      build it again and report any differences
+//
+// Replays run uncached, outside any caller's limits, so only admins may
+// ask for them, of any tenant's builds.
+func handleBuildAPI(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/builds/")
+	id, action := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		id, action = rest[:i], rest[i+1:]
+	}
+	if action == "replay" && !requireAdmin(w, r) {
+		return
+	}
+	rec, err := builds.get(id)
+	if err == errBuildNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tenant := ""
+	if t := tenantFor(r); t != nil {
+		tenant = t.Name
+	}
+	if rec.Tenant != tenant && !isAdmin(r) {
+		// Builds are private to their tenant.
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, rec)
+	case action == "provenance" && r.Method == "GET":
+		provenance, err := recordProvenance(rec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, provenance)
+	case action == "replay" && r.Method == "POST":
+		writeJSON(w, http.StatusOK, replay(rec))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// replayCommand implements "conifer replay <build-id>", exiting with a
+// failure status when the output no longer matches.
+func replayCommand(id string) int {
+	rec, err := builds.get(id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 2
+	}
+	report := replay(rec)
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if !report.OutputMatches {
+		return 1
+	}
+	return 0
+}
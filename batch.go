@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// maxBatchBuilds is how many builds one batch may hold.
+	maxBatchBuilds = 100
+	// batchWorkers is how many builds of a batch run at once, so one batch
+	// can't take every build slot.
+	batchWorkers = 4
+)
+
+type batchRequest struct {
+	Builds []jsonBuildRequest `json:"builds"`
+}
+
+// batchResult is the outcome of one build of a batch, in the order the
+// builds were given. Status is what the build would have responded with
+// on its own, with either Build or Error set.
+type batchResult struct {
+	Status int             `json:"status"`
+	Build  *buildEnvelope  `json:"build,omitempty"`
+	Error  *buildErrorBody `json:"error,omitempty"`
+	// RetryAfter is how many seconds to wait before retrying a build that
+	// was rate limited or refused under load.
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// handleBatch runs many JSON builds in one request:
+//
+//	POST /v1/batch {"builds": [{"source": "..."}, {"entry": "https://..."}]}
+//
+// Each build is authorized, limited and recorded as if it were requested
+// on its own, so one failing doesn't fail the others. The response holds
+// a result for each build once all of them are done.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBuildRequestBytes)).Decode(&body); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Builds) == 0 {
+		http.Error(w, "builds is required", http.StatusBadRequest)
+		return
+	}
+	if len(body.Builds) > maxBatchBuilds {
+		http.Error(w, "a batch may hold at most "+strconv.Itoa(maxBatchBuilds)+" builds", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]batchResult, len(body.Builds))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < batchWorkers && i < len(body.Builds); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j] = runBatchBuild(r, body.Builds[j])
+			}
+		}()
+	}
+	for i := range body.Builds {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	writeJSON(w, http.StatusOK, struct {
+		Results []batchResult `json:"results"`
+	}{results})
+}
+
+// runBatchBuild serves one build of a batch, capturing its response.
+func runBatchBuild(r *http.Request, body jsonBuildRequest) batchResult {
+	rec := newResponseRecorder()
+	serveBuildBody(rec, r, body)
+
+	result := batchResult{Status: rec.status, RetryAfter: rec.retryAfter()}
+	if rec.status == http.StatusOK {
+		var envelope buildEnvelope
+		if err := json.Unmarshal(rec.body.Bytes(), &envelope); err == nil {
+			result.Build = &envelope
+			return result
+		}
+	}
+	result.Error = rec.failure()
+	return result
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// buildRequest holds the options of a single build.
+type buildRequest struct {
+	Source string `json:"source"`
+	// Entry is the URL of a module built instead of Source, or with Files
+	// or Git, the path of the file the build starts from.
+	Entry string `json:"entry,omitempty"`
+	// Files are the files of a small project, keyed by absolute paths like
+	// "/src/index.ts", built instead of Source. They import one another
+	// with relative imports.
+	Files map[string]string `json:"files,omitempty"`
+	// Git is a commit of a repository whose files are built instead of
+	// Source, downloaded only when the build isn't cached.
+	Git    *gitSource `json:"git,omitempty"`
+	Minify bool       `json:"minify"`
+	// MinifyParts, when set, picks which kinds of minification are done
+	// instead of Minify doing them all.
+	MinifyParts *minifyParts `json:"minifyParts,omitempty"`
+	Bundle      bool         `json:"bundle"`
+	// Loader is how Source is parsed, one of loadersByName, or "js" when
+	// empty.
+	Loader string `json:"loader,omitempty"`
+	// Format is the module format of the output: "esm" when empty, "iife"
+	// or "cjs".
+	Format string `json:"format,omitempty"`
+	// Sourcemap is "inline" to append a source map to the output, or
+	// "external" to return it separately.
+	Sourcemap string `json:"sourcemap,omitempty"`
+	// KeepURLs are patterns of URLs left as imports rather than bundled.
+	KeepURLs []string `json:"keepUrls,omitempty"`
+	// Define replaces global identifiers with constant expressions.
+	Define map[string]string `json:"define,omitempty"`
+	// Lockfile, when set, refuses any module that differs from it.
+	Lockfile *lockfile `json:"lockfile,omitempty"`
+	// ImportMap resolves bare specifiers and remaps URLs, with scopes
+	// applying to modules imported from particular origins.
+	ImportMap *importMap `json:"importMap,omitempty"`
+	// Name identifies a bundle that is built repeatedly, so state such as
+	// the mangle cache can be carried from one build to the next.
+	Name string `json:"name,omitempty"`
+	// MangleProps is a regular expression of property names to mangle.
+	MangleProps string `json:"mangleProps,omitempty"`
+	// Splitting moves code shared by dynamic imports into separate chunks.
+	Splitting bool `json:"splitting,omitempty"`
+	// Target is the JavaScript version the output is lowered to, such as
+	// "es2017". Without it, syntax is left as written.
+	Target string `json:"target,omitempty"`
+	// ProxyURLs leaves remote imports unbundled, rewritten to be loaded
+	// through this service's /fetch endpoint.
+	ProxyURLs bool `json:"proxyUrls,omitempty"`
+	// TsconfigRaw is a tsconfig.json used to compile remote TypeScript.
+	TsconfigRaw string `json:"tsconfigRaw,omitempty"`
+	// Stamp is caller metadata written into the output.
+	Stamp *buildStamp `json:"stamp,omitempty"`
+	// Exposes makes the build a module federation remote, exposing modules
+	// under names like "./Button". See federation.go.
+	Exposes map[string]string `json:"exposes,omitempty"`
+	// Remotes maps aliases to the manifests of remotes whose modules the
+	// build imports, like "shop/Button".
+	Remotes map[string]string `json:"remotes,omitempty"`
+	// Routes maps the paths of a single-page app to the modules rendering
+	// them, each built into chunks of its own. See routes.go.
+	Routes map[string]string `json:"routes,omitempty"`
+	// Entries maps names to the modules of several entry points, each
+	// built into an output of its own. See entries.go.
+	Entries map[string]string `json:"entries,omitempty"`
+	// NPMDependencies imports the bare imports of files on the package CDN
+	// from the package routes of the versions their packages depend on,
+	// rather than bundling them. See npm.go.
+	NPMDependencies bool `json:"npmDependencies,omitempty"`
+	// Polyfill places polyfills for runtime features the output uses but
+	// Target lacks at the top of the output. See polyfills.go.
+	Polyfill bool `json:"polyfill,omitempty"`
+	// SmokeTest runs the output in a sandboxed runtime, failing the build
+	// when it throws. See smokeTestConfig.
+	SmokeTest bool `json:"smokeTest,omitempty"`
+
+	// Tenant is who the build is for, which scopes named state.
+	Tenant string `json:"-"`
+	// Watermark is a comment placed at the top of the output.
+	Watermark string `json:"watermark,omitempty"`
+	// BypassCache downloads every module, ignoring the module cache.
+	BypassCache bool `json:"-"`
+	// NoStale revalidates expired modules before building with them,
+	// rather than using them while they are revalidated in the background.
+	NoStale bool `json:"-"`
+	// NoMirror downloads modules from upstream even when they are mirrored.
+	NoMirror bool `json:"-"`
+	// OnModule, when set, is told of each module the build loads, to
+	// report its progress.
+	OnModule func(moduleEvent) `json:"-"`
+	// Context is the request's, whose cancellation, when the caller goes
+	// away, cancels the build's downloads.
+	Context context.Context `json:"-"`
+	// KeyLimits are those of the API key the build was asked for with,
+	// overriding its tenant's. They are part of the request so builds with
+	// different limits don't share output.
+	KeyLimits *limitsConfig `json:"keyLimits,omitempty"`
+	// SourceGenerated is whether Source was written by conifer, like a
+	// package's wrapper, rather than sent by the caller.
+	SourceGenerated bool `json:"-"`
+}
+
+// context returns the context of the request for the build, or the
+// background context when it has none.
+func (req buildRequest) context() context.Context {
+	if req.Context != nil {
+		return req.Context
+	}
+	return context.Background()
+}
+
+// minifyParts are the kinds of minification esbuild does.
+type minifyParts struct {
+	Whitespace  bool `json:"whitespace"`
+	Identifiers bool `json:"identifiers"`
+	Syntax      bool `json:"syntax"`
+}
+
+// minify returns the kinds of minification req asks for.
+func (req buildRequest) minify() minifyParts {
+	if req.MinifyParts != nil {
+		return *req.MinifyParts
+	}
+	return minifyParts{Whitespace: req.Minify, Identifiers: req.Minify, Syntax: req.Minify}
+}
+
+// sourceBytes is the size of the code req brings with it.
+func (req buildRequest) sourceBytes() int {
+	n := len(req.Source)
+	for _, contents := range req.Files {
+		n += len(contents)
+	}
+	return n
+}
+
+type buildResult struct {
+	Code []byte
+	// SourceMap is the output's source map, when one was asked for
+	// separately.
+	SourceMap []byte
+	Errors    []api.Message
+	Warnings  []api.Message
+	// Metafile describes the inputs and outputs, and is nil when the
+	// source was only transformed.
+	Metafile *metafile
+	Manifest buildManifest
+	Stats    buildStats
+	// Modules are the remote modules that were downloaded.
+	Modules []*module
+	// Graph is every import that was resolved.
+	Graph []importEdge
+	// Artifact identifies the output in the artifact store, if it is kept
+	// there.
+	Artifact string
+	// Exposes lists the names each module a remote exposes exports.
+	Exposes map[string][]string
+	// Routes says which chunks each route of a build of routes loads.
+	Routes *routeManifest
+	// Entries are the outputs of a build of entries, and their source
+	// maps, which has no Code of its own.
+	Entries []buildOutput
+	// Reused is set when the output was built earlier and kept, in the
+	// shared cache or the artifact store, so Stats are from then.
+	Reused bool
+}
+
+// buildManifest records what went into a build.
+type buildManifest struct {
+	Modules     []manifestModule `json:"modules"`
+	OutputBytes int              `json:"outputBytes"`
+	// Chunks are the names of the chunks the output imports, when code
+	// splitting is enabled.
+	Chunks []string `json:"chunks,omitempty"`
+	// Engine is the version of conifer and esbuild that made the build.
+	Engine engineInfo `json:"engine"`
+	// Pinned is set when every module was requested by an exact version
+	// or checked against a lockfile, so the same request always builds the
+	// same output.
+	Pinned bool `json:"pinned"`
+	// PostProcess records the steps the output went through after esbuild
+	// produced it.
+	PostProcess []postProcessRecord `json:"postProcess,omitempty"`
+	// Polyfills are the runtime features polyfilled for the target.
+	Polyfills []string `json:"polyfills,omitempty"`
+	// SmokeTest is the runtime the output was run in without throwing,
+	// when the build asked for a smoke test.
+	SmokeTest string `json:"smokeTest,omitempty"`
+}
+
+type manifestModule struct {
+	URL    string `json:"url"`
+	Bytes  int    `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+type buildStats struct {
+	DurationMS      int64 `json:"durationMs"`
+	DownloadedBytes int   `json:"downloadedBytes"`
+	// BundleMS is how long esbuild took, which includes resolving and
+	// downloading modules. DownloadMS sums how long each download took,
+	// so may be more than the time that passed when they overlapped.
+	BundleMS      int64 `json:"bundleMs"`
+	DownloadMS    int64 `json:"downloadMs"`
+	PolyfillMS    int64 `json:"polyfillMs,omitempty"`
+	PostProcessMS int64 `json:"postProcessMs"`
+	// ThrottleMS sums how long downloads waited for bandwidth, see
+	// bandwidthConfig.
+	ThrottleMS  int64 `json:"throttleMs,omitempty"`
+	SmokeTestMS int64 `json:"smokeTestMs,omitempty"`
+}
+
+// buildBanner is the comment placed at the top of a build's output.
+func buildBanner(req buildRequest) string {
+	var lines []string
+	if req.Watermark != "" {
+		lines = append(lines, "/* "+strings.ReplaceAll(req.Watermark, "*/", "* /")+" */")
+	}
+	if stamp := req.Stamp.banner(); stamp != "" {
+		lines = append(lines, stamp)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func runBuild(req buildRequest) *buildResult {
+	atomic.AddInt32(&activeBuilds, 1)
+	defer atomic.AddInt32(&activeBuilds, -1)
+	start := time.Now()
+	var result buildResult
+
+	var mangleCache map[string]interface{}
+	if req.MangleProps != "" && req.Name != "" {
+		mangleCache = mangleCaches.load(bundleKey(req.Tenant, req.Name))
+	}
+
+	// Anonymous builds get the default limits.
+	limits := req.limits()
+	ctx := req.context()
+	if limits.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(limits.BuildTimeout))
+		defer cancel()
+	}
+	banner := buildBanner(req)
+	define := req.Stamp.defines(req.Define)
+	minify := req.minify()
+	loader := api.LoaderJS
+	if l, ok := loadersByName[req.Loader]; ok {
+		loader = l
+	}
+
+	if req.Bundle {
+		f := newFetcher()
+		f.bypassCache = req.BypassCache
+		f.noStale = req.NoStale
+		f.noMirror = req.NoMirror
+		f.onModule = req.OnModule
+		f.ctx = ctx
+		f.limit(limits)
+		f.forTenant(tenantNamed(req.Tenant))
+		files, entry := req.Files, req.Entry
+		if req.Git != nil {
+			var err error
+			if files, err = req.Git.files(f, limits); err != nil {
+				result.Errors = []api.Message{{Text: err.Error(), Detail: err}}
+				return &result
+			}
+			if entry == "" {
+				var ok bool
+				if entry, ok = virtualFS(files).defaultEntry(); !ok {
+					result.Errors = []api.Message{{Text: "an entry is required, as " + req.Git.Repo + " has no index file at its root"}}
+					return &result
+				}
+			}
+		}
+		graph := &importGraph{}
+		plugin := &httpPlugin{
+			fetcher:      f,
+			keepURLs:     req.KeepURLs,
+			lockfile:     req.Lockfile,
+			importMap:    req.ImportMap,
+			tsconfigRaw:  req.TsconfigRaw,
+			graph:        graph,
+			proxyURLs:    req.ProxyURLs,
+			allowedHosts: limits.AllowedHosts,
+			blockedURLs:  limits.BlockedURLs,
+			policy:       policyFor(req.Tenant),
+			maxModules:   limits.MaxModules,
+			remotes:      req.Remotes,
+		}
+		if req.NPMDependencies {
+			plugin.requires = &requiredPackages{}
+			plugin.packageQuery = packageQuery(req)
+		}
+		options := api.BuildOptions{
+			Format:    formatsByName[req.Format],
+			Bundle:    true,
+			Splitting: req.Splitting,
+			// Outputs are never written, but splitting needs a directory
+			// to place chunks in. Chunk names are derived from their
+			// contents, so unchanged chunks keep their names across builds
+			// and stay cached. The entry is named stdin whether it is the
+			// source or a URL.
+			Outdir:            "out",
+			EntryNames:        "stdin",
+			ChunkNames:        "[name]-[hash]",
+			PublicPath:        cfg.PublicURL + chunkPath,
+			Plugins:           []api.Plugin{plugin.plugin()},
+			Banner:            map[string]string{"js": banner},
+			Target:            targetsByName[req.Target],
+			Define:            define,
+			MangleProps:       req.MangleProps,
+			MangleCache:       mangleCache,
+			Write:             false,
+			Metafile:          true,
+			Sourcemap:         sourcemapsByName[req.Sourcemap],
+			MinifyWhitespace:  minify.Whitespace,
+			MinifyIdentifiers: minify.Identifiers,
+			MinifySyntax:      minify.Syntax,
+		}
+		switch {
+		case len(req.Entries) > 0:
+			options.EntryPointsAdvanced = entryPoints(req.Entries)
+			options.EntryNames = "[name]"
+			if len(files) > 0 {
+				options.Plugins = append([]api.Plugin{virtualFS(files).plugin()}, options.Plugins...)
+			}
+		case len(files) > 0:
+			options.EntryPoints = []string{entry}
+			options.Plugins = append([]api.Plugin{virtualFS(files).plugin()}, options.Plugins...)
+		case req.Entry != "":
+			options.EntryPoints = []string{req.Entry}
+		case len(req.Exposes) > 0:
+			options.Stdin = &api.StdinOptions{
+				Contents:   federationEntry(req.Exposes),
+				ResolveDir: "./src",
+				Sourcefile: "remote-entry.js",
+			}
+		case len(req.Routes) > 0:
+			options.Stdin = &api.StdinOptions{
+				Contents:   routerEntry(req.Routes),
+				ResolveDir: "./src",
+				Sourcefile: "router.js",
+			}
+		default:
+			options.Stdin = &api.StdinOptions{
+				Contents: req.Source,
+				// These are all optional:
+				ResolveDir: "./src",
+				Sourcefile: "imaginary-file.js",
+				Loader:     loader,
+			}
+		}
+		bundling := time.Now()
+		built := api.Build(options)
+		result.Stats.BundleMS = time.Since(bundling).Milliseconds()
+		result.Stats.DownloadMS = time.Duration(atomic.LoadInt64(&f.downloading)).Milliseconds()
+		result.Stats.ThrottleMS = time.Duration(atomic.LoadInt64(&f.throttled)).Milliseconds()
+		result.Errors = built.Errors
+		if missing := f.missing(); len(missing) > 0 {
+			result.Errors = append([]api.Message{missingModulesError(missing)}, result.Errors...)
+		}
+		result.Warnings = built.Warnings
+		mangleCache = built.MangleCache
+		for _, file := range built.OutputFiles {
+			name := filepath.Base(file.Path)
+			if len(req.Entries) > 0 && isEntryOutput(req.Entries, name) {
+				result.Entries = append(result.Entries, buildOutput{Path: name, Contents: string(file.Contents)})
+				continue
+			}
+			if strings.HasPrefix(name, "stdin.") {
+				if strings.HasSuffix(name, ".map") {
+					result.SourceMap = file.Contents
+				} else {
+					result.Code = file.Contents
+				}
+				continue
+			}
+			if err := chunks.put(name, file.Contents); err != nil {
+				result.Errors = append(result.Errors, api.Message{Text: "storing chunk: " + err.Error()})
+			}
+			result.Manifest.Chunks = append(result.Manifest.Chunks, name)
+		}
+		sort.Slice(result.Entries, func(i, j int) bool { return result.Entries[i].Path < result.Entries[j].Path })
+		if plugin.requires != nil && len(result.Code) > 0 {
+			result.Code = append([]byte(plugin.requires.shim()), result.Code...)
+		}
+		if m, err := parseMetafile(built.Metafile); err == nil {
+			result.Metafile = m
+		}
+		result.Modules = f.modules()
+		result.Manifest.Pinned = req.Lockfile != nil || f.pinned()
+		result.Graph = graph.sortedEdges()
+		if len(req.Exposes) > 0 {
+			result.Exposes = exposedExports(req.Exposes, result.Graph, result.Metafile)
+		}
+		if len(req.Routes) > 0 {
+			result.Routes = routeChunkManifest(req.Routes, result.Graph, result.Metafile)
+		}
+		for _, mod := range result.Modules {
+			result.Manifest.Modules = append(result.Manifest.Modules, manifestModule{
+				URL:    mod.URL,
+				Bytes:  len(mod.Contents),
+				SHA256: mod.SHA256,
+			})
+			result.Stats.DownloadedBytes += len(mod.Contents)
+		}
+	} else {
+		// Without bundling nothing is resolved, so imports (including
+		// remote ones) are left untouched and only the source itself is
+		// transformed.
+		bundling := time.Now()
+		transformed := api.Transform(req.Source, api.TransformOptions{
+			Sourcefile:        "imaginary-file.js",
+			Loader:            loader,
+			Format:            formatsByName[req.Format],
+			Banner:            banner,
+			Target:            targetsByName[req.Target],
+			Define:            define,
+			MangleProps:       req.MangleProps,
+			MangleCache:       mangleCache,
+			Sourcemap:         sourcemapsByName[req.Sourcemap],
+			MinifyWhitespace:  minify.Whitespace,
+			MinifyIdentifiers: minify.Identifiers,
+			MinifySyntax:      minify.Syntax,
+		})
+		result.Stats.BundleMS = time.Since(bundling).Milliseconds()
+		result.Errors = transformed.Errors
+		result.Warnings = transformed.Warnings
+		result.Code = transformed.Code
+		if len(transformed.Map) > 0 {
+			result.SourceMap = transformed.Map
+		}
+		result.Manifest.Pinned = true
+		mangleCache = transformed.MangleCache
+	}
+
+	if req.MangleProps != "" && req.Name != "" && len(result.Errors) == 0 {
+		if err := mangleCaches.save(bundleKey(req.Tenant, req.Name), mangleCache); err != nil {
+			log.Println("saving mangle cache:", err)
+		}
+	}
+	if req.Polyfill && req.Loader != "css" && len(result.Errors) == 0 {
+		polyfilling := time.Now()
+		result.Errors = append(result.Errors, injectPolyfills(req, &result)...)
+		result.Stats.PolyfillMS = time.Since(polyfilling).Milliseconds()
+	}
+	if len(result.Errors) == 0 {
+		processing := time.Now()
+		if err := postProcess(req, &result); err != nil {
+			result.Errors = append(result.Errors, api.Message{Text: err.Error()})
+		}
+		result.Stats.PostProcessMS = time.Since(processing).Milliseconds()
+	}
+	if req.SmokeTest && len(result.Errors) == 0 {
+		testing := time.Now()
+		if err := smokeTest(req, result.Code); err != nil {
+			msg := api.Message{Text: err.Error()}
+			if failed, ok := err.(*smokeTestError); ok {
+				msg.Detail = err
+				msg.Notes = []api.Note{{Text: failed.Output}}
+			}
+			result.Errors = append(result.Errors, msg)
+		} else {
+			result.Manifest.SmokeTest = cfg.SmokeTest.Runtime
+		}
+		result.Stats.SmokeTestMS = time.Since(testing).Milliseconds()
+	}
+	result.Manifest.OutputBytes = len(result.Code)
+	for _, out := range result.Entries {
+		result.Manifest.OutputBytes += len(out.Contents)
+	}
+	result.Manifest.Engine = engine
+	result.Stats.DurationMS = time.Since(start).Milliseconds()
+	return &result
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/sync/singleflight"
+)
+
+// cachedBuild is the part of a build result that is shared between
+// instances.
+type cachedBuild struct {
+	Code     []byte        `json:"code"`
+	Manifest buildManifest `json:"manifest"`
+	Metafile *metafile     `json:"metafile"`
+	Graph    []importEdge  `json:"graph,omitempty"`
+	Artifact string        `json:"artifact,omitempty"`
+	// Stats are those of the build when it ran.
+	Stats buildStats `json:"stats"`
+	// Expires is when the earliest of the build's modules expires, after
+	// which the build is refreshed, and StaleUntil is how long it may be
+	// served while that happens. Both are zero for pinned builds, which
+	// never change.
+	Expires    time.Time `json:"expires"`
+	StaleUntil time.Time `json:"staleUntil"`
+}
+
+func (c cachedBuild) result() *buildResult {
+	return &buildResult{Code: c.Code, Manifest: c.Manifest, Metafile: c.Metafile, Graph: c.Graph, Artifact: c.Artifact, Stats: c.Stats, Reused: true}
+}
+
+// buildCacheKey identifies everything that affects a build's output.
+func buildCacheKey(req buildRequest) (string, bool) {
+	// Splitting stores chunks locally, and mangling updates a local cache,
+	// so neither can be skipped by reusing another instance's output.
+	// External source maps and the outputs of entries aren't kept with
+	// shared output.
+	if req.Splitting || req.MangleProps != "" || req.Sourcemap == "external" || len(req.Entries) > 0 {
+		return "", false
+	}
+	if req.Stamp != nil && req.Stamp.Time != "" {
+		// Requests differing only in when they were made share output,
+		// which keeps the time it was first built at.
+		stamp := *req.Stamp
+		stamp.Time = "-"
+		req.Stamp = &stamp
+	}
+	data, err := json.Marshal(struct {
+		Request     buildRequest
+		Tenant      string
+		Engine      engineInfo
+		PostProcess []postProcessStep `json:",omitempty"`
+		Policy      *importPolicy     `json:",omitempty"`
+	}{req, req.Tenant, engine, postProcessSteps(req.Tenant), policyFor(req.Tenant)})
+	if err != nil {
+		return "", false
+	}
+	return sha256Hex(data), true
+}
+
+// buildFlight coalesces identical builds running at the same time, so a
+// burst of requests for a popular build only runs it once.
+var buildFlight singleflight.Group
+
+// runCachedBuild runs a build, or reuses the output of the same build from
+// the shared cache or the artifact store when they are configured. Callers
+// asking for a build that is already running wait for its output. Under
+// pressure only reused output is returned, and errOverloaded otherwise.
+func runCachedBuild(req buildRequest) (*buildResult, error) {
+	key, ok := buildCacheKey(req)
+	if !ok {
+		if underPressure() {
+			return nil, errOverloaded
+		}
+		return runBuild(req), nil
+	}
+	for {
+		led := false
+		v, err, _ := buildFlight.Do(key, func() (interface{}, error) {
+			led = true
+			return runSharedBuild(key, req)
+		})
+		if err != nil {
+			return nil, err
+		}
+		result := v.(*buildResult)
+		if !led && result.cancelled() && req.context().Err() == nil {
+			// The caller the build ran for went away, or its timeout
+			// passed, but this one hasn't, so it runs the build itself.
+			continue
+		}
+		return result, nil
+	}
+}
+
+// cancelled reports whether a build failed because its caller went away
+// or its timeout passed.
+func (result *buildResult) cancelled() bool {
+	for _, msg := range result.Errors {
+		if err, ok := msg.Detail.(error); ok && contextEnded(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// contextEnded reports whether err is that of a context that was cancelled
+// or whose deadline passed.
+func contextEnded(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func runSharedBuild(key string, req buildRequest) (*buildResult, error) {
+	var cached cachedBuild
+	if sharedCache != nil && sharedCache.getJSON("build:"+key, &cached) {
+		now := time.Now()
+		if cached.Expires.IsZero() || now.Before(cached.Expires) {
+			atomic.AddInt64(&buildCounters.hits, 1)
+			return cached.result(), nil
+		}
+		if now.Before(cached.StaleUntil) {
+			atomic.AddInt64(&buildCounters.stale, 1)
+			go refreshBuild(key, req)
+			return cached.result(), nil
+		}
+	}
+	if sharedCache != nil {
+		atomic.AddInt64(&buildCounters.misses, 1)
+	}
+	if artifacts != nil {
+		if result, ok := artifacts.lookup(key); ok {
+			sharedCache.putBuild(key, result)
+			return result, nil
+		}
+	}
+
+	if underPressure() {
+		return nil, errOverloaded
+	}
+	result := runBuild(req)
+	if len(result.Errors) == 0 {
+		storeBuild(key, req, result)
+	}
+	return result, nil
+}
+
+// refreshBuild runs a build again in the background, replacing the stale
+// copy being served in the meantime.
+func refreshBuild(key string, req buildRequest) {
+	buildFlight.Do("refresh:"+key, func() (interface{}, error) {
+		if underPressure() {
+			return nil, nil
+		}
+		// Nobody is waiting, so expired modules are revalidated first
+		// rather than being built into the output stale.
+		req.NoStale = true
+		req.OnModule = nil
+		req.Context = nil
+		if result := runBuild(req); len(result.Errors) == 0 {
+			storeBuild(key, req, result)
+		} else {
+			log.Println("refreshing build:", result.Errors[0].Text)
+		}
+		return nil, nil
+	})
+}
+
+// storeBuild keeps a successful build in the artifact store, along with its
+// provenance, and the shared cache, when they are configured.
+func storeBuild(key string, req buildRequest, result *buildResult) {
+	if artifacts != nil {
+		id, err := artifacts.store(key, result)
+		if err != nil {
+			log.Println("artifacts:", err)
+		}
+		result.Artifact = id
+		if err == nil {
+			artifacts.storeProvenance(req, result)
+		}
+	}
+	sharedCache.putBuild(key, result)
+}
+
+// putBuild shares a finished build, when there is a shared cache.
+func (r *redisCache) putBuild(key string, result *buildResult) {
+	if r == nil {
+		return
+	}
+	cached := cachedBuild{Code: result.Code, Manifest: result.Manifest, Metafile: result.Metafile, Graph: result.Graph, Artifact: result.Artifact, Stats: result.Stats}
+	if !result.Manifest.Pinned {
+		for _, mod := range result.Modules {
+			if cached.Expires.IsZero() || mod.Expires.Before(cached.Expires) {
+				cached.Expires = mod.Expires
+			}
+			if cached.StaleUntil.IsZero() || mod.StaleUntil.Before(cached.StaleUntil) {
+				cached.StaleUntil = mod.StaleUntil
+			}
+		}
+	}
+	r.putJSON("build:"+key, cached)
+	r.indexDependents(key, result.Manifest.Modules)
+}
+
+// dependentsKey is the set of builds that included the module at url.
+func dependentsKey(url string) string {
+	return "dependents:" + sha256Hex([]byte(url))
+}
+
+// indexDependents records that the build stored under key included each of
+// modules, so changing one of them only invalidates the builds using it.
+func (r *redisCache) indexDependents(key string, modules []manifestModule) {
+	if len(modules) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err := r.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, m := range modules {
+			set := r.prefix + dependentsKey(m.URL)
+			p.SAdd(ctx, set, key)
+			p.Expire(ctx, set, r.ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("redis:", err)
+	}
+}
+
+// invalidateDependents removes the shared builds that included the module
+// at url, returning how many were removed.
+func (r *redisCache) invalidateDependents(url string) int {
+	if r == nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	set := r.prefix + dependentsKey(url)
+	keys, err := r.client.SMembers(ctx, set).Result()
+	if err != nil {
+		log.Println("redis:", err)
+		return 0
+	}
+	n := 0
+	for _, key := range keys {
+		deleted, err := r.client.Del(ctx, r.prefix+"build:"+key).Result()
+		if err != nil {
+			log.Println("redis:", err)
+			return n
+		}
+		n += int(deleted)
+	}
+	if err := r.client.Del(ctx, set).Err(); err != nil {
+		log.Println("redis:", err)
+	}
+	return n
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// buildErrorBody is the response to a build that failed. Code is stable,
+// and names the kind of the first error, which Message repeats.
+type buildErrorBody struct {
+	Code     string         `json:"code"`
+	Message  string         `json:"message"`
+	Errors   []buildMessage `json:"errors"`
+	Warnings []buildMessage `json:"warnings"`
+}
+
+type buildMessage struct {
+	Code       string           `json:"code"`
+	Text       string           `json:"text"`
+	PluginName string           `json:"pluginName,omitempty"`
+	Location   *messageLocation `json:"location,omitempty"`
+	Notes      []messageNote    `json:"notes,omitempty"`
+}
+
+type messageLocation struct {
+	File      string `json:"file"`
+	Namespace string `json:"namespace,omitempty"`
+	// Line is 1-based and Column is 0-based, in bytes, as esbuild reports
+	// them.
+	Line       int    `json:"line"`
+	Column     int    `json:"column"`
+	Length     int    `json:"length"`
+	LineText   string `json:"lineText"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+type messageNote struct {
+	Text     string           `json:"text"`
+	Location *messageLocation `json:"location,omitempty"`
+}
+
+// classifyBuildError returns the code of an esbuild error and the status
+// it is reported with. Errors the caller can fix, like a syntax error in
+// the source or an import of a missing module, get 4xx statuses; failures of upstream or of
+// conifer itself get 5xx ones.
+func classifyBuildError(msg api.Message) (string, int) {
+	if err, ok := msg.Detail.(error); ok {
+		var (
+			offline   *offlineError
+			host      *hostNotAllowedError
+			blocked   *urlBlockedError
+			private   *privateAddressError
+			limit     *moduleLimitError
+			tooLarge  *moduleSizeError
+			buildSize *buildSizeError
+			output    *outputSizeError
+			lock      *lockfileError
+			integrity *integrityError
+			failure   *cachedFailure
+			denied    *policyDeniedError
+			smoke     *smokeTestError
+		)
+		switch {
+		case errors.As(err, &offline):
+			return "offline", http.StatusServiceUnavailable
+		case errors.As(err, &denied):
+			return "policy_denied", http.StatusForbidden
+		case errors.As(err, &host):
+			return "host_not_allowed", http.StatusForbidden
+		case errors.As(err, &blocked):
+			return "url_blocked", http.StatusForbidden
+		case errors.As(err, &private):
+			return "private_address", http.StatusForbidden
+		case errors.As(err, &limit):
+			return "too_many_modules", http.StatusUnprocessableEntity
+		case errors.As(err, &tooLarge):
+			return "module_too_large", http.StatusUnprocessableEntity
+		case errors.As(err, &buildSize):
+			return "build_too_large", http.StatusUnprocessableEntity
+		case errors.As(err, &output):
+			return "output_too_large", http.StatusUnprocessableEntity
+		case errors.As(err, &lock):
+			return "lockfile_mismatch", http.StatusUnprocessableEntity
+		case errors.As(err, &smoke):
+			return "smoke_test_failed", http.StatusUnprocessableEntity
+		case errors.As(err, &integrity):
+			return "integrity_mismatch", http.StatusUnprocessableEntity
+		case errors.As(err, &failure), permanentFailure(err):
+			// Only permanent failures are cached.
+			return "module_not_found", http.StatusUnprocessableEntity
+		case errors.Is(err, context.DeadlineExceeded):
+			return "timeout", http.StatusGatewayTimeout
+		}
+		return "upstream_error", http.StatusBadGateway
+	}
+	switch {
+	case strings.HasPrefix(msg.Text, "Could not resolve"):
+		return "unresolved_import", http.StatusUnprocessableEntity
+	case msg.Location != nil:
+		// esbuild locates its errors in the code causing them, such as
+		// syntax errors and imports of names that aren't exported.
+		return "source_error", http.StatusUnprocessableEntity
+	}
+	return "build_failed", http.StatusInternalServerError
+}
+
+// writeFetchError reports a module that couldn't be downloaded, with the
+// status a build failing to download it would get.
+func writeFetchError(w http.ResponseWriter, err error) {
+	_, status := classifyBuildError(api.Message{Text: err.Error(), Detail: err})
+	http.Error(w, err.Error(), status)
+}
+
+func newBuildMessages(msgs []api.Message) []buildMessage {
+	converted := make([]buildMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		code, _ := classifyBuildError(msg)
+		m := buildMessage{Code: code, Text: msg.Text, PluginName: msg.PluginName, Location: newMessageLocation(msg.Location)}
+		for _, note := range msg.Notes {
+			m.Notes = append(m.Notes, messageNote{Text: note.Text, Location: newMessageLocation(note.Location)})
+		}
+		converted = append(converted, m)
+	}
+	return converted
+}
+
+func newMessageLocation(l *api.Location) *messageLocation {
+	if l == nil {
+		return nil
+	}
+	return &messageLocation{
+		File:       l.File,
+		Namespace:  l.Namespace,
+		Line:       l.Line,
+		Column:     l.Column,
+		Length:     l.Length,
+		LineText:   l.LineText,
+		Suggestion: l.Suggestion,
+	}
+}
+
+// writeBuildErrors responds to a failed build with every error and warning
+// it reported, with the status of the first error.
+func writeBuildErrors(w http.ResponseWriter, errs, warnings []api.Message) {
+	_, status := classifyBuildError(errs[0])
+	writeJSON(w, status, newBuildErrorBody(errs, warnings))
+}
+
+// newBuildErrorBody describes a failed build.
+func newBuildErrorBody(errs, warnings []api.Message) *buildErrorBody {
+	code, _ := classifyBuildError(errs[0])
+	return &buildErrorBody{
+		Code:     code,
+		Message:  errs[0].Text,
+		Errors:   newBuildMessages(errs),
+		Warnings: newBuildMessages(warnings),
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxBuildRequestBytes limits JSON build requests, which carry their source.
+const maxBuildRequestBytes = 10 << 20
+
+// jsonBuildRequest is a build described in a JSON body rather than the
+// query string:
+//
+//	{"source": "export * from 'react'", "format": "iife", "minify": {"whitespace": true}, "sourcemap": "external"}
+//	{"entry": "https://cdn.jsdelivr.net/npm/react@17.0.2/index.js", "target": "es2017"}
+//	{"files": {"/index.ts": "export * from './util'", "/util.ts": "..."}}
+type jsonBuildRequest struct {
+	Source string `json:"source"`
+	// Entry is the URL of a module to build instead of source, or with
+	// files, the path of the file to start from.
+	Entry string `json:"entry"`
+	// Files are built instead of source, starting from entry or else an
+	// index file.
+	Files  map[string]string `json:"files"`
+	Loader string            `json:"loader"`
+	Format string            `json:"format"`
+	Target string            `json:"target"`
+	// Minify is true or false, or picks kinds of minification like
+	// {"whitespace": true, "syntax": true}.
+	Minify    json.RawMessage   `json:"minify"`
+	Bundle    *bool             `json:"bundle"`
+	Define    map[string]string `json:"define"`
+	External  []string          `json:"external"`
+	Sourcemap string            `json:"sourcemap"`
+
+	Name        string     `json:"name"`
+	MangleProps string     `json:"mangleProps"`
+	Splitting   bool       `json:"splitting"`
+	ProxyURLs   bool       `json:"proxyUrls"`
+	Polyfill    bool       `json:"polyfill"`
+	SmokeTest   bool       `json:"smokeTest"`
+	Lockfile    *lockfile  `json:"lockfile"`
+	ImportMap   *importMap `json:"importMap"`
+	TsconfigRaw string     `json:"tsconfigRaw"`
+	// Exposes and Remotes are for module federation, see federation.go.
+	Exposes map[string]string `json:"exposes"`
+	Remotes map[string]string `json:"remotes"`
+	// Routes are built into a chunk each, see routes.go.
+	Routes map[string]string `json:"routes"`
+	// Entries are built into an output each, see entries.go.
+	Entries map[string]string `json:"entries"`
+	// ServiceWorker adds a service worker precaching the output to the
+	// outputs, see serviceWorker.
+	ServiceWorker bool `json:"serviceWorker"`
+}
+
+// buildEnvelope is the response to a JSON build request.
+type buildEnvelope struct {
+	ID       string         `json:"id"`
+	Artifact string         `json:"artifact,omitempty"`
+	Outputs  []buildOutput  `json:"outputs"`
+	Warnings []buildMessage `json:"warnings"`
+	Manifest buildManifest  `json:"manifest"`
+	// Release is what the source map was uploaded to error trackers as,
+	// see sourceMapUpload.
+	Release string `json:"release,omitempty"`
+}
+
+type buildOutput struct {
+	Path     string `json:"path"`
+	Contents string `json:"contents"`
+}
+
+// buildRequest checks body, returning the build it describes.
+func (body jsonBuildRequest) buildRequest() (buildRequest, error) {
+	req := buildRequest{
+		Source:      body.Source,
+		Entry:       body.Entry,
+		Bundle:      body.Bundle == nil || *body.Bundle,
+		Loader:      body.Loader,
+		Format:      body.Format,
+		Target:      body.Target,
+		Define:      body.Define,
+		KeepURLs:    body.External,
+		Sourcemap:   body.Sourcemap,
+		Name:        body.Name,
+		MangleProps: body.MangleProps,
+		Splitting:   body.Splitting,
+		ProxyURLs:   body.ProxyURLs,
+		Polyfill:    body.Polyfill,
+		SmokeTest:   body.SmokeTest,
+		Lockfile:    body.Lockfile,
+		ImportMap:   body.ImportMap,
+		Exposes:     body.Exposes,
+		Remotes:     body.Remotes,
+		Routes:      body.Routes,
+		Entries:     body.Entries,
+	}
+	if len(body.Minify) > 0 {
+		if err := json.Unmarshal(body.Minify, &req.Minify); err != nil {
+			req.MinifyParts = &minifyParts{}
+			if err := json.Unmarshal(body.Minify, req.MinifyParts); err != nil {
+				return req, errors.New("minify must be a boolean or an object of booleans")
+			}
+		}
+	}
+	if len(body.Files) > 0 {
+		if err := body.checkFiles(&req); err != nil {
+			return req, err
+		}
+	}
+	if err := checkFederation(&req); err != nil {
+		return req, err
+	}
+	if err := checkRoutes(&req); err != nil {
+		return req, err
+	}
+	if err := checkEntries(&req); err != nil {
+		return req, err
+	}
+	switch {
+	case len(req.Files) > 0, len(req.Exposes) > 0, len(req.Routes) > 0, len(req.Entries) > 0:
+	case (req.Source == "") == (req.Entry == ""):
+		return req, errors.New("exactly one of source and entry is required")
+	case req.Entry != "" && !strings.HasPrefix(req.Entry, "https://") && !strings.HasPrefix(req.Entry, "http://"):
+		return req, errors.New("entry must be an http or https URL")
+	case req.Entry != "" && !req.Bundle:
+		return req, errors.New("entry can only be bundled")
+	}
+	if _, ok := loadersByName[req.Loader]; req.Loader != "" && !ok {
+		return req, errors.New("unknown loader: " + req.Loader)
+	}
+	if _, ok := formatsByName[req.Format]; !ok {
+		return req, errors.New("unknown format: " + req.Format)
+	}
+	if _, ok := targetsByName[req.Target]; req.Target != "" && !ok {
+		return req, errors.New("unknown target: " + req.Target)
+	}
+	if _, ok := sourcemapsByName[req.Sourcemap]; !ok {
+		return req, errors.New("sourcemap must be inline or external")
+	}
+	if req.Splitting && (formatsByName[req.Format] != formatsByName["esm"] || req.Sourcemap == "external") {
+		return req, errors.New("splitting needs the esm format, and can't be used with external source maps")
+	}
+	if req.Name != "" && !validBundleName(req.Name) {
+		return req, errors.New("invalid bundle name")
+	}
+	if err := checkSmokeTest(req); err != nil {
+		return req, err
+	}
+	if err := req.Lockfile.check(); err != nil {
+		return req, err
+	}
+	if body.TsconfigRaw != "" {
+		normalized, err := normalizeTsconfig(body.TsconfigRaw)
+		if err != nil {
+			return req, errors.New("invalid tsconfigRaw: " + err.Error())
+		}
+		req.TsconfigRaw = normalized
+	}
+	if req.ImportMap == nil {
+		req.ImportMap = cfg.ImportMap
+	}
+	return req, nil
+}
+
+// checkFiles checks a multi-file build, keying req's files by clean paths
+// and picking its entry.
+func (body jsonBuildRequest) checkFiles(req *buildRequest) error {
+	switch {
+	case body.Source != "":
+		return errors.New("source can't be given with files")
+	case body.Loader != "":
+		return errors.New("files are loaded by their extensions, so loader can't be given")
+	case !req.Bundle:
+		return errors.New("files can only be bundled")
+	}
+	files, err := cleanFiles(body.Files)
+	if err != nil {
+		return err
+	}
+	req.Files = files
+	if len(req.Entries) > 0 {
+		// Each entry is one of the files, see checkEntries.
+		return nil
+	}
+	if req.Entry == "" {
+		entry, ok := files.defaultEntry()
+		if !ok {
+			return errors.New("entry is required, as there is no index file")
+		}
+		req.Entry = entry
+		return nil
+	}
+	req.Entry = path.Clean("/" + req.Entry)
+	if _, ok := files[req.Entry]; !ok {
+		return errors.New("entry must be one of the files")
+	}
+	return nil
+}
+
+// serveJSONBuild builds what a JSON body describes and responds with a JSON
+// envelope holding the outputs and warnings, or every error when the build
+// fails.
+func serveJSONBuild(w http.ResponseWriter, r *http.Request) {
+	var body jsonBuildRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBuildRequestBytes)).Decode(&body); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveBuildBody(w, r, body)
+}
+
+// serveMultipartBuild builds the files of a multipart form, where each part
+// is a file named by its path and an optional part named "options" holds
+// the other options of a JSON build request:
+//
+//	curl -F /index.ts=@index.ts -F /util.ts=@util.ts -F 'options={"format":"iife"}' .../v1/build
+func serveMultipartBuild(w http.ResponseWriter, r *http.Request) {
+	body, ok := readMultipartBuild(w, r)
+	if !ok {
+		return
+	}
+	serveBuildBody(w, r, body)
+}
+
+// readMultipartBuild reads the build a multipart form describes, see
+// serveMultipartBuild. When it can't, the error is written and false is
+// returned.
+func readMultipartBuild(w http.ResponseWriter, r *http.Request) (jsonBuildRequest, bool) {
+	var body jsonBuildRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxBuildRequestBytes)
+	if err := r.ParseMultipartForm(maxBuildRequestBytes); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return body, false
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	if options := r.MultipartForm.Value["options"]; len(options) > 0 {
+		if err := json.Unmarshal([]byte(options[0]), &body); err != nil {
+			http.Error(w, "invalid options: "+err.Error(), http.StatusBadRequest)
+			return body, false
+		}
+	}
+	body.Files = map[string]string{}
+	for name, values := range r.MultipartForm.Value {
+		if name != "options" {
+			body.Files[name] = values[0]
+		}
+	}
+	for name, headers := range r.MultipartForm.File {
+		f, err := headers[0].Open()
+		if err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return body, false
+		}
+		contents, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return body, false
+		}
+		body.Files[name] = string(contents)
+	}
+	if len(body.Files) == 0 {
+		http.Error(w, "no files given", http.StatusBadRequest)
+		return body, false
+	}
+	return body, true
+}
+
+// serveBuildBody builds what a JSON or multipart body describes and
+// responds with a JSON envelope.
+func serveBuildBody(w http.ResponseWriter, r *http.Request, body jsonBuildRequest) {
+	req, err := body.buildRequest()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeBuild(w, r, &req) {
+		return
+	}
+	result, ok := runRecordedBuild(w, req)
+	if !ok {
+		return
+	}
+	if format := outputArchive(r); format != "" {
+		writeOutputArchive(w, r, format, req, result, buildOutputs(req, result, body.ServiceWorker))
+		return
+	}
+	writeJSON(w, http.StatusOK, newBuildEnvelope(w, body, req, result))
+}
+
+// newBuildEnvelope wraps a recorded build, whose identifying headers have
+// been set on w.
+func newBuildEnvelope(w http.ResponseWriter, body jsonBuildRequest, req buildRequest, result *buildResult) buildEnvelope {
+	return buildEnvelope{
+		ID:       w.Header().Get("X-Conifer-Build"),
+		Artifact: result.Artifact,
+		Outputs:  buildOutputs(req, result, body.ServiceWorker),
+		Warnings: newBuildMessages(result.Warnings),
+		Manifest: result.Manifest,
+		Release:  w.Header().Get("X-Conifer-Release"),
+	}
+}
+
+// buildOutputs are the files a build produced, with a service worker
+// precaching them when asked for one.
+func buildOutputs(req buildRequest, result *buildResult, withServiceWorker bool) []buildOutput {
+	name := outputName(req)
+	outputs := []buildOutput{{Path: name, Contents: string(result.Code)}}
+	if len(result.Entries) > 0 {
+		outputs = append([]buildOutput{}, result.Entries...)
+	}
+	if len(result.SourceMap) > 0 {
+		outputs = append(outputs, buildOutput{Path: name + ".map", Contents: string(result.SourceMap)})
+	}
+	if result.Routes != nil {
+		manifest, _ := json.MarshalIndent(result.Routes, "", "  ")
+		outputs = append(outputs, buildOutput{Path: routeManifestName, Contents: string(manifest)})
+	}
+	if withServiceWorker {
+		outputs = append(outputs, buildOutput{Path: serviceWorkerName, Contents: serviceWorker(name, result)})
+	}
+	return outputs
+}
+
+// outputName is the name of a build's output in a JSON envelope.
+func outputName(req buildRequest) string {
+	if req.Loader == "css" || (len(req.Files) > 0 && path.Ext(req.Entry) == ".css") {
+		return "index.css"
+	}
+	return "index.js"
+}
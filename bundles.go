@@ -0,0 +1,575 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// namedBundle is a bundle stored under a stable name. Every build of it is
+// kept as a version, and the current version is what the stable URL serves.
+type namedBundle struct {
+	Tenant   string          `json:"tenant"`
+	Name     string          `json:"name"`
+	Current  string          `json:"current"`
+	Versions []bundleVersion `json:"versions"`
+	// Quarantine, when set, stops every version being served.
+	Quarantine *bundleQuarantine `json:"quarantine,omitempty"`
+}
+
+// bundleQuarantine records why a bundle was taken down after being
+// reported for abuse.
+type bundleQuarantine struct {
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason"`
+}
+
+type bundleVersion struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Bytes   int       `json:"bytes"`
+	// Exposes and Shared are set on versions of module federation remotes,
+	// see federationManifest.
+	Exposes map[string][]string `json:"exposes,omitempty"`
+	Shared  []string            `json:"shared,omitempty"`
+}
+
+var errBundleNotFound = errors.New("bundle not found")
+
+// bundleStore keeps named bundles in the data directory, or in memory when
+// there isn't one.
+type bundleStore struct {
+	mu       sync.Mutex
+	bundles  map[string]*namedBundle
+	contents map[string][]byte
+	// changes are closed when the version a bundle's stable URL serves
+	// changes, waking requests waiting for it to.
+	changes map[string]chan struct{}
+}
+
+var bundles = &bundleStore{
+	bundles:  make(map[string]*namedBundle),
+	contents: make(map[string][]byte),
+	changes:  make(map[string]chan struct{}),
+}
+
+func (s *bundleStore) dir(tenant string) string {
+	return filepath.Join(cfg.DataDir, "bundles", filepath.FromSlash(bundleKey(tenant, "")))
+}
+
+// tenantSegment is how a tenant appears in bundle URLs.
+func tenantSegment(tenant string) string {
+	return strings.TrimSuffix(bundleKey(tenant, ""), "/")
+}
+
+// bundleURL is the stable URL of a named bundle.
+func bundleURL(tenant, name string) string {
+	return cfg.PublicURL + "/bundles/" + tenantSegment(tenant) + "/" + name + ".js"
+}
+
+// federationManifestURL is the URL of the manifest of a named bundle that
+// is a module federation remote.
+func federationManifestURL(tenant, name string) string {
+	return cfg.PublicURL + "/bundles/" + tenantSegment(tenant) + "/" + name + federationManifestSuffix
+}
+
+// versionURL is the URL of one version of a named bundle, which never
+// changes.
+func versionURL(tenant, name, version string) string {
+	return cfg.PublicURL + "/bundles/" + tenantSegment(tenant) + "/" + name + "@" + version + ".js"
+}
+
+func (s *bundleStore) load(tenant, name string) (*namedBundle, error) {
+	key := bundleKey(tenant, name)
+	if b, ok := s.bundles[key]; ok || cfg.DataDir == "" {
+		if !ok {
+			return nil, errBundleNotFound
+		}
+		return b, nil
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir(tenant), name+".json"))
+	if os.IsNotExist(err) {
+		return nil, errBundleNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var b namedBundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	s.bundles[key] = &b
+	return &b, nil
+}
+
+func (s *bundleStore) save(b *namedBundle) error {
+	s.bundles[bundleKey(b.Tenant, b.Name)] = b
+	if cfg.DataDir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir(b.Tenant), b.Name+".json"), data)
+}
+
+// get returns a copy of the named bundle.
+func (s *bundleStore) get(tenant, name string) (namedBundle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.load(tenant, name)
+	if err != nil {
+		return namedBundle{}, err
+	}
+	copied := *b
+	copied.Versions = append([]bundleVersion(nil), b.Versions...)
+	return copied, nil
+}
+
+// watch returns a copy of the named bundle, and a channel closed when what
+// its stable URL serves next changes.
+func (s *bundleStore) watch(tenant, name string) (namedBundle, <-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.load(tenant, name)
+	if err != nil {
+		return namedBundle{}, nil, err
+	}
+	key := bundleKey(tenant, name)
+	changed, ok := s.changes[key]
+	if !ok {
+		changed = make(chan struct{})
+		s.changes[key] = changed
+	}
+	copied := *b
+	copied.Versions = append([]bundleVersion(nil), b.Versions...)
+	return copied, changed, nil
+}
+
+// changed wakes those watching the named bundle. s.mu must be held.
+func (s *bundleStore) changed(tenant, name string) {
+	key := bundleKey(tenant, name)
+	if changed, ok := s.changes[key]; ok {
+		close(changed)
+		delete(s.changes, key)
+	}
+}
+
+// put stores code as a version of the named bundle, returning its ID. The
+// version is made current when promote is true. Remotes pass what they
+// expose and share, and other bundles nil.
+func (s *bundleStore) put(tenant, name string, code []byte, exposes map[string][]string, shared []string, promote bool) (string, error) {
+	sum := sha256.Sum256(code)
+	id := hex.EncodeToString(sum[:8])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.load(tenant, name)
+	if err == errBundleNotFound {
+		b = &namedBundle{Tenant: tenant, Name: name}
+	} else if err != nil {
+		return "", err
+	}
+
+	exists := false
+	for _, v := range b.Versions {
+		exists = exists || v.ID == id
+	}
+	if !exists {
+		if err := s.writeContents(tenant, name, id, code); err != nil {
+			return "", err
+		}
+		b.Versions = append(b.Versions, bundleVersion{
+			ID:      id,
+			Created: time.Now().UTC(),
+			Bytes:   len(code),
+			Exposes: exposes,
+			Shared:  shared,
+		})
+	}
+	previous := b.Current
+	if promote {
+		b.Current = id
+	}
+	if err := s.save(b); err != nil {
+		return "", err
+	}
+	if b.Current != previous {
+		s.changed(tenant, name)
+	}
+	if b.Current != previous && previous != "" {
+		purgeURLs(bundleURL(tenant, name), federationManifestURL(tenant, name))
+	}
+	return id, nil
+}
+
+// promote makes an existing version the one served by the stable URL.
+func (s *bundleStore) promote(tenant, name, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.load(tenant, name)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, v := range b.Versions {
+		found = found || v.ID == version
+	}
+	if !found {
+		return errBundleNotFound
+	}
+	if b.Current == version {
+		return nil
+	}
+	b.Current = version
+	if err := s.save(b); err != nil {
+		return err
+	}
+	s.changed(tenant, name)
+	purgeURLs(bundleURL(tenant, name), federationManifestURL(tenant, name))
+	return nil
+}
+
+// quarantine stops the named bundle being served, or lets it be served
+// again when q is nil.
+func (s *bundleStore) quarantine(tenant, name string, q *bundleQuarantine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.load(tenant, name)
+	if err != nil {
+		return err
+	}
+	b.Quarantine = q
+	if err := s.save(b); err != nil {
+		return err
+	}
+	s.changed(tenant, name)
+	urls := []string{bundleURL(tenant, name), federationManifestURL(tenant, name)}
+	for _, v := range b.Versions {
+		urls = append(urls, versionURL(tenant, name, v.ID))
+	}
+	purgeURLs(urls...)
+	return nil
+}
+
+func (s *bundleStore) writeContents(tenant, name, version string, code []byte) error {
+	if cfg.DataDir == "" {
+		s.contents[bundleKey(tenant, name)+"@"+version] = code
+		return nil
+	}
+	return writeFileAtomic(filepath.Join(s.dir(tenant), name, version+".js"), code)
+}
+
+// read returns the code of a version of a named bundle.
+func (s *bundleStore) read(tenant, name, version string) ([]byte, error) {
+	if cfg.DataDir == "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		code, ok := s.contents[bundleKey(tenant, name)+"@"+version]
+		if !ok {
+			return nil, errBundleNotFound
+		}
+		return code, nil
+	}
+	code, err := os.ReadFile(filepath.Join(s.dir(tenant), name, version+".js"))
+	if os.IsNotExist(err) {
+		return nil, errBundleNotFound
+	}
+	return code, err
+}
+
+// handleBundleAPI manages the caller's named bundles:
+//
+//	GET  /v1/bundles/<name>                       the bundle and its versions
+//	POST /v1/bundles/<name>?promote=false         build and store a version
+//	POST /v1/bundles/<name>/promote?version=<id>  make a version current
+func handleBundleAPI(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/bundles/")
+	name, action := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, action = rest[:i], rest[i+1:]
+	}
+	if !validBundleName(name) {
+		http.Error(w, "invalid bundle name", http.StatusBadRequest)
+		return
+	}
+	tenant := ""
+	if t := tenantFor(r); t != nil {
+		tenant = t.Name
+	}
+	if r.Method == "POST" && tenant == "" {
+		// Anonymous bundles would share a namespace, so anyone could
+		// replace anyone else's.
+		http.Error(w, "an API key is required", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		b, err := bundles.get(tenant, name)
+		if err == errBundleNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, b)
+
+	case action == "" && r.Method == "POST":
+		source, ok := requestSource(w, r)
+		if !ok {
+			return
+		}
+		req, err := parseBuildRequest(r, source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Name = name
+		if !authorizeBuild(w, r, &req) {
+			return
+		}
+		result, err := runCachedBuild(req)
+		if err != nil {
+			writeOverloaded(w)
+			return
+		}
+		if len(result.Errors) > 0 {
+			writeBuildErrors(w, result.Errors, result.Warnings)
+			return
+		}
+		postBuildHook(req.Tenant, req, result)
+		buildID := builds.record(req, result)
+		var shared []string
+		if result.Exposes != nil {
+			shared = req.KeepURLs
+		}
+		version, err := bundles.put(req.Tenant, name, result.Code, result.Exposes, shared, r.URL.Query().Get("promote") != "false")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{
+			"name":       name,
+			"version":    version,
+			"url":        bundleURL(req.Tenant, name),
+			"versionUrl": versionURL(req.Tenant, name, version),
+			"build":      buildID,
+		})
+
+	case action == "promote" && r.Method == "POST":
+		t, key := keyFor(r)
+		if !checkKey(w, r, t, key, false) {
+			return
+		}
+		err := bundles.promote(tenant, name, r.URL.Query().Get("version"))
+		if err == errBundleNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBundle serves named bundles at /bundles/<tenant>/<name>.js, and
+// particular versions of them at /bundles/<tenant>/<name>@<version>.js.
+// Tenants can restrict which sites embed their bundles, see embedAllowed.
+// Remotes have their manifests at /bundles/<tenant>/<name>.federation.json,
+// and which version is current is at /bundles/<tenant>/<name>/version.
+func handleBundle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, federationManifestSuffix) {
+		serveFederationManifest(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, bundleVersionSuffix) {
+		serveBundleVersion(w, r)
+		return
+	}
+	tenant, name, version, ok := parseBundlePath(r.URL.Path)
+	tenantConfig := tenantNamed(tenant)
+	if name == "_cookie" && version == "" {
+		setEmbedCookie(w, r, tenantConfig)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !embedAllowed(r, tenantConfig) {
+		http.Error(w, "embedding this bundle is not allowed here", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("X-Robots-Tag", cfg.Hosting.robotsTag())
+
+	b, err := bundles.get(tenant, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if b.Quarantine != nil {
+		http.Error(w, "this bundle has been removed", http.StatusGone)
+		return
+	}
+	cacheControl := "public, max-age=31536000, immutable"
+	if version == "" {
+		if b.Current == "" {
+			http.NotFound(w, r)
+			return
+		}
+		version = b.Current
+		// The stable URL changes whenever a version is promoted, at which
+		// point edge caches are purged.
+		cacheControl = "public, max-age=60"
+	}
+	restricted := tenantConfig != nil && (len(tenantConfig.EmbedOrigins) > 0 || tenantConfig.EmbedSecret != "")
+	if restricted {
+		// Whether the bundle may be served depends on who is asking, so
+		// shared caches mustn't answer for us.
+		cacheControl = "private, max-age=60"
+	}
+	allowCrossOrigin(w, r, restricted)
+	code, err := bundles.read(tenant, name, version)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJavaScript(w, r, code, cacheControl)
+}
+
+// parseBundlePath reads the tenant, name and, when given, version from the
+// path of a bundle served by handleBundle.
+func parseBundlePath(path string) (tenant, name, version string, ok bool) {
+	rest := strings.TrimSuffix(strings.TrimPrefix(path, "/bundles/"), ".js")
+	parts := strings.Split(rest, "/")
+	if !strings.HasPrefix(path, "/bundles/") || len(parts) != 2 {
+		return "", "", "", false
+	}
+	tenant, name = parts[0], parts[1]
+	if tenant == "_" {
+		tenant = ""
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, version = name[:i], name[i+1:]
+	}
+	ok = validBundleName(name) && (version == "" || validBundleName(version))
+	return tenant, name, version, ok
+}
+
+// bundleVersionSuffix ends the path of the current version of a named
+// bundle.
+const bundleVersionSuffix = "/version"
+
+// maxBundleWait caps how long a request for the current version waits for
+// it to change, below the idle timeouts of common proxies.
+const maxBundleWait = 55 * time.Second
+
+// currentBundleVersion is what /bundles/<tenant>/<name>/version responds
+// with.
+type currentBundleVersion struct {
+	Name       string    `json:"name"`
+	Version    string    `json:"version"`
+	Created    time.Time `json:"created"`
+	URL        string    `json:"url"`
+	VersionURL string    `json:"versionUrl"`
+}
+
+// serveBundleVersion tells clients like service workers and CLIs which
+// version of a named bundle is current, without them downloading it. The
+// version is the ETag, so a request with If-None-Match naming it is
+// answered with 304 Not Modified. Given ?wait=<seconds>, such a request is
+// held until the version changes or the wait is up, letting clients
+// long-poll for new versions:
+//
+//	GET /bundles/<tenant>/<name>/version?wait=30
+//	If-None-Match: "<version>"
+//
+// Changes are seen as this instance makes them.
+func serveBundleVersion(w http.ResponseWriter, r *http.Request) {
+	tenant, name, version, ok := parseBundlePath(strings.TrimSuffix(r.URL.Path, bundleVersionSuffix) + ".js")
+	if !ok || version != "" {
+		http.NotFound(w, r)
+		return
+	}
+	tenantConfig := tenantNamed(tenant)
+	if !embedAllowed(r, tenantConfig) {
+		http.Error(w, "embedding this bundle is not allowed here", http.StatusForbidden)
+		return
+	}
+	wait := time.Duration(0)
+	if s := r.URL.Query().Get("wait"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			http.Error(w, "wait must be a number of seconds", http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+		if wait > maxBundleWait {
+			wait = maxBundleWait
+		}
+	}
+	restricted := tenantConfig != nil && (len(tenantConfig.EmbedOrigins) > 0 || tenantConfig.EmbedSecret != "")
+	allowCrossOrigin(w, r, restricted)
+	w.Header().Set("Cache-Control", "no-cache")
+	if restricted {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		b, changed, err := bundles.watch(tenant, name)
+		if err != nil || (b.Current == "" && b.Quarantine == nil && wait == 0) {
+			http.NotFound(w, r)
+			return
+		}
+		if b.Quarantine != nil {
+			http.Error(w, "this bundle has been removed", http.StatusGone)
+			return
+		}
+		etag := `"` + b.Current + `"`
+		if b.Current != "" && !etagMatches(r.Header.Get("If-None-Match"), etag) {
+			current := currentBundleVersion{
+				Name:       name,
+				Version:    b.Current,
+				URL:        bundleURL(tenant, name),
+				VersionURL: versionURL(tenant, name, b.Current),
+			}
+			for _, v := range b.Versions {
+				if v.ID == b.Current {
+					current.Created = v.Created
+				}
+			}
+			w.Header().Set("ETag", etag)
+			writeJSON(w, http.StatusOK, current)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			if b.Current == "" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAnonymousCallersCantPublishBundles(t *testing.T) {
+	for _, path := range []string{"/v1/bundles/app", "/v1/bundles/app/promote?version=1"} {
+		r := httptest.NewRequest("POST", path, strings.NewReader("export {}"))
+		w := httptest.NewRecorder()
+		handleBundleAPI(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("anonymous POST %s got %d, want 401", path, w.Code)
+		}
+	}
+}
+
+// Promoting is checked against the key's restrictions, as publishing is.
+func TestPromoteChecksKey(t *testing.T) {
+	saved := cfg.Tenants
+	defer func() { cfg.Tenants = saved }()
+	cfg.Tenants = []tenantConfig{{
+		Name:    "acme",
+		APIKeys: []apiKey{{Key: "secret", Origins: []string{"https://acme.example"}}},
+	}}
+
+	r := httptest.NewRequest("POST", "/v1/bundles/app/promote?version=1", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Origin", "https://evil.example")
+	w := httptest.NewRecorder()
+	handleBundleAPI(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("promoting from a site the key isn't for got %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Default limits of the in-memory module cache.
+const (
+	defaultCacheEntries = 10000
+	defaultCacheBytes   = 256 << 20
+	defaultCacheTTL     = 10 * time.Minute
+	defaultStaleWindow  = time.Hour
+)
+
+// cacheConfig limits the modules kept between builds. Zero values use the
+// defaults.
+type cacheConfig struct {
+	MaxEntries int   `json:"maxEntries"`
+	MaxBytes   int64 `json:"maxBytes"`
+	// TTL is how long a module is reused before it is revalidated, when
+	// upstream doesn't say with Cache-Control or Expires headers.
+	TTL duration `json:"ttl"`
+	// StaleWhileRevalidate is how long after expiring a module may still
+	// be used while it is revalidated in the background, when upstream
+	// doesn't say with a stale-while-revalidate directive.
+	StaleWhileRevalidate *duration `json:"staleWhileRevalidate"`
+	// NegativeTTL is how long a download that failed because the module
+	// is missing, or its host doesn't exist, fails again without retrying.
+	// It defaults to 30s, and "0s" always retries.
+	NegativeTTL *duration `json:"negativeTtl"`
+	// Rules override how long modules are reused for particular URLs, the
+	// first matching rule applying. See ttlRule.
+	Rules []ttlRule `json:"rules"`
+
+	// Dir is where modules are also cached on disk, so they survive
+	// restarts. It defaults to a "modules" directory in the data directory.
+	Dir          string   `json:"dir"`
+	MaxDiskBytes int64    `json:"maxDiskBytes"`
+	DiskTTL      duration `json:"diskTtl"`
+	// CompressDisk gzips the modules cached on disk, which fits several
+	// times as many in MaxDiskBytes for the time taken to decompress them.
+	CompressDisk bool `json:"compressDisk"`
+
+	// Hot, when set along with a disk cache, replaces the in-memory cache
+	// of every module with one of only small modules used often, for
+	// instances with little memory. See hotCache.
+	Hot *hotCacheConfig `json:"hot"`
+
+	// MaxDerivedBytes limits the artifacts derived from builds, like
+	// analyses of their metafiles, kept in memory. It defaults to 64MB.
+	MaxDerivedBytes int64 `json:"maxDerivedBytes"`
+	// MaxChunkBytes limits the chunks of split builds kept in memory when
+	// there is no data directory to store them in. It defaults to 128MB.
+	MaxChunkBytes int64 `json:"maxChunkBytes"`
+}
+
+// moduleCache keeps downloaded modules between builds, keyed by URL.
+type moduleCache interface {
+	get(url string) (*module, bool)
+	put(url string, mod *module)
+	// purge removes the modules whose requested or final URL matches,
+	// returning how many were removed.
+	purge(match func(url string) bool) int
+	// stats reports how each layer of the cache has been used.
+	stats() []cacheStats
+}
+
+var modulesCache moduleCache = newMemoryCache(cacheConfig{})
+
+// newModuleCache builds the module cache described by the config.
+func newModuleCache(c cacheConfig) moduleCache {
+	dir := c.Dir
+	if dir == "" && cfg.DataDir != "" {
+		dir = filepath.Join(cfg.DataDir, "modules")
+	}
+	var layers layeredCache
+	switch {
+	case dir != "" && c.Hot != nil:
+		layers = layeredCache{newHotCache(*c.Hot), newDiskCache(dir, c)}
+	case dir != "":
+		layers = layeredCache{newMemoryCache(c), newDiskCache(dir, c)}
+	default:
+		layers = layeredCache{newMemoryCache(c)}
+	}
+	if sharedCache != nil {
+		layers = append(layers, sharedCache)
+	}
+	return layers
+}
+
+type memoryCacheEntry struct {
+	url string
+	mod *module
+}
+
+// memoryCache is a least recently used cache of modules in this process.
+// Entries past their expiry are kept, so they can be revalidated.
+type memoryCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	bytes   int64
+
+	counters cacheCounters
+}
+
+func newMemoryCache(c cacheConfig) *memoryCache {
+	m := &memoryCache{
+		maxEntries: c.MaxEntries,
+		maxBytes:   c.MaxBytes,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+	if m.maxEntries == 0 {
+		m.maxEntries = defaultCacheEntries
+	}
+	if m.maxBytes == 0 {
+		m.maxBytes = defaultCacheBytes
+	}
+	return m
+}
+
+func (m *memoryCache) get(url string) (*module, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[url]
+	if !ok {
+		return m.counters.lookup(nil, false)
+	}
+	m.order.MoveToFront(el)
+	return m.counters.lookup(el.Value.(*memoryCacheEntry).mod, true)
+}
+
+func (m *memoryCache) put(url string, mod *module) {
+	size := int64(len(mod.Contents))
+	if size > m.maxBytes {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[url]; ok {
+		m.remove(el)
+	}
+	m.entries[url] = m.order.PushFront(&memoryCacheEntry{url: url, mod: mod})
+	m.bytes += size
+	for m.order.Len() > m.maxEntries || m.bytes > m.maxBytes {
+		m.remove(m.order.Back())
+		m.counters.evicted(1)
+	}
+}
+
+func (m *memoryCache) delete(url string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[url]; ok {
+		m.remove(el)
+	}
+}
+
+// recentURLs returns up to n of the cached URLs, most recently used first.
+func (m *memoryCache) recentURLs(n int) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var urls []string
+	for el := m.order.Front(); el != nil && len(urls) < n; el = el.Next() {
+		urls = append(urls, el.Value.(*memoryCacheEntry).url)
+	}
+	return urls
+}
+
+func (m *memoryCache) purge(match func(url string) bool) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for url, el := range m.entries {
+		if match(url) || match(el.Value.(*memoryCacheEntry).mod.URL) {
+			m.remove(el)
+			n++
+		}
+	}
+	return n
+}
+
+func (m *memoryCache) stats() []cacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.counters.stats("memory")
+	bytes := m.bytes
+	s.Entries, s.Bytes = m.order.Len(), &bytes
+	s.MaxEntries, s.MaxBytes = m.maxEntries, m.maxBytes
+	return []cacheStats{s}
+}
+
+// shrink evicts the least recently used half of the cached bytes,
+// returning how many modules were evicted.
+func (m *memoryCache) shrink() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target, n := m.bytes/2, 0
+	for m.bytes > target && m.order.Len() > 0 {
+		m.remove(m.order.Back())
+		n++
+	}
+	m.counters.evicted(n)
+	return n
+}
+
+func (m *memoryCache) remove(el *list.Element) {
+	entry := m.order.Remove(el).(*memoryCacheEntry)
+	delete(m.entries, entry.url)
+	m.bytes -= int64(len(entry.mod.Contents))
+}
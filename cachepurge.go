@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cachePurge selects cached modules, and the builds that used them, to be
+// dropped after an upstream file turns out to be wrong.
+type cachePurge struct {
+	// URL purges exactly one module.
+	URL string `json:"url,omitempty"`
+	// Prefix purges every module whose URL starts with it.
+	Prefix string `json:"prefix,omitempty"`
+	// All purges everything.
+	All bool `json:"all,omitempty"`
+
+	Modules bool `json:"modules"`
+	Builds  bool `json:"builds"`
+}
+
+func (p cachePurge) match(url string) bool {
+	switch {
+	case p.All:
+		return true
+	case p.Prefix != "":
+		return strings.HasPrefix(url, p.Prefix)
+	default:
+		return url == p.URL
+	}
+}
+
+// purgeLocalCaches applies p to the caches this instance keeps itself.
+// Builds are only cached in the shared cache, so only modules, and failures
+// to download them, are purged.
+func purgeLocalCaches(p cachePurge) {
+	if !p.Modules {
+		return
+	}
+	if layers, ok := modulesCache.(layeredCache); ok {
+		layers.purgeLocal(p.match)
+	}
+	failures.purge(p.match)
+}
+
+// handlePurge drops cached modules and builds:
+//
+//	POST /v1/admin/purge?url=<url>        one module
+//	POST /v1/admin/purge?prefix=<prefix>  every module under a prefix
+//	POST /v1/admin/purge?all=true         everything
+//
+// Adding cache=modules or cache=builds purges only that cache. With a
+// shared cache, every instance drops its own copies too.
+//
+// Artifacts are never purged: they are only reused after their modules are
+// checked against upstream again, so once the modules are purged an
+// outdated artifact is rebuilt rather than served.
+func handlePurge(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "purging requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	p := cachePurge{Prefix: q.Get("prefix"), All: q.Get("all") == "true"}
+	if u := q.Get("url"); u != "" {
+		p.URL = canonicalURL(u)
+	}
+	if p.URL == "" && p.Prefix == "" && !p.All {
+		http.Error(w, "one of url, prefix or all=true is required", http.StatusBadRequest)
+		return
+	}
+	switch q.Get("cache") {
+	case "":
+		p.Modules, p.Builds = true, true
+	case "modules":
+		p.Modules = true
+	case "builds":
+		p.Builds = true
+	default:
+		http.Error(w, "cache must be modules or builds", http.StatusBadRequest)
+		return
+	}
+
+	var purged struct {
+		Modules int `json:"modules"`
+		Builds  int `json:"builds"`
+	}
+	if p.Modules {
+		purged.Modules = modulesCache.purge(p.match)
+		failures.purge(p.match)
+	}
+	if sharedCache != nil {
+		switch {
+		case !p.Builds:
+		case p.URL != "":
+			purged.Builds = sharedCache.invalidateDependents(p.URL)
+		default:
+			purged.Builds = sharedCache.purgeBuilds(p.match)
+		}
+		sharedCache.publishPurge(p)
+	}
+	writeJSON(w, http.StatusOK, purged)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// cacheStats reports how one layer of the module cache is being used.
+type cacheStats struct {
+	Layer string `json:"layer"`
+	Hits  int64  `json:"hits"`
+	// Stale counts the hits on builds that had expired, which were served
+	// while they were refreshed.
+	Stale  int64 `json:"stale,omitempty"`
+	Misses int64 `json:"misses"`
+	// Evictions are only counted for the caches conifer manages, so not
+	// for the shared cache, which Redis expires itself.
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	// Bytes is the size of the cached contents, which isn't known for the
+	// shared cache.
+	Bytes      *int64 `json:"bytes,omitempty"`
+	MaxEntries int    `json:"maxEntries,omitempty"`
+	MaxBytes   int64  `json:"maxBytes,omitempty"`
+}
+
+// cacheCounters counts a cache's lookups and evictions since startup.
+type cacheCounters struct {
+	hits, misses, evictions int64
+}
+
+// lookup counts the result of a lookup, passing it through.
+func (c *cacheCounters) lookup(mod *module, ok bool) (*module, bool) {
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	return mod, ok
+}
+
+func (c *cacheCounters) evicted(n int) {
+	atomic.AddInt64(&c.evictions, int64(n))
+}
+
+// stats fills in the counts for a layer.
+func (c *cacheCounters) stats(layer string) cacheStats {
+	return cacheStats{
+		Layer:     layer,
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Evictions: atomic.LoadInt64(&c.evictions),
+	}
+}
+
+// buildCounters counts lookups of the shared build cache.
+var buildCounters struct {
+	hits, stale, misses int64
+}
+
+// countEntries counts the keys matching pattern.
+func (r *redisCache) countEntries(pattern string) int {
+	ctx := context.Background()
+	n := 0
+	iter := r.client.Scan(ctx, 0, r.prefix+pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		log.Println("redis:", err)
+	}
+	return n
+}
+
+// handleCacheStats reports how each cache has been used since this
+// instance started, for tuning their sizes:
+//
+//	GET /v1/admin/cache-stats
+//
+// Counting the shared cache's entries scans Redis, so this is for operators
+// rather than frequent polling.
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := struct {
+		Modules []cacheStats `json:"modules"`
+		Builds  *cacheStats  `json:"builds,omitempty"`
+		Derived []cacheStats `json:"derived"`
+	}{Modules: modulesCache.stats(), Derived: derived.stats()}
+	if sharedCache != nil {
+		stats.Builds = &cacheStats{
+			Layer:   "shared",
+			Hits:    atomic.LoadInt64(&buildCounters.hits),
+			Stale:   atomic.LoadInt64(&buildCounters.stale),
+			Misses:  atomic.LoadInt64(&buildCounters.misses),
+			Entries: sharedCache.countEntries("build:*"),
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
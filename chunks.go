@@ -0,0 +1,136 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// chunkPath is where chunks produced by code splitting are served from.
+const chunkPath = "/chunks/"
+
+const defaultChunkBytes = 128 << 20
+
+type chunkEntry struct {
+	name     string
+	contents []byte
+}
+
+// chunkStore keeps the chunks produced by code splitting. Chunk names
+// contain a hash of their contents, so a chunk never changes once stored
+// and can be cached by browsers and CDNs forever. Without a data directory
+// they are kept in memory, least recently used evicted first, so a chunk
+// nobody has asked for in a while has to be built again.
+type chunkStore struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	bytes   int64
+}
+
+var chunks = &chunkStore{order: list.New(), entries: make(map[string]*list.Element)}
+
+func (s *chunkStore) limit() int64 {
+	if cfg.Cache.MaxChunkBytes > 0 {
+		return cfg.Cache.MaxChunkBytes
+	}
+	return defaultChunkBytes
+}
+
+func (s *chunkStore) put(name string, contents []byte) error {
+	if cfg.DataDir != "" {
+		path := filepath.Join(cfg.DataDir, "chunks", name)
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		return writeFileAtomic(path, contents)
+	}
+	max := s.limit()
+	if int64(len(contents)) > max {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[name]; ok {
+		return nil
+	}
+	s.entries[name] = s.order.PushFront(&chunkEntry{name: name, contents: contents})
+	s.bytes += int64(len(contents))
+	for s.bytes > max {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+func (s *chunkStore) get(name string) ([]byte, bool) {
+	if cfg.DataDir != "" {
+		contents, err := os.ReadFile(filepath.Join(cfg.DataDir, "chunks", name))
+		return contents, err == nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[name]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(el)
+	return el.Value.(*chunkEntry).contents, true
+}
+
+// shrink evicts the least recently used half of the chunks' bytes kept in
+// memory, returning how many chunks were evicted.
+func (s *chunkStore) shrink() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target, n := s.bytes/2, 0
+	for s.bytes > target && s.order.Len() > 0 {
+		s.remove(s.order.Back())
+		n++
+	}
+	return n
+}
+
+func (s *chunkStore) remove(el *list.Element) {
+	entry := s.order.Remove(el).(*chunkEntry)
+	delete(s.entries, entry.name)
+	s.bytes -= int64(len(entry.contents))
+}
+
+// storeOutput keeps a build's output with the chunks, named by its hash,
+// returning its name.
+func storeOutput(req buildRequest, code []byte) (string, error) {
+	ext := ".js"
+	if req.Loader == "css" {
+		ext = ".css"
+	}
+	name := "build-" + sha256Hex(code)[:16] + ext
+	return name, chunks.put(name, code)
+}
+
+func handleChunk(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, chunkPath)
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	contents, ok := chunks.get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	allowCrossOrigin(w, r, false)
+	if strings.HasSuffix(name, ".css") {
+		// The stylesheets of pages are kept with the chunks.
+		writeContent(w, r, "text/css; charset=utf-8", contents, "public, max-age=31536000, immutable")
+		return
+	}
+	if strings.HasSuffix(name, ".map") {
+		// So are the source maps of deploy manifests.
+		writeContent(w, r, "application/json", contents, "public, max-age=31536000, immutable")
+		return
+	}
+	writeJavaScript(w, r, contents, "public, max-age=31536000, immutable")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Chunks are cached forever by name, so a change to one entry mustn't
+// rename the chunks it shares with the others.
+func TestSharedChunkNamesStable(t *testing.T) {
+	files := map[string]string{
+		"/shared.js": "export const shared = (x) => x * 2;\n",
+		"/a.js":      "import { shared } from './shared.js';\nconsole.log(shared(1));\n",
+		"/b.js":      "import { shared } from './shared.js';\nconsole.log(shared(2));\n",
+	}
+	before := splitChunks(t, files)
+
+	files["/b.js"] += "console.log('unrelated');\n"
+	after := splitChunks(t, files)
+
+	if len(before) == 0 {
+		t.Fatal("the build has no shared chunk")
+	}
+	if strings.Join(before, " ") != strings.Join(after, " ") {
+		t.Errorf("shared chunks renamed by an unrelated change: %v, then %v", before, after)
+	}
+	for _, name := range after {
+		if _, ok := chunks.get(name); !ok {
+			t.Errorf("chunk %s wasn't stored", name)
+		}
+	}
+}
+
+func splitChunks(t *testing.T, files map[string]string) []string {
+	t.Helper()
+	req := buildRequest{
+		Files:     make(map[string]string),
+		Entries:   map[string]string{"a": "/a.js", "b": "/b.js"},
+		Bundle:    true,
+		Splitting: true,
+		Format:    "esm",
+	}
+	for path, contents := range files {
+		req.Files[path] = contents
+	}
+	result := runBuild(req)
+	if len(result.Errors) > 0 {
+		t.Fatalf("build failed: %s", result.Errors[0].Text)
+	}
+	names := append([]string(nil), result.Manifest.Chunks...)
+	sort.Strings(names)
+	return names
+}
+
+func TestChunkStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	saved := cfg.Cache.MaxChunkBytes
+	defer func() { cfg.Cache.MaxChunkBytes = saved }()
+	cfg.Cache.MaxChunkBytes = 10
+
+	s := &chunkStore{order: list.New(), entries: make(map[string]*list.Element)}
+	s.put("a", []byte("aaaa"))
+	s.put("b", []byte("bbbb"))
+	s.get("a")
+	s.put("c", []byte("cccc"))
+	if _, ok := s.get("b"); ok {
+		t.Error("the least recently used chunk wasn't evicted")
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, ok := s.get(name); !ok {
+			t.Errorf("chunk %s was evicted", name)
+		}
+	}
+	if n := s.shrink(); n != 1 || s.bytes != 4 {
+		t.Errorf("shrink evicted %d chunks leaving %d bytes, want 1 leaving 4", n, s.bytes)
+	}
+}
@@ -0,0 +1,1625 @@
+// Package client calls a conifer server's /v1 API, as described by
+// openapi.json at the root of the repository.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIVersion is the version of the API this package was written against.
+// It is sent with every request, so a server that changes the API refuses
+// the request rather than answering in a shape this package can't read.
+const APIVersion = "1"
+
+// Client calls a conifer server.
+type Client struct {
+	// BaseURL is where the server is, like "https://conifer.example.com".
+	BaseURL string
+	// APIKey is the tenant's key. Without one, requests are anonymous.
+	APIKey string
+	// HTTPClient makes the requests, defaulting to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL, apiKey string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), APIKey: apiKey}
+}
+
+// Error is a response the server refused or failed to answer.
+type Error struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is how long the server asked to wait before trying again,
+	// when it is rate limiting or overloaded.
+	RetryAfter time.Duration
+	// Code is the kind of a failed build's first error, like
+	// "source_error". It is empty for other failures.
+	Code string
+	// Errors and Warnings are everything a failed build reported.
+	Errors   []BuildMessage
+	Warnings []BuildMessage
+}
+
+// BuildMessage is an error or warning reported by a build.
+type BuildMessage struct {
+	Code       string           `json:"code"`
+	Text       string           `json:"text"`
+	PluginName string           `json:"pluginName,omitempty"`
+	Location   *MessageLocation `json:"location,omitempty"`
+	Notes      []struct {
+		Text     string           `json:"text"`
+		Location *MessageLocation `json:"location,omitempty"`
+	} `json:"notes,omitempty"`
+}
+
+// MessageLocation is where in a file a message applies. Line is 1-based
+// and Column is 0-based, in bytes.
+type MessageLocation struct {
+	File       string `json:"file"`
+	Namespace  string `json:"namespace,omitempty"`
+	Line       int    `json:"line"`
+	Column     int    `json:"column"`
+	Length     int    `json:"length"`
+	LineText   string `json:"lineText"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("conifer: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// BuildOptions are the options of a build. The zero value bundles source
+// with the server's defaults.
+type BuildOptions struct {
+	Minify bool
+	// NoBundle only transforms the source, leaving its imports alone.
+	NoBundle bool
+	// KeepURLs are patterns like "unpkg.com/*" of imports left in the output.
+	KeepURLs     []string
+	AutoExternal bool
+	Name         string
+	MangleProps  string
+	Splitting    bool
+	Target       string
+	// Format is the module format of the output, "esm" when empty, "iife"
+	// or "cjs".
+	Format string
+	// InlineSourcemap appends a source map to the output.
+	InlineSourcemap bool
+	// Differential builds for LegacyTarget when UserAgent isn't a modern
+	// browser.
+	Differential bool
+	LegacyTarget string
+	UserAgent    string
+	ProxyURLs    bool
+	// Polyfill adds polyfills for runtime features the output uses but
+	// Target lacks, listed in BuildResult.Polyfills.
+	Polyfill bool
+	// SmokeTest runs the output in the server's sandboxed runtime, failing
+	// the build when it throws, and naming the runtime in
+	// BuildResult.SmokeTest.
+	SmokeTest   bool
+	Lockfile    *Lockfile
+	ImportMap   *ImportMap
+	TsconfigRaw string
+	// Exposes makes the build a module federation remote exposing these
+	// modules, like {"./Button": "https://example.com/button.js"}, instead
+	// of building a source. Experimental.
+	Exposes map[string]string
+	// Remotes maps aliases to the manifest URLs of module federation
+	// remotes, so importing "<alias>/Button" loads ./Button from the
+	// remote's current version. Experimental.
+	Remotes map[string]string
+	// Stamp writes these fields, like {"gitSha": "0a1b2c"}, into the output
+	// along with the time of the build.
+	Stamp map[string]string
+	// StampAsDefine defines the stamp as the __CONIFER_STAMP__ global
+	// instead of writing it as a banner comment.
+	StampAsDefine bool
+	// NoTimestamps leaves the time out of the stamp, keeping the output
+	// reproducible.
+	NoTimestamps bool
+	// IfNoneMatch is the ETag of an earlier result. When the output hasn't
+	// changed, Build returns a result with NotModified set and no code.
+	IfNoneMatch string
+}
+
+// Lockfile pins each module URL to a "sha256-<base64>" hash.
+type Lockfile struct {
+	Modules map[string]string `json:"modules"`
+}
+
+// ImportMap resolves bare specifiers like "react" to URLs.
+type ImportMap struct {
+	Imports map[string]string            `json:"imports,omitempty"`
+	Scopes  map[string]map[string]string `json:"scopes,omitempty"`
+}
+
+func (o BuildOptions) query() (url.Values, error) {
+	q := url.Values{}
+	if o.Minify {
+		q.Set("minify", "")
+	}
+	if o.NoBundle {
+		q.Set("bundle", "false")
+	}
+	if len(o.KeepURLs) > 0 {
+		q.Set("keepUrls", strings.Join(o.KeepURLs, ","))
+	}
+	setBool(q, "autoExternal", o.AutoExternal)
+	setString(q, "name", o.Name)
+	setString(q, "mangleProps", o.MangleProps)
+	setBool(q, "splitting", o.Splitting)
+	setString(q, "target", o.Target)
+	setString(q, "format", o.Format)
+	if o.InlineSourcemap {
+		q.Set("sourcemap", "inline")
+	}
+	setBool(q, "differential", o.Differential)
+	setString(q, "legacyTarget", o.LegacyTarget)
+	setBool(q, "proxyUrls", o.ProxyURLs)
+	setBool(q, "polyfill", o.Polyfill)
+	setBool(q, "smokeTest", o.SmokeTest)
+	setString(q, "tsconfigRaw", o.TsconfigRaw)
+	if o.Stamp != nil {
+		fields := make([]string, 0, len(o.Stamp))
+		for name, value := range o.Stamp {
+			fields = append(fields, name+":"+value)
+		}
+		sort.Strings(fields)
+		q.Set("stamp", strings.Join(fields, ","))
+		if o.StampAsDefine {
+			q.Set("stampAs", "define")
+		}
+		setBool(q, "noTimestamps", o.NoTimestamps)
+	}
+	if o.Lockfile != nil {
+		if err := setJSON(q, "lockfile", o.Lockfile); err != nil {
+			return nil, err
+		}
+	}
+	if o.ImportMap != nil {
+		if err := setJSON(q, "importMap", o.ImportMap); err != nil {
+			return nil, err
+		}
+	}
+	if o.Exposes != nil {
+		if err := setJSON(q, "exposes", o.Exposes); err != nil {
+			return nil, err
+		}
+	}
+	if o.Remotes != nil {
+		if err := setJSON(q, "remotes", o.Remotes); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func setJSON(q url.Values, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	q.Set(name, string(b))
+	return nil
+}
+
+func setBool(q url.Values, name string, v bool) {
+	if v {
+		q.Set(name, "true")
+	}
+}
+
+func setString(q url.Values, name, v string) {
+	if v != "" {
+		q.Set(name, v)
+	}
+}
+
+// BuildResult is the output of a build.
+type BuildResult struct {
+	Code string
+	// BuildID identifies the build for GetBuild and Replay.
+	BuildID string
+	// ArtifactID, when the server stores artifacts, is where the output can
+	// be fetched from again at /v1/artifacts/<id>.js.
+	ArtifactID string
+	ETag       string
+	// NotModified is set when the output matched IfNoneMatch.
+	NotModified bool
+	// Commit is the commit BuildGit built.
+	Commit string
+	// Polyfills are the runtime features polyfilled for the target.
+	Polyfills []string
+	// SmokeTest is the runtime the output was smoke tested in.
+	SmokeTest string
+	// Warnings is how many warnings the build reported, which BuildJSON
+	// returns in full.
+	Warnings int
+}
+
+// Build builds source.
+func (c *Client) Build(ctx context.Context, source string, opts BuildOptions) (*BuildResult, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", "/v1/build", q, strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/javascript")
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
+	}
+	if opts.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", opts.IfNoneMatch)
+	}
+	return c.doBuild(req)
+}
+
+// BuildEntry bundles the module at entry, an http or https URL, and
+// everything it imports.
+func (c *Client) BuildEntry(ctx context.Context, entry string, opts BuildOptions) (*BuildResult, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("entry", entry)
+	req, err := c.newRequest(ctx, "GET", "/v1/bundle", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
+	}
+	if opts.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", opts.IfNoneMatch)
+	}
+	return c.doBuild(req)
+}
+
+// BuildPage builds the module scripts and stylesheets of an HTML page,
+// returning the page loading the outputs. Relative URLs in the page are
+// resolved against base, the page's URL.
+func (c *Client) BuildPage(ctx context.Context, page, base string, opts BuildOptions) (string, error) {
+	q, err := opts.query()
+	if err != nil {
+		return "", err
+	}
+	if base != "" {
+		q.Set("base", base)
+	}
+	req, err := c.newRequest(ctx, "POST", "/v1/build", q, strings.NewReader(page))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/html")
+	_, body, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// TransformOptions control how a single file is compiled.
+type TransformOptions struct {
+	// Loader is how the source is parsed, like "ts" or "jsx", "js" when
+	// empty.
+	Loader string
+	// Sourcefile names the file in errors and source maps.
+	Sourcefile string
+	Minify     bool
+	Target     string
+	// Format is "esm", "iife" or "cjs", or empty to keep the source's.
+	Format          string
+	InlineSourcemap bool
+	TsconfigRaw     string
+}
+
+// Transform compiles source, such as TypeScript or JSX, to JavaScript
+// without resolving or downloading anything it imports.
+func (c *Client) Transform(ctx context.Context, source string, opts TransformOptions) (string, error) {
+	q := url.Values{}
+	setString(q, "loader", opts.Loader)
+	setString(q, "sourcefile", opts.Sourcefile)
+	if opts.Minify {
+		q.Set("minify", "")
+	}
+	setString(q, "target", opts.Target)
+	setString(q, "format", opts.Format)
+	if opts.InlineSourcemap {
+		q.Set("sourcemap", "inline")
+	}
+	setString(q, "tsconfigRaw", opts.TsconfigRaw)
+	req, err := c.newRequest(ctx, "POST", "/v1/transform", q, strings.NewReader(source))
+	if err != nil {
+		return "", err
+	}
+	_, body, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// GitSource picks a file of a GitHub repository to build.
+type GitSource struct {
+	// Repo is like "github.com/owner/repo".
+	Repo string
+	// Ref is a branch, tag or commit, the default branch when empty.
+	Ref string
+	// Entry is the path of the file to start from, an index file at the
+	// root when empty.
+	Entry string
+}
+
+// BuildGit builds a file of a GitHub repository and the files it imports
+// from it. Builds are cached by the commit the ref points at.
+func (c *Client) BuildGit(ctx context.Context, src GitSource, opts BuildOptions) (*BuildResult, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("repo", src.Repo)
+	if src.Ref != "" {
+		q.Set("ref", src.Ref)
+	}
+	if src.Entry != "" {
+		q.Set("entry", src.Entry)
+	}
+	req, err := c.newRequest(ctx, "GET", "/v1/git", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", opts.IfNoneMatch)
+	}
+	return c.doBuild(req)
+}
+
+// ModuleEvent reports a module a streamed build loaded.
+type ModuleEvent struct {
+	URL   string `json:"url"`
+	Bytes int    `json:"bytes"`
+	// Cached is set when the module came from the server's module cache
+	// rather than being downloaded.
+	Cached bool `json:"cached"`
+}
+
+// BuildDone is a finished streamed build, whose output is at URL.
+type BuildDone struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Integrity string   `json:"integrity"`
+	Artifact  string   `json:"artifact,omitempty"`
+	Manifest  Manifest `json:"manifest"`
+}
+
+// BuildStream builds source as Build does, calling onModule as each module
+// is loaded, so long builds can show progress. The output isn't returned
+// but kept by the server at BuildDone.URL.
+func (c *Client) BuildStream(ctx context.Context, source string, opts BuildOptions, onModule func(ModuleEvent)) (*BuildDone, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", "/v1/build", q, strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, newError(res, body)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	// The done event holds the whole manifest.
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	var event string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := []byte(strings.TrimPrefix(line, "data: "))
+			switch event {
+			case "module":
+				var m ModuleEvent
+				if err := json.Unmarshal(data, &m); err == nil && onModule != nil {
+					onModule(m)
+				}
+			case "done":
+				var done BuildDone
+				if err := json.Unmarshal(data, &done); err != nil {
+					return nil, err
+				}
+				return &done, nil
+			case "error":
+				var failed struct {
+					Status int `json:"status"`
+					Error  struct {
+						Code     string         `json:"code"`
+						Message  string         `json:"message"`
+						Errors   []BuildMessage `json:"errors"`
+						Warnings []BuildMessage `json:"warnings"`
+					} `json:"error"`
+					RetryAfter int `json:"retryAfter"`
+				}
+				if err := json.Unmarshal(data, &failed); err != nil {
+					return nil, err
+				}
+				return nil, &Error{
+					StatusCode: failed.Status,
+					Message:    failed.Error.Message,
+					RetryAfter: time.Duration(failed.RetryAfter) * time.Second,
+					Code:       failed.Error.Code,
+					Errors:     failed.Error.Errors,
+					Warnings:   failed.Error.Warnings,
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+func (c *Client) doBuild(req *http.Request) (*BuildResult, error) {
+	res, body, err := c.do(req, http.StatusOK, http.StatusNotModified)
+	if err != nil {
+		return nil, err
+	}
+	var polyfills []string
+	if header := res.Header.Get("X-Conifer-Polyfills"); header != "" {
+		polyfills = strings.Split(header, ", ")
+	}
+	warnings, _ := strconv.Atoi(res.Header.Get("X-Build-Warnings-Count"))
+	return &BuildResult{
+		Code:        string(body),
+		BuildID:     res.Header.Get("X-Conifer-Build"),
+		ArtifactID:  res.Header.Get("X-Conifer-Artifact"),
+		ETag:        res.Header.Get("ETag"),
+		NotModified: res.StatusCode == http.StatusNotModified,
+		Commit:      res.Header.Get("X-Conifer-Commit"),
+		Polyfills:   polyfills,
+		SmokeTest:   res.Header.Get("X-Conifer-Smoke-Test"),
+		Warnings:    warnings,
+	}, nil
+}
+
+// BuildRequest describes a build in full. Exactly one of Source, Entry and
+// Files is required, though Entry may also pick the file Files start from.
+type BuildRequest struct {
+	Source string `json:"source,omitempty"`
+	// Entry is the URL of a module to build instead of Source, or with
+	// Files, the path of the file to start from, an index file when empty.
+	Entry string `json:"entry,omitempty"`
+	// Files are built instead of Source, keyed by absolute paths like
+	// "/src/index.ts". They import one another with relative imports.
+	Files map[string]string `json:"files,omitempty"`
+	// Loader is how Source is parsed, like "ts". It defaults to "js".
+	Loader string `json:"loader,omitempty"`
+	// Format is "esm", the default, "iife" or "cjs".
+	Format string `json:"format,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Minify picks the kinds of minification done, with none when nil.
+	Minify *MinifyOptions `json:"minify,omitempty"`
+	// NoBundle only transforms Source, leaving its imports alone.
+	NoBundle bool              `json:"-"`
+	Define   map[string]string `json:"define,omitempty"`
+	// External are patterns like "unpkg.com/*" of imports left in the
+	// output.
+	External []string `json:"external,omitempty"`
+	// Sourcemap is "inline" or "external".
+	Sourcemap   string     `json:"sourcemap,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	MangleProps string     `json:"mangleProps,omitempty"`
+	Splitting   bool       `json:"splitting,omitempty"`
+	ProxyURLs   bool       `json:"proxyUrls,omitempty"`
+	Polyfill    bool       `json:"polyfill,omitempty"`
+	SmokeTest   bool       `json:"smokeTest,omitempty"`
+	Lockfile    *Lockfile  `json:"lockfile,omitempty"`
+	ImportMap   *ImportMap `json:"importMap,omitempty"`
+	TsconfigRaw string     `json:"tsconfigRaw,omitempty"`
+	// Exposes and Remotes are as in BuildOptions.
+	Exposes map[string]string `json:"exposes,omitempty"`
+	Remotes map[string]string `json:"remotes,omitempty"`
+	// Routes maps the paths of a single-page app, like "/settings", to the
+	// modules rendering them, building each into chunks of its own instead
+	// of building a source or entry. The outputs gain routes.json, a
+	// RouteManifest.
+	Routes map[string]string `json:"routes,omitempty"`
+	// Entries maps names, like "main" and "worker", to the modules of
+	// several entry points, URLs or with Files, their paths, instead of
+	// building a source or entry. Each is built into an output named after
+	// it, like main.js, and with Splitting, the code they share into
+	// chunks.
+	Entries map[string]string `json:"entries,omitempty"`
+	// ServiceWorker adds sw.js to the outputs, a service worker precaching
+	// the output and its chunks, to deploy next to it.
+	ServiceWorker bool `json:"serviceWorker,omitempty"`
+}
+
+// MinifyOptions are the kinds of minification a build does.
+type MinifyOptions struct {
+	Whitespace  bool `json:"whitespace"`
+	Identifiers bool `json:"identifiers"`
+	Syntax      bool `json:"syntax"`
+}
+
+// BuildEnvelope is the result of BuildJSON.
+type BuildEnvelope struct {
+	ID       string `json:"id"`
+	Artifact string `json:"artifact,omitempty"`
+	// Outputs are index.js, or index.css for CSS, and its source map when
+	// it is external.
+	Outputs []struct {
+		Path     string `json:"path"`
+		Contents string `json:"contents"`
+	} `json:"outputs"`
+	Warnings []BuildMessage `json:"warnings"`
+	Manifest Manifest       `json:"manifest"`
+	// Release is the release the external source map was uploaded to the
+	// server's error trackers under, when it was.
+	Release string `json:"release,omitempty"`
+}
+
+// RouteManifest says which chunks each route of a build of routes loads.
+type RouteManifest struct {
+	Routes map[string]struct {
+		// Chunk is the URL of the route's own chunk, and Imports those of
+		// the chunks it imports.
+		Chunk   string   `json:"chunk"`
+		Imports []string `json:"imports"`
+	} `json:"routes"`
+	// Shared are the chunks more than one route loads.
+	Shared []string `json:"shared"`
+}
+
+// BuildJSON runs the build breq describes. When it fails, the *Error
+// returned lists every error and warning.
+func (c *Client) BuildJSON(ctx context.Context, breq BuildRequest) (*BuildEnvelope, error) {
+	body, err := breq.marshal()
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", "/v1/build", nil, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.doBuildEnvelope(req)
+}
+
+// BatchResult is the outcome of one build of BuildBatch. Build is set when
+// it succeeded, and Err when it didn't.
+type BatchResult struct {
+	Build *BuildEnvelope
+	Err   *Error
+}
+
+// BuildBatch runs many builds in one request, which the server runs a few
+// at a time. Each succeeds or fails on its own, with the results in the
+// order of breqs; the error is only for the request as a whole.
+func (c *Client) BuildBatch(ctx context.Context, breqs []BuildRequest) ([]BatchResult, error) {
+	builds := make([]json.RawMessage, len(breqs))
+	for i, breq := range breqs {
+		body, err := breq.marshal()
+		if err != nil {
+			return nil, err
+		}
+		builds[i] = body
+	}
+	body, err := json.Marshal(map[string]interface{}{"builds": builds})
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Results []struct {
+			Status int            `json:"status"`
+			Build  *BuildEnvelope `json:"build"`
+			Error  *struct {
+				Code     string         `json:"code"`
+				Message  string         `json:"message"`
+				Errors   []BuildMessage `json:"errors"`
+				Warnings []BuildMessage `json:"warnings"`
+			} `json:"error"`
+			RetryAfter int `json:"retryAfter"`
+		} `json:"results"`
+	}
+	if err := c.call(ctx, "POST", "/v1/batch", nil, bytes.NewReader(body), &res, http.StatusOK); err != nil {
+		return nil, err
+	}
+	results := make([]BatchResult, len(res.Results))
+	for i, r := range res.Results {
+		results[i].Build = r.Build
+		if r.Error != nil {
+			results[i].Err = &Error{
+				StatusCode: r.Status,
+				Message:    r.Error.Message,
+				RetryAfter: time.Duration(r.RetryAfter) * time.Second,
+				Code:       r.Error.Code,
+				Errors:     r.Error.Errors,
+				Warnings:   r.Error.Warnings,
+			}
+		}
+	}
+	return results, nil
+}
+
+// BuildArchive builds the project in archive, a gzipped tarball, tarball
+// or zip file, as contentType says, like "application/gzip". breq.Entry is
+// the path inside the archive of the file to start from, and the rest of
+// breq holds the other options, without Source or Files.
+func (c *Client) BuildArchive(ctx context.Context, archive io.Reader, contentType string, breq BuildRequest) (*BuildEnvelope, error) {
+	q := url.Values{}
+	if breq.Entry != "" {
+		q.Set("entry", breq.Entry)
+		breq.Entry = ""
+	}
+	options, err := breq.marshal()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("options", string(options))
+	req, err := c.newRequest(ctx, "POST", "/v1/build", q, archive)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.doBuildEnvelope(req)
+}
+
+// OutputArchive runs the build breq describes, returning an archive of its
+// outputs and the chunks they import, which are under chunks/. Format is
+// "zip" or "tar", for a gzipped tarball.
+func (c *Client) OutputArchive(ctx context.Context, breq BuildRequest, format string) ([]byte, error) {
+	body, err := breq.marshal()
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", "/v1/build", url.Values{"output": {format}}, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, archive, err := c.do(req, http.StatusOK)
+	return archive, err
+}
+
+// marshal encodes breq, sending bundle explicitly as it defaults to true.
+func (breq BuildRequest) marshal() ([]byte, error) {
+	return json.Marshal(struct {
+		BuildRequest
+		Bundle bool `json:"bundle"`
+	}{breq, !breq.NoBundle})
+}
+
+func (c *Client) doBuildEnvelope(req *http.Request) (*BuildEnvelope, error) {
+	_, resBody, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var env BuildEnvelope
+	if err := json.Unmarshal(resBody, &env); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// Lock builds source and returns a lockfile pinning the modules it used.
+func (c *Client) Lock(ctx context.Context, source string, opts BuildOptions) (*Lockfile, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("output", "lockfile")
+	var lock Lockfile
+	if err := c.call(ctx, "POST", "/v1/build", q, strings.NewReader(source), &lock, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// DeployManifest is a record of a build to keep with the deploy it went
+// into. The output is kept at URL, named by its hash.
+type DeployManifest struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Integrity string `json:"integrity"`
+	// SourceMapURL is where the source map is kept, when one was asked for.
+	SourceMapURL string `json:"sourceMapUrl,omitempty"`
+	Artifact     string `json:"artifact,omitempty"`
+	Release      string `json:"release,omitempty"`
+	Dependencies []struct {
+		URL string `json:"url"`
+		// Package and Version are set when the module's URL names a
+		// package with a version.
+		Package   string `json:"package,omitempty"`
+		Version   string `json:"version,omitempty"`
+		Bytes     int    `json:"bytes"`
+		Integrity string `json:"integrity"`
+	} `json:"dependencies"`
+	Chunks   []string       `json:"chunks,omitempty"`
+	Warnings []BuildMessage `json:"warnings"`
+	// Timings are how long the build took. When its output was reused,
+	// the phases are those of the build that made it.
+	Timings struct {
+		TotalMS       int64 `json:"totalMs"`
+		Reused        bool  `json:"reused"`
+		BundleMS      int64 `json:"bundleMs"`
+		DownloadMS    int64 `json:"downloadMs"`
+		PolyfillMS    int64 `json:"polyfillMs"`
+		PostProcessMS int64 `json:"postProcessMs"`
+		// ThrottleMS is how long downloads waited for bandwidth.
+		ThrottleMS  int64 `json:"throttleMs"`
+		SmokeTestMS int64 `json:"smokeTestMs"`
+	} `json:"timings"`
+	Engine    Engine   `json:"engine"`
+	Pinned    bool     `json:"pinned"`
+	Polyfills []string `json:"polyfills,omitempty"`
+	SmokeTest string   `json:"smokeTest,omitempty"`
+}
+
+// DeployManifest builds source and returns a record of the build, keeping
+// its output on the server. With sourceMap, an external source map is
+// kept next to it.
+func (c *Client) DeployManifest(ctx context.Context, source string, opts BuildOptions, sourceMap bool) (*DeployManifest, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("output", "manifest")
+	if sourceMap {
+		q.Set("sourcemap", "external")
+	}
+	var m DeployManifest
+	if err := c.call(ctx, "POST", "/v1/build", q, strings.NewReader(source), &m, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ImportTrace is every import of a remote module a build resolved, sorted by
+// importer and specifier, traced to where its code ended up.
+type ImportTrace struct {
+	Imports []struct {
+		// Importer is the URL of the importing module, or "" for the
+		// source or its files.
+		Importer  string `json:"importer"`
+		Specifier string `json:"specifier"`
+		// URL is what the specifier resolved to, after import maps,
+		// policy and redirects.
+		URL string `json:"url"`
+		// Kind is how it was imported, like "import-statement" or
+		// "dynamic-import".
+		Kind     string `json:"kind,omitempty"`
+		External bool   `json:"external,omitempty"`
+		// Output is the file the module was placed in, "index.js" for the
+		// output or the URL of a chunk, and BytesInOutput how much of it
+		// is left there, 0 when it was tree-shaken.
+		Output        string `json:"output,omitempty"`
+		BytesInOutput int    `json:"bytesInOutput"`
+	} `json:"imports"`
+}
+
+// TraceImports builds source and returns where each of its imports ended
+// up rather than its output.
+func (c *Client) TraceImports(ctx context.Context, source string, opts BuildOptions) (*ImportTrace, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("output", "imports")
+	var t ImportTrace
+	if err := c.call(ctx, "POST", "/v1/build", q, strings.NewReader(source), &t, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Metafile is esbuild's metafile, describing a build's inputs and outputs.
+type Metafile struct {
+	Inputs  map[string]MetafileInput  `json:"inputs"`
+	Outputs map[string]MetafileOutput `json:"outputs"`
+}
+
+type MetafileInput struct {
+	Bytes   int              `json:"bytes"`
+	Imports []MetafileImport `json:"imports"`
+}
+
+type MetafileImport struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+type MetafileOutput struct {
+	Bytes int `json:"bytes"`
+	// Inputs lists how many bytes each input contributes to the output.
+	Inputs map[string]struct {
+		BytesInOutput int `json:"bytesInOutput"`
+	} `json:"inputs"`
+	Imports    []MetafileImport `json:"imports"`
+	EntryPoint string           `json:"entryPoint,omitempty"`
+	Exports    []string         `json:"exports,omitempty"`
+}
+
+// Analyze builds source and returns its metafile rather than its output.
+func (c *Client) Analyze(ctx context.Context, source string, opts BuildOptions) (*Metafile, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("analyze", "json")
+	var m Metafile
+	if err := c.call(ctx, "POST", "/v1/build", q, strings.NewReader(source), &m, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// TreemapNode is a module, or a group of them by host, package and
+// directory, in a treemap of a build's output. Groups add up the sizes of
+// what is in them.
+type TreemapNode struct {
+	Name string `json:"name"`
+	// URL is set on remote modules.
+	URL string `json:"url,omitempty"`
+	// Bytes is the size of the modules' source. BytesInOutput is how much
+	// of it is left in the unminified output, and MinifiedBytes in the
+	// minified output, both 0 when it was tree-shaken.
+	Bytes         int            `json:"bytes"`
+	BytesInOutput int            `json:"bytesInOutput"`
+	MinifiedBytes int            `json:"minifiedBytes"`
+	Children      []*TreemapNode `json:"children,omitempty"`
+}
+
+// Treemap builds source and returns a treemap of what its output is made
+// of rather than its output. opts' minify options are ignored, as the
+// output is built both unminified and minified.
+func (c *Client) Treemap(ctx context.Context, source string, opts BuildOptions) (*TreemapNode, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("analyze", "treemap")
+	var t TreemapNode
+	if err := c.call(ctx, "POST", "/v1/build", q, strings.NewReader(source), &t, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// LicenseReport is the third-party code left in a build's output and its
+// licenses, sorted by URL.
+type LicenseReport struct {
+	Packages []struct {
+		// Package and Version are set for modules of versioned packages,
+		// whose URLs begin with URL. Otherwise URL is the module's.
+		Package string   `json:"package,omitempty"`
+		Version string   `json:"version,omitempty"`
+		URL     string   `json:"url"`
+		Modules []string `json:"modules"`
+		// BytesInOutput is how much of the modules is left in the output
+		// and its chunks.
+		BytesInOutput int `json:"bytesInOutput"`
+		// Licenses is empty when none were found.
+		Licenses []struct {
+			License string `json:"license"`
+			// Source is the URL of the package.json declaring the
+			// license, or of the module with a comment naming it.
+			Source string `json:"source"`
+		} `json:"licenses"`
+	} `json:"packages"`
+}
+
+// Licenses builds source and returns the licenses of the third-party code
+// in its output rather than its output.
+func (c *Client) Licenses(ctx context.Context, source string, opts BuildOptions) (*LicenseReport, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("licenses", "json")
+	var l LicenseReport
+	if err := c.call(ctx, "POST", "/v1/build", q, strings.NewReader(source), &l, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// SBOM builds source and returns a bill of materials of it rather than
+// its output, as a CycloneDX document when format is "cyclonedx" or an
+// SPDX document when it is "spdx".
+func (c *Client) SBOM(ctx context.Context, source, format string, opts BuildOptions) ([]byte, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("sbom", format)
+	req, err := c.newRequest(ctx, "POST", "/v1/build", q, strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	_, body, err := c.do(req, http.StatusOK)
+	return body, err
+}
+
+// MinifySize is the size of an output minified some way, and how many
+// bytes smaller than the unminified output it is.
+type MinifySize struct {
+	Bytes     int `json:"bytes"`
+	GzipBytes int `json:"gzipBytes"`
+	Saved     int `json:"saved"`
+	GzipSaved int `json:"gzipSaved"`
+}
+
+// MinifyComparison is what each kind of minification saves on its own, and
+// all of them together.
+type MinifyComparison struct {
+	Unminified  MinifySize `json:"unminified"`
+	Whitespace  MinifySize `json:"whitespace"`
+	Identifiers MinifySize `json:"identifiers"`
+	Syntax      MinifySize `json:"syntax"`
+	All         MinifySize `json:"all"`
+}
+
+// CompareMinify builds source and returns what minifying its output each
+// way saves rather than its output. opts' minify options are ignored.
+func (c *Client) CompareMinify(ctx context.Context, source string, opts BuildOptions) (*MinifyComparison, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	q.Set("compareMinify", "true")
+	var m MinifyComparison
+	if err := c.call(ctx, "POST", "/v1/build", q, strings.NewReader(source), &m, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// AnalyzeText builds source and returns esbuild's summary of how many
+// bytes each input contributes to the output.
+func (c *Client) AnalyzeText(ctx context.Context, source string, opts BuildOptions) (string, error) {
+	q, err := opts.query()
+	if err != nil {
+		return "", err
+	}
+	q.Set("analyze", "text")
+	req, err := c.newRequest(ctx, "POST", "/v1/build", q, strings.NewReader(source))
+	if err != nil {
+		return "", err
+	}
+	_, body, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// Graph is every module a source pulls in and the imports between them.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+type GraphNode struct {
+	URL    string `json:"url"`
+	Bytes  int    `json:"bytes,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// External modules are left as imports, so weren't downloaded.
+	External bool `json:"external,omitempty"`
+}
+
+// GraphEdge is an import. Importer is "" for imports of the source itself.
+type GraphEdge struct {
+	Importer  string `json:"importer"`
+	Specifier string `json:"specifier"`
+	URL       string `json:"url"`
+	External  bool   `json:"external,omitempty"`
+}
+
+// Graph resolves the imports of source without bundling it.
+func (c *Client) Graph(ctx context.Context, source string, opts BuildOptions) (*Graph, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	var g Graph
+	if err := c.call(ctx, "POST", "/v1/graph", q, strings.NewReader(source), &g, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// Vendor downloads the modules source imports as a gzipped tarball with an
+// import map. The caller must close it.
+func (c *Client) Vendor(ctx context.Context, source string, opts BuildOptions) (io.ReadCloser, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", "/v1/vendor", q, strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return nil, newError(res, body)
+	}
+	return res.Body, nil
+}
+
+// Bundle is a named bundle and its versions.
+type Bundle struct {
+	Tenant   string          `json:"tenant"`
+	Name     string          `json:"name"`
+	Current  string          `json:"current"`
+	Versions []BundleVersion `json:"versions"`
+	// Quarantine is set while the bundle is taken down after abuse reports.
+	Quarantine *struct {
+		Since  time.Time `json:"since"`
+		Reason string    `json:"reason"`
+	} `json:"quarantine,omitempty"`
+}
+
+// BundleVersion is one stored build of a bundle.
+type BundleVersion struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Bytes   int       `json:"bytes"`
+	// Exposes lists the names each module a module federation remote
+	// exposes exports, and Shared the patterns of URLs it keeps as imports.
+	Exposes map[string][]string `json:"exposes,omitempty"`
+	Shared  []string            `json:"shared,omitempty"`
+}
+
+// PublishedBundle is a version just stored by PublishBundle.
+type PublishedBundle struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// URL serves whichever version is current.
+	URL string `json:"url"`
+	// VersionURL always serves this version.
+	VersionURL string `json:"versionUrl"`
+	Build      string `json:"build"`
+}
+
+// GetBundle returns the bundle called name.
+func (c *Client) GetBundle(ctx context.Context, name string) (*Bundle, error) {
+	var b Bundle
+	if err := c.call(ctx, "GET", "/v1/bundles/"+url.PathEscape(name), nil, nil, &b, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// PublishBundle builds source and stores it as a new version of the bundle
+// called name, making it current unless promote is false.
+func (c *Client) PublishBundle(ctx context.Context, name, source string, opts BuildOptions, promote bool) (*PublishedBundle, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	if !promote {
+		q.Set("promote", "false")
+	}
+	var p PublishedBundle
+	if err := c.call(ctx, "POST", "/v1/bundles/"+url.PathEscape(name), q, strings.NewReader(source), &p, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// PromoteBundle makes a stored version of a bundle the current one.
+func (c *Client) PromoteBundle(ctx context.Context, name, version string) error {
+	q := url.Values{"version": {version}}
+	return c.call(ctx, "POST", "/v1/bundles/"+url.PathEscape(name)+"/promote", q, nil, nil, http.StatusNoContent)
+}
+
+// Engine is the versions of conifer and esbuild a build ran with.
+type Engine struct {
+	Conifer string `json:"conifer"`
+	Esbuild string `json:"esbuild"`
+}
+
+// Manifest lists the modules a build used.
+type Manifest struct {
+	Modules []struct {
+		URL    string `json:"url"`
+		Bytes  int    `json:"bytes"`
+		SHA256 string `json:"sha256"`
+	} `json:"modules"`
+	OutputBytes int      `json:"outputBytes"`
+	Chunks      []string `json:"chunks,omitempty"`
+	Engine      Engine   `json:"engine"`
+	Pinned      bool     `json:"pinned"`
+	// PostProcess lists the steps the output went through after it was
+	// built, in order.
+	PostProcess []struct {
+		Type   string `json:"type"`
+		Bytes  int    `json:"bytes"`
+		SHA256 string `json:"sha256"`
+	} `json:"postProcess,omitempty"`
+	// Polyfills are the runtime features polyfilled for the target.
+	Polyfills []string `json:"polyfills,omitempty"`
+	// SmokeTest is the runtime the output was run in without throwing,
+	// when the build asked for a smoke test.
+	SmokeTest string `json:"smokeTest,omitempty"`
+}
+
+// BuildRecord is a past build.
+type BuildRecord struct {
+	ID       string          `json:"id"`
+	Created  time.Time       `json:"created"`
+	Tenant   string          `json:"tenant,omitempty"`
+	Request  json.RawMessage `json:"request"`
+	Manifest Manifest        `json:"manifest"`
+	// OutputSHA256 is the hex encoded hash of the output.
+	OutputSHA256 string `json:"outputSha256"`
+}
+
+// ReplayReport compares a past build with running it again.
+type ReplayReport struct {
+	ID            string `json:"id"`
+	OutputMatches bool   `json:"outputMatches"`
+	OutputSHA256  string `json:"outputSha256"`
+	ReplaySHA256  string `json:"replaySha256,omitempty"`
+	Changed       []struct {
+		URL    string `json:"url"`
+		Before string `json:"before"`
+		After  string `json:"after"`
+	} `json:"changed"`
+	Errors []string `json:"errors,omitempty"`
+	Engine Engine   `json:"engine"`
+}
+
+// GetBuild returns the record of the build with id.
+func (c *Client) GetBuild(ctx context.Context, id string) (*BuildRecord, error) {
+	var rec BuildRecord
+	if err := c.call(ctx, "GET", "/v1/builds/"+url.PathEscape(id), nil, nil, &rec, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// Replay runs the build with id again, reporting any modules that changed.
+// It requires an admin key.
+func (c *Client) Replay(ctx context.Context, id string) (*ReplayReport, error) {
+	var report ReplayReport
+	if err := c.call(ctx, "POST", "/v1/builds/"+url.PathEscape(id)+"/replay", nil, nil, &report, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// ProvenanceStatement is an in-toto Statement with a SLSA provenance
+// predicate, see https://slsa.dev/provenance/v1.
+type ProvenanceStatement struct {
+	Type    string `json:"_type"`
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// DSSEEnvelope is a signed statement.
+type DSSEEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	// Payload is the base64 encoded statement.
+	Payload    string `json:"payload"`
+	Signatures []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// GetProvenance returns an in-toto attestation of how the build with id was
+// made: the statement itself, or a DSSE envelope containing it when the
+// server signs provenance, to unmarshal into a ProvenanceStatement or a
+// DSSEEnvelope.
+func (c *Client) GetProvenance(ctx context.Context, id string) (json.RawMessage, error) {
+	var provenance json.RawMessage
+	if err := c.call(ctx, "GET", "/v1/builds/"+url.PathEscape(id)+"/provenance", nil, nil, &provenance, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return provenance, nil
+}
+
+// ProvenanceKey is the public key provenance is signed with.
+type ProvenanceKey struct {
+	KeyID     string `json:"keyid"`
+	Algorithm string `json:"algorithm"`
+	// PublicKey is base64 encoded.
+	PublicKey string `json:"publicKey"`
+}
+
+// GetProvenanceKey returns the key provenance is signed with.
+func (c *Client) GetProvenanceKey(ctx context.Context) (*ProvenanceKey, error) {
+	var k ProvenanceKey
+	if err := c.call(ctx, "GET", "/v1/provenance-key", nil, nil, &k, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// Limits are the caller's limits and what remains of its daily quota.
+type Limits struct {
+	Tenant string `json:"tenant,omitempty"`
+	Limits struct {
+		RequestsPerMinute int      `json:"requestsPerMinute,omitempty"`
+		BuildsPerDay      int      `json:"buildsPerDay,omitempty"`
+		MaxSourceBytes    int64    `json:"maxSourceBytes,omitempty"`
+		MaxModuleBytes    int64    `json:"maxModuleBytes,omitempty"`
+		MaxBuildBytes     int64    `json:"maxBuildBytes,omitempty"`
+		MaxOutputBytes    int64    `json:"maxOutputBytes,omitempty"`
+		MaxModules        int      `json:"maxModules,omitempty"`
+		BuildTimeout      string   `json:"buildTimeout,omitempty"`
+		AllowedHosts      []string `json:"allowedHosts,omitempty"`
+		BlockedURLs       []string `json:"blockedUrls,omitempty"`
+	} `json:"limits"`
+	Quota struct {
+		BuildsPerDay int `json:"buildsPerDay"`
+		Used         int `json:"used"`
+		// Remaining is nil when builds aren't limited per day.
+		Remaining *int      `json:"remaining,omitempty"`
+		Resets    time.Time `json:"resets"`
+	} `json:"quota"`
+}
+
+// GetLimits returns the caller's limits.
+func (c *Client) GetLimits(ctx context.Context) (*Limits, error) {
+	var l Limits
+	if err := c.call(ctx, "GET", "/v1/limits", nil, nil, &l, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// ImportPolicy decides what happens to each import a build resolves. The
+// first rule matching an import decides, and Default applies when none do.
+type ImportPolicy struct {
+	Rules   []PolicyRule `json:"rules"`
+	Default string       `json:"default,omitempty"`
+}
+
+// PolicyRule matches an import when every condition it sets holds.
+type PolicyRule struct {
+	// Action is "allow", "deny" or "rewrite".
+	Action    string `json:"action"`
+	Specifier string `json:"specifier,omitempty"`
+	// Importer matches the importing module's URL, or is "source" for the
+	// build's own source.
+	Importer string `json:"importer,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	Host     string `json:"host,omitempty"`
+	// Path is a regular expression matching the imported URL's path.
+	Path string `json:"path,omitempty"`
+	// To is where a rewrite rule sends the import.
+	To     string `json:"to,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// PolicyImport is an import to dry run a policy against. Importer is empty
+// for the build's source, and Kind defaults to "import-statement".
+type PolicyImport struct {
+	Specifier string `json:"specifier"`
+	Importer  string `json:"importer,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+}
+
+// PolicyResult is what a policy does with an import.
+type PolicyResult struct {
+	PolicyImport
+	// URL is what the import resolves to.
+	URL      string          `json:"url"`
+	Decision *PolicyDecision `json:"decision,omitempty"`
+	// Error is why the import couldn't be resolved.
+	Error string `json:"error,omitempty"`
+}
+
+// PolicyDecision is what a policy decided to do with an import.
+type PolicyDecision struct {
+	// Action is "allow", "deny" or "rewrite".
+	Action string `json:"action"`
+	// URL is what is downloaded.
+	URL string `json:"url"`
+	// Rule is the index of the rule that decided, or nil when the default
+	// did.
+	Rule   *int   `json:"rule,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// GetPolicy returns the import policy applying to the caller's builds.
+func (c *Client) GetPolicy(ctx context.Context) (*ImportPolicy, error) {
+	var p ImportPolicy
+	if err := c.call(ctx, "GET", "/v1/policy", nil, nil, &p, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// DryRunPolicy shows how the caller's import policy treats imports, without
+// building anything. Bare specifiers are resolved with importMap, or the
+// server's when it is nil.
+func (c *Client) DryRunPolicy(ctx context.Context, imports []PolicyImport, importMap *ImportMap) ([]PolicyResult, error) {
+	body, err := json.Marshal(struct {
+		Imports   []PolicyImport `json:"imports"`
+		ImportMap *ImportMap     `json:"importMap,omitempty"`
+	}{imports, importMap})
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Results []PolicyResult `json:"results"`
+	}
+	if err := c.call(ctx, "POST", "/v1/policy/dry-run", nil, bytes.NewReader(body), &out, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return out.Results, nil
+}
+
+// Permalink is a source stored under a short ID, served at URL.
+type Permalink struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// CreatePermalink stores source and opts, returning the URL its build is
+// served at from then on.
+func (c *Client) CreatePermalink(ctx context.Context, source string, opts BuildOptions) (*Permalink, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	var p Permalink
+	if err := c.call(ctx, "POST", "/v1/permalink", q, strings.NewReader(source), &p, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Preview is a build served as a site at URL until it expires.
+type Preview struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+	// Files are the paths of the files served, with "index.html" the
+	// page at the root.
+	Files []string `json:"files"`
+}
+
+// CreatePreview builds source and serves it for a short while, with a page
+// loading the output.
+func (c *Client) CreatePreview(ctx context.Context, source string, opts BuildOptions) (*Preview, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	var p Preview
+	if err := c.call(ctx, "POST", "/v1/preview", q, strings.NewReader(source), &p, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// CreatePagePreview builds an HTML page, as BuildPage does, and serves it
+// with its built assets for a short while.
+func (c *Client) CreatePagePreview(ctx context.Context, page, base string, opts BuildOptions) (*Preview, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+	if base != "" {
+		q.Set("base", base)
+	}
+	req, err := c.newRequest(ctx, "POST", "/v1/preview", q, strings.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/html")
+	_, body, err := c.do(req, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	var p Preview
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// EmbedToken lets a page load the tenant's bundles until it expires.
+type EmbedToken struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// CreateEmbedToken creates a token lasting ttl, or the server's default
+// when ttl is zero.
+func (c *Client) CreateEmbedToken(ctx context.Context, ttl time.Duration) (*EmbedToken, error) {
+	q := url.Values{}
+	if ttl > 0 {
+		q.Set("ttl", ttl.String())
+	}
+	var t EmbedToken
+	if err := c.call(ctx, "POST", "/v1/embed-tokens", q, nil, &t, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SignedURL lets a page load a URL with the API key that signed it,
+// until it expires.
+type SignedURL struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// SignURL signs path, a path on the server with its query like
+// "/v1/bundle?entry=https://esm.sh/react", for ttl, or the server's default
+// when ttl is zero. The signed URL is absolute.
+func (c *Client) SignURL(ctx context.Context, path string, ttl time.Duration) (*SignedURL, error) {
+	q := url.Values{}
+	if ttl > 0 {
+		q.Set("ttl", ttl.String())
+	}
+	body, err := json.Marshal(map[string]string{"url": path})
+	if err != nil {
+		return nil, err
+	}
+	var s SignedURL
+	if err := c.call(ctx, "POST", "/v1/signed-urls", q, bytes.NewReader(body), &s, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(s.URL, "/") {
+		s.URL = strings.TrimSuffix(c.BaseURL, "/") + s.URL
+	}
+	return &s, nil
+}
+
+// Ready reports whether the server is ready to build.
+func (c *Client) Ready(ctx context.Context) (bool, error) {
+	err := c.call(ctx, "GET", "/v1/ready", nil, nil, nil, http.StatusOK)
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusServiceUnavailable {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetOpenAPI returns the server's OpenAPI description.
+func (c *Client) GetOpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var description json.RawMessage
+	if err := c.call(ctx, "GET", "/v1/openapi.json", nil, nil, &description, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return description, nil
+}
+
+// AbuseReport is a report of a hosted bundle awaiting review.
+type AbuseReport struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// ReportAbuse reports the bundle at bundleURL, a URL under /bundles/, for
+// review. Anyone may report a bundle, so it needs no API key.
+func (c *Client) ReportAbuse(ctx context.Context, bundleURL, reason string) (*AbuseReport, error) {
+	body, err := json.Marshal(map[string]string{"url": bundleURL, "reason": reason})
+	if err != nil {
+		return nil, err
+	}
+	var r AbuseReport
+	if err := c.call(ctx, "POST", "/v1/abuse-reports", nil, bytes.NewReader(body), &r, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, q url.Values, body io.Reader) (*http.Request, error) {
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Conifer-API-Version", APIVersion)
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	return req, nil
+}
+
+// call makes a request, decoding its JSON response into out when out isn't
+// nil.
+func (c *Client) call(ctx context.Context, method, path string, q url.Values, body io.Reader, out interface{}, ok int) error {
+	req, err := c.newRequest(ctx, method, path, q, body)
+	if err != nil {
+		return err
+	}
+	_, data, err := c.do(req, ok)
+	if err != nil || out == nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewReader(data)).Decode(out)
+}
+
+// do makes a request, returning an *Error unless it succeeds with one of
+// the ok statuses.
+func (c *Client) do(req *http.Request, ok ...int) (*http.Response, []byte, error) {
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, status := range ok {
+		if res.StatusCode == status {
+			return res, body, nil
+		}
+	}
+	return nil, nil, newError(res, body)
+}
+
+func newError(res *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(body))}
+	var failed struct {
+		Code     string         `json:"code"`
+		Message  string         `json:"message"`
+		Errors   []BuildMessage `json:"errors"`
+		Warnings []BuildMessage `json:"warnings"`
+	}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") && json.Unmarshal(body, &failed) == nil {
+		e.Message, e.Code, e.Errors, e.Warnings = failed.Message, failed.Code, failed.Errors, failed.Warnings
+	}
+	if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(s) * time.Second
+	}
+	return e
+}
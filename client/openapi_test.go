@@ -0,0 +1,150 @@
+package client
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// clientName is what the Go and TypeScript clients call an operation or a
+// schema of the OpenAPI description. An empty name means that client has
+// none.
+type clientName struct {
+	goName, tsName string
+}
+
+// operationNames are the operations whose client methods aren't named after
+// their operation IDs. The others are, capitalized in Go.
+var operationNames = map[string]clientName{
+	"buildBody":       {"BuildJSON", "buildJson"},
+	"transformBody":   {"Transform", "transform"},
+	"replayBuild":     {"Replay", "replay"},
+	"createSignedUrl": {"SignURL", "signUrl"},
+	"getReady":        {"Ready", "ready"},
+	// Go's standard library has no WebSocket client.
+	"openSession": {"", "openSession"},
+}
+
+// schemaNames are the schemas whose client types aren't named after them.
+var schemaNames = map[string]clientName{
+	"BuildError":       {"Error", "BuildError"},
+	"DependencyGraph":  {"Graph", "DependencyGraph"},
+	"BuildDoneEvent":   {"BuildDone", "BuildDone"},
+	"BuildFailedEvent": {"Error", "ConiferError"},
+	// Sessions are only in the TypeScript client, which rejects failed
+	// builds with a ConiferError.
+	"SessionBuild":   {"", "SessionBuild"},
+	"SessionFailure": {"", "ConiferError"},
+}
+
+var (
+	tsMethod = regexp.MustCompile(`(?m)^  (?:async )?([a-z]\w*)\(`)
+	tsType   = regexp.MustCompile(`(?m)^export (?:interface|type|class) (\w+)`)
+)
+
+// The clients are written by hand, so this checks each operation and schema
+// of the OpenAPI description has a method or type in both.
+func TestClientsCoverOpenAPI(t *testing.T) {
+	data, err := os.ReadFile("../openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var description struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &description); err != nil {
+		t.Fatal(err)
+	}
+	goMethods, goTypes := goDeclarations(t, "client.go")
+	ts, err := os.ReadFile("../clients/typescript/conifer.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsMethods, tsTypes := matches(tsMethod, ts), matches(tsType, ts)
+
+	var operations []string
+	for _, methods := range description.Paths {
+		for _, raw := range methods {
+			var op struct {
+				OperationID string `json:"operationId"`
+			}
+			if json.Unmarshal(raw, &op) == nil && op.OperationID != "" {
+				operations = append(operations, op.OperationID)
+			}
+		}
+	}
+	sort.Strings(operations)
+	for _, id := range operations {
+		names, ok := operationNames[id]
+		if !ok {
+			names = clientName{strings.ToUpper(id[:1]) + id[1:], id}
+		}
+		if names.goName != "" && !goMethods[names.goName] {
+			t.Errorf("operation %s has no Go client method %s", id, names.goName)
+		}
+		if names.tsName != "" && !tsMethods[names.tsName] {
+			t.Errorf("operation %s has no TypeScript client method %s", id, names.tsName)
+		}
+	}
+
+	for schema := range description.Components.Schemas {
+		names, ok := schemaNames[schema]
+		if !ok {
+			names = clientName{schema, schema}
+		}
+		if names.goName != "" && !goTypes[names.goName] {
+			t.Errorf("schema %s has no Go client type %s", schema, names.goName)
+		}
+		if names.tsName != "" && !tsTypes[names.tsName] {
+			t.Errorf("schema %s has no TypeScript client type %s", schema, names.tsName)
+		}
+	}
+}
+
+// goDeclarations returns the exported methods of Client and the exported
+// types declared in file.
+func goDeclarations(t *testing.T, file string) (methods, types map[string]bool) {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods, types = make(map[string]bool), make(map[string]bool)
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil || !decl.Name.IsExported() {
+				continue
+			}
+			if star, ok := decl.Recv.List[0].Type.(*ast.StarExpr); ok {
+				if ident, ok := star.X.(*ast.Ident); ok && ident.Name == "Client" {
+					methods[decl.Name.Name] = true
+				}
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				if spec, ok := spec.(*ast.TypeSpec); ok && spec.Name.IsExported() {
+					types[spec.Name.Name] = true
+				}
+			}
+		}
+	}
+	return methods, types
+}
+
+func matches(re *regexp.Regexp, src []byte) map[string]bool {
+	names := make(map[string]bool)
+	for _, m := range re.FindAllSubmatch(src, -1) {
+		names[string(m[1])] = true
+	}
+	return names
+}
@@ -0,0 +1,1055 @@
+// A client for a conifer server's /v1 API, written against openapi.json at
+// the root of the repository. It only uses fetch, so it runs in browsers,
+// Deno, and Node 18+.
+
+export const apiVersion = "1";
+
+export type Target =
+  | "esnext"
+  | "es5"
+  | "es2015"
+  | "es2016"
+  | "es2017"
+  | "es2018"
+  | "es2019"
+  | "es2020"
+  | "es2021";
+
+/** Pins each module URL to a "sha256-<base64>" hash. */
+export interface Lockfile {
+  modules: Record<string, string>;
+}
+
+export interface TransformOptions {
+  /** How the source is parsed, "js" when not given. */
+  loader?: "js" | "jsx" | "ts" | "tsx" | "json" | "css" | "text";
+  /** Names the file in errors and source maps. */
+  sourcefile?: string;
+  minify?: boolean;
+  target?: string;
+  /** The source's own format is kept when not given. */
+  format?: "esm" | "iife" | "cjs";
+  sourcemap?: "inline";
+  tsconfigRaw?: string;
+}
+
+/** esbuild's metafile, describing a build's inputs and outputs. */
+export interface Metafile {
+  inputs: Record<string, { bytes: number; imports: { path: string; kind: string }[] }>;
+  outputs: Record<
+    string,
+    {
+      bytes: number;
+      /** How many bytes each input contributes to the output. */
+      inputs: Record<string, { bytesInOutput: number }>;
+      imports: { path: string; kind: string }[];
+      entryPoint?: string;
+      exports?: string[];
+    }
+  >;
+}
+
+/** Every module a source pulls in and the imports between them. */
+export interface DependencyGraph {
+  nodes: { url: string; bytes?: number; sha256?: string; external?: boolean }[];
+  /** Imports, with an empty importer for those of the source itself. */
+  edges: { importer: string; specifier: string; url: string; external?: boolean }[];
+}
+
+/** Resolves bare specifiers like "react" to URLs. */
+export interface ImportMap {
+  imports?: Record<string, string>;
+  scopes?: Record<string, Record<string, string>>;
+}
+
+export interface BuildOptions {
+  minify?: boolean;
+  /** Set to false to only transform the source, leaving its imports alone. */
+  bundle?: boolean;
+  /** Patterns like "unpkg.com/*" of imports left in the output. */
+  keepUrls?: string[];
+  autoExternal?: boolean;
+  name?: string;
+  mangleProps?: string;
+  splitting?: boolean;
+  target?: Target;
+  /** The module format of the output, esm when absent. */
+  format?: "esm" | "iife" | "cjs";
+  /** Appends a source map to the output. */
+  sourcemap?: "inline";
+  differential?: boolean;
+  legacyTarget?: string;
+  proxyUrls?: boolean;
+  /** Adds polyfills for runtime features the output uses but the target lacks, listed in BuildResult.polyfills. */
+  polyfill?: boolean;
+  /** Runs the output in the server's sandboxed runtime, failing the build when it throws, and naming the runtime in BuildResult.smokeTest. */
+  smokeTest?: boolean;
+  lockfile?: Lockfile;
+  importMap?: ImportMap;
+  tsconfigRaw?: string;
+  /** Experimental. Makes the build a module federation remote exposing these modules, like { "./Button": "https://example.com/button.js" }. */
+  exposes?: Record<string, string>;
+  /** Experimental. Maps aliases to the manifest URLs of module federation remotes, so "<alias>/Button" imports ./Button. */
+  remotes?: Record<string, string>;
+  /** Fields like { gitSha: "0a1b2c" } written into the output with the time of the build. */
+  stamp?: Record<string, string>;
+  /** Defines the stamp as the __CONIFER_STAMP__ global instead of a banner comment. */
+  stampAs?: "banner" | "define";
+  /** Leaves the time out of the stamp, keeping the output reproducible. */
+  noTimestamps?: boolean;
+  /** The ETag of an earlier result, answered with notModified when unchanged. */
+  ifNoneMatch?: string;
+}
+
+/** A record of a build to keep with the deploy it went into. The output is kept at url, named by its hash. */
+export interface DeployManifest {
+  id: string;
+  url: string;
+  integrity: string;
+  /** Where the source map is kept, when one was asked for. */
+  sourceMapUrl?: string;
+  artifact?: string;
+  release?: string;
+  /** package and version are set when the module's URL names a package with a version. */
+  dependencies: { url: string; package?: string; version?: string; bytes: number; integrity: string }[];
+  chunks?: string[];
+  warnings: BuildMessage[];
+  /** How long the build took. When its output was reused, the phases are those of the build that made it. */
+  timings: {
+    totalMs: number;
+    reused: boolean;
+    bundleMs: number;
+    downloadMs: number;
+    polyfillMs: number;
+    postProcessMs: number;
+    /** How long downloads waited for bandwidth. */
+    throttleMs: number;
+    smokeTestMs: number;
+  };
+  engine: Engine;
+  pinned: boolean;
+  polyfills?: string[];
+  smokeTest?: string;
+}
+
+/** Every import of a remote module a build resolved, sorted by importer and specifier, traced to where its code ended up. */
+export interface ImportTrace {
+  imports: {
+    /** The URL of the importing module, or "" for the source or its files. */
+    importer: string;
+    specifier: string;
+    /** What the specifier resolved to, after import maps, policy and redirects. */
+    url: string;
+    /** How it was imported, like "import-statement" or "dynamic-import". */
+    kind?: string;
+    external?: boolean;
+    /** The file the module was placed in, "index.js" for the output or the URL of a chunk. */
+    output?: string;
+    /** How much of the module is left in its output, 0 when it was tree-shaken. */
+    bytesInOutput: number;
+  }[];
+}
+
+/** A module, or a group of them by host, package and directory, in a treemap of a build's output. Groups add up the sizes of what is in them. */
+export interface TreemapNode {
+  name: string;
+  /** Set on remote modules. */
+  url?: string;
+  /** The size of the modules' source. */
+  bytes: number;
+  /** How much of the source is left in the unminified output, 0 when it was tree-shaken. */
+  bytesInOutput: number;
+  /** How much of the source is left in the minified output. */
+  minifiedBytes: number;
+  children?: TreemapNode[];
+}
+
+/** The third-party code left in a build's output and its licenses, sorted by URL. */
+export interface LicenseReport {
+  packages: {
+    /** Set for modules of versioned packages. */
+    package?: string;
+    version?: string;
+    /** The URL the package's modules begin with, or the module's URL when it isn't part of a package. */
+    url: string;
+    modules: string[];
+    /** How much of the modules is left in the output and its chunks. */
+    bytesInOutput: number;
+    /** Empty when no license was found. */
+    licenses: {
+      license: string;
+      /** The URL of the package.json declaring the license, or of the module with a comment naming it. */
+      source: string;
+    }[];
+  }[];
+}
+
+/** A module a streamed build loaded. */
+export interface ModuleEvent {
+  url: string;
+  bytes: number;
+  /** Set when the module came from the server's module cache rather than being downloaded. */
+  cached: boolean;
+}
+
+/** A finished streamed build, whose output is at url. */
+export interface BuildDone {
+  id: string;
+  url: string;
+  integrity: string;
+  artifact?: string;
+  manifest: Manifest;
+}
+
+/** The size of an output minified some way, and how many bytes smaller than the unminified output it is. */
+export interface MinifySize {
+  bytes: number;
+  gzipBytes: number;
+  saved: number;
+  gzipSaved: number;
+}
+
+/** What each kind of minification saves on its own, and all of them together. */
+export interface MinifyComparison {
+  unminified: MinifySize;
+  whitespace: MinifySize;
+  identifiers: MinifySize;
+  syntax: MinifySize;
+  all: MinifySize;
+}
+
+export interface BuildResult {
+  code: string;
+  /** Identifies the build for getBuild and replay. */
+  buildId: string | null;
+  /** Where the output is stored at /v1/artifacts/<id>.js, if it is. */
+  artifactId: string | null;
+  etag: string | null;
+  notModified: boolean;
+  /** The commit buildGit built. */
+  commit?: string | null;
+  /** The runtime features polyfilled for the target. */
+  polyfills: string[];
+  /** The runtime the output was smoke tested in, when smokeTest was set. */
+  smokeTest: string | null;
+  /** How many warnings the build reported, which buildJson returns in full. */
+  warnings: number;
+}
+
+/** A file of a GitHub repository to build. */
+export interface GitSource {
+  /** Like "github.com/owner/repo". */
+  repo: string;
+  /** A branch, tag or commit, the default branch when absent. */
+  ref?: string;
+  /** The path of the file to start from, an index file at the root when absent. */
+  entry?: string;
+}
+
+/**
+ * A build described in full. Exactly one of source, entry and files is
+ * required, though entry may also pick the file files start from.
+ */
+export interface BuildRequest {
+  source?: string;
+  /**
+   * The URL of a module to build instead of source, or with files, the path
+   * of the file to start from, an index file when absent.
+   */
+  entry?: string;
+  /** Files keyed by absolute paths like "/src/index.ts", importing one another. */
+  files?: Record<string, string>;
+  loader?: "js" | "jsx" | "ts" | "tsx" | "json" | "css" | "text";
+  format?: "esm" | "iife" | "cjs";
+  target?: string;
+  minify?: boolean | { whitespace?: boolean; identifiers?: boolean; syntax?: boolean };
+  bundle?: boolean;
+  define?: Record<string, string>;
+  /** Patterns like "unpkg.com/*" of imports left in the output. */
+  external?: string[];
+  sourcemap?: "inline" | "external";
+  name?: string;
+  mangleProps?: string;
+  splitting?: boolean;
+  proxyUrls?: boolean;
+  polyfill?: boolean;
+  smokeTest?: boolean;
+  lockfile?: Lockfile;
+  importMap?: ImportMap;
+  tsconfigRaw?: string;
+  exposes?: Record<string, string>;
+  remotes?: Record<string, string>;
+  /** Maps the paths of a single-page app, like "/settings", to the modules rendering them, building each into chunks of its own instead of building a source or entry. The outputs gain routes.json, a RouteManifest. */
+  routes?: Record<string, string>;
+  /** Maps names, like "main" and "worker", to the modules of several entry points, URLs or with files, their paths, instead of building a source or entry. Each is built into an output named after it, like main.js, and with splitting, the code they share into chunks. */
+  entries?: Record<string, string>;
+  /** Adds sw.js to the outputs, a service worker precaching the output and its chunks, to deploy next to it. */
+  serviceWorker?: boolean;
+}
+
+/** Which chunks each route of a build of routes loads, by URL. */
+export interface RouteManifest {
+  routes: Record<string, { chunk: string; imports: string[] }>;
+  /** The chunks more than one route loads. */
+  shared: string[];
+}
+
+export interface BuildEnvelope {
+  id: string;
+  artifact?: string;
+  /** index.js, or index.css for CSS, and its source map when it is external. */
+  outputs: { path: string; contents: string }[];
+  warnings: BuildMessage[];
+  manifest: Manifest;
+  /** The release the external source map was uploaded to the server's error trackers under, when it was. */
+  release?: string;
+}
+
+export interface Engine {
+  conifer: string;
+  esbuild: string;
+}
+
+export interface Manifest {
+  modules: { url: string; bytes: number; sha256: string }[];
+  outputBytes: number;
+  chunks?: string[];
+  engine: Engine;
+  pinned: boolean;
+  /** The steps the output went through after it was built, in order. */
+  postProcess?: { type: string; bytes: number; sha256: string }[];
+  /** The runtime features polyfilled for the target. */
+  polyfills?: string[];
+  /** The runtime the output was run in without throwing, when the build asked for a smoke test. */
+  smokeTest?: string;
+}
+
+export interface BuildRecord {
+  id: string;
+  created: string;
+  tenant?: string;
+  request: Record<string, unknown>;
+  manifest: Manifest;
+  outputSha256: string;
+}
+
+export interface ReplayReport {
+  id: string;
+  outputMatches: boolean;
+  outputSha256: string;
+  replaySha256?: string;
+  changed: { url: string; before: string; after: string }[];
+  errors?: string[];
+  engine: Engine;
+}
+
+export interface Bundle {
+  tenant: string;
+  name: string;
+  current: string;
+  versions: {
+    id: string;
+    created: string;
+    bytes: number;
+    /** On module federation remotes, the names each exposed module exports. */
+    exposes?: Record<string, string[]>;
+    /** On module federation remotes, the patterns of URLs kept as imports. */
+    shared?: string[];
+  }[];
+  /** Set while the bundle is taken down after abuse reports. */
+  quarantine?: { since: string; reason: string };
+}
+
+export interface PublishedBundle {
+  name: string;
+  version: string;
+  /** Serves whichever version is current. */
+  url: string;
+  /** Always serves this version. */
+  versionUrl: string;
+  build: string;
+}
+
+export interface Limits {
+  tenant?: string;
+  limits: {
+    requestsPerMinute?: number;
+    buildsPerDay?: number;
+    maxSourceBytes?: number;
+    maxModuleBytes?: number;
+    maxBuildBytes?: number;
+    maxOutputBytes?: number;
+    maxModules?: number;
+    buildTimeout?: string;
+    allowedHosts?: string[];
+    blockedUrls?: string[];
+  };
+  quota: {
+    buildsPerDay: number;
+    used: number;
+    remaining?: number;
+    resets: string;
+  };
+}
+
+export interface EmbedToken {
+  token: string;
+  expires: string;
+}
+
+export interface SignedURL {
+  url: string;
+  expires: string;
+}
+
+export interface Permalink {
+  id: string;
+  /** Serves the build from then on. */
+  url: string;
+}
+
+export interface Preview {
+  id: string;
+  /** Serves the build as a site until it expires. */
+  url: string;
+  expires: string;
+  /** The paths of the files served, with index.html the page at the root. */
+  files: string[];
+}
+
+export interface ImportPolicy {
+  /** The first rule matching an import decides. */
+  rules: PolicyRule[];
+  default?: "allow" | "deny";
+}
+
+export interface PolicyRule {
+  action: "allow" | "deny" | "rewrite";
+  specifier?: string;
+  /** Matches the importing module's URL, or "source" for the build's own source. */
+  importer?: string;
+  kind?: string;
+  host?: string;
+  /** A regular expression matching the imported URL's path. */
+  path?: string;
+  /** Where a rewrite rule sends the import. */
+  to?: string;
+  reason?: string;
+}
+
+export interface PolicyImport {
+  specifier: string;
+  /** Absent for the build's source. */
+  importer?: string;
+  /** Defaults to "import-statement". */
+  kind?: string;
+}
+
+export interface PolicyResult extends PolicyImport {
+  /** What the import resolves to. */
+  url: string;
+  decision?: PolicyDecision;
+  /** Why the import couldn't be resolved. */
+  error?: string;
+}
+
+export interface PolicyDecision {
+  action: "allow" | "deny" | "rewrite";
+  /** What is downloaded. */
+  url: string;
+  /** The index of the rule that decided, absent when the default did. */
+  rule?: number;
+  reason?: string;
+}
+
+/** An in-toto Statement, see https://slsa.dev/provenance/v1. */
+export interface ProvenanceStatement {
+  _type: string;
+  subject: { name: string; digest: Record<string, string> }[];
+  predicateType: string;
+  predicate: Record<string, unknown>;
+}
+
+export interface DSSEEnvelope {
+  payloadType: string;
+  /** The base64 encoded statement. */
+  payload: string;
+  signatures: { keyid: string; sig: string }[];
+}
+
+export interface AbuseReport {
+  id: string;
+  status: string;
+}
+
+export interface ProvenanceKey {
+  keyid: string;
+  algorithm: "ed25519";
+  /** Base64 encoded. */
+  publicKey: string;
+}
+
+export interface MessageLocation {
+  file: string;
+  namespace?: string;
+  /** 1-based. */
+  line: number;
+  /** 0-based, in bytes. */
+  column: number;
+  length: number;
+  lineText: string;
+  suggestion?: string;
+}
+
+/** An error or warning reported by a build. */
+export interface BuildMessage {
+  code: string;
+  text: string;
+  pluginName?: string;
+  location?: MessageLocation;
+  notes?: { text: string; location?: MessageLocation }[];
+}
+
+/** The body of a response to a failed build. */
+export interface BuildError {
+  /** The kind of the first error, like "source_error". */
+  code: string;
+  message: string;
+  errors: BuildMessage[];
+  warnings: BuildMessage[];
+}
+
+/** The outcome of one build of buildBatch, with build or error set. */
+export interface BatchResult {
+  /** The status the build would have responded with on its own. */
+  status: number;
+  build?: BuildEnvelope;
+  /** Why the build failed. Builds refused before they ran have the code "request_failed". */
+  error?: BuildError;
+  /** Seconds to wait before retrying a build that was rate limited or refused under load. */
+  retryAfter?: number;
+}
+
+/** A response the server refused or failed to answer. */
+export class ConiferError extends Error {
+  constructor(
+    readonly status: number,
+    message: string,
+    /** Seconds the server asked to wait before trying again. */
+    readonly retryAfter: number | null,
+    /** Everything a failed build reported, when it was a build that failed. */
+    readonly build: BuildError | null = null,
+  ) {
+    super(`conifer: ${status}: ${message}`);
+    this.name = "ConiferError";
+  }
+}
+
+export interface ClientOptions {
+  /** The tenant's key. Without one, requests are anonymous. */
+  apiKey?: string;
+  fetch?: typeof fetch;
+}
+
+/** A build of a session. */
+export interface SessionBuild {
+  code: string;
+  warnings: BuildMessage[];
+  /** Set when the build reused the session's earlier work. */
+  rebuild: boolean;
+  durationMs: number;
+}
+
+/**
+ * A build session, a WebSocket rebuilding source each time it is sent, which
+ * only parses what changed. See Client.openSession.
+ */
+export class BuildSession {
+  private nextId = 0;
+  private readonly pending = new Map<number, { resolve: (build: SessionBuild) => void; reject: (err: Error) => void }>();
+
+  constructor(private readonly socket: WebSocket) {
+    socket.addEventListener("message", (event) => {
+      const reply = JSON.parse(event.data as string);
+      const waiting = this.pending.get(reply.id);
+      if (!waiting) return;
+      this.pending.delete(reply.id);
+      if (reply.type === "error") {
+        waiting.reject(new ConiferError(reply.status, reply.error.message, reply.retryAfter ?? null, reply.error));
+      } else {
+        waiting.resolve(reply);
+      }
+    });
+    socket.addEventListener("close", () => {
+      for (const waiting of this.pending.values()) waiting.reject(new Error("conifer: the session closed"));
+      this.pending.clear();
+    });
+  }
+
+  /** Builds source. */
+  build(source: string): Promise<SessionBuild> {
+    const id = this.nextId++;
+    return new Promise((resolve, reject) => {
+      this.pending.set(id, { resolve, reject });
+      this.socket.send(JSON.stringify({ id, source }));
+    });
+  }
+
+  close(): void {
+    this.socket.close();
+  }
+}
+
+export class Client {
+  private readonly baseUrl: string;
+  private readonly apiKey?: string;
+  private readonly fetch: typeof fetch;
+
+  constructor(baseUrl: string, options: ClientOptions = {}) {
+    this.baseUrl = baseUrl.replace(/\/$/, "");
+    this.apiKey = options.apiKey;
+    this.fetch = options.fetch ?? globalThis.fetch.bind(globalThis);
+  }
+
+  async build(source: string, options: BuildOptions = {}): Promise<BuildResult> {
+    const headers: Record<string, string> = { "Content-Type": "text/javascript" };
+    if (options.ifNoneMatch) headers["If-None-Match"] = options.ifNoneMatch;
+    const res = await this.request("POST", "/v1/build", buildQuery(options), source, headers, [200, 304]);
+    return buildResult(res);
+  }
+
+  /**
+   * Builds source as build does, calling onModule as each module is loaded,
+   * so long builds can show progress. The output isn't returned but kept by
+   * the server at the url of the result.
+   */
+  async buildStream(source: string, options: BuildOptions = {}, onModule?: (event: ModuleEvent) => void): Promise<BuildDone> {
+    const res = await this.request("POST", "/v1/build", buildQuery(options), source, {
+      "Content-Type": "text/javascript",
+      Accept: "text/event-stream",
+    });
+    const reader = res.body!.pipeThrough(new TextDecoderStream()).getReader();
+    let buffered = "";
+    for (;;) {
+      const { done, value } = await reader.read();
+      if (done) throw new Error("conifer: the build stream ended early");
+      buffered += value;
+      let end: number;
+      while ((end = buffered.indexOf("\n\n")) >= 0) {
+        const message = buffered.slice(0, end);
+        buffered = buffered.slice(end + 2);
+        let event = "";
+        let data = "";
+        for (const line of message.split("\n")) {
+          if (line.startsWith("event: ")) event = line.slice("event: ".length);
+          if (line.startsWith("data: ")) data = line.slice("data: ".length);
+        }
+        if (event === "module") onModule?.(JSON.parse(data));
+        if (event === "done") {
+          reader.cancel();
+          return JSON.parse(data);
+        }
+        if (event === "error") {
+          reader.cancel();
+          const failed = JSON.parse(data) as { status: number; error: BuildError; retryAfter?: number };
+          throw new ConiferError(failed.status, failed.error.message, failed.retryAfter ?? null, failed.error);
+        }
+      }
+    }
+  }
+
+  /**
+   * Opens a build session, building with options each source sent to it.
+   * Browsers can't send the API key with a WebSocket, so sessions have the
+   * limits of anonymous builds.
+   */
+  openSession(options: BuildOptions = {}): Promise<BuildSession> {
+    const query = buildQuery(options);
+    const url = this.baseUrl.replace(/^http/, "ws") + "/v1/sessions" + ([...query.keys()].length > 0 ? "?" + query.toString() : "");
+    const socket = new WebSocket(url);
+    return new Promise((resolve, reject) => {
+      socket.addEventListener("open", () => resolve(new BuildSession(socket)), { once: true });
+      socket.addEventListener("error", () => reject(new Error("conifer: the session couldn't be opened")), { once: true });
+    });
+  }
+
+  /** Bundles the module at entry, an http or https URL, and everything it imports. */
+  async buildEntry(entry: string, options: BuildOptions = {}): Promise<BuildResult> {
+    const query = buildQuery(options);
+    query.set("entry", entry);
+    const headers: Record<string, string> = {};
+    if (options.ifNoneMatch) headers["If-None-Match"] = options.ifNoneMatch;
+    const res = await this.request("GET", "/v1/bundle", query, undefined, headers, [200, 304]);
+    return buildResult(res);
+  }
+
+  /** Compiles source, such as TypeScript or JSX, without resolving or downloading anything it imports. */
+  async transform(source: string, options: TransformOptions = {}): Promise<string> {
+    const query = new URLSearchParams();
+    if (options.loader) query.set("loader", options.loader);
+    if (options.sourcefile) query.set("sourcefile", options.sourcefile);
+    if (options.minify) query.set("minify", "");
+    if (options.target) query.set("target", options.target);
+    if (options.format) query.set("format", options.format);
+    if (options.sourcemap) query.set("sourcemap", options.sourcemap);
+    if (options.tsconfigRaw) query.set("tsconfigRaw", options.tsconfigRaw);
+    const res = await this.request("POST", "/v1/transform", query, source);
+    return res.text();
+  }
+
+  /**
+   * Builds the module scripts and stylesheets of an HTML page, returning the page loading the outputs.
+   * Relative URLs in the page are resolved against base, the page's URL.
+   */
+  async buildPage(page: string, base?: string, options: BuildOptions = {}): Promise<string> {
+    const query = buildQuery(options);
+    if (base) query.set("base", base);
+    const res = await this.request("POST", "/v1/build", query, page, { "Content-Type": "text/html" });
+    return res.text();
+  }
+
+  /**
+   * Builds a file of a GitHub repository and the files it imports from it.
+   * Builds are cached by the commit the ref points at.
+   */
+  async buildGit(source: GitSource, options: BuildOptions = {}): Promise<BuildResult> {
+    const query = buildQuery(options);
+    query.set("repo", source.repo);
+    if (source.ref) query.set("ref", source.ref);
+    if (source.entry) query.set("entry", source.entry);
+    const headers: Record<string, string> = {};
+    if (options.ifNoneMatch) headers["If-None-Match"] = options.ifNoneMatch;
+    const res = await this.request("GET", "/v1/git", query, undefined, headers, [200, 304]);
+    return buildResult(res);
+  }
+
+  /** Runs the build request describes. A failure's ConiferError lists every error and warning. */
+  async buildJson(request: BuildRequest): Promise<BuildEnvelope> {
+    const res = await this.request("POST", "/v1/build", undefined, JSON.stringify(request), {
+      "Content-Type": "application/json",
+    });
+    return res.json();
+  }
+
+  /**
+   * Runs many builds in one request, which the server runs a few at a time.
+   * Each succeeds or fails on its own, with the results in the order of
+   * requests.
+   */
+  async buildBatch(requests: BuildRequest[]): Promise<BatchResult[]> {
+    const res = await this.request("POST", "/v1/batch", undefined, JSON.stringify({ builds: requests }), {
+      "Content-Type": "application/json",
+    });
+    return (await res.json()).results;
+  }
+
+  /**
+   * Builds the project in archive, a gzipped tarball, tarball or zip file, as
+   * contentType says, like "application/gzip". request.entry is the path
+   * inside the archive of the file to start from, and the rest of request
+   * holds the other options, without source or files.
+   */
+  async buildArchive(archive: Blob, contentType: string, request: BuildRequest = {}): Promise<BuildEnvelope> {
+    const { entry, ...options } = request;
+    const query = new URLSearchParams({ options: JSON.stringify(options) });
+    if (entry) query.set("entry", entry);
+    const res = await this.request("POST", "/v1/build", query, archive, { "Content-Type": contentType });
+    return res.json();
+  }
+
+  /** Runs the build request describes, returning an archive of its outputs and the chunks they import, under chunks/. A tar archive is gzipped. */
+  async outputArchive(request: BuildRequest, format: "zip" | "tar" = "zip"): Promise<Uint8Array> {
+    const res = await this.request("POST", "/v1/build", new URLSearchParams({ output: format }), JSON.stringify(request), {
+      "Content-Type": "application/json",
+    });
+    return new Uint8Array(await res.arrayBuffer());
+  }
+
+  /** Builds source and returns a lockfile pinning the modules it used. */
+  async lock(source: string, options: BuildOptions = {}): Promise<Lockfile> {
+    const query = buildQuery(options);
+    query.set("output", "lockfile");
+    const res = await this.request("POST", "/v1/build", query, source);
+    return res.json();
+  }
+
+  /** Builds source and returns a record of the build, keeping its output on the server, and with sourceMap, an external source map next to it. */
+  async deployManifest(source: string, options: BuildOptions = {}, sourceMap = false): Promise<DeployManifest> {
+    const query = buildQuery(options);
+    query.set("output", "manifest");
+    if (sourceMap) query.set("sourcemap", "external");
+    const res = await this.request("POST", "/v1/build", query, source);
+    return res.json();
+  }
+
+  /** Builds source and returns where each of its imports ended up rather than its output. */
+  async traceImports(source: string, options: BuildOptions = {}): Promise<ImportTrace> {
+    const query = buildQuery(options);
+    query.set("output", "imports");
+    const res = await this.request("POST", "/v1/build", query, source);
+    return res.json();
+  }
+
+  /** Builds source and returns what minifying its output each way saves rather than its output. Minify options are ignored. */
+  async compareMinify(source: string, options: BuildOptions = {}): Promise<MinifyComparison> {
+    const query = buildQuery(options);
+    query.set("compareMinify", "true");
+    const res = await this.request("POST", "/v1/build", query, source);
+    return res.json();
+  }
+
+  /** Builds source and returns its metafile rather than its output. */
+  async analyze(source: string, options: BuildOptions = {}): Promise<Metafile> {
+    const query = buildQuery(options);
+    query.set("analyze", "json");
+    const res = await this.request("POST", "/v1/build", query, source);
+    return res.json();
+  }
+
+  /** Builds source and returns a treemap of what its output is made of rather than its output. Minify options are ignored. */
+  async treemap(source: string, options: BuildOptions = {}): Promise<TreemapNode> {
+    const query = buildQuery(options);
+    query.set("analyze", "treemap");
+    const res = await this.request("POST", "/v1/build", query, source);
+    return res.json();
+  }
+
+  /** Builds source and returns the licenses of the third-party code in its output rather than its output. */
+  async licenses(source: string, options: BuildOptions = {}): Promise<LicenseReport> {
+    const query = buildQuery(options);
+    query.set("licenses", "json");
+    const res = await this.request("POST", "/v1/build", query, source);
+    return res.json();
+  }
+
+  /** Builds source and returns a CycloneDX or SPDX bill of materials of it rather than its output. */
+  async sbom(source: string, format: "cyclonedx" | "spdx", options: BuildOptions = {}): Promise<Record<string, unknown>> {
+    const query = buildQuery(options);
+    query.set("sbom", format);
+    const res = await this.request("POST", "/v1/build", query, source);
+    return res.json();
+  }
+
+  /** Builds source and returns esbuild's summary of how many bytes each input contributes. */
+  async analyzeText(source: string, options: BuildOptions = {}): Promise<string> {
+    const query = buildQuery(options);
+    query.set("analyze", "text");
+    const res = await this.request("POST", "/v1/build", query, source);
+    return res.text();
+  }
+
+  /** Resolves the imports of source without bundling it. */
+  async graph(source: string, options: BuildOptions = {}): Promise<DependencyGraph> {
+    const res = await this.request("POST", "/v1/graph", buildQuery(options), source);
+    return res.json();
+  }
+
+  /** Downloads the modules source imports as a gzipped tarball. */
+  async vendor(source: string, options: BuildOptions = {}): Promise<Blob> {
+    const res = await this.request("POST", "/v1/vendor", buildQuery(options), source);
+    return res.blob();
+  }
+
+  async getBundle(name: string): Promise<Bundle> {
+    const res = await this.request("GET", `/v1/bundles/${encodeURIComponent(name)}`);
+    return res.json();
+  }
+
+  /** Builds source as a new version of a bundle, current unless promote is false. */
+  async publishBundle(
+    name: string,
+    source: string,
+    options: BuildOptions = {},
+    promote = true,
+  ): Promise<PublishedBundle> {
+    const query = buildQuery(options);
+    if (!promote) query.set("promote", "false");
+    const res = await this.request("POST", `/v1/bundles/${encodeURIComponent(name)}`, query, source, {}, [201]);
+    return res.json();
+  }
+
+  async promoteBundle(name: string, version: string): Promise<void> {
+    const query = new URLSearchParams({ version });
+    await this.request("POST", `/v1/bundles/${encodeURIComponent(name)}/promote`, query, undefined, {}, [204]);
+  }
+
+  async getBuild(id: string): Promise<BuildRecord> {
+    const res = await this.request("GET", `/v1/builds/${encodeURIComponent(id)}`);
+    return res.json();
+  }
+
+  /** Runs a past build again, reporting any modules that changed. Requires an admin key. */
+  async replay(id: string): Promise<ReplayReport> {
+    const res = await this.request("POST", `/v1/builds/${encodeURIComponent(id)}/replay`);
+    return res.json();
+  }
+
+  /**
+   * An in-toto attestation of how a build was made: the statement itself,
+   * or a DSSE envelope containing it when the server signs provenance.
+   */
+  async getProvenance(id: string): Promise<ProvenanceStatement | DSSEEnvelope> {
+    const res = await this.request("GET", `/v1/builds/${encodeURIComponent(id)}/provenance`);
+    return res.json();
+  }
+
+  async getProvenanceKey(): Promise<ProvenanceKey> {
+    const res = await this.request("GET", "/v1/provenance-key");
+    return res.json();
+  }
+
+  async getLimits(): Promise<Limits> {
+    const res = await this.request("GET", "/v1/limits");
+    return res.json();
+  }
+
+  async getPolicy(): Promise<ImportPolicy> {
+    const res = await this.request("GET", "/v1/policy");
+    return res.json();
+  }
+
+  /** Shows how the caller's import policy treats imports, without building anything. */
+  async dryRunPolicy(imports: PolicyImport[], importMap?: ImportMap): Promise<PolicyResult[]> {
+    const body = JSON.stringify({ imports, importMap });
+    const res = await this.request("POST", "/v1/policy/dry-run", undefined, body, { "Content-Type": "application/json" });
+    return (await res.json()).results;
+  }
+
+  /** Stores source and its options under a short, permanent URL. */
+  async createPermalink(source: string, options: BuildOptions = {}): Promise<Permalink> {
+    const res = await this.request("POST", "/v1/permalink", buildQuery(options), source, {}, [201]);
+    return res.json();
+  }
+
+  /** Builds source and serves it for a short while, with a page loading the output. */
+  async createPreview(source: string, options: BuildOptions = {}): Promise<Preview> {
+    const res = await this.request("POST", "/v1/preview", buildQuery(options), source, {}, [201]);
+    return res.json();
+  }
+
+  /** Builds an HTML page and serves it with its built assets for a short while. */
+  async createPagePreview(page: string, base?: string, options: BuildOptions = {}): Promise<Preview> {
+    const query = buildQuery(options);
+    if (base) query.set("base", base);
+    const res = await this.request("POST", "/v1/preview", query, page, { "Content-Type": "text/html" }, [201]);
+    return res.json();
+  }
+
+  /** Creates a token letting a page load the tenant's bundles, lasting ttl like "30m". */
+  async createEmbedToken(ttl?: string): Promise<EmbedToken> {
+    const query = new URLSearchParams();
+    if (ttl) query.set("ttl", ttl);
+    const res = await this.request("POST", "/v1/embed-tokens", query, undefined, {}, [201]);
+    return res.json();
+  }
+
+  /**
+   * Signs a path on the server with its query, like "/v1/bundle?entry=...", so
+   * pages can load it with this client's API key without carrying it, lasting ttl like "720h".
+   */
+  async signUrl(path: string, ttl?: string): Promise<SignedURL> {
+    const query = new URLSearchParams();
+    if (ttl) query.set("ttl", ttl);
+    const res = await this.request(
+      "POST",
+      "/v1/signed-urls",
+      query,
+      JSON.stringify({ url: path }),
+      { "Content-Type": "application/json" },
+      [201],
+    );
+    const signed: SignedURL = await res.json();
+    if (signed.url.startsWith("/")) signed.url = this.baseUrl + signed.url;
+    return signed;
+  }
+
+  async ready(): Promise<boolean> {
+    try {
+      await this.request("GET", "/v1/ready");
+      return true;
+    } catch (error) {
+      if (error instanceof ConiferError && error.status === 503) return false;
+      throw error;
+    }
+  }
+
+  async getOpenAPI(): Promise<Record<string, unknown>> {
+    const res = await this.request("GET", "/v1/openapi.json");
+    return res.json();
+  }
+
+  /** Reports the bundle at url, a URL under /bundles/, for review. Needs no API key. */
+  async reportAbuse(url: string, reason: string): Promise<AbuseReport> {
+    const body = JSON.stringify({ url, reason });
+    const res = await this.request("POST", "/v1/abuse-reports", undefined, body, { "Content-Type": "application/json" }, [201]);
+    return res.json();
+  }
+
+  private async request(
+    method: string,
+    path: string,
+    query?: URLSearchParams,
+    body?: BodyInit,
+    headers: Record<string, string> = {},
+    ok: number[] = [200],
+  ): Promise<Response> {
+    let url = this.baseUrl + path;
+    if (query && [...query.keys()].length > 0) url += "?" + query.toString();
+    headers = { ...headers, "Conifer-API-Version": apiVersion };
+    if (this.apiKey) headers["Authorization"] = `Bearer ${this.apiKey}`;
+    const res = await this.fetch(url, { method, headers, body });
+    if (!ok.includes(res.status)) {
+      const retryAfter = Number.parseInt(res.headers.get("Retry-After") ?? "", 10);
+      const text = (await res.text()).trim();
+      let build: BuildError | null = null;
+      if (res.headers.get("Content-Type")?.startsWith("application/json")) {
+        try {
+          build = JSON.parse(text) as BuildError;
+        } catch {
+          // Not a build error after all.
+        }
+      }
+      throw new ConiferError(res.status, build?.message ?? text, Number.isNaN(retryAfter) ? null : retryAfter, build);
+    }
+    return res;
+  }
+}
+
+function buildQuery(options: BuildOptions): URLSearchParams {
+  const query = new URLSearchParams();
+  if (options.minify) query.set("minify", "");
+  if (options.bundle === false) query.set("bundle", "false");
+  if (options.keepUrls?.length) query.set("keepUrls", options.keepUrls.join(","));
+  for (const name of ["autoExternal", "splitting", "differential", "proxyUrls", "polyfill", "smokeTest"] as const) {
+    if (options[name]) query.set(name, "true");
+  }
+  for (const name of ["name", "mangleProps", "target", "format", "sourcemap", "legacyTarget", "tsconfigRaw"] as const) {
+    const value = options[name];
+    if (value) query.set(name, value);
+  }
+  if (options.lockfile) query.set("lockfile", JSON.stringify(options.lockfile));
+  if (options.importMap) query.set("importMap", JSON.stringify(options.importMap));
+  if (options.exposes) query.set("exposes", JSON.stringify(options.exposes));
+  if (options.remotes) query.set("remotes", JSON.stringify(options.remotes));
+  if (options.stamp) {
+    const fields = Object.entries(options.stamp).map(([name, value]) => `${name}:${value}`);
+    query.set("stamp", fields.sort().join(","));
+    if (options.stampAs) query.set("stampAs", options.stampAs);
+    if (options.noTimestamps) query.set("noTimestamps", "true");
+  }
+  return query;
+}
+
+async function buildResult(res: Response): Promise<BuildResult> {
+  return {
+    code: res.status === 304 ? "" : await res.text(),
+    buildId: res.headers.get("X-Conifer-Build"),
+    artifactId: res.headers.get("X-Conifer-Artifact"),
+    etag: res.headers.get("ETag"),
+    notModified: res.status === 304,
+    commit: res.headers.get("X-Conifer-Commit"),
+    polyfills: res.headers.get("X-Conifer-Polyfills")?.split(", ") ?? [],
+    smokeTest: res.headers.get("X-Conifer-Smoke-Test"),
+    warnings: Number(res.headers.get("X-Build-Warnings-Count") ?? 0),
+  };
+}
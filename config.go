@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// config is read at startup from the JSON file named by CONIFER_CONFIG.
+type config struct {
+	// Hosts configures how modules are downloaded from particular hosts,
+	// keyed by host name (optionally with a port).
+	Hosts map[string]hostConfig `json:"hosts"`
+
+	// AdminKeys are API keys for operators, who can see reports spanning
+	// every tenant. They may reference environment variables.
+	AdminKeys []string `json:"adminKeys"`
+
+	// Tenants are the organizations allowed to identify themselves with an
+	// API key.
+	Tenants []tenantConfig `json:"tenants"`
+
+	// Mirrors lists groups of interchangeable CDNs. When downloading from
+	// one of them fails, the same path is tried on the others in order.
+	Mirrors []mirrorConfig `json:"mirrors"`
+
+	Webhooks webhooksConfig `json:"webhooks"`
+
+	// Script is the path of a Starlark file that can adjust the options of
+	// each build. See buildScript.
+	Script string `json:"script"`
+
+	// ImportMap is used by builds that don't provide their own.
+	ImportMap *importMap `json:"importMap"`
+
+	// DataDir is where state that should survive restarts is kept. When
+	// empty, that state is only kept in memory.
+	DataDir string `json:"dataDir"`
+	// BuildRetention is how long the records of builds are kept in
+	// DataDir, like "720h", 30 days when empty.
+	BuildRetention duration `json:"buildRetention"`
+
+	// PublicURL is the origin conifer is reached at, like
+	// "https://conifer.example.com", used when output must refer back to
+	// it. When empty, output refers to it with root relative paths.
+	PublicURL string `json:"publicUrl"`
+
+	// LegacySunset is the date, like "2025-06-30", after which the
+	// unversioned routes may be removed. It is announced in their
+	// responses' Sunset header.
+	LegacySunset string `json:"legacySunset"`
+
+	// Hosting applies to the named bundles served at /bundles/.
+	Hosting hostingConfig `json:"hosting"`
+
+	// Policy decides which imports builds may make, unless the tenant has
+	// its own. See importPolicy.
+	Policy *importPolicy `json:"policy"`
+
+	// PostProcess is applied to the output of every build, unless the
+	// tenant has its own. See postProcessStep.
+	PostProcess []postProcessStep `json:"postProcess"`
+
+	// Purge lists the CDNs to purge when a named bundle changes.
+	Purge []purgeConfig `json:"purge"`
+
+	// SourceMapUploads are the error trackers sent the external source
+	// maps of builds, unless the tenant has its own.
+	SourceMapUploads []sourceMapUpload `json:"sourceMapUploads"`
+
+	// Cache limits how many downloaded modules are kept between builds.
+	Cache cacheConfig `json:"cache"`
+
+	// Upstreams are hosts served file by file under a path of conifer's
+	// own, transformed into ES modules on the way through.
+	Upstreams []upstreamConfig `json:"upstreams"`
+
+	// Offline, when enabled, stops modules being downloaded.
+	Offline offlineConfig `json:"offline"`
+
+	// Mirror is a copy of upstream modules kept in conifer's own storage
+	// and served at /mirror/.
+	Mirror hostedMirrorConfig `json:"mirror"`
+
+	// Warm lists modules downloaded at startup, before anyone asks for them.
+	Warm warmConfig `json:"warm"`
+
+	// NPMRegistry is the registry packages served at paths like
+	// /react@18.2.0 are resolved through, https://registry.npmjs.org/ when
+	// empty. Their files are downloaded from Warm's package CDN.
+	NPMRegistry string `json:"npmRegistry"`
+
+	// Polyfills configures the polyfills builds asking for them get.
+	Polyfills polyfillConfig `json:"polyfills"`
+
+	// Artifacts, when set, is object storage finished builds are kept in.
+	Artifacts *objectStoreConfig `json:"artifacts"`
+
+	// Provenance signs the provenance attested for each build.
+	Provenance provenanceConfig `json:"provenance"`
+
+	// Redis, when its URL is set, is a cache shared between instances.
+	Redis redisConfig `json:"redis"`
+
+	Engine engineConfig `json:"engine"`
+
+	// Playground, when set, lets anonymous callers build under tight
+	// limits, with their output watermarked.
+	Playground *playgroundConfig `json:"playground"`
+
+	Pressure pressureConfig `json:"pressure"`
+
+	// Bandwidth caps how fast modules are downloaded.
+	Bandwidth bandwidthConfig `json:"bandwidth"`
+
+	// Shadow mirrors a sample of build requests to a second deployment.
+	Shadow shadowConfig `json:"shadow"`
+
+	// SmokeTest is the runtime builds asking for a smoke test run their
+	// output in.
+	SmokeTest smokeTestConfig `json:"smokeTest"`
+
+	// Preview limits the previews served at /previews/.
+	Preview previewConfig `json:"preview"`
+
+	// Limits apply to every caller, unless their tenant sets its own.
+	Limits limitsConfig `json:"limits"`
+	// RateLimits limit how often each caller may request particular routes,
+	// on top of their limits.
+	RateLimits []routeRateLimit `json:"rateLimits"`
+	// TrustProxyHeaders, when conifer runs behind a proxy like Fly's,
+	// identifies clients by the address in its Fly-Client-IP or
+	// X-Forwarded-For header rather than the proxy's own.
+	TrustProxyHeaders bool `json:"trustProxyHeaders"`
+	// MaxBodyBytes caps source sent as a request body, 1 MiB when zero, so
+	// one request can't take up arbitrary memory. Builds sent as JSON,
+	// forms or archives have a cap of their own. See requestSource.
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+	// RequireAPIKey refuses builds by anonymous callers, unless the
+	// playground lets them build.
+	RequireAPIKey bool `json:"requireApiKey"`
+}
+
+// hostConfig holds credentials injected into requests to a host. Values may
+// reference environment variables like "$GITHUB_TOKEN" so secrets don't need
+// to live in the config file.
+type hostConfig struct {
+	BearerToken string            `json:"bearerToken"`
+	Username    string            `json:"username"`
+	Password    string            `json:"password"`
+	Headers     map[string]string `json:"headers"`
+	// BytesPerSecond caps how fast modules are downloaded from the host,
+	// in place of the bandwidth config's cap for each host.
+	BytesPerSecond int64 `json:"bytesPerSecond"`
+	// Tenants, when set, are the only tenants whose builds may download
+	// from the host while it has credentials; otherwise any tenant's may.
+	// Anonymous callers never may, so can't read private modules.
+	Tenants []string `json:"tenants"`
+	// Private lets the host be on a private network, like an internal
+	// registry, which modules are otherwise never downloaded from. See
+	// dialUpstream.
+	Private bool `json:"private"`
+}
+
+type tenantConfig struct {
+	Name    string   `json:"name"`
+	APIKeys []apiKey `json:"apiKeys"`
+
+	// EmbedOrigins are the sites, like "https://*.example.com", allowed to
+	// load the tenant's named bundles. Empty allows any site.
+	EmbedOrigins []string `json:"embedOrigins"`
+	// EmbedSecret signs short-lived embed tokens that also allow loading
+	// the tenant's named bundles. It may reference an environment variable.
+	EmbedSecret string `json:"embedSecret"`
+	// URLSecret signs URLs that build with one of the tenant's API keys
+	// without carrying it. It may reference an environment variable. See
+	// handleSignedURL.
+	URLSecret string `json:"urlSecret"`
+
+	// Limits override the default limits for this tenant.
+	Limits *limitsConfig `json:"limits"`
+
+	// PostProcess replaces the server's post-processing pipeline for this
+	// tenant's builds. An empty list turns it off.
+	PostProcess []postProcessStep `json:"postProcess"`
+
+	// Policy replaces the server's import policy for this tenant's builds.
+	Policy *importPolicy `json:"policy"`
+
+	// SourceMapUploads replace the server's error trackers for this
+	// tenant's builds. An empty list turns uploading off.
+	SourceMapUploads []sourceMapUpload `json:"sourceMapUploads"`
+}
+
+// mirrorConfig is a group of URL prefixes serving the same files, such as
+// "https://unpkg.com/" and "https://cdn.jsdelivr.net/npm/".
+type mirrorConfig struct {
+	Prefixes []string `json:"prefixes"`
+	// Timeout limits each attempt, so a host that hangs fails over too.
+	Timeout duration `json:"timeout"`
+}
+
+// duration is a time.Duration written in config as a string like "5s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var cfg config
+
+func loadConfig() error {
+	path := os.Getenv("CONIFER_CONFIG")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &cfg)
+}
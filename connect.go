@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The API is also a Connect service (https://connectrpc.com), described
+// by proto/conifer/v1/conifer.proto, so services can call conifer with
+// generated clients. Each procedure serves the same handler as its HTTP
+// route, against a responseRecorder, translating the response.
+//
+// Only the JSON codec is spoken. gRPC itself needs HTTP/2 and trailers,
+// which conifer's plain HTTP/1.1 listener doesn't have.
+
+const connectServicePath = "/conifer.v1.ConiferService/"
+
+// Flags of the envelopes streamed messages are sent in.
+const (
+	connectFlagCompressed = 0x01
+	connectFlagEndStream  = 0x02
+)
+
+// connectError is the body of a failed call.
+type connectError struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message,omitempty"`
+	Details []connectErrorDetail `json:"details,omitempty"`
+}
+
+// connectErrorDetail carries the errors of a failed build. Detail values
+// are binary protobuf, which conifer doesn't encode, so the errors are
+// given in Debug, the JSON form clients show.
+type connectErrorDetail struct {
+	Type  string          `json:"type"`
+	Value string          `json:"value"`
+	Debug *buildErrorBody `json:"debug,omitempty"`
+}
+
+// connectCodes are the Connect codes of the statuses the handlers respond
+// with, and the statuses Connect responds to each with.
+var connectCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_argument",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "permission_denied",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "aborted",
+	http.StatusRequestEntityTooLarge: "resource_exhausted",
+	http.StatusUnprocessableEntity:   "failed_precondition",
+	http.StatusTooManyRequests:       "resource_exhausted",
+	http.StatusNotImplemented:        "unimplemented",
+	http.StatusBadGateway:            "unavailable",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "deadline_exceeded",
+}
+
+var connectStatuses = map[string]int{
+	"invalid_argument":    http.StatusBadRequest,
+	"unauthenticated":     http.StatusUnauthorized,
+	"permission_denied":   http.StatusForbidden,
+	"not_found":           http.StatusNotFound,
+	"aborted":             http.StatusConflict,
+	"resource_exhausted":  http.StatusTooManyRequests,
+	"failed_precondition": http.StatusBadRequest,
+	"unimplemented":       http.StatusNotImplemented,
+	"unavailable":         http.StatusServiceUnavailable,
+	"deadline_exceeded":   http.StatusGatewayTimeout,
+	"internal":            http.StatusInternalServerError,
+	"unknown":             http.StatusInternalServerError,
+}
+
+// newConnectError describes a response recorded from a handler that
+// failed.
+func newConnectError(rec *responseRecorder) *connectError {
+	code, ok := connectCodes[rec.status]
+	if !ok {
+		code = "unknown"
+		if rec.status >= 500 {
+			code = "internal"
+		}
+	}
+	failure := rec.failure()
+	e := &connectError{Code: code, Message: failure.Message}
+	if failure.Code != "request_failed" {
+		e.Details = []connectErrorDetail{{Type: "conifer.v1.BuildErrors", Value: "", Debug: failure}}
+	}
+	return e
+}
+
+// connectUnary are the procedures answered with one message. Each serves
+// a call's JSON message, writing the response message to rec, or failing
+// as the HTTP route would.
+var connectUnary = map[string]func(rec *responseRecorder, r *http.Request, message []byte){
+	"Build": func(rec *responseRecorder, r *http.Request, message []byte) {
+		var body jsonBuildRequest
+		if err := json.Unmarshal(message, &body); err != nil {
+			http.Error(rec, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveBuildBody(rec, r, body)
+	},
+	"ResolveGraph": func(rec *responseRecorder, r *http.Request, message []byte) {
+		var body jsonBuildRequest
+		if err := json.Unmarshal(message, &body); err != nil {
+			http.Error(rec, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req, err := body.buildRequest()
+		if err != nil {
+			http.Error(rec, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveGraph(rec, r, req)
+	},
+	"Transform": func(rec *responseRecorder, r *http.Request, message []byte) {
+		var body struct {
+			Source      string `json:"source"`
+			Loader      string `json:"loader"`
+			Target      string `json:"target"`
+			Format      string `json:"format"`
+			Minify      bool   `json:"minify"`
+			Sourcemap   string `json:"sourcemap"`
+			Sourcefile  string `json:"sourcefile"`
+			TsconfigRaw string `json:"tsconfigRaw"`
+		}
+		if err := json.Unmarshal(message, &body); err != nil {
+			http.Error(rec, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := make(neturl.Values)
+		for name, value := range map[string]string{
+			"loader":      body.Loader,
+			"target":      body.Target,
+			"format":      body.Format,
+			"sourcemap":   body.Sourcemap,
+			"sourcefile":  body.Sourcefile,
+			"tsconfigRaw": body.TsconfigRaw,
+		} {
+			if value != "" {
+				q.Set(name, value)
+			}
+		}
+		if body.Minify {
+			q.Set("minify", "")
+		}
+		handleTransform(rec, connectSubrequest(r, "/v1/transform", q, body.Source))
+		if rec.status == http.StatusOK {
+			code := rec.body.String()
+			rec.body.Reset()
+			json.NewEncoder(&rec.body).Encode(struct {
+				Code string `json:"code"`
+			}{code})
+		}
+	},
+	"PurgeCache": func(rec *responseRecorder, r *http.Request, message []byte) {
+		var body struct {
+			URL    string `json:"url"`
+			Prefix string `json:"prefix"`
+			All    bool   `json:"all"`
+			Cache  string `json:"cache"`
+		}
+		if err := json.Unmarshal(message, &body); err != nil {
+			http.Error(rec, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := make(neturl.Values)
+		for name, value := range map[string]string{"url": body.URL, "prefix": body.Prefix, "cache": body.Cache} {
+			if value != "" {
+				q.Set(name, value)
+			}
+		}
+		if body.All {
+			q.Set("all", "true")
+		}
+		handlePurge(rec, connectSubrequest(r, "/v1/admin/purge", q, ""))
+	},
+}
+
+// connectSubrequest is a call as the request its HTTP route takes, with
+// the caller's headers, so it is authorized as the caller.
+func connectSubrequest(r *http.Request, path string, q neturl.Values, body string) *http.Request {
+	sub := r.Clone(r.Context())
+	sub.URL = &neturl.URL{Path: path, RawQuery: q.Encode()}
+	sub.RequestURI = sub.URL.RequestURI()
+	sub.Method = "POST"
+	sub.Body = io.NopCloser(strings.NewReader(body))
+	sub.ContentLength = int64(len(body))
+	sub.Header.Del("Content-Type")
+	// The response is always wanted, whatever the caller has cached.
+	sub.Header.Del("If-None-Match")
+	return sub
+}
+
+// connectTimeout reads the deadline a caller set, in milliseconds.
+func connectTimeout(r *http.Request) (time.Duration, bool, error) {
+	header := r.Header.Get("Connect-Timeout-Ms")
+	if header == "" {
+		return 0, false, nil
+	}
+	ms, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || ms < 0 || len(header) > 10 {
+		return 0, false, errors.New("Connect-Timeout-Ms must be up to 10 digits")
+	}
+	return time.Duration(ms) * time.Millisecond, true, nil
+}
+
+// handleConnect serves the Connect procedures:
+//
+//	POST /conifer.v1.ConiferService/Build {"source": "export * from 'react'"}
+//
+// Calls past their deadline fail with deadline_exceeded. The build goes
+// on, and is cached for the next call.
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	procedure := strings.TrimPrefix(r.URL.Path, connectServicePath)
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeConnectError(w, http.StatusMethodNotAllowed, &connectError{Code: "unimplemented", Message: "calls must be POSTed"})
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/grpc") {
+		writeConnectError(w, http.StatusUnsupportedMediaType, &connectError{Code: "unimplemented", Message: "gRPC isn't served, call with the Connect protocol and JSON"})
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "" && r.Header.Get("Content-Encoding") != "identity" {
+		writeConnectError(w, http.StatusNotImplemented, &connectError{Code: "unimplemented", Message: "compressed calls aren't supported"})
+		return
+	}
+	timeout, hasTimeout, err := connectTimeout(r)
+	if err != nil {
+		writeConnectError(w, http.StatusBadRequest, &connectError{Code: "invalid_argument", Message: err.Error()})
+		return
+	}
+	ctx := r.Context()
+	if hasTimeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	r = r.WithContext(ctx)
+
+	if procedure == "BuildStream" {
+		if !strings.HasPrefix(contentType, "application/connect+json") {
+			w.Header().Set("Accept-Post", "application/connect+json")
+			writeConnectError(w, http.StatusUnsupportedMediaType, &connectError{Code: "unimplemented", Message: "streams must be application/connect+json"})
+			return
+		}
+		serveConnectBuildStream(w, r)
+		return
+	}
+	call, ok := connectUnary[procedure]
+	if !ok {
+		writeConnectError(w, http.StatusNotFound, &connectError{Code: "unimplemented", Message: "no procedure " + procedure})
+		return
+	}
+	if !strings.HasPrefix(contentType, "application/json") {
+		w.Header().Set("Accept-Post", "application/json")
+		writeConnectError(w, http.StatusUnsupportedMediaType, &connectError{Code: "unimplemented", Message: "calls must be application/json"})
+		return
+	}
+	message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBuildRequestBytes))
+	if err != nil {
+		writeConnectError(w, http.StatusRequestEntityTooLarge, &connectError{Code: "resource_exhausted", Message: err.Error()})
+		return
+	}
+
+	rec := newResponseRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The build outlives the call, so a call past its deadline
+		// leaves it cached for the next.
+		call(rec, r.WithContext(context.Background()), message)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		writeConnectError(w, http.StatusGatewayTimeout, &connectError{Code: "deadline_exceeded", Message: "the call's deadline passed"})
+		return
+	}
+	if retryAfter := rec.header.Get("Retry-After"); retryAfter != "" {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	if rec.status != http.StatusOK {
+		writeConnectError(w, rec.status, newConnectError(rec))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(rec.body.Bytes())
+}
+
+// writeConnectError fails a unary call. Its status is Connect's for the
+// code, except for failures of the protocol itself.
+func writeConnectError(w http.ResponseWriter, status int, e *connectError) {
+	if s, ok := connectStatuses[e.Code]; ok && status != http.StatusUnsupportedMediaType && status != http.StatusMethodNotAllowed {
+		status = s
+	}
+	writeJSON(w, status, e)
+}
+
+// connectStream writes the enveloped messages of a streaming response.
+// Once ended, messages are dropped.
+type connectStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	ended   bool
+}
+
+func (s *connectStream) write(flags byte, message interface{}) {
+	encoded, _ := json.Marshal(message)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	var prefix [5]byte
+	prefix[0] = flags
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(encoded)))
+	s.w.Write(prefix[:])
+	s.w.Write(encoded)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	if flags&connectFlagEndStream != 0 {
+		s.ended = true
+	}
+}
+
+func (s *connectStream) send(message interface{}) { s.write(0, message) }
+
+// end ends the stream, failing it when e isn't nil.
+func (s *connectStream) end(e *connectError) {
+	s.write(connectFlagEndStream, struct {
+		Error *connectError `json:"error,omitempty"`
+	}{e})
+}
+
+// readConnectEnvelope reads the one message of a streaming request.
+func readConnectEnvelope(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, errors.New("reading the message: " + err.Error())
+	}
+	if prefix[0]&connectFlagCompressed != 0 {
+		return nil, errors.New("compressed messages aren't supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxBuildRequestBytes {
+		return nil, errors.New("the message is larger than " + strconv.Itoa(maxBuildRequestBytes) + " bytes")
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, errors.New("reading the message: " + err.Error())
+	}
+	return message, nil
+}
+
+// serveConnectBuildStream builds as Build does, streaming a {"module": ...}
+// message for each module loaded and then {"build": ...}.
+func serveConnectBuildStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/connect+json")
+	flusher, _ := w.(http.Flusher)
+	stream := &connectStream{w: w, flusher: flusher}
+	message, err := readConnectEnvelope(r.Body)
+	// Streams are answered 200 OK, failing in the message ending them.
+	w.WriteHeader(http.StatusOK)
+	if err != nil {
+		stream.end(&connectError{Code: "invalid_argument", Message: err.Error()})
+		return
+	}
+	var body jsonBuildRequest
+	if err := json.Unmarshal(bytes.TrimSpace(message), &body); err != nil {
+		stream.end(&connectError{Code: "invalid_argument", Message: "invalid request: " + err.Error()})
+		return
+	}
+	req, err := body.buildRequest()
+	if err != nil {
+		stream.end(&connectError{Code: "invalid_argument", Message: err.Error()})
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rec := newResponseRecorder()
+		if !authorizeBuild(rec, r, &req) {
+			stream.end(newConnectError(rec))
+			return
+		}
+		req.OnModule = func(e moduleEvent) {
+			stream.send(struct {
+				Module moduleEvent `json:"module"`
+			}{e})
+		}
+		result, ok := runRecordedBuild(rec, req)
+		if !ok {
+			stream.end(newConnectError(rec))
+			return
+		}
+		stream.send(struct {
+			Build buildEnvelope `json:"build"`
+		}{newBuildEnvelope(rec, body, req, result)})
+		stream.end(nil)
+	}()
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		stream.end(&connectError{Code: "deadline_exceeded", Message: "the call's deadline passed"})
+	}
+}
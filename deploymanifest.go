@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// deployDependency is a module a build included.
+type deployDependency struct {
+	URL string `json:"url"`
+	// Package and Version are set for modules of a versioned package,
+	// like "react" and "17.0.2".
+	Package   string `json:"package,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Bytes     int    `json:"bytes"`
+	Integrity string `json:"integrity"`
+}
+
+// deployTimings is how long a build took. When its output was reused, the
+// phases are those of the build that made it, and TotalMS is how long this
+// request waited.
+type deployTimings struct {
+	TotalMS       int64 `json:"totalMs"`
+	Reused        bool  `json:"reused"`
+	BundleMS      int64 `json:"bundleMs"`
+	DownloadMS    int64 `json:"downloadMs"`
+	PolyfillMS    int64 `json:"polyfillMs"`
+	PostProcessMS int64 `json:"postProcessMs"`
+	// ThrottleMS is how long downloads waited for bandwidth.
+	ThrottleMS  int64 `json:"throttleMs"`
+	SmokeTestMS int64 `json:"smokeTestMs"`
+}
+
+// deployManifest is a machine-readable record of a build, to keep with
+// the deploy it went into. The output itself is kept at URL, named by its
+// hash, rather than inlined.
+type deployManifest struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Integrity string `json:"integrity"`
+	// SourceMapURL is set when the build asked for an external source map.
+	SourceMapURL string             `json:"sourceMapUrl,omitempty"`
+	Artifact     string             `json:"artifact,omitempty"`
+	Release      string             `json:"release,omitempty"`
+	Dependencies []deployDependency `json:"dependencies"`
+	Chunks       []string           `json:"chunks,omitempty"`
+	Warnings     []buildMessage     `json:"warnings"`
+	Timings      deployTimings      `json:"timings"`
+	Engine       engineInfo         `json:"engine"`
+	Pinned       bool               `json:"pinned"`
+	Polyfills    []string           `json:"polyfills,omitempty"`
+	SmokeTest    string             `json:"smokeTest,omitempty"`
+}
+
+// writeDeployManifest responds with the manifest of a recorded build that
+// started at start, storing its output and source map with the chunks.
+func writeDeployManifest(w http.ResponseWriter, req buildRequest, result *buildResult, start time.Time) {
+	name, err := storeOutput(req, result.Code)
+	if err != nil {
+		http.Error(w, "storing the output: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m := deployManifest{
+		ID:           w.Header().Get("X-Conifer-Build"),
+		URL:          cfg.PublicURL + chunkPath + name,
+		Integrity:    subresourceIntegrity(result.Code),
+		Artifact:     result.Artifact,
+		Release:      w.Header().Get("X-Conifer-Release"),
+		Dependencies: []deployDependency{},
+		Chunks:       result.Manifest.Chunks,
+		Warnings:     newBuildMessages(result.Warnings),
+		Timings: deployTimings{
+			TotalMS:       time.Since(start).Milliseconds(),
+			Reused:        result.Reused,
+			BundleMS:      result.Stats.BundleMS,
+			DownloadMS:    result.Stats.DownloadMS,
+			PolyfillMS:    result.Stats.PolyfillMS,
+			PostProcessMS: result.Stats.PostProcessMS,
+			ThrottleMS:    result.Stats.ThrottleMS,
+			SmokeTestMS:   result.Stats.SmokeTestMS,
+		},
+		Engine:    result.Manifest.Engine,
+		Pinned:    result.Manifest.Pinned,
+		Polyfills: result.Manifest.Polyfills,
+		SmokeTest: result.Manifest.SmokeTest,
+	}
+	if len(result.SourceMap) > 0 {
+		if err := chunks.put(name+".map", result.SourceMap); err != nil {
+			http.Error(w, "storing the source map: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.SourceMapURL = m.URL + ".map"
+	}
+	for _, mod := range result.Manifest.Modules {
+		pkg, version := packageVersionOf(mod.URL)
+		sum, _ := hex.DecodeString(mod.SHA256)
+		m.Dependencies = append(m.Dependencies, deployDependency{
+			URL:       mod.URL,
+			Package:   pkg,
+			Version:   version,
+			Bytes:     mod.Bytes,
+			Integrity: "sha256-" + base64.StdEncoding.EncodeToString(sum),
+		})
+	}
+	writeJSON(w, http.StatusOK, m)
+}
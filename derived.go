@@ -0,0 +1,162 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultDerivedBytes = 64 << 20
+
+// buildHash identifies a build by the hash of its output and the modules
+// and engine it was built from, which is everything an artifact derived
+// from the build, like an analysis of its metafile, depends on. Recorded
+// builds have the same hash as when they were built.
+func buildHash(manifest buildManifest, outputSHA256 string) string {
+	h := sha256.New()
+	io.WriteString(h, manifest.Engine.Conifer+" "+manifest.Engine.Esbuild+"\n")
+	for _, m := range manifest.Modules {
+		io.WriteString(h, m.URL+" "+m.SHA256+"\n")
+	}
+	io.WriteString(h, outputSHA256)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type derivedEntry struct {
+	key  string
+	data []byte
+}
+
+// derivedCache keeps artifacts derived from builds, like metafile analyses,
+// dependency graphs and license reports, so inspecting the same bundle
+// again doesn't redo the work. They are keyed by the build's hash, so never
+// go stale, and are kept in memory, least recently used evicted first, and
+// in the shared cache when there is one.
+type derivedCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	bytes   int64
+
+	flight   singleflight.Group
+	counters cacheCounters
+	shared   cacheCounters
+}
+
+var derived = &derivedCache{order: list.New(), entries: make(map[string]*list.Element)}
+
+func (c *derivedCache) limit() int64 {
+	if cfg.Cache.MaxDerivedBytes > 0 {
+		return cfg.Cache.MaxDerivedBytes
+	}
+	return defaultDerivedBytes
+}
+
+// get returns the artifact of kind derived from the build with hash,
+// calling compute only when it isn't cached. Kind names the artifact and
+// its format, like "treemap.v1", so changing the format leaves old entries
+// behind. Errors aren't cached.
+func (c *derivedCache) get(kind, hash string, compute func() ([]byte, error)) ([]byte, error) {
+	key := kind + ":" + hash
+	if data, ok := c.lookup(key); ok {
+		return data, nil
+	}
+	v, err, _ := c.flight.Do(key, func() (interface{}, error) {
+		var data []byte
+		if sharedCache != nil {
+			if sharedCache.getJSON("derived:"+key, &data) {
+				atomic.AddInt64(&c.shared.hits, 1)
+				c.put(key, data)
+				return data, nil
+			}
+			atomic.AddInt64(&c.shared.misses, 1)
+		}
+		data, err := compute()
+		if err != nil {
+			return nil, err
+		}
+		c.put(key, data)
+		if sharedCache != nil {
+			sharedCache.putJSON("derived:"+key, data)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func (c *derivedCache) lookup(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		atomic.AddInt64(&c.counters.misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&c.counters.hits, 1)
+	c.order.MoveToFront(el)
+	return el.Value.(*derivedEntry).data, true
+}
+
+func (c *derivedCache) put(key string, data []byte) {
+	max := c.limit()
+	if int64(len(data)) > max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&derivedEntry{key: key, data: data})
+	c.bytes += int64(len(data))
+	for c.bytes > max {
+		c.remove(c.order.Back())
+		c.counters.evicted(1)
+	}
+}
+
+// shrink evicts the least recently used half of the cached bytes,
+// returning how many artifacts were evicted.
+func (c *derivedCache) shrink() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	target, n := c.bytes/2, 0
+	for c.bytes > target && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+		n++
+	}
+	c.counters.evicted(n)
+	return n
+}
+
+func (c *derivedCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*derivedEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.data))
+}
+
+// stats reports the memory layer, and the shared one when there is one.
+func (c *derivedCache) stats() []cacheStats {
+	c.mu.Lock()
+	memory := c.counters.stats("memory")
+	memory.Entries = len(c.entries)
+	bytes := c.bytes
+	memory.Bytes = &bytes
+	c.mu.Unlock()
+	memory.MaxBytes = c.limit()
+	stats := []cacheStats{memory}
+	if sharedCache != nil {
+		shared := c.shared.stats("shared")
+		shared.Entries = sharedCache.countEntries("derived:*")
+		stats = append(stats, shared)
+	}
+	return stats
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default limits of the on-disk module cache.
+const (
+	defaultDiskCacheBytes = 1 << 30
+	defaultDiskCacheTTL   = 24 * time.Hour
+)
+
+// diskCacheMeta is stored next to each cached module's contents.
+type diskCacheMeta struct {
+	URL      string    `json:"url"`
+	FinalURL string    `json:"finalUrl"`
+	SHA256   string    `json:"sha256"`
+	Fetched  time.Time `json:"fetched"`
+
+	Expires      time.Time `json:"expires"`
+	StaleUntil   time.Time `json:"staleUntil"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	// Gzip is set when the contents are stored gzipped.
+	Gzip bool `json:"gzip,omitempty"`
+}
+
+// diskCache keeps modules in a directory so they survive restarts. Each
+// module is stored as <hash of URL>.js, with its metadata in
+// <hash of URL>.json. When the directory grows past its limit the least
+// recently used modules are removed. With compress, the contents are
+// gzipped, and sizes are counted as stored.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+	compress bool
+
+	mu    sync.Mutex
+	bytes int64
+
+	counters cacheCounters
+}
+
+func newDiskCache(dir string, c cacheConfig) *diskCache {
+	d := &diskCache{dir: dir, maxBytes: c.MaxDiskBytes, ttl: time.Duration(c.DiskTTL), compress: c.CompressDisk}
+	if d.maxBytes == 0 {
+		d.maxBytes = defaultDiskCacheBytes
+	}
+	if d.ttl == 0 {
+		d.ttl = defaultDiskCacheTTL
+	}
+	for _, f := range d.files() {
+		d.bytes += f.size
+	}
+	return d
+}
+
+func (d *diskCache) path(url, ext string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+ext)
+}
+
+func (d *diskCache) get(url string) (*module, bool) {
+	return d.counters.lookup(d.read(url))
+}
+
+func (d *diskCache) read(url string) (*module, bool) {
+	data, err := os.ReadFile(d.path(url, ".json"))
+	if err != nil {
+		return nil, false
+	}
+	var meta diskCacheMeta
+	if err := json.Unmarshal(data, &meta); err != nil || meta.URL != url || time.Since(meta.Fetched) > d.ttl {
+		return nil, false
+	}
+	contents, err := os.ReadFile(d.path(url, ".js"))
+	if err != nil {
+		return nil, false
+	}
+	if meta.Gzip {
+		// Modules cached before compression was turned on or off are
+		// still read as they were stored.
+		zr, err := gzip.NewReader(bytes.NewReader(contents))
+		if err == nil {
+			contents, err = io.ReadAll(zr)
+		}
+		if err != nil {
+			log.Println("disk cache: corrupt entry for", url)
+			return nil, false
+		}
+	}
+	sum := sha256.Sum256(contents)
+	if hex.EncodeToString(sum[:]) != meta.SHA256 {
+		log.Println("disk cache: corrupt entry for", url)
+		return nil, false
+	}
+	// The modification time records use, for eviction.
+	now := time.Now()
+	os.Chtimes(d.path(url, ".js"), now, now)
+	return &module{
+		URL:          meta.FinalURL,
+		Contents:     string(contents),
+		SHA256:       meta.SHA256,
+		Expires:      meta.Expires,
+		StaleUntil:   meta.StaleUntil,
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+	}, true
+}
+
+func (d *diskCache) put(url string, mod *module) {
+	contents := []byte(mod.Contents)
+	if d.compress {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write(contents)
+		zw.Close()
+		contents = b.Bytes()
+	}
+	size := int64(len(contents))
+	if size > d.maxBytes {
+		return
+	}
+	meta, err := json.Marshal(diskCacheMeta{
+		URL:          url,
+		FinalURL:     mod.URL,
+		SHA256:       mod.SHA256,
+		Fetched:      time.Now().UTC(),
+		Expires:      mod.Expires,
+		StaleUntil:   mod.StaleUntil,
+		ETag:         mod.ETag,
+		LastModified: mod.LastModified,
+		Gzip:         d.compress,
+	})
+	if err != nil {
+		return
+	}
+	var replaced int64
+	if info, err := os.Stat(d.path(url, ".js")); err == nil {
+		replaced = info.Size()
+	}
+	// Contents are written first, so metadata never describes a file that
+	// isn't there yet.
+	if err := writeFileAtomic(d.path(url, ".js"), contents); err != nil {
+		log.Println("disk cache:", err)
+		return
+	}
+	if err := writeFileAtomic(d.path(url, ".json"), meta); err != nil {
+		log.Println("disk cache:", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bytes += size - replaced
+	if d.bytes > d.maxBytes {
+		d.evict()
+	}
+}
+
+func (d *diskCache) purge(match func(url string) bool) int {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(d.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var meta diskCacheMeta
+		if json.Unmarshal(data, &meta) != nil || !(match(meta.URL) || match(meta.FinalURL)) {
+			continue
+		}
+		contents := strings.TrimSuffix(path, ".json") + ".js"
+		if info, err := os.Stat(contents); err == nil && os.Remove(contents) == nil {
+			d.bytes -= info.Size()
+		}
+		os.Remove(path)
+		n++
+	}
+	return n
+}
+
+func (d *diskCache) stats() []cacheStats {
+	files := d.files()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := d.counters.stats("disk")
+	bytes := d.bytes
+	s.Entries, s.Bytes, s.MaxBytes = len(files), &bytes, d.maxBytes
+	return []cacheStats{s}
+}
+
+type diskCacheFile struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// files lists the cached contents, least recently used first.
+func (d *diskCache) files() []diskCacheFile {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil
+	}
+	var files []diskCacheFile
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".js") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, diskCacheFile{filepath.Join(d.dir, entry.Name()), info.Size(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].used.Before(files[j].used)
+	})
+	return files
+}
+
+// evict removes the least recently used modules until the cache is back
+// under 90% of its limit, so eviction doesn't run on every write.
+func (d *diskCache) evict() {
+	files := d.files()
+	d.bytes = 0
+	for _, f := range files {
+		d.bytes += f.size
+	}
+	for _, f := range files {
+		if d.bytes <= d.maxBytes/10*9 {
+			break
+		}
+		os.Remove(strings.TrimSuffix(f.path, ".js") + ".json")
+		if os.Remove(f.path) == nil {
+			d.bytes -= f.size
+			d.counters.evicted(1)
+		}
+	}
+}
+
+// layeredCache checks faster caches before slower ones, copying modules
+// found in a slower cache into the faster ones.
+type layeredCache []moduleCache
+
+func (l layeredCache) get(url string) (*module, bool) {
+	for i, c := range l {
+		if mod, ok := c.get(url); ok {
+			for _, faster := range l[:i] {
+				faster.put(url, mod)
+			}
+			return mod, true
+		}
+	}
+	return nil, false
+}
+
+func (l layeredCache) put(url string, mod *module) {
+	for _, c := range l {
+		c.put(url, mod)
+	}
+}
+
+func (l layeredCache) stats() []cacheStats {
+	var stats []cacheStats
+	for _, c := range l {
+		stats = append(stats, c.stats()...)
+	}
+	return stats
+}
+
+func (l layeredCache) purge(match func(url string) bool) int {
+	n := 0
+	for _, c := range l {
+		n += c.purge(match)
+	}
+	return n
+}
+
+// recentURLs returns up to n of the URLs kept in memory, most recently
+// used first within each layer.
+func (l layeredCache) recentURLs(n int) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, c := range l {
+		var layer []string
+		switch c := c.(type) {
+		case *memoryCache:
+			layer = c.recentURLs(n)
+		case *hotCache:
+			layer = c.recentURLs(n)
+		}
+		for _, u := range layer {
+			if !seen[u] && len(urls) < n {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// markHot marks a module as hot in the layers that keep only hot modules.
+func (l layeredCache) markHot(url string) {
+	for _, c := range l {
+		if h, ok := c.(*hotCache); ok {
+			h.markHot(url)
+		}
+	}
+}
+
+// shrink shrinks the layers kept in memory, returning how many modules were
+// evicted.
+func (l layeredCache) shrink() int {
+	n := 0
+	for _, c := range l {
+		if s, ok := c.(shrinker); ok {
+			n += s.shrink()
+		}
+	}
+	return n
+}
+
+// purgeLocal purges only the caches kept by this instance, leaving the
+// shared cache alone.
+func (l layeredCache) purgeLocal(match func(url string) bool) {
+	for _, c := range l {
+		if _, shared := c.(*redisCache); !shared {
+			c.purge(match)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEmbedTokenTTL = 10 * time.Minute
+	maxEmbedTokenTTL     = 24 * time.Hour
+)
+
+// embedCookie is the name of the cookie holding a tenant's embed token.
+func embedCookie(tenant string) string {
+	return "conifer_embed_" + tenant
+}
+
+// requestOrigin is the site of the page making r, from its Origin header or
+// else its Referer, or "" when neither says.
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	if referer, err := url.Parse(r.Referer()); err == nil && referer.Host != "" {
+		return referer.Scheme + "://" + referer.Host
+	}
+	return ""
+}
+
+// embedAllowed reports whether r may load the tenant's named bundles. When
+// the tenant restricts embedding, the request must come from one of its
+// origins or carry an embed token, either as a cookie or a token parameter.
+func embedAllowed(r *http.Request, tenant *tenantConfig) bool {
+	if tenant == nil || (len(tenant.EmbedOrigins) == 0 && tenant.EmbedSecret == "") {
+		return true
+	}
+
+	origin := requestOrigin(r)
+	for _, allowed := range tenant.EmbedOrigins {
+		if origin != "" && matchWildcard(allowed, origin) {
+			return true
+		}
+	}
+
+	if tenant.EmbedSecret == "" {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if cookie, err := r.Cookie(embedCookie(tenant.Name)); err == nil && token == "" {
+		token = cookie.Value
+	}
+	return verifyEmbedToken(tenant, token)
+}
+
+// signEmbedToken returns a token that allows loading the tenant's bundles
+// until it expires.
+func signEmbedToken(tenant *tenantConfig, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + embedSignature(tenant, expiry)
+}
+
+func verifyEmbedToken(tenant *tenantConfig, token string) bool {
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return false
+	}
+	expiry, signature := token[:i], token[i+1:]
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(embedSignature(tenant, expiry)))
+}
+
+func embedSignature(tenant *tenantConfig, expiry string) string {
+	mac := hmac.New(sha256.New, []byte(os.ExpandEnv(tenant.EmbedSecret)))
+	mac.Write([]byte(tenant.Name + "." + expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handleEmbedToken issues an embed token to an authenticated tenant, which
+// its pages pass along when loading bundles:
+//
+//	POST /v1/embed-tokens?ttl=10m
+func handleEmbedToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant := tenantFor(r)
+	if tenant == nil {
+		http.Error(w, "an API key is required", http.StatusUnauthorized)
+		return
+	}
+	if tenant.EmbedSecret == "" {
+		http.Error(w, "embed tokens are not configured for this tenant", http.StatusNotFound)
+		return
+	}
+	ttl := defaultEmbedTokenTTL
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		parsed, err := time.ParseDuration(s)
+		if err != nil || parsed <= 0 || parsed > maxEmbedTokenTTL {
+			http.Error(w, "ttl must be a duration up to 24h", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+	expires := time.Now().Add(ttl)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token":   signEmbedToken(tenant, expires),
+		"expires": expires.UTC(),
+	})
+}
+
+// setEmbedCookie exchanges an embed token for a cookie, so later bundle
+// requests from the same browser don't need to carry the token.
+func setEmbedCookie(w http.ResponseWriter, r *http.Request, tenant *tenantConfig) {
+	token := r.URL.Query().Get("token")
+	if tenant == nil || tenant.EmbedSecret == "" || !verifyEmbedToken(tenant, token) {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	expiry, _ := strconv.ParseInt(token[:strings.Index(token, ".")], 10, 64)
+	http.SetCookie(w, &http.Cookie{
+		Name:     embedCookie(tenant.Name),
+		Value:    token,
+		Path:     "/bundles/" + tenant.Name + "/",
+		Expires:  time.Unix(expiry, 0),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// embedLoader is the script /embed responds with, given the bundle's URL,
+// its integrity and the mount selector. The bundle is preloaded with its
+// integrity checked, or fetched to check it where modulepreload isn't
+// supported, then imported and handed the mount element. Failures are shown
+// in an overlay rather than only in the console.
+const embedLoader = `(function () {
+  var script = document.currentScript;
+  var src = new URL(%s, script ? script.src : location.href).href;
+  var integrity = %s;
+  var mount = %s;
+  function overlay(message) {
+    var el = document.createElement("div");
+    el.setAttribute("role", "alert");
+    el.style.cssText = "position:fixed;left:16px;right:16px;bottom:16px;z-index:2147483647;padding:12px 16px;border-radius:6px;background:#7f1d1d;color:#fff;font:13px/1.4 ui-monospace,monospace;white-space:pre-wrap";
+    el.textContent = "conifer: " + message;
+    (document.body || document.documentElement).appendChild(el);
+  }
+  function verify() {
+    var link = document.createElement("link");
+    if (!link.relList || !link.relList.supports || !link.relList.supports("modulepreload")) {
+      return fetch(src, { integrity: integrity, mode: "cors" });
+    }
+    return new Promise(function (resolve, reject) {
+      link.rel = "modulepreload";
+      link.href = src;
+      link.integrity = integrity;
+      link.crossOrigin = "anonymous";
+      link.onload = resolve;
+      link.onerror = reject;
+      document.head.appendChild(link);
+    });
+  }
+  function start() {
+    var target = null;
+    if (mount) {
+      target = document.querySelector(mount);
+      if (!target) return overlay("nothing on the page matches " + mount);
+    }
+    verify().then(function () {
+      return import(src).then(function (m) {
+        var fn = typeof m.mount === "function" ? m.mount : m.default;
+        if (target && typeof fn === "function") return fn(target);
+      });
+    }, function () {
+      throw new Error("couldn't load " + src + ", or it failed its integrity check");
+    }).catch(function (err) {
+      overlay(String((err && err.stack) || err));
+    });
+  }
+  if (document.readyState === "loading") document.addEventListener("DOMContentLoaded", start);
+  else start();
+})();
+`
+
+// subresourceIntegrity is the integrity attribute value for code.
+func subresourceIntegrity(code []byte) string {
+	sum := sha512.Sum384(code)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// jsString quotes s as a JavaScript string literal. encoding/json escapes
+// "<", ">" and "&", as well as the line separators JSON allows in strings
+// and older JavaScript doesn't.
+func jsString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// handleEmbed responds with a loader script embedding a conifer-built app
+// in any page with a single tag:
+//
+//	<div id="app"></div>
+//	<script src="https://conifer.example/embed?entry=https://example.com/app.js&mount=%23app"></script>
+//
+// Either entry is the URL of a module to bundle with the build options in
+// the query string, or bundle is a named bundle as <tenant>/<name>, "_"
+// standing for no tenant, optionally followed by @<version>. The loader
+// points at output that never changes, the build's artifact or a chunk, or
+// a version of the named bundle, so the script is only cached briefly. With
+// mount, the module's mount export, or else its default export, is called
+// with the element the selector matches.
+func handleEmbed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	var src string
+	var code []byte
+	cacheControl := "public, max-age=60"
+	switch {
+	case q.Get("bundle") != "" && q.Get("entry") == "":
+		tenant, name, version, ok := parseBundlePath("/bundles/" + q.Get("bundle") + ".js")
+		if !ok {
+			http.Error(w, "bundle must be like <tenant>/<name>", http.StatusBadRequest)
+			return
+		}
+		tenantConfig := tenantNamed(tenant)
+		if !embedAllowed(r, tenantConfig) {
+			http.Error(w, "embedding this bundle is not allowed here", http.StatusForbidden)
+			return
+		}
+		b, err := bundles.get(tenant, name)
+		if err != nil || b.Current == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if b.Quarantine != nil {
+			http.Error(w, "this bundle has been removed", http.StatusGone)
+			return
+		}
+		if version == "" {
+			version = b.Current
+		}
+		if code, err = bundles.read(tenant, name, version); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		src = versionURL(tenant, name, version)
+		if token := q.Get("token"); token != "" {
+			src += "?token=" + url.QueryEscape(token)
+		}
+		if tenantConfig != nil && (len(tenantConfig.EmbedOrigins) > 0 || tenantConfig.EmbedSecret != "") {
+			cacheControl = "private, max-age=60"
+		}
+
+	case q.Get("entry") != "" && q.Get("bundle") == "":
+		entry := q.Get("entry")
+		if !strings.HasPrefix(entry, "https://") && !strings.HasPrefix(entry, "http://") {
+			http.Error(w, "entry must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+		req, err := parseBuildRequest(r, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Entry, req.Bundle = entry, true
+		if !authorizeBuild(w, r, &req) {
+			return
+		}
+		result, ok := runRecordedBuild(w, req)
+		if !ok {
+			return
+		}
+		code = result.Code
+		if result.Artifact != "" {
+			src = cfg.PublicURL + "/v1/artifacts/" + result.Artifact + ".js"
+		} else {
+			// Chunk names are derived from their contents, so the chunk
+			// store keeps the output at a URL that never changes.
+			name := "embed-" + sha256Hex(code)[:16] + ".js"
+			if err := chunks.put(name, code); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			src = cfg.PublicURL + chunkPath + name
+		}
+		if req.Tenant != "" {
+			cacheControl = "private, max-age=60"
+		}
+
+	default:
+		http.Error(w, "one of entry and bundle is required", http.StatusBadRequest)
+		return
+	}
+
+	loader := fmt.Sprintf(embedLoader, jsString(src), jsString(subresourceIntegrity(code)), jsString(q.Get("mount")))
+	writeJavaScript(w, r, []byte(loader), cacheControl)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+)
+
+const esbuildModule = "github.com/evanw/esbuild"
+
+// engineInfo identifies the code that produced a build. Two conifer
+// deployments with different embedded versions of esbuild can run side by
+// side, and manifests record which one built what.
+type engineInfo struct {
+	Conifer string `json:"conifer"`
+	Esbuild string `json:"esbuild"`
+}
+
+var engine = readEngineInfo()
+
+func readEngineInfo() engineInfo {
+	info := engineInfo{Conifer: "unknown", Esbuild: "unknown"}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Conifer = build.Main.Version
+	for _, dep := range build.Deps {
+		if dep.Path == esbuildModule {
+			info.Esbuild = strings.TrimPrefix(dep.Version, "v")
+			if dep.Replace != nil {
+				info.Esbuild = strings.TrimPrefix(dep.Replace.Version, "v")
+			}
+		}
+	}
+	return info
+}
+
+// engineConfig is checked at startup before a deployment reports ready.
+type engineConfig struct {
+	// Esbuild, when set, is the esbuild version this deployment must embed,
+	// so a rollout of the wrong build never receives traffic.
+	Esbuild string `json:"esbuild"`
+}
+
+// ready is set once the engine has passed its self check.
+var ready int32
+
+// checkEngine verifies the embedded esbuild is the expected version and can
+// build, after which the deployment reports itself ready.
+func checkEngine() error {
+	if want := cfg.Engine.Esbuild; want != "" && want != engine.Esbuild {
+		return fmt.Errorf("expected esbuild %s but this build embeds %s", want, engine.Esbuild)
+	}
+	result := runBuild(buildRequest{Source: "export const ready = 40 + 2"})
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("self check build failed: %s", result.Errors[0].Text)
+	}
+	if !strings.Contains(string(result.Code), "ready") {
+		return fmt.Errorf("self check build produced unexpected output")
+	}
+	atomic.StoreInt32(&ready, 1)
+	log.Printf("ready with conifer %s and esbuild %s", engine.Conifer, engine.Esbuild)
+	return nil
+}
+
+// handleReady answers readiness probes during blue/green rollouts. It
+// reports the engine so a rollout can confirm which version is serving
+// before moving traffic over.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	if atomic.LoadInt32(&ready) == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"ready":   status == http.StatusOK,
+		"engine":  engine,
+		"offline": cfg.Offline.Enabled,
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// A build of entries bundles several entry points at once, like a page's
+// main script and the web workers it starts, mapping names like "main" and
+// "worker" to the modules they start from. Each is built into an output of
+// its own named after it, such as main.js, so they are built from the same
+// modules and options, and with splitting, the code they share is moved
+// into chunks they both import.
+
+var entryName = regexp.MustCompile(`^[A-Za-z0-9][\w.-]*$`)
+
+// checkEntries validates a build's entries. With files, each entry is the
+// path of one of them, and otherwise the URL of a module.
+func checkEntries(req *buildRequest) error {
+	if len(req.Entries) == 0 {
+		return nil
+	}
+	switch {
+	case req.Source != "" || req.Entry != "":
+		return errors.New("a build of entries has no source or entry of its own")
+	case len(req.Exposes) > 0 || len(req.Routes) > 0:
+		return errors.New("entries can't be given with exposes or routes")
+	case !req.Bundle:
+		return errors.New("entries can only be bundled")
+	case req.Polyfill || req.SmokeTest:
+		return errors.New("polyfill and smokeTest need a single output, so can't be used with entries")
+	}
+	for name, specifier := range req.Entries {
+		if !entryName.MatchString(name) {
+			return fmt.Errorf("entries must be named like main or worker, not %q", name)
+		}
+		switch {
+		case len(req.Files) > 0:
+			specifier = path.Clean("/" + specifier)
+			if _, ok := req.Files[specifier]; !ok {
+				return fmt.Errorf("entry %s must be one of the files", name)
+			}
+			req.Entries[name] = specifier
+		case !strings.HasPrefix(specifier, "https://") && !strings.HasPrefix(specifier, "http://"):
+			return fmt.Errorf("entry %s must be an http or https URL, or one of the files", name)
+		}
+	}
+	return nil
+}
+
+// entryPoints are the entry points of a build of entries, in the order of
+// their names.
+func entryPoints(entries map[string]string) []api.EntryPoint {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	points := make([]api.EntryPoint, len(names))
+	for i, name := range names {
+		points[i] = api.EntryPoint{InputPath: entries[name], OutputPath: name}
+	}
+	return points
+}
+
+// isEntryOutput reports whether the output file named file is one of the
+// entries' outputs or their source maps, rather than a chunk.
+func isEntryOutput(entries map[string]string, file string) bool {
+	file = strings.TrimSuffix(file, ".map")
+	_, ok := entries[strings.TrimSuffix(file, path.Ext(file))]
+	return ok
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNegativeTTL = 30 * time.Second
+	// maxCachedFailures bounds the failures remembered at once.
+	maxCachedFailures = 10000
+)
+
+// statusError is a download answered with a status other than 200 OK.
+type statusError struct {
+	URL    string
+	Code   int
+	Status string
+}
+
+func (e *statusError) Error() string {
+	return "GET " + e.URL + ": " + e.Status
+}
+
+// permanentFailure reports whether retrying a failed download straight away
+// is pointless: the file is missing, or its host doesn't exist.
+func permanentFailure(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.Code == http.StatusNotFound || status.Code == http.StatusGone
+	}
+	var dns *net.DNSError
+	return errors.As(err, &dns) && !dns.IsTimeout && !dns.IsTemporary
+}
+
+// cachedFailure is a download failure being reused rather than retried.
+type cachedFailure struct {
+	message string
+	at      time.Time
+}
+
+func (e *cachedFailure) Error() string {
+	return fmt.Sprintf("%s (failed %s ago, not retried yet)", e.message, time.Since(e.at).Round(time.Second))
+}
+
+// failureCache remembers downloads that failed permanently, so a build
+// importing a missing module doesn't hit upstream every time it is retried.
+type failureCache struct {
+	mu       sync.Mutex
+	failures map[string]*cachedFailure
+}
+
+var failures = &failureCache{failures: make(map[string]*cachedFailure)}
+
+func negativeTTL() time.Duration {
+	if cfg.Cache.NegativeTTL != nil {
+		return time.Duration(*cfg.Cache.NegativeTTL)
+	}
+	return defaultNegativeTTL
+}
+
+// get returns the recent failure to download url, if there is one.
+func (c *failureCache) get(url string) (error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failure, ok := c.failures[url]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(failure.at) >= negativeTTL() {
+		delete(c.failures, url)
+		return nil, false
+	}
+	return failure, true
+}
+
+func (c *failureCache) put(url string, err error) {
+	if negativeTTL() <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.failures) >= maxCachedFailures {
+		for u, failure := range c.failures {
+			if time.Since(failure.at) >= negativeTTL() {
+				delete(c.failures, u)
+			}
+		}
+		if len(c.failures) >= maxCachedFailures {
+			return
+		}
+	}
+	c.failures[url] = &cachedFailure{message: err.Error(), at: time.Now()}
+}
+
+// purge forgets the failures of the URLs that match, returning how many.
+func (c *failureCache) purge(match func(url string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for url := range c.failures {
+		if match(url) {
+			delete(c.failures, url)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// Module federation lets bundles built and deployed independently share
+// code at runtime. A remote is a named bundle built with exposes, mapping
+// names like "./Button" to the modules it exposes. Its output is a small
+// remote entry whose get function imports an exposed module, each of which
+// code splitting puts in its own chunk. Libraries shared with the bundles
+// using the remote are kept as URL imports on both sides, through keepUrls,
+// so the browser loads them once.
+//
+// A build using remotes maps aliases to the manifests of remotes, served
+// at /bundles/<tenant>/<name>.federation.json. Importing "<alias>/Button"
+// loads the remote's current entry when the page runs, and so picks up the
+// versions the remote promotes after the build.
+
+// federationManifestSuffix ends the path of a named bundle's manifest.
+const federationManifestSuffix = ".federation.json"
+
+// federationManifest describes what a remote exposes.
+type federationManifest struct {
+	Name string `json:"name"`
+	// RemoteEntry is the stable URL of the remote, which always serves
+	// its current version.
+	RemoteEntry string `json:"remoteEntry"`
+	Version     string `json:"version"`
+	// Exposes lists the names each exposed module exports.
+	Exposes map[string][]string `json:"exposes"`
+	// Shared are the patterns of URLs the remote keeps as imports, which
+	// builds using it should keep too.
+	Shared []string `json:"shared,omitempty"`
+}
+
+var (
+	exposeName       = regexp.MustCompile(`^\.(/[\w.-]+)*$`)
+	remoteAlias      = regexp.MustCompile(`^(@[\w.-]+/)?[\w.-]+$`)
+	identifierExport = regexp.MustCompile(`^[A-Za-z_$][\w$]*$`)
+)
+
+// checkFederation validates a build's exposes and remotes. Builds exposing
+// modules split them into chunks.
+func checkFederation(req *buildRequest) error {
+	if len(req.Exposes) > 0 {
+		if req.Source != "" || req.Entry != "" || len(req.Files) > 0 {
+			return errors.New("a build exposing modules has no source or entry of its own")
+		}
+		if !req.Bundle || formatsByName[req.Format] != formatsByName["esm"] {
+			return errors.New("exposing modules needs a bundled build in the esm format")
+		}
+		for name, specifier := range req.Exposes {
+			if !exposeName.MatchString(name) {
+				return fmt.Errorf("exposed names must be like ./Button, not %q", name)
+			}
+			if specifier == "" {
+				return fmt.Errorf("%s exposes nothing", name)
+			}
+		}
+		req.Splitting = true
+	}
+	for alias, manifestURL := range req.Remotes {
+		if !remoteAlias.MatchString(alias) {
+			return fmt.Errorf("invalid remote alias %q", alias)
+		}
+		if !strings.HasPrefix(manifestURL, "https://") && !strings.HasPrefix(manifestURL, "http://") {
+			return fmt.Errorf("the manifest of remote %s must be an http or https URL", alias)
+		}
+	}
+	return nil
+}
+
+// federationEntry is the source of a remote entry exposing modules.
+func federationEntry(exposes map[string]string) string {
+	names := make([]string, 0, len(exposes))
+	for name := range exposes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("const modules = {\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s: () => import(%s),\n", jsString(name), jsString(exposes[name]))
+	}
+	b.WriteString("};\n")
+	b.WriteString("export const exposes = Object.keys(modules);\n")
+	b.WriteString("export function get(name) {\n")
+	b.WriteString("  const load = modules[name];\n")
+	b.WriteString("  return load ? load() : Promise.reject(new Error(\"this remote doesn't expose \" + name));\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// exposedExports returns the names each exposed module exports, found from
+// the chunk code splitting made of it.
+func exposedExports(exposes map[string]string, graph []importEdge, m *metafile) map[string][]string {
+	if m == nil {
+		return nil
+	}
+	byEntryPoint := make(map[string][]string)
+	for _, out := range m.Outputs {
+		if out.EntryPoint != "" {
+			byEntryPoint[out.EntryPoint] = out.Exports
+		}
+	}
+	exports := make(map[string][]string, len(exposes))
+	for name, specifier := range exposes {
+		exports[name] = []string{}
+		for _, edge := range graph {
+			if edge.Importer == "" && edge.Specifier == specifier && !edge.External {
+				if names, ok := byEntryPoint["http-url:"+edge.URL]; ok {
+					exports[name] = names
+				}
+			}
+		}
+	}
+	return exports
+}
+
+// splitRemoteImport returns the alias and exposed name of an import of a
+// remote, like "shop/Button", which imports "./Button" of the remote shop.
+func splitRemoteImport(remotes map[string]string, specifier string) (string, string, bool) {
+	for alias := range remotes {
+		switch {
+		case specifier == alias:
+			return alias, ".", true
+		case strings.HasPrefix(specifier, alias+"/"):
+			return alias, "." + strings.TrimPrefix(specifier, alias), true
+		}
+	}
+	return "", "", false
+}
+
+// remoteModule is the source of a module standing in for a module a remote
+// exposes. It imports the remote's entry when the page runs, then re-exports
+// what the manifest says the exposed module exports.
+func (p *httpPlugin) remoteModule(specifier string) (string, error) {
+	alias, name, _ := splitRemoteImport(p.remotes, specifier)
+	manifestURL := p.remotes[alias]
+	if err := p.checkUpstream(manifestURL); err != nil {
+		return "", err
+	}
+	mod, err := p.fetcher.fetch(manifestURL)
+	if err != nil {
+		return "", err
+	}
+	var manifest federationManifest
+	if err := json.Unmarshal([]byte(mod.Contents), &manifest); err != nil {
+		return "", fmt.Errorf("the manifest of remote %s is invalid: %w", alias, err)
+	}
+	exports, ok := manifest.Exposes[name]
+	if !ok {
+		return "", fmt.Errorf("remote %s doesn't expose %s", alias, name)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "import { get } from %s;\n", jsString(manifest.RemoteEntry))
+	fmt.Fprintf(&b, "const m = await get(%s);\n", jsString(name))
+	var named []string
+	for _, export := range exports {
+		switch {
+		case export == "default":
+			b.WriteString("export default m.default;\n")
+		case identifierExport.MatchString(export) && export != "m" && export != "get":
+			named = append(named, export)
+		}
+	}
+	if len(named) > 0 {
+		fmt.Fprintf(&b, "export const { %s } = m;\n", strings.Join(named, ", "))
+	}
+	return b.String(), nil
+}
+
+// federationPlugin resolves imports of remotes, leaving the remote entries
+// they load as imports in the output.
+func (p *httpPlugin) federationPlugin(build api.PluginBuild) {
+	if len(p.remotes) == 0 {
+		return
+	}
+	build.OnResolve(api.OnResolveOptions{Filter: `^[^./]`},
+		func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+			if args.Namespace == "federation" {
+				p.record(args, args.Path, true)
+				return api.OnResolveResult{Path: args.Path, External: true}, nil
+			}
+			if _, _, ok := splitRemoteImport(p.remotes, args.Path); !ok {
+				return api.OnResolveResult{}, nil
+			}
+			return api.OnResolveResult{Path: args.Path, Namespace: "federation"}, nil
+		})
+	build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: "federation"},
+		func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+			contents, err := p.remoteModule(args.Path)
+			if err != nil {
+				return api.OnLoadResult{}, err
+			}
+			return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+		})
+}
+
+// federationManifestFor returns the manifest of a named bundle's current
+// version, and false when it exposes nothing.
+func federationManifestFor(b namedBundle) (federationManifest, bool) {
+	for _, v := range b.Versions {
+		if v.ID == b.Current && v.Exposes != nil {
+			return federationManifest{
+				Name:        b.Name,
+				RemoteEntry: bundleURL(b.Tenant, b.Name),
+				Version:     v.ID,
+				Exposes:     v.Exposes,
+				Shared:      v.Shared,
+			}, true
+		}
+	}
+	return federationManifest{}, false
+}
+
+// serveFederationManifest serves the manifest of a remote's current version.
+// Builds using the remote download it, so it isn't restricted to the sites
+// allowed to embed the tenant's bundles. It holds only names and URLs, and
+// the remote entry it points at is still restricted.
+func serveFederationManifest(w http.ResponseWriter, r *http.Request) {
+	tenant, name, version, ok := parseBundlePath(strings.TrimSuffix(r.URL.Path, federationManifestSuffix) + ".js")
+	if !ok || version != "" {
+		http.NotFound(w, r)
+		return
+	}
+	b, err := bundles.get(tenant, name)
+	if err != nil || b.Quarantine != nil {
+		http.NotFound(w, r)
+		return
+	}
+	manifest, ok := federationManifestFor(b)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// Promoting a version changes the manifest, at which point edge caches
+	// are purged.
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	allowCrossOrigin(w, r, false)
+	writeJSON(w, http.StatusOK, manifest)
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// maxRedirects is how many redirects are followed before a download
+	// fails.
+	maxRedirects = 10
+	// maxDownloadBytes is the largest module downloaded, whatever a
+	// caller's limits allow, so a runaway response can't exhaust memory.
+	maxDownloadBytes = 64 << 20
+)
+
+// module is a remote file downloaded while building.
+type module struct {
+	// URL is the final location of the module after following redirects.
+	// Relative imports inside the module are resolved against it.
+	URL      string
+	Contents string
+	// SHA256 is the hex encoded hash of the contents.
+	SHA256 string
+
+	// Expires is when the module must be revalidated, following the
+	// upstream Cache-Control or Expires headers. ETag and LastModified
+	// let that revalidation skip downloading the module again.
+	Expires      time.Time
+	ETag         string
+	LastModified string
+	// StaleUntil is how long past Expires the module may still be used
+	// while it is revalidated in the background.
+	StaleUntil time.Time
+	// noStore is set when upstream asked for the module not to be cached.
+	noStore bool
+}
+
+type fetchEntry struct {
+	once sync.Once
+	mod  *module
+	err  error
+	// requested is set once the URL is fetched, rather than only being
+	// where another URL redirected to.
+	requested bool
+}
+
+// fetcher downloads the remote modules of a single build. Each URL is only
+// downloaded once, and a module can be looked up by either the URL that was
+// requested or the URL it was redirected to.
+type fetcher struct {
+	client *http.Client
+	// bypassCache ignores the module cache, though downloads still fill it.
+	bypassCache bool
+	// ctx cancels downloads, when the build is cancelled or past its
+	// deadline.
+	ctx context.Context
+	// maxModuleBytes and maxBuildBytes, when positive, cap the size of each
+	// module loaded and of every module loaded together. loadedBytes sums
+	// the modules loaded so far.
+	maxModuleBytes int64
+	maxBuildBytes  int64
+	loadedBytes    int64
+	// allowedHosts and blockedURLs limit where downloads may be
+	// redirected to, as they do what a build may import.
+	allowedHosts []string
+	blockedURLs  []string
+	// forCaller is set when f downloads for a caller, of tenant or
+	// anonymous when it is "", who may only download from hosts with
+	// credentials that allow it. See hostConfig.Tenants.
+	forCaller bool
+	tenant    string
+	// noStale waits for expired modules to be revalidated rather than
+	// using them while they are revalidated in the background.
+	noStale bool
+	// noMirror downloads modules that are mirrored too.
+	noMirror bool
+	// onModule, when set, is told of each module as it is loaded.
+	onModule func(moduleEvent)
+	// downloading is the nanoseconds spent downloading, summed over
+	// downloads running at the same time.
+	downloading int64
+	// throttled is the nanoseconds downloads spent waiting for bandwidth,
+	// see bandwidthConfig.
+	throttled int64
+
+	mu      sync.Mutex
+	entries map[string]*fetchEntry
+}
+
+func newFetcher() *fetcher {
+	f := &fetcher{
+		ctx:     context.Background(),
+		entries: make(map[string]*fetchEntry),
+	}
+	f.client = &http.Client{
+		Transport: credentialsTransport{upstreamTransport},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if err := f.checkCredentials(req.URL.String()); err != nil {
+				return err
+			}
+			return checkUpstream(f.allowedHosts, f.blockedURLs, req.URL.String())
+		},
+	}
+	return f
+}
+
+// forTenant makes f download for a caller of tenant, nil when anonymous.
+func (f *fetcher) forTenant(tenant *tenantConfig) {
+	f.forCaller, f.tenant = true, ""
+	if tenant != nil {
+		f.tenant = tenant.Name
+	}
+}
+
+// checkCredentials returns an error when rawURL is on a host with
+// credentials the caller f downloads for may not use. Modules downloaded
+// with them are cached for everyone, so this is checked before the cache.
+func (f *fetcher) checkCredentials(rawURL string) error {
+	if !f.forCaller {
+		return nil
+	}
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	host, ok := hostConfigFor(u)
+	if !ok || host.allows(f.tenant) {
+		return nil
+	}
+	return &hostNotAllowedError{URL: rawURL}
+}
+
+// allows reports whether callers of tenant, "" when anonymous, may
+// download from the host.
+func (h hostConfig) allows(tenant string) bool {
+	if h.BearerToken == "" && h.Username == "" && len(h.Headers) == 0 {
+		return true
+	}
+	if tenant == "" {
+		return false
+	}
+	if len(h.Tenants) == 0 {
+		return true
+	}
+	for _, t := range h.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// limit applies the caller's limits to what f downloads.
+func (f *fetcher) limit(limits limitsConfig) {
+	f.maxModuleBytes, f.maxBuildBytes = limits.MaxModuleBytes, limits.MaxBuildBytes
+	f.allowedHosts, f.blockedURLs = limits.AllowedHosts, limits.BlockedURLs
+}
+
+func (f *fetcher) entry(url string, requested bool) *fetchEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[url]
+	if !ok {
+		e = &fetchEntry{}
+		f.entries[url] = e
+	}
+	e.requested = e.requested || requested
+	return e
+}
+
+// canonicalURL removes the fragment from rawURL, as fragments are never
+// sent to servers, so "mod.js#a" and "mod.js#b" are the same module. Query
+// strings are kept: CDNs like esm.sh and Skypack use flags such as "?module"
+// or "?bundle=false" to serve different files from the same path.
+func canonicalURL(rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// fetch downloads url, or returns the module downloaded earlier in this build
+// or found in the module cache. Cached modules past their expiry are
+// revalidated with a conditional request, in the background while they are
+// still allowed to be used stale. Offline, nothing is downloaded; see
+// offlineModule.
+func (f *fetcher) fetch(url string) (*module, error) {
+	url = canonicalURL(url)
+	if err := f.checkCredentials(url); err != nil {
+		return nil, err
+	}
+	if err := checkUpstream(f.allowedHosts, f.blockedURLs, url); err != nil {
+		return nil, err
+	}
+	e := f.entry(url, true)
+	e.once.Do(func() {
+		var cached *module
+		if !f.bypassCache || cfg.Offline.Enabled {
+			cached, _ = modulesCache.get(url)
+		}
+		now := time.Now()
+		defer func() {
+			if e.err == nil && f.onModule != nil {
+				f.onModule(moduleEvent{URL: e.mod.URL, Bytes: len(e.mod.Contents), Cached: e.mod == cached})
+			}
+		}()
+		switch {
+		case cached != nil && now.Before(cached.Expires):
+			e.mod = cached
+		case cfg.Offline.Enabled:
+			e.mod, e.err = offlineModule(url, cached)
+		case cached != nil && now.Before(cached.StaleUntil) && !f.noStale:
+			e.mod = cached
+			go revalidate(url, cached)
+		default:
+			e.mod, e.err = f.sharedDownload(url, cached)
+			if e.err == nil {
+				storeDownload(url, cached, e.mod)
+			}
+		}
+		if e.err == nil {
+			if e.err = f.checkSize(url, e.mod); e.err != nil {
+				e.mod = nil
+			}
+		}
+		if e.err == nil && e.mod.URL != url {
+			// Remember the module under its final URL too, so loading the
+			// resolved path doesn't download it a second time.
+			final := f.entry(e.mod.URL, false)
+			final.once.Do(func() { final.mod = e.mod })
+		}
+	})
+	return e.mod, e.err
+}
+
+// checkSize returns an error when mod, loaded from url, takes the build
+// past its size limits.
+func (f *fetcher) checkSize(url string, mod *module) error {
+	size := int64(len(mod.Contents))
+	if f.maxModuleBytes > 0 && size > f.maxModuleBytes {
+		return &moduleSizeError{URL: url, Max: f.maxModuleBytes}
+	}
+	if total := atomic.AddInt64(&f.loadedBytes, size); f.maxBuildBytes > 0 && total > f.maxBuildBytes {
+		return &buildSizeError{Max: f.maxBuildBytes}
+	}
+	return nil
+}
+
+// maxDownload is the most read of a module before it is refused, which is
+// the caller's limit when it has a smaller one than everyone's.
+func (f *fetcher) maxDownload() int64 {
+	if f.maxModuleBytes > 0 && f.maxModuleBytes < maxDownloadBytes {
+		return f.maxModuleBytes
+	}
+	return maxDownloadBytes
+}
+
+// moduleSizeError is a module larger than the caller's limits allow.
+type moduleSizeError struct {
+	URL string
+	Max int64
+}
+
+func (e *moduleSizeError) Error() string {
+	return fmt.Sprintf("%s is larger than the %d bytes a module may be", e.URL, e.Max)
+}
+
+// buildSizeError is a build whose modules together are larger than the
+// caller's limits allow.
+type buildSizeError struct {
+	Max int64
+}
+
+func (e *buildSizeError) Error() string {
+	return fmt.Sprintf("the modules a build imports may be at most %d bytes together", e.Max)
+}
+
+// outputSizeError is a build whose output is larger than the caller's
+// limits allow.
+type outputSizeError struct {
+	Bytes int
+	Max   int64
+}
+
+func (e *outputSizeError) Error() string {
+	return fmt.Sprintf("the build's output is %d bytes, more than the %d bytes it may be", e.Bytes, e.Max)
+}
+
+// revalidate refreshes a module that is being used stale.
+func revalidate(url string, stale *module) {
+	mod, err := newFetcher().sharedDownload(url, stale)
+	if err != nil {
+		log.Printf("revalidating %s: %v", url, err)
+		return
+	}
+	storeDownload(url, stale, mod)
+}
+
+// storeDownload caches a module downloaded from url, replacing cached.
+func storeDownload(url string, cached, mod *module) {
+	if cached != nil && mod.SHA256 != cached.SHA256 {
+		// The module changed upstream, so builds that included the old
+		// contents are outdated.
+		sharedCache.invalidateDependents(cached.URL)
+	}
+	if mod.noStore {
+		return
+	}
+	modulesCache.put(url, mod)
+	if mod.URL != url {
+		modulesCache.put(mod.URL, mod)
+	}
+}
+
+// pinned reports whether every URL requested so far was pinned, or matched
+// an immutable TTL rule, so the same requests will always get the same
+// modules.
+func (f *fetcher) pinned() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for url, e := range f.entries {
+		if e.requested && !pinnedURL(url) && !cfg.Cache.immutableURL(url) {
+			return false
+		}
+	}
+	return true
+}
+
+// modules returns every module downloaded so far, ordered by URL.
+func (f *fetcher) modules() []*module {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := make(map[*module]bool)
+	var mods []*module
+	for _, e := range f.entries {
+		if e.mod != nil && !seen[e.mod] {
+			seen[e.mod] = true
+			mods = append(mods, e.mod)
+		}
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		return mods[i].URL < mods[j].URL
+	})
+	return mods
+}
+
+// downloads coalesces downloads of the same URL by concurrent builds.
+var downloads singleflight.Group
+
+// sharedDownload downloads url, or waits for another build that is already
+// downloading it.
+func (f *fetcher) sharedDownload(url string, stale *module) (*module, error) {
+	key := url
+	if max := f.maxDownload(); max < maxDownloadBytes {
+		// Downloads stop at the caller's limit, so are only shared with
+		// callers with the same limit.
+		key += " " + strconv.FormatInt(max, 10)
+	}
+	for {
+		led := false
+		v, err, _ := downloads.Do(key, func() (interface{}, error) {
+			led = true
+			return f.download(url, stale)
+		})
+		if err != nil && !led && contextEnded(err) && f.ctx.Err() == nil {
+			// The build downloading it was cancelled or timed out rather
+			// than this one, so this one downloads it instead.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return v.(*module), nil
+	}
+}
+
+// download fetches url, trying mirrors when it fails, unless conifer's own
+// mirror has a copy. When a stale copy is given, the request is made
+// conditional on it having changed. When every attempt failed permanently,
+// the failure is reused for a while rather than trying again.
+func (f *fetcher) download(url string, stale *module) (*module, error) {
+	start := time.Now()
+	defer func() { atomic.AddInt64(&f.downloading, int64(time.Since(start))) }()
+	if !f.noMirror {
+		if mod, ok := hostedMirror.get(url); ok {
+			return mod, nil
+		}
+	}
+	if err, ok := failures.get(url); ok {
+		return nil, err
+	}
+	urls, timeout := mirrorsFor(url)
+	var errs []string
+	var err error
+	permanent := true
+	for _, u := range urls {
+		var mod *module
+		mod, err = f.get(u, timeout, stale)
+		if err == nil {
+			return mod, nil
+		}
+		permanent = permanent && permanentFailure(err)
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 1 {
+		// Every attempt is reported, wrapping the last so the kind of
+		// failure can still be told.
+		err = fmt.Errorf("%s; %w", strings.Join(errs[:len(errs)-1], "; "), err)
+	}
+	if permanent {
+		failures.put(url, err)
+	}
+	return nil, err
+}
+
+func (f *fetcher) get(url string, timeout time.Duration, stale *module) (*module, error) {
+	ctx := f.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if stale != nil {
+		if stale.ETag != "" {
+			req.Header.Set("If-None-Match", stale.ETag)
+		}
+		if stale.LastModified != "" {
+			req.Header.Set("If-Modified-Since", stale.LastModified)
+		}
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && stale != nil {
+		revalidated := *stale
+		revalidated.Expires, revalidated.StaleUntil, revalidated.noStore = expiry(url, res.Header, time.Now())
+		if etag := res.Header.Get("ETag"); etag != "" {
+			revalidated.ETag = etag
+		}
+		return &revalidated, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{URL: url, Code: res.StatusCode, Status: res.Status}
+	}
+	max := f.maxDownload()
+	if res.ContentLength > max {
+		return nil, &moduleSizeError{URL: url, Max: max}
+	}
+	bytes, err := io.ReadAll(io.LimitReader(throttle(ctx, res.Request.URL, res.Body, &f.throttled), max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(bytes)) > max {
+		// The module is refused, so isn't cached either.
+		return nil, &moduleSizeError{URL: url, Max: max}
+	}
+	sum := sha256.Sum256(bytes)
+	mod := &module{
+		URL:          canonicalURL(res.Request.URL.String()),
+		Contents:     string(bytes),
+		SHA256:       hex.EncodeToString(sum[:]),
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}
+	mod.Expires, mod.StaleUntil, mod.noStore = expiry(url, res.Header, time.Now())
+	return mod, nil
+}
+
+// expiresFrom works out until when a response may be reused without
+// revalidating it, from its Cache-Control or Expires header. Without either
+// the cache's configured TTL is used. It also reports whether the response
+// must not be cached at all.
+func expiresFrom(h http.Header, now time.Time) (time.Time, bool) {
+	maxAge, sharedMaxAge := -1, -1
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], strings.Trim(name[i+1:], `"`)
+		}
+		switch strings.ToLower(name) {
+		case "no-store":
+			return now, true
+		case "no-cache":
+			maxAge = 0
+		case "max-age":
+			if n, err := strconv.Atoi(value); err == nil && maxAge != 0 {
+				maxAge = n
+			}
+		case "s-maxage":
+			// conifer is a shared cache, so this takes precedence.
+			if n, err := strconv.Atoi(value); err == nil {
+				sharedMaxAge = n
+			}
+		}
+	}
+	if sharedMaxAge >= 0 && maxAge != 0 {
+		maxAge = sharedMaxAge
+	}
+	if maxAge >= 0 {
+		return now.Add(time.Duration(maxAge) * time.Second), false
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		return expires, false
+	}
+	ttl := time.Duration(cfg.Cache.TTL)
+	if ttl == 0 {
+		ttl = defaultCacheTTL
+	}
+	return now.Add(ttl), false
+}
+
+// staleWindow works out how long past its expiry a response may be used
+// while it is revalidated, from the stale-while-revalidate directive of its
+// Cache-Control header, or else the configured default. Responses that must
+// be revalidated before every use are never used stale.
+func staleWindow(h http.Header) time.Duration {
+	window := time.Duration(-1)
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], strings.Trim(name[i+1:], `"`)
+		}
+		switch strings.ToLower(name) {
+		case "no-cache", "must-revalidate", "proxy-revalidate":
+			return 0
+		case "stale-while-revalidate":
+			if n, err := strconv.Atoi(value); err == nil {
+				window = time.Duration(n) * time.Second
+			}
+		}
+	}
+	if window >= 0 {
+		return window
+	}
+	if cfg.Cache.StaleWhileRevalidate != nil {
+		return time.Duration(*cfg.Cache.StaleWhileRevalidate)
+	}
+	return defaultStaleWindow
+}
+
+// mirrorsFor returns the URLs to try when downloading url: url itself,
+// followed by the equivalent URL on each configured mirror.
+func mirrorsFor(url string) ([]string, time.Duration) {
+	for _, mirror := range cfg.Mirrors {
+		for _, prefix := range mirror.Prefixes {
+			if !strings.HasPrefix(url, prefix) {
+				continue
+			}
+			path := strings.TrimPrefix(url, prefix)
+			urls := []string{url}
+			for _, other := range mirror.Prefixes {
+				if other != prefix {
+					urls = append(urls, other+path)
+				}
+			}
+			return urls, time.Duration(mirror.Timeout)
+		}
+	}
+	return []string{url}, 0
+}
+
+// credentialsTransport adds the configured credentials for each host to
+// requests. Applying them per request rather than up front means a redirect
+// to another host never carries the first host's credentials. Callers who
+// may not use a host's credentials are refused before any request is made,
+// see fetcher.checkCredentials.
+type credentialsTransport struct {
+	base http.RoundTripper
+}
+
+// hostConfigFor returns the config of the host u is on, looked up with its
+// port and then without.
+func hostConfigFor(u *neturl.URL) (hostConfig, bool) {
+	host, ok := cfg.Hosts[u.Host]
+	if !ok {
+		host, ok = cfg.Hosts[u.Hostname()]
+	}
+	return host, ok
+}
+
+func (t credentialsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host, ok := hostConfigFor(req.URL)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	for name, value := range host.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+	if host.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+os.ExpandEnv(host.BearerToken))
+	} else if host.Username != "" {
+		req.SetBasicAuth(os.ExpandEnv(host.Username), os.ExpandEnv(host.Password))
+	}
+	return t.base.RoundTrip(req)
+}
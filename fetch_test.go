@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// A module larger than the caller may load is refused without being read
+// whole, or cached for callers allowed it.
+func TestFetchRefusesModulesOverCallersLimit(t *testing.T) {
+	var served int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		// Without a Content-Length, so only reading tells its size.
+		w.(http.Flusher).Flush()
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	saved := cfg.Hosts
+	defer func() { cfg.Hosts = saved }()
+	cfg.Hosts = map[string]hostConfig{host: {Private: true}}
+	url := srv.URL + "/big.js"
+
+	f := newFetcher()
+	f.maxModuleBytes = 10
+	_, err := f.fetch(url)
+	var tooLarge *moduleSizeError
+	if !errors.As(err, &tooLarge) || tooLarge.Max != 10 {
+		t.Fatalf("fetch = %v, want a module size error at 10 bytes", err)
+	}
+	if _, ok := modulesCache.get(canonicalURL(url)); ok {
+		t.Error("the refused module was cached")
+	}
+
+	mod, err := newFetcher().fetch(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mod.Contents) != 100 || atomic.LoadInt32(&served) != 2 {
+		t.Errorf("got %d bytes from %d downloads, want 100 bytes from 2", len(mod.Contents), atomic.LoadInt32(&served))
+	}
+}
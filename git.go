@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+const (
+	// maxGitArchiveBytes limits the repository archives downloaded for git
+	// builds, and maxGitSourceBytes the files kept from them.
+	maxGitArchiveBytes = 100 << 20
+	maxGitSourceBytes  = 50 << 20
+	// gitRefTTL is how long a branch or tag is taken to point at the same
+	// commit before asking GitHub again.
+	gitRefTTL = time.Minute
+)
+
+// gitSource is a commit of a GitHub repository whose files are built.
+type gitSource struct {
+	// Repo is like "github.com/owner/repo".
+	Repo string `json:"repo"`
+	// Commit is the full hash of the commit, so builds of it are cached by
+	// it.
+	Commit string `json:"commit"`
+}
+
+var (
+	githubRepo     = regexp.MustCompile(`^(?:(?:https?://)?github\.com/)?([\w.-]+)/([\w.-]+?)(?:\.git)?/?$`)
+	fullCommitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// parseGitRepo returns the owner and name of a GitHub repository written as
+// a URL like "https://github.com/owner/repo.git", "github.com/owner/repo" or
+// just "owner/repo".
+func parseGitRepo(repo string) (string, string, bool) {
+	m := githubRepo.FindStringSubmatch(repo)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+type resolvedRef struct {
+	commit  string
+	expires time.Time
+}
+
+// gitRefs remembers the commits branches and tags pointed at recently.
+var gitRefs = struct {
+	sync.Mutex
+	m map[string]resolvedRef
+}{m: make(map[string]resolvedRef)}
+
+// resolveGitRef returns the commit ref points at, asking GitHub unless ref
+// is already a full commit hash.
+func resolveGitRef(f *fetcher, limits limitsConfig, owner, repo, ref string) (string, error) {
+	if fullCommitHash.MatchString(ref) {
+		return ref, nil
+	}
+	// The ref may be resolved with a tenant's credentials for a private
+	// repository, so isn't shared with other tenants.
+	key := f.tenant + " " + owner + "/" + repo + "@" + ref
+	gitRefs.Lock()
+	resolved, ok := gitRefs.m[key]
+	gitRefs.Unlock()
+	if ok && time.Now().Before(resolved.expires) {
+		return resolved.commit, nil
+	}
+
+	if ref == "" {
+		ref = "HEAD"
+	}
+	commitURL := "https://api.github.com/repos/" + owner + "/" + repo + "/commits/" + url.PathEscape(ref)
+	if err := limits.checkUpstream(commitURL); err != nil {
+		return "", err
+	}
+	body, err := mirroredGet(f, commitURL, "application/vnd.github.sha", 1<<10)
+	if err != nil {
+		return "", err
+	}
+	commit := strings.TrimSpace(string(body))
+	if !fullCommitHash.MatchString(commit) {
+		return "", fmt.Errorf("GitHub resolved %s/%s@%s to %q, which isn't a commit", owner, repo, ref, commit)
+	}
+	gitRefs.Lock()
+	gitRefs.m[key] = resolvedRef{commit: commit, expires: time.Now().Add(gitRefTTL)}
+	gitRefs.Unlock()
+	return commit, nil
+}
+
+// files downloads the commit's archive and returns the files in it a build
+// can load, keyed by their paths in the repository.
+func (g gitSource) files(f *fetcher, limits limitsConfig) (map[string]string, error) {
+	owner, repo, ok := parseGitRepo(g.Repo)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a GitHub repository", g.Repo)
+	}
+	archiveURL := "https://codeload.github.com/" + owner + "/" + repo + "/tar.gz/" + g.Commit
+	if err := limits.checkUpstream(archiveURL); err != nil {
+		return nil, err
+	}
+	data, err := mirroredGet(f, archiveURL, "", maxGitArchiveBytes)
+	if err != nil {
+		return nil, err
+	}
+	return unpackArchive("application/gzip", data, maxGitSourceBytes)
+}
+
+// mirroredGet downloads url, or its equivalent on a configured mirror,
+// with the credentials configured for its host. Unlike modules, what it
+// downloads isn't kept in the module cache.
+func mirroredGet(f *fetcher, rawURL, accept string, maxBytes int64) ([]byte, error) {
+	if err := f.checkCredentials(rawURL); err != nil {
+		return nil, err
+	}
+	if err := checkUpstream(f.allowedHosts, f.blockedURLs, rawURL); err != nil {
+		return nil, err
+	}
+	urls, timeout := mirrorsFor(rawURL)
+	var err error
+	for _, u := range urls {
+		var data []byte
+		if data, err = mirroredGetOnce(f, u, accept, maxBytes, timeout); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func mirroredGetOnce(f *fetcher, rawURL, accept string, maxBytes int64, timeout time.Duration) ([]byte, error) {
+	ctx := f.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{URL: rawURL, Code: res.StatusCode, Status: res.Status}
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("%s is larger than %d bytes", rawURL, maxBytes)
+	}
+	return data, nil
+}
+
+// handleGit builds a file of a GitHub repository along with the files it
+// imports from the repository, with the same options as /v1/build:
+//
+//	GET /v1/git?repo=github.com/owner/repo&ref=main&entry=src/index.ts
+//
+// The ref, a branch, tag or commit, defaults to the default branch, and the
+// entry to an index file at the root. Builds are cached by the commit the
+// ref points at, which X-Conifer-Commit reports.
+func handleGit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	owner, repo, ok := parseGitRepo(q.Get("repo"))
+	if !ok {
+		http.Error(w, "repo must be a GitHub repository like github.com/owner/repo", http.StatusBadRequest)
+		return
+	}
+	req, err := parseBuildRequest(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !req.Bundle {
+		http.Error(w, "repositories can only be bundled", http.StatusBadRequest)
+		return
+	}
+	if entry := q.Get("entry"); entry != "" {
+		req.Entry = path.Clean("/" + entry)
+	}
+	if !authorizeBuild(w, r, &req) {
+		return
+	}
+
+	limits := req.limits()
+	f := newFetcher()
+	f.ctx = r.Context()
+	f.limit(limits)
+	f.forTenant(tenantNamed(req.Tenant))
+	commit, err := resolveGitRef(f, limits, owner, repo, q.Get("ref"))
+	if err != nil {
+		writeBuildErrors(w, []api.Message{{Text: err.Error(), Detail: err}}, nil)
+		return
+	}
+	req.Git = &gitSource{Repo: "github.com/" + owner + "/" + repo, Commit: commit}
+	w.Header().Set("X-Conifer-Commit", commit)
+
+	result, ok := runRecordedBuild(w, req)
+	if !ok {
+		return
+	}
+	w.Header().Set("X-Conifer-Engine", "esbuild/"+engine.Esbuild)
+	writeJavaScript(w, r, result.Code, buildCacheControl(req, result))
+}
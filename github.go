@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// githubGlob is a set of files in a GitHub repository directory, written as
+// "gh:owner/repo@ref/dir/*.js" or as a tree URL like
+// "https://github.com/owner/repo/tree/ref/dir". The ref may be left out to
+// use the default branch, and the file name pattern defaults to every
+// module in the directory.
+type githubGlob struct {
+	Owner, Repo, Ref, Dir, Pattern string
+}
+
+var (
+	githubShorthand = regexp.MustCompile(`^gh:([\w.-]+)/([\w.-]+?)(?:@([^/]+))?(?:/(.*))?$`)
+	githubTreeURL   = regexp.MustCompile(`^https://github\.com/([\w.-]+)/([\w.-]+)/tree/([^/]+)(?:/(.*))?$`)
+)
+
+// githubGlobFilter matches the imports parseGitHubGlob understands.
+const githubGlobFilter = `^(gh:|https://github\.com/[^/]+/[^/]+/tree/)`
+
+func parseGitHubGlob(spec string) (githubGlob, bool) {
+	m := githubShorthand.FindStringSubmatch(spec)
+	if m == nil {
+		m = githubTreeURL.FindStringSubmatch(spec)
+	}
+	if m == nil {
+		return githubGlob{}, false
+	}
+	g := githubGlob{Owner: m[1], Repo: m[2], Ref: m[3], Dir: strings.Trim(m[4], "/"), Pattern: "*"}
+	if base := path.Base(g.Dir); strings.Contains(base, "*") {
+		g.Pattern = base
+		g.Dir = strings.TrimSuffix(strings.TrimSuffix(g.Dir, base), "/")
+	}
+	return g, true
+}
+
+// githubContent is an entry of the GitHub contents API's directory listing.
+type githubContent struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+}
+
+// expand lists the directory through the GitHub API and returns a module
+// re-exporting every matching file, saving repositories from maintaining
+// barrel files. Requests to api.github.com get credentials from the hosts
+// config like any other download, which raises GitHub's rate limit.
+func (g githubGlob) expand(f *fetcher) (string, error) {
+	listURL := "https://api.github.com/repos/" + g.Owner + "/" + g.Repo + "/contents/" + g.Dir
+	if g.Ref != "" {
+		listURL += "?ref=" + url.QueryEscape(g.Ref)
+	}
+	listing, err := f.fetch(listURL)
+	if err != nil {
+		return "", err
+	}
+	var entries []githubContent
+	if err := json.Unmarshal([]byte(listing.Contents), &entries); err != nil {
+		return "", fmt.Errorf("listing %s/%s/%s: %w", g.Owner, g.Repo, g.Dir, err)
+	}
+
+	ref := g.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	var lines []string
+	for _, entry := range entries {
+		if entry.Type != "file" || !matchWildcard(g.Pattern, entry.Name) || !isScriptModule(entry.Name) {
+			continue
+		}
+		rawURL := "https://raw.githubusercontent.com/" + g.Owner + "/" + g.Repo + "/" + ref + "/" + entry.Path
+		lines = append(lines, "export * from "+strconv.Quote(rawURL)+";")
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("no modules in %s/%s/%s match %q", g.Owner, g.Repo, g.Dir, g.Pattern)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// isScriptModule reports whether name is a JavaScript or TypeScript file
+// worth re-exporting, which excludes type declarations.
+func isScriptModule(name string) bool {
+	switch loadersByExtension[path.Ext(name)] {
+	case api.LoaderJS, api.LoaderJSX, api.LoaderTS, api.LoaderTSX:
+		return !strings.HasSuffix(name, ".d.ts")
+	}
+	return false
+}
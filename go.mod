@@ -3,6 +3,14 @@ module github.com/JavaScriptRegenerated/conifer
 go 1.17
 
 require (
-	github.com/evanw/esbuild v0.13.7 // indirect
-	golang.org/x/sys v0.0.0-20210908233432-aa78b53d3365 // indirect
+	github.com/evanw/esbuild v0.14.54
+	github.com/go-redis/redis/v8 v8.11.5
+	go.starlark.net v0.0.0-20220714194419-4cadf0a12139
+	golang.org/x/sync v0.1.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 )
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// importEdge is one import resolved while building.
+type importEdge struct {
+	// Importer is the URL of the importing module, or "" for the entry
+	// source.
+	Importer  string `json:"importer"`
+	Specifier string `json:"specifier"`
+	URL       string `json:"url"`
+	External  bool   `json:"external,omitempty"`
+}
+
+// importGraph collects the imports resolved during a build.
+type importGraph struct {
+	mu    sync.Mutex
+	edges []importEdge
+}
+
+func (g *importGraph) add(edge importEdge) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.edges = append(g.edges, edge)
+}
+
+// reset forgets every edge, for a build resolving everything again.
+func (g *importGraph) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.edges = nil
+}
+
+// sortedEdges returns the edges in a stable order, as esbuild resolves
+// imports concurrently.
+func (g *importGraph) sortedEdges() []importEdge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	edges := append([]importEdge(nil), g.edges...)
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Importer != edges[j].Importer {
+			return edges[i].Importer < edges[j].Importer
+		}
+		return edges[i].Specifier < edges[j].Specifier
+	})
+	return edges
+}
+
+// graphNode is a module in a dependency graph.
+type graphNode struct {
+	URL    string `json:"url"`
+	Bytes  int    `json:"bytes,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// External modules are left as imports, so weren't downloaded.
+	External bool `json:"external,omitempty"`
+}
+
+// dependencyGraph is every module a source pulls in and the imports
+// between them. Edges from the source itself have no importer.
+type dependencyGraph struct {
+	Nodes []graphNode  `json:"nodes"`
+	Edges []importEdge `json:"edges"`
+}
+
+// handleGraph resolves the imports of a source, and of everything they
+// import, returning the modules and imports as JSON rather than a bundle,
+// so what a source would pull in can be audited before building it.
+func handleGraph(w http.ResponseWriter, r *http.Request) {
+	source, ok := requestSource(w, r)
+	if !ok {
+		return
+	}
+	req, err := parseBuildRequest(r, source)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveGraph(w, r, req)
+}
+
+// serveGraph resolves the graph of a parsed build.
+func serveGraph(w http.ResponseWriter, r *http.Request, req buildRequest) {
+	// As with vendoring, bundling is how the graph gets resolved.
+	req.Bundle = true
+	if !authorizeBuild(w, r, &req) {
+		return
+	}
+
+	if underPressure() {
+		writeOverloaded(w)
+		return
+	}
+	result := runBuild(req)
+	if len(result.Errors) > 0 {
+		writeBuildErrors(w, result.Errors, result.Warnings)
+		return
+	}
+
+	graph := dependencyGraph{Nodes: []graphNode{}, Edges: result.Graph}
+	if graph.Edges == nil {
+		graph.Edges = []importEdge{}
+	}
+	seen := make(map[string]bool)
+	for _, mod := range result.Modules {
+		seen[mod.URL] = true
+		graph.Nodes = append(graph.Nodes, graphNode{URL: mod.URL, Bytes: len(mod.Contents), SHA256: mod.SHA256})
+	}
+	for _, edge := range result.Graph {
+		if edge.External && !seen[edge.URL] {
+			seen[edge.URL] = true
+			graph.Nodes = append(graph.Nodes, graphNode{URL: edge.URL, External: true})
+		}
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].URL < graph.Nodes[j].URL })
+	writeJSON(w, http.StatusOK, graph)
+}
@@ -0,0 +1,108 @@
+package main
+
+import "sync"
+
+// Default limits of the hot module cache.
+const (
+	defaultHotModuleBytes = 16 << 10
+	defaultHotMinHits     = 3
+	defaultHotBytes       = 32 << 20
+)
+
+// hotCacheConfig keeps only small modules that are used often in memory,
+// leaving the rest to the disk cache. Zero values use the defaults.
+type hotCacheConfig struct {
+	// MaxModuleBytes is the largest module kept, 16KB by default.
+	MaxModuleBytes int `json:"maxModuleBytes"`
+	// MinHits is how many times a module must be looked up before it is
+	// kept, 3 by default.
+	MinHits int `json:"minHits"`
+	// MaxEntries and MaxBytes limit the tier as a whole. MaxBytes is 32MB
+	// by default.
+	MaxEntries int   `json:"maxEntries"`
+	MaxBytes   int64 `json:"maxBytes"`
+}
+
+// hotCache is the in-memory tier of a cache for instances with little
+// memory to spare. Most modules are only looked up once or twice, by
+// builds of one package, while a few small ones, like the helpers every
+// package imports, are looked up by nearly every build. Keeping only those
+// in memory saves reading them from disk for most builds, in a fraction of
+// the memory of keeping every module.
+type hotCache struct {
+	*memoryCache
+	maxModuleBytes int
+	minHits        int
+
+	mu sync.Mutex
+	// lookups counts the lookups of each URL recently, halved whenever it
+	// grows past maxLookups, so modules that stop being used cool down.
+	lookups    map[string]int
+	maxLookups int
+}
+
+func newHotCache(c hotCacheConfig) *hotCache {
+	h := &hotCache{
+		memoryCache:    newMemoryCache(cacheConfig{MaxEntries: c.MaxEntries, MaxBytes: c.MaxBytes}),
+		maxModuleBytes: c.MaxModuleBytes,
+		minHits:        c.MinHits,
+		lookups:        make(map[string]int),
+	}
+	if c.MaxBytes == 0 {
+		h.memoryCache.maxBytes = defaultHotBytes
+	}
+	if h.maxModuleBytes == 0 {
+		h.maxModuleBytes = defaultHotModuleBytes
+	}
+	if h.minHits == 0 {
+		h.minHits = defaultHotMinHits
+	}
+	h.maxLookups = 4 * h.memoryCache.maxEntries
+	return h
+}
+
+func (h *hotCache) get(url string) (*module, bool) {
+	h.mu.Lock()
+	h.lookups[url]++
+	if len(h.lookups) > h.maxLookups {
+		for u, n := range h.lookups {
+			if n /= 2; n == 0 {
+				delete(h.lookups, u)
+			} else {
+				h.lookups[u] = n
+			}
+		}
+	}
+	h.mu.Unlock()
+	return h.memoryCache.get(url)
+}
+
+// markHot lets the module at url be kept the next time it is put, as it
+// was hot before a restart.
+func (h *hotCache) markHot(url string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lookups[url] < h.minHits {
+		h.lookups[url] = h.minHits
+	}
+}
+
+// put keeps a module when it is small and has been looked up often enough,
+// which the layered cache does when it finds it in a slower tier.
+func (h *hotCache) put(url string, mod *module) {
+	h.mu.Lock()
+	hot := h.lookups[url] >= h.minHits
+	h.mu.Unlock()
+	if !hot || len(mod.Contents) > h.maxModuleBytes {
+		// A module that outgrew the tier mustn't be served as it was.
+		h.memoryCache.delete(url)
+		return
+	}
+	h.memoryCache.put(url, mod)
+}
+
+func (h *hotCache) stats() []cacheStats {
+	s := h.memoryCache.stats()
+	s[0].Layer = "hot"
+	return s
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	htmlComment    = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlScript     = regexp.MustCompile(`(?is)<script\b([^>]*)>(.*?)</script\s*>`)
+	htmlLink       = regexp.MustCompile(`(?is)<link\b([^>]*?)/?>`)
+	htmlAttributes = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+))?`)
+)
+
+// htmlAttribute is an attribute of a tag, with its value as written.
+type htmlAttribute struct {
+	name, raw string
+}
+
+func parseAttributes(s string) []htmlAttribute {
+	var attrs []htmlAttribute
+	for _, m := range htmlAttributes.FindAllStringSubmatch(s, -1) {
+		attrs = append(attrs, htmlAttribute{name: strings.ToLower(m[1]), raw: m[0]})
+	}
+	return attrs
+}
+
+// attribute returns the unescaped value of the attribute called name.
+func attribute(attrs []htmlAttribute, name string) (string, bool) {
+	for _, a := range attrs {
+		if a.name != name {
+			continue
+		}
+		value := ""
+		if i := strings.IndexByte(a.raw, '='); i >= 0 {
+			value = strings.Trim(strings.TrimSpace(a.raw[i+1:]), `"'`)
+		}
+		return html.UnescapeString(value), true
+	}
+	return "", false
+}
+
+// setAttribute replaces the attribute called name, or adds it.
+func setAttribute(attrs []htmlAttribute, name, value string) []htmlAttribute {
+	raw := name + `="` + html.EscapeString(value) + `"`
+	for i, a := range attrs {
+		if a.name == name {
+			attrs[i].raw = raw
+			return attrs
+		}
+	}
+	return append(attrs, htmlAttribute{name: name, raw: raw})
+}
+
+func writeTag(b *strings.Builder, tag string, attrs []htmlAttribute) {
+	b.WriteString("<" + tag)
+	for _, a := range attrs {
+		b.WriteString(" " + a.raw)
+	}
+	b.WriteString(">")
+}
+
+// pageAsset is a module script or stylesheet of a page, which is built and
+// replaced by a tag loading the output.
+type pageAsset struct {
+	start, end int
+	stylesheet bool
+	attrs      []htmlAttribute
+	// src is the URL the asset is loaded from, or "" for inline scripts,
+	// whose source is in inline.
+	src    string
+	inline string
+}
+
+// pageAssets finds the <script type="module"> and <link rel="stylesheet">
+// tags of a page, outside of comments, in the order they appear.
+func pageAssets(page string) []pageAsset {
+	comments := htmlComment.FindAllStringIndex(page, -1)
+	commented := func(i int) bool {
+		for _, c := range comments {
+			if i >= c[0] && i < c[1] {
+				return true
+			}
+		}
+		return false
+	}
+	var assets []pageAsset
+	for _, m := range htmlScript.FindAllStringSubmatchIndex(page, -1) {
+		attrs := parseAttributes(page[m[2]:m[3]])
+		if typ, _ := attribute(attrs, "type"); !strings.EqualFold(typ, "module") || commented(m[0]) {
+			continue
+		}
+		asset := pageAsset{start: m[0], end: m[1], attrs: attrs}
+		asset.src, _ = attribute(attrs, "src")
+		if asset.src == "" {
+			asset.inline = page[m[4]:m[5]]
+		}
+		assets = append(assets, asset)
+	}
+	for _, m := range htmlLink.FindAllStringSubmatchIndex(page, -1) {
+		attrs := parseAttributes(page[m[2]:m[3]])
+		rel, _ := attribute(attrs, "rel")
+		href, _ := attribute(attrs, "href")
+		if !strings.EqualFold(strings.TrimSpace(rel), "stylesheet") || href == "" || commented(m[0]) {
+			continue
+		}
+		assets = append(assets, pageAsset{start: m[0], end: m[1], stylesheet: true, attrs: attrs, src: href})
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].start < assets[j].start })
+	return assets
+}
+
+// resolvePageURL resolves the URL of a page's asset against the page's.
+func resolvePageURL(base, ref string) (string, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", ref, err)
+	}
+	if !u.IsAbs() {
+		b, err := url.Parse(base)
+		if base == "" || err != nil || !b.IsAbs() {
+			return "", fmt.Errorf("%s is relative, so needs the page's URL as base", ref)
+		}
+		u = b.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%s must be an http or https URL", ref)
+	}
+	return u.String(), nil
+}
+
+// assetName names the output of a page's asset after what it was built
+// from and a hash of its contents, so it can be cached forever.
+func assetName(asset pageAsset, code []byte) string {
+	stem, ext := "inline", ".js"
+	if asset.src != "" {
+		if u, err := url.Parse(asset.src); err == nil {
+			stem = strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+		}
+	}
+	if asset.stylesheet {
+		ext = ".css"
+	}
+	if stem == "" || stem == "." || stem == "/" {
+		stem = "index"
+	}
+	return safeAssetStem.ReplaceAllString(stem, "_") + "-" + sha256Hex(code)[:8] + ext
+}
+
+var safeAssetStem = regexp.MustCompile(`[^\w.-]`)
+
+// pageOutput is the built output of one of a page's assets.
+type pageOutput struct {
+	name string
+	code []byte
+}
+
+// buildPage builds each module script and stylesheet of an HTML page,
+// returning the page loading the outputs instead. Relative URLs are
+// resolved against base, the page's URL. Each asset is built with req's
+// options, which has been authorized as one build for the whole page.
+//
+// The outputs are kept with the chunks and loaded from there, or when
+// local, loaded from assets/ next to the page, which is where the caller
+// must put them. When a build fails, the failure is written and false is
+// returned.
+func buildPage(w http.ResponseWriter, req buildRequest, page, base string, local bool) (string, []pageOutput, bool) {
+	var outputs []pageOutput
+	var builds []string
+	var rewritten strings.Builder
+	last := 0
+	for _, asset := range pageAssets(page) {
+		areq := req
+		areq.Source, areq.Entry, areq.Loader = "", "", ""
+		areq.Bundle = true
+		if asset.src != "" {
+			u, err := resolvePageURL(base, asset.src)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return "", nil, false
+			}
+			areq.Entry = u
+		} else {
+			areq.Source = asset.inline
+		}
+		if asset.stylesheet {
+			areq.Format = ""
+		}
+		result, ok := runRecordedBuild(w, areq)
+		if !ok {
+			return "", nil, false
+		}
+		builds = append(builds, w.Header().Get("X-Conifer-Build"))
+		name := assetName(asset, result.Code)
+		outputs = append(outputs, pageOutput{name: name, code: result.Code})
+
+		src := "assets/" + name
+		if !local {
+			if err := chunks.put(name, result.Code); err != nil {
+				http.Error(w, "storing "+name+": "+err.Error(), http.StatusInternalServerError)
+				return "", nil, false
+			}
+			src = cfg.PublicURL + chunkPath + name
+		}
+		attrs := setAttribute(asset.attrs, "integrity", subresourceIntegrity(result.Code))
+		if _, ok := attribute(attrs, "crossorigin"); !ok && !local {
+			// Integrity is only checked for cross-origin responses
+			// requested with CORS.
+			attrs = setAttribute(attrs, "crossorigin", "anonymous")
+		}
+		rewritten.WriteString(page[last:asset.start])
+		if asset.stylesheet {
+			writeTag(&rewritten, "link", setAttribute(attrs, "href", src))
+		} else {
+			writeTag(&rewritten, "script", setAttribute(attrs, "src", src))
+			rewritten.WriteString("</script>")
+		}
+		last = asset.end
+	}
+	rewritten.WriteString(page[last:])
+	// Each asset is its own build.
+	if len(builds) > 0 {
+		w.Header().Set("X-Conifer-Build", strings.Join(builds, ", "))
+	}
+	w.Header().Del("X-Conifer-Artifact")
+	w.Header().Del("X-Conifer-Release")
+	return rewritten.String(), outputs, true
+}
+
+// servePage builds an HTML page, see buildPage, and responds with the page
+// loading its built assets, or with output=archive, with a gzipped tarball
+// of the page as index.html and the outputs in assets/, to deploy together.
+func servePage(w http.ResponseWriter, r *http.Request, req buildRequest, page, base string) {
+	archive := r.URL.Query().Get("output") == "archive"
+	rewritten, outputs, ok := buildPage(w, req, page, base, archive)
+	if !ok {
+		return
+	}
+	if !archive {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		io.WriteString(w, rewritten)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="page.tar.gz"`)
+	w.WriteHeader(http.StatusOK)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	writeTarFile(tw, "index.html", []byte(rewritten))
+	for _, o := range outputs {
+		writeTarFile(tw, "assets/"+o.name, o.code)
+	}
+	tw.Close()
+	gz.Close()
+}
+
+// isHTMLEntry reports whether an entry URL is of a page rather than a
+// module.
+func isHTMLEntry(entry string) bool {
+	u, err := url.Parse(entry)
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	return ext == ".html" || ext == ".htm"
+}
+
+// serveHTMLBuild builds a page sent as the body of a request, whose
+// relative URLs are resolved against the base query parameter.
+func serveHTMLBuild(w http.ResponseWriter, r *http.Request) {
+	page, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBuildRequestBytes))
+	if err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := parseBuildRequest(r, string(page))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeBuild(w, r, &req) {
+		return
+	}
+	servePage(w, r, req, string(page), r.URL.Query().Get("base"))
+}
+
+// serveHTMLEntry builds the page at an entry URL.
+func serveHTMLEntry(w http.ResponseWriter, r *http.Request, req buildRequest) {
+	if !authorizeBuild(w, r, &req) {
+		return
+	}
+	if err := req.limits().checkUpstream(req.Entry); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	f := newFetcher()
+	f.forTenant(tenantNamed(req.Tenant))
+	mod, err := f.fetch(req.Entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	servePage(w, r, req, mod.Contents, mod.URL)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+)
+
+// importMap maps import specifiers to URLs, following the shape of browser
+// import maps. Scopes apply to modules whose URL starts with the scope, so
+// modules from different origins can resolve the same bare specifier, such
+// as "react", to different pinned versions.
+type importMap struct {
+	Imports map[string]string            `json:"imports"`
+	Scopes  map[string]map[string]string `json:"scopes,omitempty"`
+}
+
+// resolve returns the URL that specifier maps to when imported by the
+// module at importer.
+func (m *importMap) resolve(specifier, importer string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	// More specific scopes take precedence over less specific ones, and
+	// every scope takes precedence over the top-level imports.
+	bestScope := ""
+	for scope := range m.Scopes {
+		if strings.HasPrefix(importer, scope) && len(scope) > len(bestScope) {
+			bestScope = scope
+		}
+	}
+	if bestScope != "" {
+		if u, ok := resolveImports(m.Scopes[bestScope], specifier); ok {
+			return u, true
+		}
+	}
+	return resolveImports(m.Imports, specifier)
+}
+
+// resolveImports looks specifier up by exact match, or else by the longest
+// key ending in "/" that it starts with.
+func resolveImports(imports map[string]string, specifier string) (string, bool) {
+	if u, ok := imports[specifier]; ok {
+		return u, true
+	}
+	bestKey := ""
+	for key := range imports {
+		if strings.HasSuffix(key, "/") && strings.HasPrefix(specifier, key) && len(key) > len(bestKey) {
+			bestKey = key
+		}
+	}
+	if bestKey == "" {
+		return "", false
+	}
+	return imports[bestKey] + strings.TrimPrefix(specifier, bestKey), true
+}
+
+// isBareSpecifier reports whether specifier is a package name like "react"
+// rather than a URL or a relative path.
+func isBareSpecifier(specifier string) bool {
+	return !strings.HasPrefix(specifier, "/") &&
+		!strings.HasPrefix(specifier, "./") &&
+		!strings.HasPrefix(specifier, "../") &&
+		!strings.Contains(specifier, "://")
+}
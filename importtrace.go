@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// tracedImport follows one import of a build from its specifier to where
+// the code it imports ended up.
+type tracedImport struct {
+	// Importer is the URL of the importing module, or "" for the source or
+	// its files.
+	Importer  string `json:"importer"`
+	Specifier string `json:"specifier"`
+	// URL is what the specifier resolved to, after import maps, policy
+	// and redirects.
+	URL string `json:"url"`
+	// Kind is how it was imported, like "import-statement" or
+	// "dynamic-import".
+	Kind string `json:"kind,omitempty"`
+	// External imports are left in the output rather than bundled.
+	External bool `json:"external,omitempty"`
+	// Output is the file the imported module was placed in: the output,
+	// named as in a JSON envelope, or the URL of a chunk. BytesInOutput is
+	// how much of it is left there. Neither is set for a module that was
+	// tree-shaken away entirely.
+	Output        string `json:"output,omitempty"`
+	BytesInOutput int    `json:"bytesInOutput"`
+}
+
+// importTrace is every import of remote modules a build resolved, traced to
+// where it ended up, sorted by importer and specifier.
+type importTrace struct {
+	Imports []tracedImport `json:"imports"`
+}
+
+// writeImportTrace responds with the trace of a recorded build's imports
+// instead of its output, for output=imports.
+func writeImportTrace(w http.ResponseWriter, req buildRequest, result *buildResult) {
+	if result.Metafile == nil {
+		http.Error(w, "only bundled builds can have their imports traced", http.StatusBadRequest)
+		return
+	}
+	m := result.Metafile
+	type placement struct {
+		output string
+		bytes  int
+	}
+	placed := make(map[string]placement)
+	for path, out := range m.Outputs {
+		if strings.HasSuffix(path, ".map") {
+			continue
+		}
+		output := outputName(req)
+		if !strings.HasPrefix(filepath.Base(path), "stdin.") {
+			output = cfg.PublicURL + chunkPath + filepath.Base(path)
+		}
+		for input, in := range out.Inputs {
+			placed[input] = placement{output, in.BytesInOutput}
+		}
+	}
+
+	trace := importTrace{Imports: []tracedImport{}}
+	seen := make(map[[2]string]bool)
+	for _, edge := range result.Graph {
+		key := [2]string{edge.Importer, edge.Specifier}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		imp := tracedImport{
+			Importer:  edge.Importer,
+			Specifier: edge.Specifier,
+			URL:       edge.URL,
+			External:  edge.External,
+			Kind:      importKind(m, edge),
+		}
+		if p, ok := placed["http-url:"+edge.URL]; ok && !edge.External {
+			imp.Output, imp.BytesInOutput = p.output, p.bytes
+		}
+		trace.Imports = append(trace.Imports, imp)
+	}
+	writeJSON(w, http.StatusOK, trace)
+}
+
+// importKind finds how an import was made in the metafile, which only
+// records bundled imports.
+func importKind(m *metafile, edge importEdge) string {
+	for path, in := range m.Inputs {
+		if edge.Importer == "" && strings.HasPrefix(path, "http-url:") || edge.Importer != "" && path != "http-url:"+edge.Importer {
+			continue
+		}
+		for _, imp := range in.Imports {
+			if imp.Path == "http-url:"+edge.URL {
+				return imp.Kind
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+var integrityHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// splitIntegrity separates an integrity fragment, such as the
+// "#sha256-<hash>" in "https://example.com/mod.js#sha256-<hash>", from a
+// URL. The URL is returned unchanged when it has no integrity fragment.
+func splitIntegrity(rawURL string) (string, string) {
+	i := strings.LastIndex(rawURL, "#")
+	if i < 0 {
+		return rawURL, ""
+	}
+	fragment := rawURL[i+1:]
+	for alg := range integrityHashes {
+		if strings.HasPrefix(fragment, alg+"-") {
+			return rawURL[:i], fragment
+		}
+	}
+	return rawURL, ""
+}
+
+// parseIntegrity splits an integrity value like "sha256-<hash>" into its
+// algorithm and hash, returning an error when it isn't one.
+func parseIntegrity(integrity string) (string, string, error) {
+	i := strings.Index(integrity, "-")
+	if i < 0 {
+		return "", "", fmt.Errorf("integrity %q must be like sha256-<hash>", integrity)
+	}
+	alg, expected := integrity[:i], integrity[i+1:]
+	if _, ok := integrityHashes[alg]; !ok {
+		return "", "", fmt.Errorf("integrity %q has an unknown algorithm, not sha256, sha384 or sha512", integrity)
+	}
+	if _, err := base64.StdEncoding.DecodeString(expected); err != nil {
+		if _, err := hex.DecodeString(expected); err != nil {
+			return "", "", fmt.Errorf("integrity %q must have a base64 or hex encoded hash", integrity)
+		}
+	}
+	return alg, expected, nil
+}
+
+// verifyIntegrity checks contents against an integrity value like
+// "sha256-<hash>", where the hash is base64 encoded as in Subresource
+// Integrity or hex encoded as printed by sha256sum.
+func verifyIntegrity(integrity string, contents string) error {
+	alg, expected, err := parseIntegrity(integrity)
+	if err != nil {
+		return err
+	}
+	h := integrityHashes[alg]()
+	h.Write([]byte(contents))
+	sum := h.Sum(nil)
+	if expected == base64.StdEncoding.EncodeToString(sum) || strings.EqualFold(expected, hex.EncodeToString(sum)) {
+		return nil
+	}
+	return &integrityError{Expected: integrity, Got: alg + "-" + base64.StdEncoding.EncodeToString(sum)}
+}
+
+// integrityError is a module whose contents don't match the integrity value
+// it was expected to have.
+type integrityError struct {
+	Expected string
+	Got      string
+}
+
+func (e *integrityError) Error() string {
+	return "expected " + e.Expected + " but got " + e.Got
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// recentBuildsPerTenant is how many builds are remembered per tenant
+	// when looking for libraries shared between them.
+	recentBuildsPerTenant = 50
+
+	// minSharedLibraryBytes is the smallest library worth externalizing.
+	// Below this the extra request costs more than the duplicated bytes.
+	minSharedLibraryBytes = 10 * 1024
+)
+
+// libraryOf returns the URL prefix of the versioned package a module belongs
+// to, such as "https://cdn.jsdelivr.net/npm/react@17.0.2/", or "" when the
+// URL doesn't look like it is part of a package.
+func libraryOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	segments := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "@") && !strings.Contains(segment[1:], "@") {
+			// A scope like "@babel", followed by the package name.
+			continue
+		}
+		if strings.LastIndex(segment, "@") > 0 {
+			prefix := u.Scheme + "://" + u.Host + "/" + strings.Join(segments[:i+1], "/")
+			if i < len(segments)-1 {
+				prefix += "/"
+			}
+			return prefix
+		}
+	}
+	return ""
+}
+
+// packageVersionOf returns the package and version a module belongs to,
+// like "@babel/core" and "7.22.5", from its library's URL, or "" for both
+// when it isn't part of one.
+func packageVersionOf(rawURL string) (string, string) {
+	library := libraryOf(rawURL)
+	if library == "" {
+		return "", ""
+	}
+	segments := strings.Split(strings.TrimSuffix(library, "/"), "/")
+	name := segments[len(segments)-1]
+	if scope := segments[len(segments)-2]; strings.HasPrefix(scope, "@") {
+		name = scope + "/" + name
+	}
+	at := strings.LastIndex(name, "@")
+	return name[:at], name[at+1:]
+}
+
+// libraryUsage is how much of a library one build included.
+type libraryUsage struct {
+	Bytes int
+	// Imports are the library's URLs imported from outside of it.
+	Imports map[string]bool
+}
+
+// sharedLibrary is a library included by several of a tenant's recent
+// builds, which would be cheaper to serve once as an external import.
+type sharedLibrary struct {
+	Library string `json:"library"`
+	Builds  int    `json:"builds"`
+	// Bytes is the library's average size in each build's output.
+	Bytes int `json:"bytes"`
+	// Savings is roughly how many bytes fewer would be served across the
+	// recent builds if the library was downloaded once.
+	Savings  int      `json:"savings"`
+	Imports  []string `json:"imports"`
+	KeepURLs string   `json:"keepUrls"`
+}
+
+// libraryTracker remembers which libraries each tenant's recent builds
+// included.
+type libraryTracker struct {
+	mu     sync.Mutex
+	recent map[string][]map[string]*libraryUsage
+}
+
+var libraries = &libraryTracker{recent: make(map[string][]map[string]*libraryUsage)}
+
+func (t *libraryTracker) record(tenant string, m *metafile) {
+	usage := make(map[string]*libraryUsage)
+	for _, output := range m.Outputs {
+		for path, input := range output.Inputs {
+			u, ok := inputURL(path)
+			if !ok {
+				continue
+			}
+			lib := libraryOf(u)
+			if lib == "" {
+				continue
+			}
+			if usage[lib] == nil {
+				usage[lib] = &libraryUsage{Imports: make(map[string]bool)}
+			}
+			usage[lib].Bytes += input.BytesInOutput
+		}
+	}
+	for path, input := range m.Inputs {
+		importerLib := ""
+		if u, ok := inputURL(path); ok {
+			importerLib = libraryOf(u)
+		}
+		for _, imp := range input.Imports {
+			u, ok := inputURL(imp.Path)
+			if !ok {
+				continue
+			}
+			if lib := libraryOf(u); lib != importerLib && usage[lib] != nil {
+				usage[lib].Imports[u] = true
+			}
+		}
+	}
+	if len(usage) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	recent := append(t.recent[tenant], usage)
+	if len(recent) > recentBuildsPerTenant {
+		recent = recent[len(recent)-recentBuildsPerTenant:]
+	}
+	t.recent[tenant] = recent
+}
+
+// shared returns the libraries included by more than one of the tenant's
+// recent builds, most wasteful first.
+func (t *libraryTracker) shared(tenant string) []sharedLibrary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	totals := make(map[string]*sharedLibrary)
+	imports := make(map[string]map[string]bool)
+	for _, usage := range t.recent[tenant] {
+		for lib, u := range usage {
+			s := totals[lib]
+			if s == nil {
+				s = &sharedLibrary{Library: lib, KeepURLs: lib + "*"}
+				totals[lib] = s
+				imports[lib] = make(map[string]bool)
+			}
+			s.Builds++
+			s.Bytes += u.Bytes
+			for imp := range u.Imports {
+				imports[lib][imp] = true
+			}
+		}
+	}
+
+	shared := []sharedLibrary{}
+	for lib, s := range totals {
+		if s.Builds < 2 {
+			continue
+		}
+		s.Bytes /= s.Builds
+		if s.Bytes < minSharedLibraryBytes {
+			continue
+		}
+		s.Savings = (s.Builds - 1) * s.Bytes
+		for imp := range imports[lib] {
+			s.Imports = append(s.Imports, imp)
+		}
+		sort.Strings(s.Imports)
+		shared = append(shared, *s)
+	}
+	sort.Slice(shared, func(i, j int) bool {
+		return shared[i].Savings > shared[j].Savings
+	})
+	return shared
+}
+
+// sharedKeepURLs returns keepUrls patterns externalizing the tenant's shared
+// libraries, so the browser downloads and caches each one once instead of
+// every bundle carrying its own copy.
+func (t *libraryTracker) sharedKeepURLs(tenant string) []string {
+	var patterns []string
+	for _, s := range t.shared(tenant) {
+		patterns = append(patterns, s.KeepURLs)
+	}
+	return patterns
+}
+
+func handleSharedLibraries(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFor(r)
+	if tenant == nil {
+		http.Error(w, "an API key is required", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, libraries.shared(tenant.Name))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	licenseComment = regexp.MustCompile(`@license[ \t]+([^\r\n*]+)`)
+	spdxComment    = regexp.MustCompile(`SPDX-License-Identifier:[ \t]*([^\s*]+)`)
+)
+
+// foundLicense is a license declared for bundled code, and where.
+type foundLicense struct {
+	License string `json:"license"`
+	// Source is the URL of the package.json declaring it, or of the module
+	// with an @license or SPDX-License-Identifier comment.
+	Source string `json:"source"`
+}
+
+// licensedCode is a package, or a module outside of any package, included
+// in a build's output.
+type licensedCode struct {
+	// Package and Version are set for modules of versioned packages, whose
+	// URLs begin with URL. Otherwise URL is the module's.
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+	URL     string `json:"url"`
+	// Modules are the URLs of the modules included, and BytesInOutput how
+	// much of them is left in the output and its chunks.
+	Modules       []string `json:"modules"`
+	BytesInOutput int      `json:"bytesInOutput"`
+	// Licenses is empty when none were found, which should be looked into
+	// before the code is served.
+	Licenses []foundLicense `json:"licenses"`
+}
+
+// licenseReport is the third-party code included in a build's output and
+// its licenses, sorted by URL. External imports and the build's own source
+// aren't included, nor modules tree-shaken away entirely.
+type licenseReport struct {
+	Packages []licensedCode `json:"packages"`
+}
+
+// packageLicenses reads the license of a package.json, which is an SPDX
+// expression, or in older packages, an object or a list of them.
+func packageLicenses(data string) []string {
+	type typed struct {
+		Type string `json:"type"`
+	}
+	var pkg struct {
+		License  json.RawMessage `json:"license"`
+		Licenses []typed         `json:"licenses"`
+	}
+	if json.Unmarshal([]byte(data), &pkg) != nil {
+		return nil
+	}
+	var licenses []string
+	var s string
+	var t typed
+	switch {
+	case json.Unmarshal(pkg.License, &s) == nil && s != "":
+		licenses = append(licenses, s)
+	case json.Unmarshal(pkg.License, &t) == nil && t.Type != "":
+		licenses = append(licenses, t.Type)
+	}
+	for _, t := range pkg.Licenses {
+		if t.Type != "" {
+			licenses = append(licenses, t.Type)
+		}
+	}
+	return licenses
+}
+
+// commentLicenses finds the licenses named in a module's comments.
+func commentLicenses(contents string) []string {
+	var licenses []string
+	seen := make(map[string]bool)
+	for _, re := range []*regexp.Regexp{licenseComment, spdxComment} {
+		for _, m := range re.FindAllStringSubmatch(contents, -1) {
+			if l := strings.TrimSpace(m[1]); !seen[l] {
+				seen[l] = true
+				licenses = append(licenses, l)
+			}
+		}
+	}
+	return licenses
+}
+
+// newLicenseReport finds the licenses of the remote modules left in a
+// build's output, from the package.json of their packages and their
+// comments. Modules are fetched through the module cache, where the build
+// left them, and packages whose package.json can't be fetched only have
+// their comments' licenses.
+func newLicenseReport(m *metafile) *licenseReport {
+	included := make(map[string]int)
+	for _, out := range m.Outputs {
+		for input, in := range out.Inputs {
+			if u, ok := inputURL(input); ok && in.BytesInOutput > 0 {
+				included[u] += in.BytesInOutput
+			}
+		}
+	}
+	f := newFetcher()
+	byURL := make(map[string]*licensedCode)
+	for u, bytes := range included {
+		library := libraryOf(u)
+		key := library
+		if key == "" {
+			key = u
+		}
+		code, ok := byURL[key]
+		if !ok {
+			code = &licensedCode{URL: key, Licenses: []foundLicense{}}
+			if library != "" {
+				code.Package, code.Version = packageVersionOf(u)
+				manifest := strings.TrimSuffix(key, "/") + "/package.json"
+				if mod, err := f.fetch(manifest); err == nil {
+					for _, l := range packageLicenses(mod.Contents) {
+						code.Licenses = append(code.Licenses, foundLicense{License: l, Source: manifest})
+					}
+				}
+			}
+			byURL[key] = code
+		}
+		code.Modules = append(code.Modules, u)
+		code.BytesInOutput += bytes
+		if mod, err := f.fetch(u); err == nil {
+			for _, l := range commentLicenses(mod.Contents) {
+				code.Licenses = append(code.Licenses, foundLicense{License: l, Source: u})
+			}
+		}
+	}
+
+	report := &licenseReport{Packages: []licensedCode{}}
+	for _, code := range byURL {
+		sort.Strings(code.Modules)
+		sort.SliceStable(code.Licenses, func(i, j int) bool { return code.Licenses[i].Source < code.Licenses[j].Source })
+		report.Packages = append(report.Packages, *code)
+	}
+	sort.Slice(report.Packages, func(i, j int) bool { return report.Packages[i].URL < report.Packages[j].URL })
+	return report
+}
+
+// cachedLicenseReport is newLicenseReport for a bundled build, kept with
+// the other artifacts derived from builds.
+func cachedLicenseReport(result *buildResult) (*licenseReport, error) {
+	data, err := derived.get("licenses.v1", buildHash(result.Manifest, sha256Hex(result.Code)), func() ([]byte, error) {
+		return json.Marshal(newLicenseReport(result.Metafile))
+	})
+	if err != nil {
+		return nil, err
+	}
+	var l licenseReport
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// writeLicenseReport responds with the licenses of the code in a recorded
+// build's output instead of the output, for licenses=json.
+func writeLicenseReport(w http.ResponseWriter, result *buildResult) {
+	if result.Metafile == nil {
+		http.Error(w, "only bundled builds have license reports", http.StatusBadRequest)
+		return
+	}
+	report, err := cachedLicenseReport(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limitsConfig caps what a caller may do. Zero values mean no limit.
+type limitsConfig struct {
+	RequestsPerMinute int `json:"requestsPerMinute,omitempty"`
+	// BuildsPerDay is the quota of builds per UTC day.
+	BuildsPerDay   int   `json:"buildsPerDay,omitempty"`
+	MaxSourceBytes int64 `json:"maxSourceBytes,omitempty"`
+	// MaxModuleBytes caps the size of each module a build loads, and
+	// MaxBuildBytes that of every module it loads together.
+	MaxModuleBytes int64 `json:"maxModuleBytes,omitempty"`
+	MaxBuildBytes  int64 `json:"maxBuildBytes,omitempty"`
+	// MaxOutputBytes caps the size of a build's output, its bundle and any
+	// other files together.
+	MaxOutputBytes int64 `json:"maxOutputBytes,omitempty"`
+	// MaxModules caps how many remote modules one build may download.
+	MaxModules int `json:"maxModules,omitempty"`
+	// BuildTimeout is how long a build may take, after which the downloads
+	// it is waiting for are cancelled and it fails.
+	BuildTimeout duration `json:"buildTimeout,omitempty"`
+	// AllowedHosts are the hosts, like "*.jsdelivr.net", modules may be
+	// downloaded from. Empty allows any host.
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+	// BlockedURLs are patterns like those of keepUrls, such as
+	// "unpkg.com/evil-package*", of URLs modules may not be downloaded
+	// from even when their hosts are allowed. A tenant's add to the
+	// configured ones rather than replacing them.
+	BlockedURLs []string `json:"blockedUrls,omitempty"`
+}
+
+// limitsFor returns the limits that apply to tenant: the configured
+// defaults, with any limits the tenant sets itself taking precedence.
+// Anonymous callers get the playground's limits when there is one.
+func limitsFor(tenant *tenantConfig) limitsConfig {
+	if tenant == nil {
+		if cfg.Playground != nil {
+			return overrideLimits(cfg.Limits, &cfg.Playground.Limits)
+		}
+		return cfg.Limits
+	}
+	return overrideLimits(cfg.Limits, tenant.Limits)
+}
+
+// limits returns the limits that apply to the build: its tenant's, with
+// any of its API key's taking precedence.
+func (req buildRequest) limits() limitsConfig {
+	return overrideLimits(limitsFor(tenantNamed(req.Tenant)), req.KeyLimits)
+}
+
+// overrideLimits returns limits with every limit set in override replaced.
+func overrideLimits(limits limitsConfig, override *limitsConfig) limitsConfig {
+	if override == nil {
+		return limits
+	}
+	if override.RequestsPerMinute != 0 {
+		limits.RequestsPerMinute = override.RequestsPerMinute
+	}
+	if override.BuildsPerDay != 0 {
+		limits.BuildsPerDay = override.BuildsPerDay
+	}
+	if override.MaxSourceBytes != 0 {
+		limits.MaxSourceBytes = override.MaxSourceBytes
+	}
+	if override.MaxModuleBytes != 0 {
+		limits.MaxModuleBytes = override.MaxModuleBytes
+	}
+	if override.MaxBuildBytes != 0 {
+		limits.MaxBuildBytes = override.MaxBuildBytes
+	}
+	if override.MaxOutputBytes != 0 {
+		limits.MaxOutputBytes = override.MaxOutputBytes
+	}
+	if override.MaxModules != 0 {
+		limits.MaxModules = override.MaxModules
+	}
+	if override.BuildTimeout != 0 {
+		limits.BuildTimeout = override.BuildTimeout
+	}
+	if override.AllowedHosts != nil {
+		limits.AllowedHosts = override.AllowedHosts
+	}
+	if len(override.BlockedURLs) > 0 {
+		limits.BlockedURLs = append(append([]string{}, limits.BlockedURLs...), override.BlockedURLs...)
+	}
+	return limits
+}
+
+// checkUpstream returns an error when limits don't let modules be
+// downloaded from rawURL.
+func (l limitsConfig) checkUpstream(rawURL string) error {
+	return checkUpstream(l.AllowedHosts, l.BlockedURLs, rawURL)
+}
+
+// callerKey identifies who limits are counted against: the tenant, or for
+// anonymous requests the client's IP address.
+func callerKey(r *http.Request, tenant *tenantConfig) string {
+	if tenant != nil {
+		return "tenant:" + tenant.Name
+	}
+	return "ip:" + clientIP(r)
+}
+
+// quotaTracker counts each caller's builds during the current UTC day.
+type quotaTracker struct {
+	mu     sync.Mutex
+	day    map[string]string
+	builds map[string]int
+}
+
+var quotas = &quotaTracker{day: make(map[string]string), builds: make(map[string]int)}
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// used returns how many builds caller has run today.
+func (q *quotaTracker) used(caller string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.day[caller] != today() {
+		return 0
+	}
+	return q.builds[caller]
+}
+
+// take counts a build against caller's quota, reporting false when the
+// quota has already been used up.
+func (q *quotaTracker) take(caller string, perDay int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if d := today(); q.day[caller] != d {
+		q.day[caller] = d
+		q.builds[caller] = 0
+	}
+	if perDay > 0 && q.builds[caller] >= perDay {
+		return false
+	}
+	q.builds[caller]++
+	return true
+}
+
+// writeQuotaExceeded refuses a request by a caller who has used up its
+// daily build quota.
+func writeQuotaExceeded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(nextQuotaReset()).Seconds())+1))
+	http.Error(w, "daily build quota exceeded", http.StatusTooManyRequests)
+}
+
+// nextQuotaReset is when the daily build quota next starts over.
+func nextQuotaReset() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+type quotaStatus struct {
+	BuildsPerDay int `json:"buildsPerDay"`
+	Used         int `json:"used"`
+	// Remaining is omitted when there is no quota.
+	Remaining *int      `json:"remaining,omitempty"`
+	Resets    time.Time `json:"resets"`
+}
+
+// handleLimits describes the limits that apply to the caller's API key, or
+// to anonymous playground callers, and how much of the quota is left, so
+// clients can adapt before hitting errors.
+func handleLimits(w http.ResponseWriter, r *http.Request) {
+	tenant, key := keyFor(r)
+	if tenant == nil && cfg.Playground == nil {
+		http.Error(w, "an API key is required", http.StatusUnauthorized)
+		return
+	}
+	name := ""
+	if tenant != nil {
+		name = tenant.Name
+	}
+	limits, caller := keyLimits(r, tenant, key)
+	quota := quotaStatus{
+		BuildsPerDay: limits.BuildsPerDay,
+		Used:         quotas.used(caller),
+		Resets:       nextQuotaReset(),
+	}
+	if limits.BuildsPerDay > 0 {
+		remaining := limits.BuildsPerDay - quota.Used
+		if remaining < 0 {
+			remaining = 0
+		}
+		quota.Remaining = &remaining
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenant": name,
+		"limits": limits,
+		"quota":  quota,
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"path"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+var loadersByExtension = map[string]api.Loader{
+	".js":   api.LoaderJS,
+	".mjs":  api.LoaderJS,
+	".cjs":  api.LoaderJS,
+	".jsx":  api.LoaderJSX,
+	".ts":   api.LoaderTS,
+	".mts":  api.LoaderTS,
+	".cts":  api.LoaderTS,
+	".tsx":  api.LoaderTSX,
+	".json": api.LoaderJSON,
+	".css":  api.LoaderCSS,
+}
+
+var targetsByName = map[string]api.Target{
+	"esnext": api.ESNext,
+	"es5":    api.ES5,
+	"es2015": api.ES2015,
+	"es2016": api.ES2016,
+	"es2017": api.ES2017,
+	"es2018": api.ES2018,
+	"es2019": api.ES2019,
+	"es2020": api.ES2020,
+	"es2021": api.ES2021,
+}
+
+// loadersByName are the loaders a build's source may be parsed with.
+var loadersByName = map[string]api.Loader{
+	"js":   api.LoaderJS,
+	"jsx":  api.LoaderJSX,
+	"ts":   api.LoaderTS,
+	"tsx":  api.LoaderTSX,
+	"json": api.LoaderJSON,
+	"css":  api.LoaderCSS,
+	"text": api.LoaderText,
+}
+
+var formatsByName = map[string]api.Format{
+	"":     api.FormatESModule,
+	"esm":  api.FormatESModule,
+	"iife": api.FormatIIFE,
+	"cjs":  api.FormatCommonJS,
+}
+
+var sourcemapsByName = map[string]api.SourceMap{
+	"":         api.SourceMapNone,
+	"inline":   api.SourceMapInline,
+	"external": api.SourceMapExternal,
+}
+
+// loaderFor picks how to parse a remote module from its URL's extension.
+// esbuild would otherwise parse everything a plugin loads as JavaScript.
+func loaderFor(rawURL string) api.Loader {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return api.LoaderJS
+	}
+	if loader, ok := loadersByExtension[path.Ext(u.Path)]; ok {
+		return loader
+	}
+	return api.LoaderJS
+}
+
+// normalizeTsconfig prepares a tsconfig.json supplied with a request for
+// esbuild. Path mappings are dropped, as remote modules have no file system
+// for them to refer to, and "verbatimModuleSyntax" is translated to the
+// older options esbuild understands.
+func normalizeTsconfig(raw string) (string, error) {
+	var tsconfig map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &tsconfig); err != nil {
+		return "", err
+	}
+	if options, ok := tsconfig["compilerOptions"].(map[string]interface{}); ok {
+		delete(options, "paths")
+		delete(options, "baseUrl")
+		if verbatim, ok := options["verbatimModuleSyntax"].(bool); ok {
+			delete(options, "verbatimModuleSyntax")
+			if verbatim {
+				options["preserveValueImports"] = true
+				options["importsNotUsedAsValues"] = "preserve"
+			}
+		}
+	}
+	normalized, err := json.Marshal(tsconfig)
+	return string(normalized), err
+}
+
+// compileTypeScript compiles a remote TypeScript module with the request's
+// tsconfig.json, as esbuild can only apply one to files on disk. An inline
+// source map lets esbuild map the output back to the original source.
+func compileTypeScript(contents string, loader api.Loader, sourcefile string, tsconfigRaw string) (string, []api.Message) {
+	result := api.Transform(contents, api.TransformOptions{
+		Loader:      loader,
+		TsconfigRaw: tsconfigRaw,
+		Sourcefile:  sourcefile,
+		Sourcemap:   api.SourceMapInline,
+	})
+	return string(result.Code), result.Errors
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// lockfile pins every module of a build to the hash of its contents, so a
+// later build from mutable CDN URLs can be refused if anything changed.
+type lockfile struct {
+	// Modules maps each module's final URL to its integrity value, like
+	// "sha256-<base64 hash>".
+	Modules map[string]string `json:"modules"`
+}
+
+func newLockfile(manifest buildManifest) *lockfile {
+	lock := &lockfile{Modules: make(map[string]string)}
+	for _, mod := range manifest.Modules {
+		sum, _ := hex.DecodeString(mod.SHA256)
+		lock.Modules[mod.URL] = "sha256-" + base64.StdEncoding.EncodeToString(sum)
+	}
+	return lock
+}
+
+// check returns an error when an integrity value of the lockfile is
+// malformed, so the caller is told before anything is built.
+func (lock *lockfile) check() error {
+	if lock == nil {
+		return nil
+	}
+	for url, integrity := range lock.Modules {
+		if _, _, err := parseIntegrity(integrity); err != nil {
+			return fmt.Errorf("invalid lockfile: %s: %v", url, err)
+		}
+	}
+	return nil
+}
+
+// verify checks that mod is locked and unchanged.
+func (lock *lockfile) verify(mod *module) error {
+	integrity, ok := lock.Modules[mod.URL]
+	if !ok {
+		return &lockfileError{URL: mod.URL}
+	}
+	if err := verifyIntegrity(integrity, mod.Contents); err != nil {
+		return &lockfileError{URL: mod.URL, Err: err}
+	}
+	return nil
+}
+
+// lockfileError is a module refused by a lockfile, either because it isn't
+// listed or, when Err is set, because its contents changed.
+type lockfileError struct {
+	URL string
+	Err error
+}
+
+func (e *lockfileError) Error() string {
+	if e.Err == nil {
+		return e.URL + " is not in the lockfile"
+	}
+	return e.URL + " does not match the lockfile: " + e.Err.Error()
+}
+
+func (e *lockfileError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Malformed integrity values come from callers, so are refused rather than
+// failing inside the build.
+var malformedIntegrity = []string{"bogus", "md5-abc", "sha256-!!!"}
+
+func TestVerifyIntegrityRefusesMalformedValues(t *testing.T) {
+	for _, integrity := range malformedIntegrity {
+		if err := verifyIntegrity(integrity, "x"); err == nil {
+			t.Errorf("verifyIntegrity(%q) accepted it", integrity)
+		}
+	}
+}
+
+func TestMalformedLockfileQueryRefused(t *testing.T) {
+	valid := `{"modules": {"https://example.com/a.js": "sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}`
+	r := httptest.NewRequest("POST", "/v1/build?lockfile="+url.QueryEscape(valid), nil)
+	if _, err := parseBuildRequest(r, "export {}"); err != nil {
+		t.Fatal(err)
+	}
+	for _, integrity := range malformedIntegrity {
+		lock := `{"modules": {"https://example.com/a.js": "` + integrity + `"}}`
+		r := httptest.NewRequest("POST", "/v1/build?lockfile="+url.QueryEscape(lock), nil)
+		if _, err := parseBuildRequest(r, "export {}"); err == nil {
+			t.Errorf("parseBuildRequest accepted a lockfile with %q", integrity)
+		}
+	}
+}
+
+func TestMalformedLockfileBodyRefused(t *testing.T) {
+	for _, integrity := range malformedIntegrity {
+		body := `{"source": "export {}", "lockfile": {"modules": {"https://example.com/a.js": "` + integrity + `"}}}`
+		r := httptest.NewRequest("POST", "/v1/build", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		serveJSONBuild(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("a lockfile with %q got %d, want 400: %s", integrity, w.Code, w.Body)
+		}
+	}
+}
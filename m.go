@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// modulePath is where single modules are served unbundled.
+const modulePath = "/m/"
+
+// moduleURL returns the URL serving the module at rawURL unbundled, with
+// the options in query.
+func moduleURL(rawURL, query string) string {
+	u := cfg.PublicURL + modulePath + url.PathEscape(rawURL)
+	if query != "" {
+		u += "?" + query
+	}
+	return u
+}
+
+// withModulePaths serves /m/ ahead of next. The URLs in those paths contain
+// "//", which http.ServeMux would redirect away.
+func withModulePaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, modulePath) {
+			handleModule(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleModule serves one remote module at /m/<encoded URL>, converted to an
+// ES module a browser can load directly. Nothing is bundled: each import,
+// including bare ones like "react", is rewritten to another /m/ URL, which
+// makes this a development alternative to bundling. Bare imports resolve
+// through the configured import map, or else the package CDN.
+//
+// The query string may set target and minify=true, and is passed on to the
+// module's imports.
+func handleModule(w http.ResponseWriter, r *http.Request) {
+	rawURL, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), modulePath))
+	if err != nil {
+		http.Error(w, "invalid module URL", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, "the module must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	target, ok := targetsByName[q.Get("target")]
+	if !ok && q.Get("target") != "" {
+		http.Error(w, "unknown target "+q.Get("target"), http.StatusBadRequest)
+		return
+	}
+	if loaderFor(rawURL) == api.LoaderCSS {
+		http.Error(w, "stylesheets aren't served as modules", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if !authorizeCaller(w, r) {
+		return
+	}
+	tenant, tenantKey := keyFor(r)
+	limits, _ := keyLimits(r, tenant, tenantKey)
+	if err := limits.checkUpstream(canonicalURL(rawURL)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, cached := modulesCache.get(canonicalURL(rawURL)); !cached && underPressure() {
+		writeOverloaded(w)
+		return
+	}
+	f := newFetcher()
+	f.limit(limits)
+	f.forTenant(tenant)
+	mod, err := f.fetch(rawURL)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	// The module may have been downloaded for another caller, which its
+	// redirects were allowed for.
+	if err := limits.checkUpstream(mod.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	cacheControl := "public, max-age=300"
+	if pinnedURL(rawURL) {
+		cacheControl = "public, max-age=31536000, immutable"
+	}
+	key := modulePath + r.URL.RawQuery + "@" + mod.SHA256
+	if done, ok := transformed.get(key); ok {
+		writeJavaScript(w, r, []byte(done.Contents), cacheControl)
+		return
+	}
+	code, errors := proxyModule(mod, proxyOptions{
+		Resolve: func(base *url.URL, path string) (string, error) {
+			return resolveModuleImport(base, path, r.URL.RawQuery)
+		},
+		Minify: q.Get("minify") == "true",
+		Target: target,
+	})
+	if len(errors) > 0 {
+		writeBuildErrors(w, errors, nil)
+		return
+	}
+	transformed.put(key, &module{URL: mod.URL, Contents: string(code), SHA256: mod.SHA256})
+	writeJavaScript(w, r, code, cacheControl)
+}
+
+// resolveModuleImport points an import of path from the module at base at
+// the /m/ URL serving it.
+func resolveModuleImport(base *url.URL, path, query string) (string, error) {
+	if isBareSpecifier(path) {
+		if mapped, ok := cfg.ImportMap.resolve(path, base.String()); ok {
+			path = mapped
+		} else {
+			path = cfg.Warm.packageCDN() + path
+		}
+	}
+	relative, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	return moduleURL(base.ResolveReference(relative).String(), query), nil
+}
@@ -1,72 +1,18 @@
 package main
 
 import (
-	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/evanw/esbuild/pkg/api"
 )
 
-var httpPlugin = api.Plugin{
-	Name: "http",
-	Setup: func(build api.PluginBuild) {
-		// Intercept import paths starting with "http:" and "https:" so
-		// esbuild doesn't attempt to map them to a file system location.
-		// Tag them with the "http-url" namespace to associate them with
-		// this plugin.
-		build.OnResolve(api.OnResolveOptions{Filter: `^https?://`},
-			func(args api.OnResolveArgs) (api.OnResolveResult, error) {
-				return api.OnResolveResult{
-					Path:      args.Path,
-					Namespace: "http-url",
-				}, nil
-			})
-
-		// We also want to intercept all import paths inside downloaded
-		// files and resolve them against the original URL. All of these
-		// files will be in the "http-url" namespace. Make sure to keep
-		// the newly resolved URL in the "http-url" namespace so imports
-		// inside it will also be resolved as URLs recursively.
-		build.OnResolve(api.OnResolveOptions{Filter: ".*", Namespace: "http-url"},
-			func(args api.OnResolveArgs) (api.OnResolveResult, error) {
-				base, err := url.Parse(args.Importer)
-				if err != nil {
-					return api.OnResolveResult{}, err
-				}
-				relative, err := url.Parse(args.Path)
-				if err != nil {
-					return api.OnResolveResult{}, err
-				}
-				return api.OnResolveResult{
-					Path:      base.ResolveReference(relative).String(),
-					Namespace: "http-url",
-				}, nil
-			})
-
-		// When a URL is loaded, we want to actually download the content
-		// from the internet. This has just enough logic to be able to
-		// handle the example import from unpkg.com but in reality this
-		// would probably need to be more complex.
-		build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: "http-url"},
-			func(args api.OnLoadArgs) (api.OnLoadResult, error) {
-				res, err := http.Get(args.Path)
-				if err != nil {
-					return api.OnLoadResult{}, err
-				}
-				defer res.Body.Close()
-				bytes, err := io.ReadAll(res.Body)
-				if err != nil {
-					return api.OnLoadResult{}, err
-				}
-				contents := string(bytes)
-				return api.OnLoadResult{Contents: &contents}, nil
-			})
-	},
-}
-
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -75,6 +21,104 @@ func main() {
 
 	// region := os.Getenv("FLY_REGION")
 
+	if err := loadConfig(); err != nil {
+		log.Fatal("loading config: ", err)
+	}
+	if os.Getenv("CONIFER_OFFLINE") == "true" {
+		cfg.Offline.Enabled = true
+	}
+	if cfg.Redis.URL != "" {
+		var err error
+		if sharedCache, err = newRedisCache(cfg.Redis); err != nil {
+			log.Fatal("connecting to redis: ", err)
+		}
+	}
+	if cfg.Artifacts != nil {
+		artifacts = &artifactStore{objects: newObjectStore(*cfg.Artifacts)}
+	}
+	modulesCache = newModuleCache(cfg.Cache)
+	if sharedCache != nil {
+		go sharedCache.subscribePurges(purgeLocalCaches)
+	}
+	if len(os.Args) == 3 && os.Args[1] == "replay" {
+		os.Exit(replayCommand(os.Args[2]))
+	}
+	if err := compilePolicies(); err != nil {
+		log.Fatal("loading policy: ", err)
+	}
+	if err := cfg.SmokeTest.check(); err != nil {
+		log.Fatal("smoke tests: ", err)
+	}
+	if cfg.Script != "" {
+		if err := loadScript(cfg.Script); err != nil {
+			log.Fatal("loading script: ", err)
+		}
+	}
+
+	go pressure.watch()
+
+	http.HandleFunc("/v1/shared-libraries", handleSharedLibraries)
+	http.HandleFunc(chunkPath, handleChunk)
+	http.HandleFunc("/v1/vendor", handleVendor)
+	http.HandleFunc("/v1/graph", handleGraph)
+	http.HandleFunc("/v1/transform", handleTransform)
+	http.HandleFunc("/v1/batch", handleBatch)
+	http.HandleFunc("/v1/sessions", handleSession)
+	http.HandleFunc("/v1/preview", handlePreview)
+	http.HandleFunc(previewPath, handlePreviewFile)
+	http.HandleFunc(connectServicePath, handleConnect)
+	http.HandleFunc("/v1/bundles/", handleBundleAPI)
+	http.HandleFunc("/bundles/", handleBundle)
+	http.HandleFunc("/fetch", handleFetch)
+	http.HandleFunc("/v1/bundle", handleBundleEntry)
+	http.HandleFunc("/v1/git", handleGit)
+	http.HandleFunc("/embed", handleEmbed)
+	http.HandleFunc(mirrorPath, handleMirror)
+	for _, u := range cfg.Upstreams {
+		http.HandleFunc(u.Prefix, handleUpstream(u))
+	}
+	http.HandleFunc("/v1/permalink", handlePermalinkAPI)
+	http.HandleFunc(permalinkPath, handlePermalink)
+	http.HandleFunc("/v1/embed-tokens", handleEmbedToken)
+	http.HandleFunc("/v1/signed-urls", handleSignedURL)
+	http.HandleFunc("/v1/limits", handleLimits)
+	http.HandleFunc("/v1/policy", handlePolicy)
+	http.HandleFunc("/v1/policy/dry-run", handlePolicyDryRun)
+	http.HandleFunc("/v1/ready", handleReady)
+	http.HandleFunc("/v1/builds/", handleBuildAPI)
+	http.HandleFunc("/v1/provenance-key", handleProvenanceKey)
+	http.HandleFunc("/v1/admin/popularity", handlePopularity)
+	http.HandleFunc("/v1/admin/purge", handlePurge)
+	http.HandleFunc("/v1/admin/warm", handleWarm)
+	http.HandleFunc("/v1/admin/mirror", handleMirrorAdmin)
+	http.HandleFunc("/v1/admin/cache-stats", handleCacheStats)
+	http.HandleFunc("/v1/admin/shadow", handleShadow)
+	http.HandleFunc("/v1/abuse-reports", handleAbuseReport)
+	http.HandleFunc("/v1/admin/abuse-reports", handleAbuseReview)
+	http.HandleFunc("/v1/admin/abuse-reports/", handleAbuseReview)
+	http.HandleFunc("/v1/artifacts/", handleArtifact)
+	http.HandleFunc("/v1/openapi.json", handleOpenAPI)
+	http.HandleFunc("/v1/build", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			switch contentType := r.Header.Get("Content-Type"); {
+			case strings.HasPrefix(contentType, "application/json"):
+				serveJSONBuild(w, r)
+				return
+			case strings.HasPrefix(contentType, "multipart/form-data"):
+				serveMultipartBuild(w, r)
+				return
+			case isArchive(contentType):
+				serveArchiveBuild(w, r)
+				return
+			case strings.HasPrefix(contentType, "text/html"):
+				serveHTMLBuild(w, r)
+				return
+			}
+		}
+		if source, ok := requestSource(w, r); ok {
+			serveBuild(w, r, source)
+		}
+	})
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		var source = ""
 		if r.URL.Path == "/health" {
@@ -88,52 +132,249 @@ func main() {
 			export * from 'https://raw.githubusercontent.com/RoyalIcing/modules/0003a973c63dfc78bbc595d5d3b7891b89a1b829/generators.js'
 			// export const pi = Math.PI;
 			`
-		} else if r.Method == "POST" {
-			defer r.Body.Close()
-			if b, err := io.ReadAll(r.Body); err == nil {
-				source = string(b)
-			}
-		} else if r.URL.Path == "/react@17.0.2" {
-			source = `
-			export * from "https://cdn.jsdelivr.net/npm/react@17.0.2/umd/react.production.min.js";
-			//export * from "https://cdn.jsdelivr.net/npm/react-dom@17.0.2/umd/react-dom.production.min.js";
-			`
+		} else if name, spec, subpath, ok := parsePackagePath(r.URL.Path); ok && r.Method == "GET" && !r.URL.Query().Has("source") {
+			handlePackage(w, r, name, spec, subpath)
+			return
 		} else {
-			source = r.URL.Query().Get("source")
+			// Building at the root is the original, unversioned API.
+			deprecateLegacyRoute(w, "/v1/build")
+			var ok bool
+			if source, ok = requestSource(w, r); !ok {
+				return
+			}
 		}
+		serveBuild(w, r, source)
+	})
 
-		var minify = r.URL.Query().Has("minify")
+	go func() {
+		if err := checkEngine(); err != nil {
+			log.Println("not ready:", err)
+			return
+		}
+		warming.enqueue(cfg.Warm.Entries)
+		go restoreSnapshot()
+		hostedMirror.start()
+	}()
+
+	srv := &http.Server{Addr: ":" + port, Handler: withAPIVersion(withRateLimits(withKnownKeys(withShadow(withModulePaths(http.DefaultServeMux)))))}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		log.Println("shutting down")
+		shutdown(srv)
+	}()
+	log.Println("listening on", port)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// ListenAndServe returns as soon as shutdown starts, so wait for the
+	// snapshot to be saved.
+	<-shutdownDone
+}
+
+// serveBuild builds source with the options in the request's query string
+// and responds with the output.
+func serveBuild(w http.ResponseWriter, r *http.Request, source string) {
+	if r.URL.Query().Get("differential") == "true" {
+		// The same URL serves different output depending on the
+		// browser, so caches must keep a copy per User-Agent.
+		w.Header().Add("Vary", "User-Agent")
+	}
+	req, err := parseBuildRequest(r, source)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveBuildRequest(w, r, req)
+}
 
-		result := api.Build(api.BuildOptions{
-			Stdin: &api.StdinOptions{
-				Contents: source,
-				// These are all optional:
-				ResolveDir: "./src",
-				Sourcefile: "imaginary-file.js",
-				Loader:     api.LoaderJS,
-			},
-			Format:            api.FormatESModule,
-			Bundle:            true,
-			Plugins:           []api.Plugin{httpPlugin},
-			Write:             false,
-			MinifyWhitespace:  minify,
-			MinifyIdentifiers: minify,
-			MinifySyntax:      minify,
-		})
+// handleBundleEntry bundles the module at a URL, using it as the entry
+// point rather than a source importing it, with the same options as
+// /v1/build:
+//
+//	GET /v1/bundle?entry=https://example.com/app.js&format=iife&minify
+//
+// An entry ending in .html is a page, whose scripts and stylesheets are
+// built, see servePage.
+func handleBundleEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	entry := r.URL.Query().Get("entry")
+	if !strings.HasPrefix(entry, "https://") && !strings.HasPrefix(entry, "http://") {
+		http.Error(w, "entry must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("differential") == "true" {
+		w.Header().Add("Vary", "User-Agent")
+	}
+	req, err := parseBuildRequest(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !req.Bundle {
+		http.Error(w, "entry can only be bundled", http.StatusBadRequest)
+		return
+	}
+	req.Entry = entry
+	if isHTMLEntry(entry) {
+		serveHTMLEntry(w, r, req)
+		return
+	}
+	serveBuildRequest(w, r, req)
+}
 
-		if len(result.Errors) > 0 {
-			http.Error(w, result.Errors[0].Text, http.StatusInternalServerError)
+// serveBuildRequest runs a build parsed from the query string and responds
+// with the output, its lockfile when output=lockfile, its deploy manifest
+// when output=manifest, a trace of its imports when output=imports, an
+// archive of it and its chunks when output=zip or output=tar, an analysis
+// of it when analyze=json, analyze=text or analyze=treemap, the licenses of
+// the code in it when licenses=json, its bill of materials when
+// sbom=cyclonedx or sbom=spdx, or a JSON envelope holding it and its
+// warnings when envelope=json.
+func serveBuildRequest(w http.ResponseWriter, r *http.Request, req buildRequest) {
+	analyze := r.URL.Query().Get("analyze")
+	if analyze != "" && analyze != "json" && analyze != "text" && analyze != "treemap" {
+		http.Error(w, "analyze must be json, text or treemap", http.StatusBadRequest)
+		return
+	}
+	licenses := r.URL.Query().Get("licenses")
+	if licenses != "" && licenses != "json" {
+		http.Error(w, "licenses must be json", http.StatusBadRequest)
+		return
+	}
+	sbom := r.URL.Query().Get("sbom")
+	if sbom != "" && sbom != "cyclonedx" && sbom != "spdx" {
+		http.Error(w, "sbom must be cyclonedx or spdx", http.StatusBadRequest)
+		return
+	}
+	envelope := r.URL.Query().Get("envelope")
+	if envelope != "" && envelope != "json" {
+		http.Error(w, "envelope must be json", http.StatusBadRequest)
+		return
+	}
+	compare := r.URL.Query().Get("compareMinify") == "true"
+	stream := wantsEventStream(r)
+	if stream && (analyze != "" || licenses != "" || sbom != "" || envelope != "" || compare || r.URL.Query().Get("output") != "") {
+		http.Error(w, "analyses and other outputs can't be streamed", http.StatusBadRequest)
+		return
+	}
+	if compare {
+		if analyze != "" || r.URL.Query().Get("output") != "" {
+			http.Error(w, "compareMinify can't be combined with analyze or output", http.StatusBadRequest)
 			return
 		}
+		// The comparison minifies the unminified output each way.
+		req.Minify, req.MinifyParts, req.Sourcemap = false, nil, ""
+	}
+	if analyze == "treemap" {
+		// The treemap builds minified output itself, to compare with.
+		req.Minify, req.MinifyParts = false, nil
+	}
+	if !authorizeBuild(w, r, &req) {
+		return
+	}
+	if stream {
+		streamBuild(w, r, req)
+		return
+	}
+	start := time.Now()
+	result, ok := runRecordedBuild(w, req)
+	if !ok {
+		return
+	}
+
+	switch r.URL.Query().Get("output") {
+	case "lockfile":
+		writeJSON(w, http.StatusOK, newLockfile(result.Manifest))
+		return
+	case "manifest":
+		writeDeployManifest(w, req, result, start)
+		return
+	case "imports":
+		writeImportTrace(w, req, result)
+		return
+	}
+	if licenses != "" {
+		writeLicenseReport(w, result)
+		return
+	}
+	if sbom != "" {
+		writeSBOM(w, sbom, req, result)
+		return
+	}
+	if analyze == "treemap" {
+		writeTreemap(w, req, result)
+		return
+	}
+	if analyze != "" {
+		writeAnalysis(w, analyze, result)
+		return
+	}
+	if compare {
+		writeMinifyComparison(w, req, result)
+		return
+	}
+	if envelope != "" {
+		writeJSON(w, http.StatusOK, newBuildEnvelope(w, jsonBuildRequest{}, req, result))
+		return
+	}
+	// Archives can be asked for with the Accept header.
+	w.Header().Add("Vary", "Accept")
+	if format := outputArchive(r); format != "" {
+		writeOutputArchive(w, r, format, req, result, buildOutputs(req, result, false))
+		return
+	}
 
-		w.Header().Add("Content-Type", "text/javascript;charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
+	w.Header().Set("X-Conifer-Engine", "esbuild/"+engine.Esbuild)
+	writeJavaScript(w, r, result.Code, buildCacheControl(req, result))
+}
 
-		if len(result.OutputFiles) > 0 {
-			w.Write(result.OutputFiles[0].Contents)
+// runRecordedBuild runs an authorized build, recording it and setting the
+// headers identifying it. When it fails, the failure is written and false
+// is returned.
+func runRecordedBuild(w http.ResponseWriter, req buildRequest) (*buildResult, bool) {
+	result, err := runCachedBuild(req)
+	if err != nil {
+		writeOverloaded(w)
+		return nil, false
+	}
+	if len(result.Errors) > 0 {
+		writeBuildErrors(w, result.Errors, result.Warnings)
+		return nil, false
+	}
+	// The output is only measured once built, and the same build may be
+	// shared with callers allowed more, so this isn't a build error.
+	if max := req.limits().MaxOutputBytes; max > 0 && int64(result.Manifest.OutputBytes) > max {
+		err := &outputSizeError{Bytes: result.Manifest.OutputBytes, Max: max}
+		writeBuildErrors(w, []api.Message{{Text: err.Error(), Detail: err}}, result.Warnings)
+		return nil, false
+	}
+	if result.Metafile != nil {
+		popularity.record(result.Metafile)
+		if req.Tenant != "" {
+			libraries.record(req.Tenant, result.Metafile)
 		}
-	})
-
-	log.Println("listening on", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	}
+	postBuildHook(req.Tenant, req, result)
+	if release := uploadSourceMap(req, result); release != "" {
+		w.Header().Set("X-Conifer-Release", release)
+	}
+	w.Header().Set("X-Conifer-Build", builds.record(req, result))
+	// Warnings, like direct eval or duplicate exports, don't fail a build,
+	// so responses without them at least say how many there were.
+	w.Header().Set("X-Build-Warnings-Count", strconv.Itoa(len(result.Warnings)))
+	if result.Artifact != "" {
+		w.Header().Set("X-Conifer-Artifact", result.Artifact)
+	}
+	if len(result.Manifest.Polyfills) > 0 {
+		w.Header().Set("X-Conifer-Polyfills", strings.Join(result.Manifest.Polyfills, ", "))
+	}
+	if result.Manifest.SmokeTest != "" {
+		w.Header().Set("X-Conifer-Smoke-Test", result.Manifest.SmokeTest)
+	}
+	return result, true
 }
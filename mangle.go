@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+var bundleNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+// validBundleName reports whether name can name a bundle. Names end up in
+// file paths and URLs, so they are kept simple.
+func validBundleName(name string) bool {
+	return bundleNamePattern.MatchString(name)
+}
+
+// bundleKey scopes a bundle name to its tenant, so tenants can't see or
+// affect each other's bundles.
+func bundleKey(tenant, name string) string {
+	if tenant == "" {
+		tenant = "_"
+	}
+	return tenant + "/" + name
+}
+
+// mangleCacheStore keeps esbuild's mangle cache for each named bundle, so
+// successive builds of a bundle keep giving mangled properties the same
+// names. Changing names would invalidate every long-cached chunk that
+// refers to them.
+type mangleCacheStore struct {
+	mu     sync.Mutex
+	caches map[string]map[string]interface{}
+}
+
+var mangleCaches = &mangleCacheStore{caches: make(map[string]map[string]interface{})}
+
+func (s *mangleCacheStore) path(key string) string {
+	return filepath.Join(cfg.DataDir, "mangle", filepath.FromSlash(key)+".json")
+}
+
+func (s *mangleCacheStore) load(key string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cache, ok := s.caches[key]; ok {
+		return cache
+	}
+	cache := make(map[string]interface{})
+	if cfg.DataDir != "" {
+		if data, err := os.ReadFile(s.path(key)); err == nil {
+			json.Unmarshal(data, &cache)
+		}
+	}
+	s.caches[key] = cache
+	return cache
+}
+
+func (s *mangleCacheStore) save(key string, cache map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.caches[key] = cache
+	if cfg.DataDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(key), data)
+}
+
+// writeFileAtomic writes data to path through a temporary file, so readers
+// never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// metafile is esbuild's metafile JSON, describing a build's inputs and
+// outputs. It has every field esbuild writes, so it can be given back to
+// esbuild for analysis.
+type metafile struct {
+	Inputs  map[string]metafileInput  `json:"inputs"`
+	Outputs map[string]metafileOutput `json:"outputs"`
+}
+
+type metafileInput struct {
+	Bytes   int              `json:"bytes"`
+	Imports []metafileImport `json:"imports"`
+	Format  string           `json:"format,omitempty"`
+}
+
+type metafileImport struct {
+	Path     string `json:"path"`
+	Kind     string `json:"kind"`
+	Original string `json:"original,omitempty"`
+}
+
+type metafileOutput struct {
+	Bytes   int                            `json:"bytes"`
+	Inputs  map[string]metafileOutputInput `json:"inputs"`
+	Imports []metafileImport               `json:"imports"`
+	// EntryPoint is the input an output was made for, when it is an entry
+	// point or a chunk code splitting made of a dynamic import.
+	EntryPoint string   `json:"entryPoint,omitempty"`
+	Exports    []string `json:"exports,omitempty"`
+}
+
+type metafileOutputInput struct {
+	BytesInOutput int `json:"bytesInOutput"`
+}
+
+func parseMetafile(s string) (*metafile, error) {
+	var m metafile
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// inputURL returns the URL of a remote module from its metafile path, which
+// esbuild prefixes with the plugin namespace.
+func inputURL(path string) (string, bool) {
+	if !strings.HasPrefix(path, "http-url:") {
+		return "", false
+	}
+	return strings.TrimPrefix(path, "http-url:"), true
+}
+
+// writeAnalysis responds with what makes up a build's output instead of the
+// output: the metafile for analyze=json, or esbuild's summary of the bytes
+// each input contributes for analyze=text.
+func writeAnalysis(w http.ResponseWriter, analyze string, result *buildResult) {
+	if result.Metafile == nil {
+		http.Error(w, "only bundled builds can be analyzed", http.StatusBadRequest)
+		return
+	}
+	if analyze == "json" {
+		writeJSON(w, http.StatusOK, result.Metafile)
+		return
+	}
+	summary, err := derived.get("analyze.text.v1", buildHash(result.Manifest, sha256Hex(result.Code)), func() ([]byte, error) {
+		data, err := json.Marshal(result.Metafile)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(api.AnalyzeMetafile(string(data), api.AnalyzeMetafileOptions{})), nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(summary)
+}
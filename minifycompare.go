@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// minifySize is the size of a build's output minified some way.
+type minifySize struct {
+	Bytes     int `json:"bytes"`
+	GzipBytes int `json:"gzipBytes"`
+	// Saved and GzipSaved are how many bytes smaller than the unminified
+	// output it is.
+	Saved     int `json:"saved"`
+	GzipSaved int `json:"gzipSaved"`
+}
+
+// minifyComparison reports what each kind of minification saves on its
+// own, and all of them together.
+type minifyComparison struct {
+	Unminified  minifySize `json:"unminified"`
+	Whitespace  minifySize `json:"whitespace"`
+	Identifiers minifySize `json:"identifiers"`
+	Syntax      minifySize `json:"syntax"`
+	All         minifySize `json:"all"`
+}
+
+func gzipSize(code []byte) int {
+	var b bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+	gz.Write(code)
+	gz.Close()
+	return b.Len()
+}
+
+// compareMinify minifies a build's unminified output each way. Minifying
+// the output rather than building again reuses the modules it resolved
+// and bundled, which is where a build spends its time. Splitting's chunks
+// aren't counted.
+func compareMinify(req buildRequest, code []byte) (*minifyComparison, error) {
+	loader := api.LoaderJS
+	if req.Loader == "css" {
+		loader = api.LoaderCSS
+	}
+	unminified := minifySize{Bytes: len(code), GzipBytes: gzipSize(code)}
+	size := func(parts minifyParts) (minifySize, error) {
+		minified := api.Transform(string(code), api.TransformOptions{
+			Loader: loader,
+			// With a format, top-level names are minified too, as they
+			// are when bundling.
+			Format:            formatsByName[req.Format],
+			Target:            targetsByName[req.Target],
+			MinifyWhitespace:  parts.Whitespace,
+			MinifyIdentifiers: parts.Identifiers,
+			MinifySyntax:      parts.Syntax,
+		})
+		if len(minified.Errors) > 0 {
+			return minifySize{}, errors.New("minifying the output: " + minified.Errors[0].Text)
+		}
+		s := minifySize{Bytes: len(minified.Code), GzipBytes: gzipSize(minified.Code)}
+		s.Saved, s.GzipSaved = unminified.Bytes-s.Bytes, unminified.GzipBytes-s.GzipBytes
+		return s, nil
+	}
+	c := &minifyComparison{Unminified: unminified}
+	for _, v := range []struct {
+		size  *minifySize
+		parts minifyParts
+	}{
+		{&c.Whitespace, minifyParts{Whitespace: true}},
+		{&c.Identifiers, minifyParts{Identifiers: true}},
+		{&c.Syntax, minifyParts{Syntax: true}},
+		{&c.All, minifyParts{Whitespace: true, Identifiers: true, Syntax: true}},
+	} {
+		s, err := size(v.parts)
+		if err != nil {
+			return nil, err
+		}
+		*v.size = s
+	}
+	return c, nil
+}
+
+// writeMinifyComparison responds with what minifying a build's output each
+// way saves, instead of the output.
+func writeMinifyComparison(w http.ResponseWriter, req buildRequest, result *buildResult) {
+	report, err := derived.get("minify.compare.v1", buildHash(result.Manifest, sha256Hex(result.Code)+" "+req.Loader+" "+req.Format+" "+req.Target), func() ([]byte, error) {
+		c, err := compareMinify(req, result.Code)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(c)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var c minifyComparison
+	json.Unmarshal(report, &c)
+	writeJSON(w, http.StatusOK, c)
+}
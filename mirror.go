@@ -0,0 +1,271 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// mirrorPath is where mirrored files are served, as /mirror/<host>/<path>.
+const mirrorPath = "/mirror/"
+
+const defaultMirrorRefresh = 24 * time.Hour
+
+// hostedMirrorConfig configures the mirror conifer keeps of upstream
+// modules in its own storage. Mirrored modules are used in preference to
+// downloading them, so builds needing only mirrored modules keep working
+// however long upstream is down. Unlike Mirrors, which fail over between
+// CDNs, nothing here is fetched at build time.
+type hostedMirrorConfig struct {
+	// Entries are module URLs or package specs like "react@17.0.2",
+	// mirrored along with everything they import.
+	Entries []string `json:"entries"`
+	// Dir holds the mirrored files, laid out as <host>/<path> so it can
+	// also be used as the offline VendorDir. It defaults to "mirror" in
+	// DataDir.
+	Dir string `json:"dir"`
+	// Refresh is how often entries are downloaded again, defaulting to a
+	// day. Files are only replaced once an entry's whole graph downloads.
+	Refresh duration `json:"refresh"`
+}
+
+func (c hostedMirrorConfig) dir() string {
+	if c.Dir != "" {
+		return c.Dir
+	}
+	if cfg.DataDir != "" {
+		return filepath.Join(cfg.DataDir, "mirror")
+	}
+	return ""
+}
+
+func (c hostedMirrorConfig) refresh() time.Duration {
+	if c.Refresh > 0 {
+		return time.Duration(c.Refresh)
+	}
+	return defaultMirrorRefresh
+}
+
+// mirrorStatus reports how the last sync of an entry went.
+type mirrorStatus struct {
+	Entry   string    `json:"entry"`
+	Synced  time.Time `json:"synced,omitempty"`
+	Modules int       `json:"modules"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// mirrorStore syncs the configured entries in the background.
+type mirrorStore struct {
+	once sync.Once
+	// syncing is set while entries are being synced.
+	syncing int32
+
+	mu       sync.Mutex
+	statuses map[string]mirrorStatus
+}
+
+var hostedMirror = &mirrorStore{statuses: make(map[string]mirrorStatus)}
+
+// start syncs every entry now and then again every refresh interval.
+func (m *mirrorStore) start() {
+	if len(cfg.Mirror.Entries) == 0 {
+		return
+	}
+	if cfg.Mirror.dir() == "" {
+		log.Println("mirror: neither mirror.dir nor dataDir is set, so nothing is mirrored")
+		return
+	}
+	m.once.Do(func() {
+		go func() {
+			for {
+				m.syncAll()
+				time.Sleep(cfg.Mirror.refresh())
+			}
+		}()
+	})
+}
+
+// get returns the mirrored copy of the module at url.
+func (m *mirrorStore) get(url string) (*module, bool) {
+	dir := cfg.Mirror.dir()
+	if len(cfg.Mirror.Entries) == 0 || dir == "" {
+		return nil, false
+	}
+	mod, err := readVendored(dir, url)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("mirror:", err)
+		}
+		return nil, false
+	}
+	return mod, true
+}
+
+// syncAll downloads every entry again, unless a sync is already running.
+func (m *mirrorStore) syncAll() {
+	if !atomic.CompareAndSwapInt32(&m.syncing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&m.syncing, 0)
+	for _, entry := range cfg.Mirror.Entries {
+		status := m.sync(entry)
+		if status.Error != "" {
+			log.Printf("mirroring %s: %s", entry, status.Error)
+		}
+		m.mu.Lock()
+		if previous, ok := m.statuses[entry]; ok && status.Error != "" {
+			// The files from the last successful sync are still served.
+			status.Synced = previous.Synced
+			status.Modules = previous.Modules
+		}
+		m.statuses[entry] = status
+		m.mu.Unlock()
+	}
+}
+
+// sync downloads entry's module graph from upstream, bypassing the mirror
+// and the module cache, and stores every module in it.
+func (m *mirrorStore) sync(entry string) mirrorStatus {
+	status := mirrorStatus{Entry: entry}
+	for underPressure() {
+		time.Sleep(time.Second)
+	}
+	built := runBuild(buildRequest{
+		Source:      warmSource(entry),
+		Bundle:      true,
+		ImportMap:   cfg.ImportMap,
+		BypassCache: true,
+		NoMirror:    true,
+	})
+	if len(built.Errors) > 0 {
+		status.Error = built.Errors[0].Text
+		return status
+	}
+	dir := cfg.Mirror.dir()
+	byURL := make(map[string]*module)
+	for _, mod := range built.Modules {
+		byURL[mod.URL] = mod
+	}
+	// Requests that were redirected are mirrored under the URL asked for
+	// too, so they don't need upstream to find where they lead.
+	for _, edge := range built.Graph {
+		if requested := requestedURL(edge); requested != "" && byURL[requested] == nil && byURL[edge.URL] != nil {
+			byURL[requested] = byURL[edge.URL]
+		}
+	}
+	for u, mod := range byURL {
+		file := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(vendorPath(u), "vendor/")))
+		if err := writeFileAtomic(file, []byte(mod.Contents)); err != nil {
+			status.Error = err.Error()
+			return status
+		}
+	}
+	status.Synced = time.Now().UTC()
+	status.Modules = len(built.Modules)
+	return status
+}
+
+// requestedURL returns the URL an import asked for before any redirects, or
+// "" when it was bare or left external.
+func requestedURL(edge importEdge) string {
+	if edge.External || isBareSpecifier(edge.Specifier) {
+		return ""
+	}
+	specifier, _ := splitIntegrity(edge.Specifier)
+	ref, err := url.Parse(specifier)
+	if err != nil {
+		return ""
+	}
+	if !ref.IsAbs() {
+		base, err := url.Parse(edge.Importer)
+		if edge.Importer == "" || err != nil {
+			return ""
+		}
+		ref = base.ResolveReference(ref)
+	}
+	return canonicalURL(ref.String())
+}
+
+func (m *mirrorStore) report() []mirrorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]mirrorStatus, 0, len(cfg.Mirror.Entries))
+	for _, entry := range cfg.Mirror.Entries {
+		status, ok := m.statuses[entry]
+		if !ok {
+			status = mirrorStatus{Entry: entry}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// handleMirror serves mirrored files unchanged, as upstream served them:
+//
+//	GET /mirror/cdn.jsdelivr.net/npm/react@17.0.2/index.js
+func handleMirror(w http.ResponseWriter, r *http.Request) {
+	dir := cfg.Mirror.dir()
+	rest := strings.TrimPrefix(r.URL.Path, mirrorPath)
+	if len(cfg.Mirror.Entries) == 0 || dir == "" || !strings.Contains(rest, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	file := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+rest)))
+	data, err := os.ReadFile(file)
+	if err != nil {
+		// Directories can't be read either, and aren't listed.
+		http.NotFound(w, r)
+		return
+	}
+	contentType := "text/javascript;charset=UTF-8"
+	switch loaderFor("file:///" + rest) {
+	case api.LoaderJSON:
+		contentType = "application/json"
+	case api.LoaderCSS:
+		contentType = "text/css;charset=UTF-8"
+	}
+	etag := `"` + sha256Hex(data)[:32] + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// handleMirrorAdmin reports on the mirror, or syncs it straight away:
+//
+//	GET  /v1/admin/mirror  how the last sync of each entry went
+//	POST /v1/admin/mirror  sync every entry now
+func handleMirrorAdmin(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"dir":     cfg.Mirror.dir(),
+			"entries": hostedMirror.report(),
+		})
+	case "POST":
+		if len(cfg.Mirror.Entries) == 0 || cfg.Mirror.dir() == "" {
+			http.Error(w, "no mirror is configured", http.StatusConflict)
+			return
+		}
+		go hostedMirror.syncAll()
+		writeJSON(w, http.StatusAccepted, map[string]int{"syncing": len(cfg.Mirror.Entries)})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
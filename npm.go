@@ -0,0 +1,685 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+const (
+	defaultNPMRegistry = "https://registry.npmjs.org/"
+	// packumentTTL is how long a package's versions and tags are taken to
+	// be unchanged before asking the registry again.
+	packumentTTL        = 5 * time.Minute
+	maxPackumentBytes   = 32 << 20
+	maxPackageJSONBytes = 4 << 20
+	// maxReexports limits how many modules are followed through
+	// module.exports = require(...) when finding a CommonJS module's exports.
+	maxReexports = 8
+)
+
+// packageJSON is the part of a package version's package.json that decides
+// which of its files are imported.
+type packageJSON struct {
+	Name    string          `json:"name"`
+	Version string          `json:"version"`
+	Type    string          `json:"type"`
+	Module  string          `json:"module"`
+	Main    string          `json:"main"`
+	Browser json.RawMessage `json:"browser"`
+	Exports json.RawMessage `json:"exports"`
+
+	Dependencies         map[string]string `json:"dependencies"`
+	PeerDependencies     map[string]string `json:"peerDependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+}
+
+// dependencyRange returns the range of versions of name the package
+// depends on, or "" when it doesn't declare it.
+func (p *packageJSON) dependencyRange(name string) string {
+	for _, deps := range []map[string]string{p.Dependencies, p.PeerDependencies, p.OptionalDependencies} {
+		if r, ok := deps[name]; ok {
+			return r
+		}
+	}
+	return ""
+}
+
+type cachedPackument struct {
+	versions []string
+	distTags map[string]string
+	expires  time.Time
+}
+
+// npmPackuments remembers the versions and tags of packages recently, and
+// npmManifests the package.json of versions, which never change once
+// published.
+var (
+	npmPackuments = struct {
+		sync.Mutex
+		m map[string]cachedPackument
+	}{m: make(map[string]cachedPackument)}
+	npmManifests = struct {
+		sync.Mutex
+		m map[string]*packageJSON
+	}{m: make(map[string]*packageJSON)}
+	cjsExportNames = struct {
+		sync.Mutex
+		m map[string][]string
+	}{m: make(map[string][]string)}
+)
+
+// packageNotFoundError is a package, version or file of a package that
+// doesn't exist.
+type packageNotFoundError struct {
+	What string
+}
+
+func (e *packageNotFoundError) Error() string {
+	return e.What + " was not found"
+}
+
+func npmRegistry() string {
+	if cfg.NPMRegistry == "" {
+		return defaultNPMRegistry
+	}
+	return strings.TrimSuffix(cfg.NPMRegistry, "/") + "/"
+}
+
+// registryGet downloads a document about name from the registry.
+func registryGet(f *fetcher, name, rest, accept string, maxBytes int64) ([]byte, error) {
+	u := npmRegistry() + strings.Replace(name, "/", "%2f", 1) + rest
+	data, err := mirroredGet(f, u, accept, maxBytes)
+	var status *statusError
+	if errors.As(err, &status) && status.Code == http.StatusNotFound {
+		return nil, &packageNotFoundError{What: "package " + name + strings.Replace(rest, "/", "@", 1)}
+	}
+	return data, err
+}
+
+// resolvePackageVersion returns the newest version of name in spec, which
+// is an exact version, a range like "^18.2" or a tag like "latest".
+func resolvePackageVersion(f *fetcher, name, spec string) (string, error) {
+	// Packages are cached for everyone, as modules are.
+	if err := f.checkCredentials(npmRegistry()); err != nil {
+		return "", err
+	}
+	if spec == "" {
+		spec = "latest"
+	}
+	if _, ok := parseSemver(spec); ok {
+		return strings.TrimPrefix(strings.TrimPrefix(spec, "="), "v"), nil
+	}
+
+	npmPackuments.Lock()
+	p, ok := npmPackuments.m[name]
+	npmPackuments.Unlock()
+	if !ok || time.Now().After(p.expires) {
+		// The abbreviated document lists versions without the rest of
+		// each package.json, which for popular packages is far smaller.
+		data, err := registryGet(f, name, "", "application/vnd.npm.install-v1+json", maxPackumentBytes)
+		if err != nil {
+			return "", err
+		}
+		var doc struct {
+			DistTags map[string]string          `json:"dist-tags"`
+			Versions map[string]json.RawMessage `json:"versions"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return "", fmt.Errorf("the registry's document for %s is invalid: %w", name, err)
+		}
+		p = cachedPackument{distTags: doc.DistTags, expires: time.Now().Add(packumentTTL)}
+		for v := range doc.Versions {
+			p.versions = append(p.versions, v)
+		}
+		sort.Strings(p.versions)
+		npmPackuments.Lock()
+		npmPackuments.m[name] = p
+		npmPackuments.Unlock()
+	}
+
+	if v, ok := p.distTags[spec]; ok {
+		return v, nil
+	}
+	r, ok := parseSemverRange(spec)
+	if !ok {
+		return "", &packageNotFoundError{What: "tag " + spec + " of " + name}
+	}
+	v, ok := r.maxSatisfying(p.versions)
+	if !ok {
+		return "", &packageNotFoundError{What: "a version of " + name + " in " + spec}
+	}
+	return v, nil
+}
+
+// packageManifest returns the package.json of a version of name.
+func packageManifest(f *fetcher, name, version string) (*packageJSON, error) {
+	if err := f.checkCredentials(npmRegistry()); err != nil {
+		return nil, err
+	}
+	key := name + "@" + version
+	npmManifests.Lock()
+	pkg, ok := npmManifests.m[key]
+	npmManifests.Unlock()
+	if ok {
+		return pkg, nil
+	}
+	data, err := registryGet(f, name, "/"+version, "application/json", maxPackageJSONBytes)
+	if err != nil {
+		return nil, err
+	}
+	pkg = &packageJSON{}
+	if err := json.Unmarshal(data, pkg); err != nil {
+		return nil, fmt.Errorf("the package.json of %s is invalid: %w", key, err)
+	}
+	npmManifests.Lock()
+	npmManifests.m[key] = pkg
+	npmManifests.Unlock()
+	return pkg, nil
+}
+
+var packagePath = regexp.MustCompile(`^/((?:@[a-z0-9][\w.-]*/)?[a-z0-9][\w.-]*)(?:@([^/@]+))?(/[^@]*)?$`)
+
+// parsePackagePath reads a package path like "/react@18.2.0",
+// "/lodash-es@4/debounce" or "/@scope/pkg@1.2.3/sub/path" into the package
+// name, the version, range or tag, and the subpath.
+func parsePackagePath(p string) (name, spec, subpath string, ok bool) {
+	m := packagePath.FindStringSubmatch(p)
+	if m == nil {
+		return "", "", "", false
+	}
+	return m[1], m[2], strings.TrimSuffix(m[3], "/"), true
+}
+
+// splitBareSpecifier splits an import like "react-dom/client" into the
+// package and the subpath.
+func splitBareSpecifier(specifier string) (string, string) {
+	parts := strings.SplitN(specifier, "/", 3)
+	n := 1
+	if strings.HasPrefix(specifier, "@") && len(parts) > 1 {
+		n = 2
+	}
+	if len(parts) <= n {
+		return specifier, ""
+	}
+	name := strings.Join(parts[:n], "/")
+	return name, strings.TrimPrefix(specifier, name)
+}
+
+// packageAtURL returns the package and exact version a URL on the package
+// CDN belongs to.
+func packageAtURL(rawURL string) (string, string, bool) {
+	cdn := cfg.Warm.packageCDN()
+	if !strings.HasPrefix(rawURL, cdn) {
+		return "", "", false
+	}
+	name, version, _, ok := parsePackagePath("/" + strings.TrimPrefix(rawURL, cdn))
+	if _, exact := parseSemver(version); !ok || !exact {
+		return "", "", false
+	}
+	return name, version, true
+}
+
+// exportConditions are the conditions of package.json exports that apply
+// to builds for browsers, in the order they are preferred.
+var exportConditions = []string{"browser", "production", "import", "module", "default", "require"}
+
+// resolveExports finds the file exports maps subpath, like "." or
+// "./debounce", to, and the condition picked.
+func resolveExports(exports json.RawMessage, subpath string) (string, string, bool) {
+	var m map[string]json.RawMessage
+	if json.Unmarshal(exports, &m) != nil || len(m) == 0 {
+		if subpath != "." {
+			return "", "", false
+		}
+		return resolveConditions(exports, "")
+	}
+	subpaths := false
+	for key := range m {
+		subpaths = subpaths || strings.HasPrefix(key, ".")
+	}
+	if !subpaths {
+		if subpath != "." {
+			return "", "", false
+		}
+		return resolveConditions(exports, "")
+	}
+	if target, ok := m[subpath]; ok {
+		return resolveConditions(target, "")
+	}
+	// Patterns like "./*" or "./features/*.js" match the longest prefix.
+	best, star := "", ""
+	for key := range m {
+		i := strings.IndexByte(key, '*')
+		if i < 0 || len(key[:i]) <= len(best) {
+			continue
+		}
+		prefix, suffix := key[:i], key[i+1:]
+		if strings.HasPrefix(subpath, prefix) && strings.HasSuffix(subpath, suffix) && len(subpath) >= len(prefix)+len(suffix) {
+			best, star = key, subpath[len(prefix):len(subpath)-len(suffix)]
+		}
+	}
+	if best == "" {
+		return "", "", false
+	}
+	file, condition, ok := resolveConditions(m[best], "")
+	return strings.ReplaceAll(file, "*", star), condition, ok
+}
+
+// resolveConditions picks a file from an exports target, which is a path,
+// a list of targets or an object of targets by condition.
+func resolveConditions(target json.RawMessage, condition string) (string, string, bool) {
+	var file string
+	if json.Unmarshal(target, &file) == nil {
+		return file, condition, file != ""
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(target, &list) == nil {
+		for _, t := range list {
+			if file, c, ok := resolveConditions(t, condition); ok {
+				return file, c, true
+			}
+		}
+		return "", "", false
+	}
+	var m map[string]json.RawMessage
+	if json.Unmarshal(target, &m) != nil {
+		return "", "", false
+	}
+	for _, c := range exportConditions {
+		if t, ok := m[c]; ok {
+			if file, picked, ok := resolveConditions(t, c); ok {
+				return file, picked, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// packageEntry returns the URL of the file a subpath of a package, "" for
+// the package itself, is built from, and whether it is an ES module.
+func packageEntry(f *fetcher, pkg *packageJSON, baseURL, subpath string) (string, bool, error) {
+	var candidates []string
+	condition := ""
+	if len(pkg.Exports) > 0 && string(pkg.Exports) != "null" {
+		file, c, ok := resolveExports(pkg.Exports, "."+subpath)
+		if !ok {
+			return "", false, &packageNotFoundError{What: "export ." + subpath + " of " + pkg.Name}
+		}
+		candidates, condition = []string{file}, c
+	} else if subpath == "" {
+		var browser string
+		json.Unmarshal(pkg.Browser, &browser)
+		for _, file := range []string{pkg.Module, browser, pkg.Main, "index.js"} {
+			if file != "" {
+				candidates = append(candidates, file)
+			}
+		}
+		if pkg.Module != "" {
+			condition = "module"
+		}
+	} else {
+		candidates = []string{subpath}
+	}
+
+	// Like Node, files may be named without their extension, or be a
+	// directory with an index file. Those are tried first, as CDNs answer
+	// a directory's path with a listing of it.
+	file := path.Clean("/" + candidates[0])
+	var tried []string
+	for _, c := range candidates {
+		c = path.Clean("/" + c)
+		switch path.Ext(c) {
+		case ".js", ".mjs", ".cjs":
+		default:
+			tried = append(tried, c+".js", c+".mjs", c+"/index.js")
+		}
+		tried = append(tried, c)
+	}
+	var mod *module
+	var err error
+	for _, c := range tried {
+		if mod, err = f.fetch(baseURL + strings.TrimPrefix(c, "/")); err == nil {
+			file = c
+			break
+		}
+	}
+	if err != nil {
+		return "", false, &packageNotFoundError{What: "file " + file + " of " + pkg.Name + "@" + pkg.Version}
+	}
+
+	var esm bool
+	switch {
+	case strings.HasSuffix(file, ".mjs"):
+		esm = true
+	case strings.HasSuffix(file, ".cjs"), condition == "require":
+		esm = false
+	case condition == "import", condition == "module", pkg.Type == "module":
+		esm = true
+	default:
+		esm = esmSyntax.MatchString(mod.Contents)
+	}
+	return baseURL + strings.TrimPrefix(file, "/"), esm, nil
+}
+
+var (
+	// esmSyntax finds import and export statements, which CommonJS modules
+	// don't have.
+	esmSyntax = regexp.MustCompile(`(?:^|[;})\s])(?:export\s*(?:\{|\*|default\b|const\b|let\b|var\b|function\b|class\b|async\b)|import\s*(?:\{|\*|["'][^"']|[\w$]+\s*(?:,|from\b)))`)
+
+	cjsExport = regexp.MustCompile(`(?:^|[^.\w$])(?:module\.)?exports\s*(?:\.\s*([A-Za-z_$][\w$]*)|\[\s*["']([\w$]+)["']\s*\])\s*=[^=]` +
+		`|Object\.defineProperty\(\s*(?:module\.)?exports\s*,\s*["']([\w$]+)["']`)
+	cjsReexport = regexp.MustCompile(`module\.exports\s*=\s*require\(\s*["']([^"']+)["']\s*\)` +
+		`|__exportStar\(\s*require\(\s*["']([^"']+)["']\s*\)` +
+		`|__export\(\s*require\(\s*["']([^"']+)["']\s*\)\s*\)`)
+)
+
+// cjsExports finds the names a CommonJS module exports, like
+// cjs-module-lexer does for Node, following modules it re-exports. The
+// module is first minified with process.env.NODE_ENV defined, which drops
+// the branches React-style packages pick their development or production
+// build with.
+func cjsExports(f *fetcher, rawURL string, nodeEnv string) ([]string, error) {
+	key := nodeEnv + " " + rawURL
+	cjsExportNames.Lock()
+	names, ok := cjsExportNames.m[key]
+	cjsExportNames.Unlock()
+	if ok {
+		return names, nil
+	}
+	seen := make(map[string]bool)
+	queue := []string{rawURL}
+	for i := 0; i < len(queue) && i < maxReexports; i++ {
+		mod, err := f.fetch(queue[i])
+		if err != nil {
+			return nil, err
+		}
+		transformed := api.Transform(mod.Contents, api.TransformOptions{
+			Loader:       api.LoaderJS,
+			Define:       map[string]string{"process.env.NODE_ENV": jsString(nodeEnv)},
+			MinifySyntax: true,
+		})
+		if len(transformed.Errors) > 0 {
+			return nil, fmt.Errorf("%s: %s", mod.URL, transformed.Errors[0].Text)
+		}
+		code := string(transformed.Code)
+		for _, m := range cjsExport.FindAllStringSubmatch(code, -1) {
+			for _, name := range m[1:] {
+				if name != "" && !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+		for _, m := range cjsReexport.FindAllStringSubmatch(code, -1) {
+			for _, specifier := range m[1:] {
+				if !strings.HasPrefix(specifier, ".") {
+					continue
+				}
+				base, _ := url.Parse(mod.URL)
+				ref, err := url.Parse(specifier)
+				if err != nil {
+					continue
+				}
+				target := base.ResolveReference(ref).String()
+				if path.Ext(target) == "" {
+					target += ".js"
+				}
+				queue = append(queue, target)
+			}
+		}
+	}
+	sort.Strings(names)
+	cjsExportNames.Lock()
+	cjsExportNames.m[key] = names
+	cjsExportNames.Unlock()
+	return names, nil
+}
+
+// reservedWords can't be declared as variables, so can't be re-exported by
+// destructuring.
+var reservedWords = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true, "continue": true,
+	"debugger": true, "default": true, "delete": true, "do": true, "else": true, "enum": true,
+	"export": true, "extends": true, "false": true, "finally": true, "for": true, "function": true,
+	"if": true, "import": true, "in": true, "instanceof": true, "new": true, "null": true,
+	"return": true, "super": true, "switch": true, "this": true, "throw": true, "true": true,
+	"try": true, "typeof": true, "var": true, "void": true, "while": true, "with": true,
+	"yield": true, "let": true, "static": true, "implements": true, "interface": true,
+	"package": true, "private": true, "protected": true, "public": true, "await": true,
+	"arguments": true, "eval": true,
+}
+
+// cjsWrapper is the source of an ES module re-exporting a CommonJS module:
+// its module.exports as the default export, and each of names.
+func cjsWrapper(rawURL string, names []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "import * as m from %s;\n", jsString(rawURL))
+	b.WriteString("export default m.default;\n")
+	var named []string
+	for _, name := range names {
+		if !reservedWords[name] && name != "m" && name != "__esModule" && identifierExport.MatchString(name) {
+			named = append(named, name)
+		}
+	}
+	if len(named) > 0 {
+		fmt.Fprintf(&b, "export const { %s } = m;\n", strings.Join(named, ", "))
+	}
+	return b.String()
+}
+
+// packageQuery is the query string passed on to the package routes a
+// build's npm dependencies are imported from, so they are built the same
+// way.
+func packageQuery(req buildRequest) string {
+	q := url.Values{}
+	if req.Target != "" {
+		q.Set("target", req.Target)
+	}
+	if req.Minify {
+		q.Set("minify", "")
+	}
+	if req.Define["process.env.NODE_ENV"] == `"development"` {
+		q.Set("dev", "")
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + strings.TrimSuffix(strings.ReplaceAll(q.Encode(), "=&", "&"), "=")
+}
+
+// nodeBuiltins are Node's own modules, which packages for browsers can't
+// import.
+var nodeBuiltins = map[string]bool{
+	"assert": true, "buffer": true, "child_process": true, "crypto": true, "dns": true,
+	"events": true, "fs": true, "http": true, "https": true, "net": true, "os": true,
+	"path": true, "process": true, "querystring": true, "readline": true, "stream": true,
+	"string_decoder": true, "tls": true, "tty": true, "url": true, "util": true,
+	"vm": true, "worker_threads": true, "zlib": true,
+}
+
+// resolvePackageImport resolves a bare import made by a module on the
+// package CDN to the package route of the version its package depends on,
+// left as an import rather than bundled. Requires of them are collected for
+// the require shim.
+func (p *httpPlugin) resolvePackageImport(args api.OnResolveArgs) (api.OnResolveResult, error) {
+	name, subpath := splitBareSpecifier(args.Path)
+	if nodeBuiltins[strings.TrimPrefix(name, "node:")] || strings.HasPrefix(name, "node:") {
+		return api.OnResolveResult{}, fmt.Errorf("%s is built into Node, so isn't available in browsers", name)
+	}
+	spec := "latest"
+	if owner, version, ok := packageAtURL(importerURL(args)); ok {
+		if owner == name {
+			spec = version
+		} else if pkg, err := packageManifest(p.fetcher, owner, version); err == nil {
+			if r := pkg.dependencyRange(name); r != "" && !strings.Contains(r, ":") {
+				spec = r
+			}
+		}
+	}
+	version, err := resolvePackageVersion(p.fetcher, name, spec)
+	if err != nil {
+		return api.OnResolveResult{}, err
+	}
+	u := cfg.PublicURL + "/" + name + "@" + version + subpath + p.packageQuery
+	if args.Kind == api.ResolveJSRequireCall {
+		p.requires.add(u)
+	}
+	p.record(args, u, true)
+	return api.OnResolveResult{Path: u, External: true}, nil
+}
+
+// requiredPackages collects the package routes CommonJS modules require.
+type requiredPackages struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+func (r *requiredPackages) add(u string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.urls {
+		if existing == u {
+			return
+		}
+	}
+	r.urls = append(r.urls, u)
+}
+
+// shim is placed at the top of the output of builds that require package
+// routes, which esbuild leaves as calls to a require function browsers
+// don't have. It imports them and defines require, which the output's
+// __require helper calls. Modules wrapping CommonJS, whose named exports
+// are copied from their default export, are required as that export, as
+// module.exports.
+func (r *requiredPackages) shim() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.urls) == 0 {
+		return ""
+	}
+	urls := append([]string(nil), r.urls...)
+	sort.Strings(urls)
+	var imports, cases strings.Builder
+	for i, u := range urls {
+		fmt.Fprintf(&imports, "import * as __conifer_require%d from %s;", i, jsString(u))
+		fmt.Fprintf(&cases, "%s:__conifer_require%d,", jsString(u), i)
+	}
+	return imports.String() + "const require=(id)=>{const ns={" + cases.String() + "}[id];" +
+		`if(!ns)throw new Error("Dynamic require of "+id+" is not supported");` +
+		`const m=ns.default;return m!=null&&Object.keys(ns).every((k)=>k==="default"||ns[k]===m[k])?m:ns;};` + "\n"
+}
+
+// handlePackage builds a package, or a file of it, from the npm registry as
+// an ES module, at paths like esm.sh's:
+//
+//	GET /react@18.2.0
+//	GET /lodash-es@4/debounce
+//	GET /@scope/pkg@1.2.3/sub/path
+//
+// Ranges and tags redirect to the exact version they currently mean, which
+// is served for good. The file built is the one package.json's exports,
+// module or main fields pick. CommonJS modules are given named exports for
+// what they assign to exports. The package's own dependencies aren't
+// bundled, but imported from the package routes of the versions it depends
+// on. The query string has the options of /v1/build, and dev builds with
+// process.env.NODE_ENV set to "development" rather than "production".
+func handlePackage(w http.ResponseWriter, r *http.Request, name, spec, subpath string) {
+	if !authorizeCaller(w, r) {
+		return
+	}
+	// Resolving the version downloads from the registry and CDN before the
+	// build is authorized, so is limited as the build will be.
+	tenant, key := keyFor(r)
+	limits, caller := keyLimits(r, tenant, key)
+	if limits.BuildsPerDay > 0 && quotas.used(caller) >= limits.BuildsPerDay {
+		writeQuotaExceeded(w)
+		return
+	}
+	f := newFetcher()
+	f.ctx = r.Context()
+	f.limit(limits)
+	f.forTenant(tenant)
+	version, err := resolvePackageVersion(f, name, spec)
+	if err != nil {
+		writePackageError(w, err)
+		return
+	}
+	if version != spec {
+		target := cfg.PublicURL + "/" + name + "@" + version + subpath
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		// Which version a range means changes as versions are published.
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		allowCrossOrigin(w, r, false)
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	pkg, err := packageManifest(f, name, version)
+	if err != nil {
+		writePackageError(w, err)
+		return
+	}
+
+	req, err := parseBuildRequest(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !req.Bundle {
+		http.Error(w, "packages can only be bundled", http.StatusBadRequest)
+		return
+	}
+	nodeEnv := "production"
+	if r.URL.Query().Has("dev") {
+		nodeEnv = "development"
+	}
+	req.Define = map[string]string{"process.env.NODE_ENV": jsString(nodeEnv)}
+	req.NPMDependencies = true
+
+	entry, esm, err := packageEntry(f, pkg, cfg.Warm.packageCDN()+name+"@"+version+"/", subpath)
+	if err != nil {
+		writePackageError(w, err)
+		return
+	}
+	if esm {
+		req.Entry = entry
+	} else {
+		names, err := cjsExports(f, entry, nodeEnv)
+		if err != nil {
+			writePackageError(w, err)
+			return
+		}
+		req.Source = cjsWrapper(entry, names)
+		req.SourceGenerated = true
+	}
+	allowCrossOrigin(w, r, false)
+	w.Header().Set("X-Conifer-Package", name+"@"+version)
+	serveBuildRequest(w, r, req)
+}
+
+func writePackageError(w http.ResponseWriter, err error) {
+	var notFound *packageNotFoundError
+	var host *hostNotAllowedError
+	var blocked *urlBlockedError
+	switch {
+	case errors.As(err, &notFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.As(err, &host), errors.As(err, &blocked):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Resolving a package's version is limited as the build it leads to is, so
+// keys can't use it to reach the registry when they couldn't build.
+func TestPackageLookupsApplyKeyLimits(t *testing.T) {
+	saved := cfg.Tenants
+	defer func() { cfg.Tenants = saved }()
+	cfg.Tenants = []tenantConfig{{
+		Name: "acme",
+		APIKeys: []apiKey{
+			{Key: "restricted", Limits: &limitsConfig{AllowedHosts: []string{"example.com"}}},
+			{Key: "exhausted", Limits: &limitsConfig{BuildsPerDay: 1}},
+		},
+	}}
+	_, caller := keyLimits(httptest.NewRequest("GET", "/", nil), &cfg.Tenants[0], &cfg.Tenants[0].APIKeys[1])
+	quotas.take(caller, 1)
+
+	for key, want := range map[string]int{"restricted": http.StatusForbidden, "exhausted": http.StatusTooManyRequests} {
+		r := httptest.NewRequest("GET", "/react@latest", nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handlePackage(w, r, "react", "latest", "")
+		if w.Code != want {
+			t.Errorf("with the %s key, got %d, want %d: %s", key, w.Code, want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// objectStoreConfig points at an S3 compatible bucket, such as AWS S3,
+// Cloudflare R2, MinIO, or Google Cloud Storage with HMAC keys.
+type objectStoreConfig struct {
+	// Endpoint is like "https://s3.us-east-1.amazonaws.com". Objects are
+	// addressed as <endpoint>/<bucket>/<key>.
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region"`
+	// Prefix is prepended to every key.
+	Prefix string `json:"prefix"`
+	// The keys may reference environment variables.
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+}
+
+var errObjectNotFound = errors.New("object not found")
+
+// objectStore reads and writes objects with requests signed using AWS
+// Signature Version 4, which S3 compatible services all accept.
+type objectStore struct {
+	config objectStoreConfig
+	client *http.Client
+}
+
+func newObjectStore(c objectStoreConfig) *objectStore {
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	return &objectStore{config: c, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *objectStore) objectURL(key string) string {
+	var segments []string
+	for _, segment := range strings.Split(s.config.Prefix+key, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return strings.TrimSuffix(s.config.Endpoint, "/") + "/" + url.PathEscape(s.config.Bucket) + "/" + strings.Join(segments, "/")
+}
+
+func (s *objectStore) get(key string) ([]byte, error) {
+	res, err := s.do("GET", key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errObjectNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", key, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func (s *objectStore) put(key string, data []byte, contentType string) error {
+	res, err := s.do("PUT", key, data, contentType)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %s: %s", key, res.Status)
+	}
+	return nil
+}
+
+func (s *objectStore) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *objectStore) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + os.ExpandEnv(s.config.SecretAccessKey))
+	for _, part := range []string{date, s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+os.ExpandEnv(s.config.AccessKeyID)+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// offlineConfig is for air-gapped deployments, where modules can't be
+// downloaded. Setting CONIFER_OFFLINE=true also enables it.
+type offlineConfig struct {
+	// Enabled stops every module download. Builds only use modules already
+	// in the module cache, however old, or in VendorDir.
+	Enabled bool `json:"enabled"`
+	// VendorDir holds modules as upstream serves them, laid out as
+	// <host>/<path> like the vendor directory of /v1/vendor's tarballs.
+	VendorDir string `json:"vendorDir"`
+}
+
+// offlineError is returned for a module that would have to be downloaded.
+type offlineError struct {
+	URL string
+}
+
+func (e *offlineError) Error() string {
+	return "offline: " + e.URL + " is neither cached nor vendored"
+}
+
+// offlineModule returns the cached copy of the module at url, or else its
+// vendored or mirrored copy.
+func offlineModule(url string, cached *module) (*module, error) {
+	if cached != nil {
+		return cached, nil
+	}
+	if dir := cfg.Offline.VendorDir; dir != "" {
+		mod, err := readVendored(dir, url)
+		if err == nil {
+			return mod, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if mod, ok := hostedMirror.get(url); ok {
+		return mod, nil
+	}
+	return nil, &offlineError{URL: url}
+}
+
+// missing returns the URLs requested so far that couldn't be loaded
+// offline, in order.
+func (f *fetcher) missing() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var urls []string
+	for url, e := range f.entries {
+		if _, ok := e.err.(*offlineError); ok {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// missingModulesError summarizes the modules a build needed that aren't
+// available offline, so they can all be vendored at once.
+func missingModulesError(urls []string) api.Message {
+	detail := &offlineError{URL: urls[0]}
+	if len(urls) == 1 {
+		return api.Message{Text: "offline: 1 module is neither cached nor vendored: " + urls[0], Detail: detail}
+	}
+	return api.Message{Text: fmt.Sprintf("offline: %d modules are neither cached nor vendored: %s", len(urls), strings.Join(urls, ", ")), Detail: detail}
+}
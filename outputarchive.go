@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// outputArchiveTypes are the content types of the archives a build's
+// outputs can be returned in, by the output query parameter asking for
+// them.
+var outputArchiveTypes = map[string]string{
+	"zip": "application/zip",
+	"tar": "application/gzip",
+}
+
+// outputArchive returns the kind of archive a build's outputs are asked
+// for in, with output=zip or output=tar, or an Accept header of
+// application/zip or application/gzip, or "" for none.
+func outputArchive(r *http.Request) string {
+	output := r.URL.Query().Get("output")
+	if _, ok := outputArchiveTypes[output]; ok {
+		return output
+	}
+	if output != "" {
+		return ""
+	}
+	accept := r.Header.Get("Accept")
+	for _, format := range []string{"zip", "tar"} {
+		if strings.Contains(accept, outputArchiveTypes[format]) {
+			return format
+		}
+	}
+	return ""
+}
+
+// writeOutputArchive responds with an archive of a build's outputs and the
+// chunks they import. The chunks are under chunks/, where the output
+// imports them from, so the archive can be unpacked at the root of a site
+// to serve them itself.
+func writeOutputArchive(w http.ResponseWriter, r *http.Request, format string, req buildRequest, result *buildResult, outputs []buildOutput) {
+	files := make([]buildOutput, len(outputs), len(outputs)+len(result.Manifest.Chunks))
+	copy(files, outputs)
+	for _, name := range result.Manifest.Chunks {
+		contents, ok := chunks.get(name)
+		if !ok {
+			http.Error(w, "chunk "+name+" is missing", http.StatusInternalServerError)
+			return
+		}
+		files = append(files, buildOutput{Path: strings.TrimPrefix(chunkPath, "/") + name, Contents: string(contents)})
+	}
+	var archive []byte
+	var err error
+	if format == "zip" {
+		archive, err = zipOutputs(files)
+	} else {
+		archive, err = tarOutputs(files)
+	}
+	if err != nil {
+		http.Error(w, "archiving the outputs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := "build.zip"
+	if format == "tar" {
+		filename = "build.tar.gz"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	writeContent(w, r, outputArchiveTypes[format], archive, buildCacheControl(req, result))
+}
+
+// zipOutputs archives files as a zip file. Like writeTarFile, timestamps
+// are fixed, though to the earliest a zip file can hold.
+func zipOutputs(files []buildOutput) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     f.Path,
+			Method:   zip.Deflate,
+			Modified: time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write([]byte(f.Contents)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tarOutputs archives files as a gzipped tarball.
+func tarOutputs(files []buildOutput) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		if err := writeTarFile(tw, f.Path, []byte(f.Contents)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// matchURL reports whether rawURL matches pattern, where "*" matches any run
+// of characters. Patterns without a scheme, such as "unpkg.com/*", are
+// matched against the URL with its scheme removed.
+func matchURL(pattern, rawURL string) bool {
+	if !strings.Contains(pattern, "://") {
+		if i := strings.Index(rawURL, "://"); i >= 0 {
+			rawURL = rawURL[i+len("://"):]
+		}
+	}
+	return matchWildcard(pattern, rawURL)
+}
+
+// matchAnyURL reports whether rawURL matches any of patterns.
+func matchAnyURL(patterns []string, rawURL string) bool {
+	for _, pattern := range patterns {
+		if matchURL(pattern, rawURL) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var (
+	exactVersion = regexp.MustCompile(`@v?\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?(/|$)`)
+	commitHash   = regexp.MustCompile(`/[0-9a-f]{40}(/|$)`)
+)
+
+// pinnedURL reports whether rawURL names content that won't change, because
+// it includes an exact version like "react@17.0.2" or a git commit hash.
+// URLs with version ranges or branch names can serve different files over
+// time.
+func pinnedURL(rawURL string) bool {
+	if i := strings.IndexAny(rawURL, "?#"); i >= 0 {
+		rawURL = rawURL[:i]
+	}
+	return exactVersion.MatchString(rawURL) || commitHash.MatchString(rawURL)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// permalinkPath is where permalinked builds are served.
+const permalinkPath = "/p/"
+
+// permalink is a source and the options to build it with, stored so a short
+// URL can stand in for a long query string.
+type permalink struct {
+	ID      string       `json:"id"`
+	Created time.Time    `json:"created"`
+	Tenant  string       `json:"tenant,omitempty"`
+	Request buildRequest `json:"request"`
+}
+
+var errPermalinkNotFound = errors.New("permalink not found")
+
+// permalinkStore keeps permalinks in the data directory, or in memory when
+// there isn't one. They are never removed.
+type permalinkStore struct {
+	mu    sync.Mutex
+	links map[string]*permalink
+}
+
+var permalinks = &permalinkStore{links: make(map[string]*permalink)}
+
+// permalinkID identifies a source and its options, so creating a permalink
+// for the same build twice returns the same link.
+func permalinkID(tenant string, req buildRequest) string {
+	data, _ := json.Marshal(struct {
+		Tenant  string
+		Request buildRequest
+	}{tenant, req})
+	return sha256Hex(data)[:16]
+}
+
+func validPermalinkID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *permalinkStore) path(id string) string {
+	return filepath.Join(cfg.DataDir, "permalinks", id+".json")
+}
+
+func (s *permalinkStore) put(link *permalink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.load(link.ID); err == nil {
+		return nil
+	}
+	s.links[link.ID] = link
+	if cfg.DataDir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(link, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(link.ID), data)
+}
+
+func (s *permalinkStore) get(id string) (*permalink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(id)
+}
+
+func (s *permalinkStore) load(id string) (*permalink, error) {
+	if link, ok := s.links[id]; ok || cfg.DataDir == "" {
+		if !ok {
+			return nil, errPermalinkNotFound
+		}
+		return link, nil
+	}
+	data, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, errPermalinkNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var link permalink
+	if err := json.Unmarshal(data, &link); err != nil {
+		return nil, err
+	}
+	s.links[id] = &link
+	return &link, nil
+}
+
+// permalinkURL is where the build a permalink stands for is served.
+func permalinkURL(id string) string {
+	return cfg.PublicURL + permalinkPath + id + ".js"
+}
+
+// handlePermalinkAPI stores a source under a short ID:
+//
+//	POST /v1/permalink?minify&target=es2017  <source>
+//
+// The query string takes the same options as /v1/build, and the response
+// gives the URL the build is served at from then on.
+func handlePermalinkAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "creating a permalink requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	source, ok := requestSource(w, r)
+	if !ok {
+		return
+	}
+	req, err := parseBuildRequest(r, source)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Source == "" {
+		http.Error(w, "a source is required", http.StatusBadRequest)
+		return
+	}
+	if !authorizeBuild(w, r, &req) {
+		return
+	}
+
+	link := &permalink{
+		ID:      permalinkID(req.Tenant, req),
+		Created: time.Now().UTC(),
+		Tenant:  req.Tenant,
+		Request: req,
+	}
+	if err := permalinks.put(link); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"id": link.ID, "url": permalinkURL(link.ID)})
+}
+
+// handlePermalink serves the build a permalink stands for at /p/<id>.js. It
+// is built again whenever the caches no longer have it. A tenant's
+// permalinks may only be embedded where its named bundles may be.
+func handlePermalink(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, permalinkPath), ".js")
+	if !validPermalinkID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	link, err := permalinks.get(id)
+	if err == errPermalinkNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !embedAllowed(r, tenantNamed(link.Tenant)) {
+		http.Error(w, "embedding this permalink is not allowed here", http.StatusForbidden)
+		return
+	}
+
+	req := link.Request
+	req.Tenant = link.Tenant
+	result, err := runCachedBuild(req)
+	if err != nil {
+		writeOverloaded(w)
+		return
+	}
+	if len(result.Errors) > 0 {
+		writeBuildErrors(w, result.Errors, result.Warnings)
+		return
+	}
+	writeJavaScript(w, r, result.Code, buildCacheControl(req, result))
+}
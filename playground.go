@@ -0,0 +1,20 @@
+package main
+
+// defaultWatermark marks output built by anonymous playground callers.
+const defaultWatermark = "Built by the conifer playground. Not for production use."
+
+// playgroundConfig is the tier for callers without an API key.
+type playgroundConfig struct {
+	// Limits override the default limits for anonymous callers, and are
+	// counted per client IP address.
+	Limits limitsConfig `json:"limits"`
+	// Watermark is the comment placed at the top of playground output.
+	Watermark string `json:"watermark"`
+}
+
+func (p *playgroundConfig) watermark() string {
+	if p.Watermark == "" {
+		return defaultWatermark
+	}
+	return p.Watermark
+}
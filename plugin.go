@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// httpPlugin resolves and loads remote modules for a single build.
+type httpPlugin struct {
+	fetcher *fetcher
+
+	// keepURLs are patterns of URLs that are left as imports in the output
+	// rather than being bundled.
+	keepURLs []string
+
+	// lockfile, when set, must list every downloaded module.
+	lockfile *lockfile
+
+	// importMap remaps specifiers, letting bare imports like "react" be
+	// resolved to URLs.
+	importMap *importMap
+
+	// tsconfigRaw is the tsconfig.json remote TypeScript is compiled with.
+	tsconfigRaw string
+
+	// graph records every import that is resolved.
+	graph *importGraph
+
+	// proxyURLs leaves remote imports in the output, pointed at /fetch.
+	proxyURLs bool
+
+	// allowedHosts, when not empty, are the only hosts modules may be
+	// downloaded from, and blockedURLs are URLs they may not be.
+	allowedHosts []string
+	blockedURLs  []string
+
+	// maxModules, when positive, caps how many modules are downloaded.
+	maxModules int
+	// policy decides what happens to each import before anything else.
+	policy *importPolicy
+	// remotes maps aliases to the manifests of module federation remotes.
+	remotes map[string]string
+	// requires, when set, resolves bare imports of files on the package
+	// CDN to package routes, collecting those required. packageQuery is
+	// the query string they are imported with.
+	requires     *requiredPackages
+	packageQuery string
+}
+
+func (p *httpPlugin) plugin() api.Plugin {
+	return api.Plugin{
+		Name: "http",
+		Setup: func(build api.PluginBuild) {
+			// Imports of remotes come first, as the remote entries they
+			// load are URLs left in the output.
+			p.federationPlugin(build)
+
+			// Globs of files in GitHub repositories expand to a module
+			// re-exporting each of them. See githubGlob.
+			build.OnResolve(api.OnResolveOptions{Filter: githubGlobFilter},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					if _, ok := parseGitHubGlob(args.Path); !ok {
+						return api.OnResolveResult{}, nil
+					}
+					return api.OnResolveResult{Path: args.Path, Namespace: "github-glob"}, nil
+				})
+			build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: "github-glob"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					g, _ := parseGitHubGlob(args.Path)
+					if err := p.checkUpstream("https://api.github.com/repos/" + g.Owner + "/" + g.Repo + "/"); err != nil {
+						return api.OnLoadResult{}, fmt.Errorf("listing %s needs the GitHub API: %w", args.Path, err)
+					}
+					contents, err := g.expand(p.fetcher)
+					if err != nil {
+						return api.OnLoadResult{}, err
+					}
+					return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+				})
+
+			// Bare imports such as "react" can only be resolved through the
+			// import map. Anything it doesn't map is left for esbuild.
+			build.OnResolve(api.OnResolveOptions{Filter: `^[^./]`},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					if !isBareSpecifier(args.Path) {
+						return api.OnResolveResult{}, nil
+					}
+					u, ok := p.importMap.resolve(args.Path, importerURL(args))
+					if !ok && p.requires != nil && args.Namespace == "http-url" {
+						return p.resolvePackageImport(args)
+					}
+					if !ok {
+						return api.OnResolveResult{}, nil
+					}
+					return p.resolveURL(args, u)
+				})
+
+			// Intercept import paths starting with "http:" and "https:" so
+			// esbuild doesn't attempt to map them to a file system location.
+			// Tag them with the "http-url" namespace to associate them with
+			// this plugin.
+			build.OnResolve(api.OnResolveOptions{Filter: `^https?://`},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					return p.resolveURL(args, p.mapURL(args.Path, importerURL(args)))
+				})
+
+			// We also want to intercept all import paths inside downloaded
+			// files and resolve them against the original URL. All of these
+			// files will be in the "http-url" namespace. Make sure to keep
+			// the newly resolved URL in the "http-url" namespace so imports
+			// inside it will also be resolved as URLs recursively.
+			build.OnResolve(api.OnResolveOptions{Filter: ".*", Namespace: "http-url"},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					base, err := url.Parse(args.Importer)
+					if err != nil {
+						return api.OnResolveResult{}, err
+					}
+					relative, err := url.Parse(args.Path)
+					if err != nil {
+						return api.OnResolveResult{}, err
+					}
+					resolved := base.ResolveReference(relative).String()
+					return p.resolveURL(args, p.mapURL(resolved, args.Importer))
+				})
+
+			// When a URL is loaded, we want to actually download the content
+			// from the internet. The module was already downloaded while
+			// resolving, so this is normally served from the fetcher.
+			build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: "http-url"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					mod, err := p.fetcher.fetch(args.Path)
+					if err != nil {
+						return api.OnLoadResult{}, err
+					}
+					contents := mod.Contents
+					loader := loaderFor(mod.URL)
+					if p.tsconfigRaw != "" && (loader == api.LoaderTS || loader == api.LoaderTSX) {
+						var errors []api.Message
+						contents, errors = compileTypeScript(contents, loader, mod.URL, p.tsconfigRaw)
+						if len(errors) > 0 {
+							return api.OnLoadResult{Errors: errors}, nil
+						}
+						loader = api.LoaderJS
+					}
+					return api.OnLoadResult{Contents: &contents, Loader: loader}, nil
+				})
+		},
+	}
+}
+
+// mapURL returns where the import map sends an import of u, which is
+// usually u itself.
+func (p *httpPlugin) mapURL(u, importer string) string {
+	if mapped, ok := p.importMap.resolve(u, importer); ok {
+		return mapped
+	}
+	return u
+}
+
+// importerURL returns the URL of the module doing the import, or "" when it
+// is the entry source rather than a remote module.
+func importerURL(args api.OnResolveArgs) string {
+	if args.Namespace == "http-url" {
+		return args.Importer
+	}
+	return ""
+}
+
+// resolveURL downloads the module at rawURL so it can be resolved to the URL
+// it finally lives at. CDNs like jsDelivr redirect version ranges to pinned
+// files, and relative imports inside those files must be resolved against
+// the pinned location. The final URL also ends up in source maps.
+//
+// The import policy is applied first, and may refuse the import or send it
+// elsewhere. A URL may pin its contents with an integrity fragment like
+// "#sha256-<hash>", failing the build if the downloaded file doesn't match.
+func (p *httpPlugin) resolveURL(args api.OnResolveArgs, rawURL string) (api.OnResolveResult, error) {
+	decision := p.policy.evaluate(policyImport{
+		Specifier: args.Path,
+		Importer:  importerURL(args),
+		Kind:      importKinds[args.Kind],
+		URL:       rawURL,
+	})
+	switch decision.Action {
+	case "deny":
+		return api.OnResolveResult{}, &policyDeniedError{URL: rawURL, Reason: decision.Reason}
+	case "rewrite":
+		rawURL = decision.URL
+	}
+	if matchAnyURL(p.keepURLs, rawURL) {
+		p.record(args, rawURL, true)
+		return api.OnResolveResult{Path: rawURL, External: true}, nil
+	}
+	if p.proxyURLs {
+		p.record(args, rawURL, true)
+		return api.OnResolveResult{Path: proxyURL(rawURL), External: true}, nil
+	}
+
+	rawURL, integrity := splitIntegrity(rawURL)
+	rawURL = canonicalURL(rawURL)
+	if err := p.checkUpstream(rawURL); err != nil {
+		return api.OnResolveResult{}, err
+	}
+	mod, err := p.fetcher.fetch(rawURL)
+	if err != nil {
+		return api.OnResolveResult{}, err
+	}
+	// The module may have been downloaded for another build, which its
+	// redirects were allowed for.
+	if err := p.checkUpstream(mod.URL); err != nil {
+		return api.OnResolveResult{}, err
+	}
+	if p.maxModules > 0 && len(p.fetcher.modules()) > p.maxModules {
+		return api.OnResolveResult{}, &moduleLimitError{Max: p.maxModules}
+	}
+	if integrity != "" {
+		if err := verifyIntegrity(integrity, mod.Contents); err != nil {
+			return api.OnResolveResult{}, fmt.Errorf("integrity check failed for %s: %w", rawURL, err)
+		}
+	}
+	if p.lockfile != nil {
+		if err := p.lockfile.verify(mod); err != nil {
+			return api.OnResolveResult{}, err
+		}
+	}
+	p.record(args, mod.URL, false)
+	return api.OnResolveResult{
+		Path:      mod.URL,
+		Namespace: "http-url",
+	}, nil
+}
+
+func (p *httpPlugin) record(args api.OnResolveArgs, resolved string, external bool) {
+	if p.graph == nil {
+		return
+	}
+	p.graph.add(importEdge{
+		Importer:  importerURL(args),
+		Specifier: args.Path,
+		URL:       resolved,
+		External:  external,
+	})
+}
+
+// hostNotAllowedError is an import from a host the caller's limits don't
+// allow.
+type hostNotAllowedError struct {
+	URL string
+}
+
+func (e *hostNotAllowedError) Error() string {
+	return "downloading from the host of " + e.URL + " is not allowed"
+}
+
+// urlBlockedError is an import of a URL the caller's limits block.
+type urlBlockedError struct {
+	URL string
+}
+
+func (e *urlBlockedError) Error() string {
+	return "downloading " + e.URL + " is blocked"
+}
+
+// moduleLimitError is a build importing more modules than its limits allow.
+type moduleLimitError struct {
+	Max int
+}
+
+func (e *moduleLimitError) Error() string {
+	return fmt.Sprintf("builds may import at most %d modules", e.Max)
+}
+
+func (p *httpPlugin) checkUpstream(rawURL string) error {
+	return checkUpstream(p.allowedHosts, p.blockedURLs, rawURL)
+}
+
+// checkUpstream returns an error when rawURL's host isn't one of
+// allowedHosts, or rawURL matches one of blockedURLs.
+func checkUpstream(allowedHosts, blockedURLs []string, rawURL string) error {
+	if !hostAllowed(allowedHosts, rawURL) {
+		return &hostNotAllowedError{URL: rawURL}
+	}
+	if matchAnyURL(blockedURLs, rawURL) {
+		return &urlBlockedError{URL: rawURL}
+	}
+	return nil
+}
+
+// hostAllowed reports whether rawURL's host matches one of allowedHosts,
+// which allow every host when empty.
+func hostAllowed(allowedHosts []string, rawURL string) bool {
+	if len(allowedHosts) == 0 {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range allowedHosts {
+		if matchWildcard(pattern, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+const maxPolicyRequestBytes = 1 << 20
+
+// importPolicy decides what happens to each import a build resolves. Rules
+// are tried in order and the first to match decides:
+//
+//	{"action": "deny", "host": "*.evil.example", "reason": "blocked host"}
+//	{"action": "rewrite", "host": "unpkg.com", "path": "^/(.*)$", "to": "https://cdn.jsdelivr.net/npm/$1"}
+//	{"action": "allow", "kind": "dynamic-import", "importer": "source"}
+//
+// A tenant's policy replaces the server's.
+type importPolicy struct {
+	Rules []policyRule `json:"rules"`
+	// Default is the action for imports no rule matches, "allow" unless
+	// set to "deny".
+	Default string `json:"default,omitempty"`
+}
+
+// policyRule matches an import when every condition it sets holds.
+type policyRule struct {
+	// Action is "allow", "deny" or "rewrite".
+	Action string `json:"action"`
+	// Specifier is a pattern, where "*" matches anything, of the import as
+	// written.
+	Specifier string `json:"specifier,omitempty"`
+	// Importer is a URL pattern like those of keepUrls matching the module
+	// doing the import, or "source" for the build's own source.
+	Importer string `json:"importer,omitempty"`
+	// Kind is how the module is imported, named as esbuild names it:
+	// "import-statement", "require-call", "dynamic-import",
+	// "require-resolve", "import-rule" or "url-token".
+	Kind string `json:"kind,omitempty"`
+	// Host is a pattern like "*.example.com" matching the imported URL's
+	// host name.
+	Host string `json:"host,omitempty"`
+	// Path is a regular expression matching the imported URL's path.
+	Path string `json:"path,omitempty"`
+	// To is where a rewrite rule sends the import. It may refer to groups
+	// captured by Path, like "$1".
+	To string `json:"to,omitempty"`
+	// Reason explains the rule in errors and dry runs.
+	Reason string `json:"reason,omitempty"`
+
+	path *regexp.Regexp
+}
+
+// policyImport is an import being decided on.
+type policyImport struct {
+	Specifier string `json:"specifier"`
+	// Importer is the URL of the importing module, or "" for the build's
+	// source.
+	Importer string `json:"importer,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	// URL is what the import resolved to.
+	URL string `json:"url"`
+}
+
+// policyDecision is what a policy does with an import.
+type policyDecision struct {
+	Action string `json:"action"`
+	// URL is what is downloaded, which differs from the import's when it
+	// was rewritten.
+	URL string `json:"url"`
+	// Rule is the index of the rule that decided, or absent when the
+	// default did.
+	Rule   *int   `json:"rule,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// policyDeniedError is an import a policy refused.
+type policyDeniedError struct {
+	URL    string
+	Reason string
+}
+
+func (e *policyDeniedError) Error() string {
+	if e.Reason == "" {
+		return "importing " + e.URL + " is denied by policy"
+	}
+	return "importing " + e.URL + " is denied by policy: " + e.Reason
+}
+
+var importKinds = map[api.ResolveKind]string{
+	api.ResolveEntryPoint:        "entry-point",
+	api.ResolveJSImportStatement: "import-statement",
+	api.ResolveJSRequireCall:     "require-call",
+	api.ResolveJSDynamicImport:   "dynamic-import",
+	api.ResolveJSRequireResolve:  "require-resolve",
+	api.ResolveCSSImportRule:     "import-rule",
+	api.ResolveCSSURLToken:       "url-token",
+}
+
+// compile checks the policy, preparing its rules' regular expressions.
+func (p *importPolicy) compile() error {
+	if p == nil {
+		return nil
+	}
+	if p.Default != "" && p.Default != "allow" && p.Default != "deny" {
+		return fmt.Errorf("unknown default action %q", p.Default)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		switch rule.Action {
+		case "allow", "deny":
+		case "rewrite":
+			if rule.To == "" {
+				return fmt.Errorf("rule %d: rewrite rules need \"to\"", i+1)
+			}
+		default:
+			return fmt.Errorf("rule %d: unknown action %q", i+1, rule.Action)
+		}
+		if rule.Path != "" {
+			re, err := regexp.Compile(rule.Path)
+			if err != nil {
+				return fmt.Errorf("rule %d: %v", i+1, err)
+			}
+			rule.path = re
+		}
+	}
+	return nil
+}
+
+// compilePolicies prepares the server's policy and every tenant's.
+func compilePolicies() error {
+	if err := cfg.Policy.compile(); err != nil {
+		return err
+	}
+	for i := range cfg.Tenants {
+		if err := cfg.Tenants[i].Policy.compile(); err != nil {
+			return fmt.Errorf("tenant %s: %v", cfg.Tenants[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// policyFor is the policy for a tenant's builds.
+func policyFor(tenant string) *importPolicy {
+	return tenantPolicy(tenantNamed(tenant))
+}
+
+// tenantPolicy is the tenant's own policy, when it has one, or else the
+// server's.
+func tenantPolicy(t *tenantConfig) *importPolicy {
+	if t != nil && t.Policy != nil {
+		return t.Policy
+	}
+	return cfg.Policy
+}
+
+func (r policyRule) matches(imp policyImport) bool {
+	if r.Specifier != "" && !matchWildcard(r.Specifier, imp.Specifier) {
+		return false
+	}
+	if r.Importer != "" {
+		if imp.Importer == "" {
+			if r.Importer != "source" {
+				return false
+			}
+		} else if !matchURL(r.Importer, imp.Importer) {
+			return false
+		}
+	}
+	if r.Kind != "" && r.Kind != imp.Kind {
+		return false
+	}
+	if r.Host == "" && r.path == nil {
+		return true
+	}
+	u, err := url.Parse(imp.URL)
+	if err != nil {
+		return false
+	}
+	if r.Host != "" && !matchWildcard(r.Host, u.Hostname()) {
+		return false
+	}
+	return r.path == nil || r.path.MatchString(u.Path)
+}
+
+// evaluate decides what happens to imp. Without a policy every import is
+// allowed.
+func (p *importPolicy) evaluate(imp policyImport) policyDecision {
+	decision := policyDecision{Action: "allow", URL: imp.URL}
+	if p == nil {
+		return decision
+	}
+	for i, rule := range p.Rules {
+		if !rule.matches(imp) {
+			continue
+		}
+		i := i
+		decision.Action, decision.Rule, decision.Reason = rule.Action, &i, rule.Reason
+		if rule.Action == "rewrite" {
+			decision.URL = rule.rewrite(imp.URL)
+		}
+		return decision
+	}
+	if p.Default == "deny" {
+		decision.Action = "deny"
+	}
+	return decision
+}
+
+// rewrite returns where the rule sends rawURL.
+func (r policyRule) rewrite(rawURL string) string {
+	if r.path == nil {
+		return r.To
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return r.To
+	}
+	match := r.path.FindStringSubmatchIndex(u.Path)
+	return string(r.path.ExpandString(nil, r.To, u.Path, match))
+}
+
+// policyTarget returns the URL an import would resolve to, for dry runs.
+func policyTarget(specifier, importer string, importMap *importMap) (string, error) {
+	if isBareSpecifier(specifier) {
+		u, ok := importMap.resolve(specifier, importer)
+		if !ok {
+			return "", fmt.Errorf("%s isn't in the import map", specifier)
+		}
+		return u, nil
+	}
+	ref, err := url.Parse(specifier)
+	if err != nil {
+		return "", err
+	}
+	if !ref.IsAbs() {
+		base, err := url.Parse(importer)
+		if importer == "" || err != nil {
+			return "", fmt.Errorf("%s is relative, but there is no importer to resolve it against", specifier)
+		}
+		ref = base.ResolveReference(ref)
+	}
+	resolved := ref.String()
+	if mapped, ok := importMap.resolve(resolved, importer); ok {
+		resolved = mapped
+	}
+	return resolved, nil
+}
+
+// handlePolicy shows the policy applying to the caller's builds:
+//
+//	GET /v1/policy
+func handlePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	policy := tenantPolicy(tenantFor(r))
+	if policy == nil {
+		policy = &importPolicy{Rules: []policyRule{}}
+	}
+	writeJSON(w, http.StatusOK, policy)
+}
+
+// handlePolicyDryRun shows how the caller's policy treats imports, without
+// building anything:
+//
+//	POST /v1/policy/dry-run  {"imports": [{"specifier": "react", "kind": "import-statement"}]}
+//
+// Importers default to the build's source, and kinds to import statements.
+// Bare specifiers are resolved with the import map given, or else the
+// server's.
+func handlePolicyDryRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Imports []struct {
+			Specifier string `json:"specifier"`
+			Importer  string `json:"importer"`
+			Kind      string `json:"kind"`
+		} `json:"imports"`
+		ImportMap *importMap `json:"importMap"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPolicyRequestBytes)).Decode(&body); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.ImportMap == nil {
+		body.ImportMap = cfg.ImportMap
+	}
+	policy := tenantPolicy(tenantFor(r))
+
+	type result struct {
+		policyImport
+		Decision *policyDecision `json:"decision,omitempty"`
+		Error    string          `json:"error,omitempty"`
+	}
+	results := make([]result, 0, len(body.Imports))
+	for _, imp := range body.Imports {
+		res := result{policyImport: policyImport{Specifier: imp.Specifier, Importer: imp.Importer, Kind: imp.Kind}}
+		if res.Kind == "" {
+			res.Kind = "import-statement"
+		}
+		target, err := policyTarget(imp.Specifier, imp.Importer, body.ImportMap)
+		if err != nil {
+			res.Error = err.Error()
+			results = append(results, res)
+			continue
+		}
+		res.URL = target
+		decision := policy.evaluate(res.policyImport)
+		res.Decision = &decision
+		results = append(results, res)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+const defaultPolyfillBaseURL = "https://cdn.jsdelivr.net/npm/core-js@3.33.0/"
+
+// polyfillConfig configures where polyfills are imported from.
+type polyfillConfig struct {
+	// BaseURL is where core-js, or a copy laid out like it, is, with each
+	// polyfill at a path like actual/array/at.js.
+	BaseURL string `json:"baseUrl"`
+}
+
+func (c polyfillConfig) baseURL() string {
+	if c.BaseURL == "" {
+		return defaultPolyfillBaseURL
+	}
+	return strings.TrimSuffix(c.BaseURL, "/") + "/"
+}
+
+// runtimeFeature is something output may use that browsers supporting an
+// older target don't have.
+type runtimeFeature struct {
+	name string
+	// use finds uses of the feature in output.
+	use *regexp.Regexp
+	// since is the first target that has the feature, or "" for features
+	// of browsers rather than the language, which only esnext assumes.
+	since string
+	// paths are the polyfills to import, relative to the base URL.
+	paths []string
+}
+
+var runtimeFeatures = []runtimeFeature{
+	{"Array.prototype.flat", regexp.MustCompile(`\.flat\(`), "es2019", []string{"actual/array/flat.js"}},
+	{"Array.prototype.flatMap", regexp.MustCompile(`\.flatMap\(`), "es2019", []string{"actual/array/flat-map.js"}},
+	{"Object.fromEntries", regexp.MustCompile(`\bObject\.fromEntries\b`), "es2019", []string{"actual/object/from-entries.js"}},
+	{"String.prototype.matchAll", regexp.MustCompile(`\.matchAll\(`), "es2020", []string{"actual/string/match-all.js"}},
+	{"Promise.allSettled", regexp.MustCompile(`\bPromise\.allSettled\b`), "es2020", []string{"actual/promise/all-settled.js"}},
+	{"globalThis", regexp.MustCompile(`\bglobalThis\b`), "es2020", []string{"actual/global-this.js"}},
+	{"String.prototype.replaceAll", regexp.MustCompile(`\.replaceAll\(`), "es2021", []string{"actual/string/replace-all.js"}},
+	{"Promise.any", regexp.MustCompile(`\bPromise\.any\b`), "es2021", []string{"actual/promise/any.js"}},
+	{"Array.prototype.at", regexp.MustCompile(`\.at\(`), "es2022", []string{"actual/array/at.js", "actual/string/at.js"}},
+	{"Object.hasOwn", regexp.MustCompile(`\bObject\.hasOwn\b`), "es2022", []string{"actual/object/has-own.js"}},
+	{"Array.prototype.findLast", regexp.MustCompile(`\.findLast(Index)?\(`), "es2023", []string{"actual/array/find-last.js", "actual/array/find-last-index.js"}},
+	{"structuredClone", regexp.MustCompile(`\bstructuredClone\b`), "", []string{"actual/structured-clone.js"}},
+	{"queueMicrotask", regexp.MustCompile(`\bqueueMicrotask\b`), "", []string{"actual/queue-microtask.js"}},
+}
+
+// targetOrder ranks targets, later ones having more features.
+var targetOrder = []string{"es5", "es2015", "es2016", "es2017", "es2018", "es2019", "es2020", "es2021", "es2022", "es2023"}
+
+// targetHas reports whether browsers supporting target have a feature
+// added in since.
+func targetHas(target, since string) bool {
+	if target == "" || target == "esnext" {
+		return true
+	}
+	if since == "" {
+		return false
+	}
+	rank := func(t string) int {
+		for i, name := range targetOrder {
+			if name == t {
+				return i
+			}
+		}
+		return len(targetOrder)
+	}
+	return rank(target) >= rank(since)
+}
+
+// missingFeatures returns the features the output and its chunks use that
+// the build's target doesn't have.
+func missingFeatures(target string, code []byte, chunkNames []string) []runtimeFeature {
+	sources := [][]byte{code}
+	for _, name := range chunkNames {
+		if contents, ok := chunks.get(name); ok {
+			sources = append(sources, contents)
+		}
+	}
+	var missing []runtimeFeature
+	for _, f := range runtimeFeatures {
+		if targetHas(target, f.since) {
+			continue
+		}
+		for _, source := range sources {
+			if f.use.Match(source) {
+				missing = append(missing, f)
+				break
+			}
+		}
+	}
+	return missing
+}
+
+// injectPolyfills finds features the output uses that its target doesn't
+// have, and places polyfills for them at the top of the output, recording
+// which in the manifest. The polyfills are bundled as a script of their
+// own, so their names can't clash with the output's, and run before it.
+// Chunks the output imports statically run before it too, so aren't
+// covered.
+func injectPolyfills(req buildRequest, result *buildResult) []api.Message {
+	missing := missingFeatures(req.Target, result.Code, result.Manifest.Chunks)
+	if len(missing) == 0 {
+		return nil
+	}
+	var source strings.Builder
+	for _, f := range missing {
+		for _, p := range f.paths {
+			source.WriteString("import " + jsString(cfg.Polyfills.baseURL()+p) + ";\n")
+		}
+		result.Manifest.Polyfills = append(result.Manifest.Polyfills, f.name)
+	}
+	built := runBuild(buildRequest{
+		Source:   source.String(),
+		Bundle:   true,
+		Format:   "iife",
+		Target:   req.Target,
+		Minify:   req.Minify,
+		Lockfile: req.Lockfile,
+		Tenant:   req.Tenant,
+	})
+	if len(built.Errors) > 0 {
+		return built.Errors
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range result.Manifest.Modules {
+		seen[m.URL] = true
+	}
+	for _, m := range built.Manifest.Modules {
+		if !seen[m.URL] {
+			result.Manifest.Modules = append(result.Manifest.Modules, m)
+		}
+	}
+	sort.Slice(result.Manifest.Modules, func(i, j int) bool { return result.Manifest.Modules[i].URL < result.Manifest.Modules[j].URL })
+	result.Modules = append(result.Modules, built.Modules...)
+	result.Manifest.Pinned = result.Manifest.Pinned && built.Manifest.Pinned
+
+	polyfills := built.Code
+	if !bytes.HasSuffix(polyfills, []byte("\n")) {
+		polyfills = append(polyfills, '\n')
+	}
+	lines := bytes.Count(polyfills, []byte("\n"))
+	result.Code = shiftInlineSourceMap(append(polyfills, result.Code...), lines)
+	if len(result.SourceMap) > 0 {
+		result.SourceMap = shiftSourceMap(result.SourceMap, lines)
+	}
+	return nil
+}
+
+const inlineSourceMapPrefix = "//# sourceMappingURL=data:application/json;base64,"
+
+// shiftInlineSourceMap moves the mappings of code's inline source map down
+// by lines, for code placed above what it maps.
+func shiftInlineSourceMap(code []byte, lines int) []byte {
+	i := bytes.LastIndex(code, []byte(inlineSourceMapPrefix))
+	if i < 0 {
+		return code
+	}
+	encoded := bytes.TrimSpace(code[i+len(inlineSourceMapPrefix):])
+	sourceMap, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return code
+	}
+	shifted := base64.StdEncoding.EncodeToString(shiftSourceMap(sourceMap, lines))
+	return append(code[:i:i], []byte(inlineSourceMapPrefix+shifted+"\n")...)
+}
+
+// shiftSourceMap moves a source map's mappings down by lines. Each ";"
+// starts the mappings of the next generated line.
+func shiftSourceMap(sourceMap []byte, lines int) []byte {
+	var m map[string]interface{}
+	if err := json.Unmarshal(sourceMap, &m); err != nil {
+		return sourceMap
+	}
+	mappings, _ := m["mappings"].(string)
+	m["mappings"] = strings.Repeat(";", lines) + mappings
+	shifted, err := json.Marshal(m)
+	if err != nil {
+		return sourceMap
+	}
+	return shifted
+}
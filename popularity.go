@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// moduleUsage is how often a module, or a library of modules, has been
+// bundled and how much of the output it accounted for.
+type moduleUsage struct {
+	URL    string `json:"url"`
+	Builds int    `json:"builds"`
+	// OutputBytes totals the bytes the module took up in every build.
+	OutputBytes int64 `json:"outputBytes"`
+}
+
+// popularityTracker counts the remote modules bundled by every build since
+// startup, to guide which packages are worth pre-bundling or mirroring.
+type popularityTracker struct {
+	mu      sync.Mutex
+	since   time.Time
+	builds  int
+	modules map[string]*moduleUsage
+}
+
+var popularity = &popularityTracker{since: time.Now().UTC(), modules: make(map[string]*moduleUsage)}
+
+func (t *popularityTracker) record(m *metafile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.builds++
+	for _, output := range m.Outputs {
+		for path, input := range output.Inputs {
+			u, ok := inputURL(path)
+			if !ok {
+				continue
+			}
+			usage := t.modules[u]
+			if usage == nil {
+				usage = &moduleUsage{URL: u}
+				t.modules[u] = usage
+			}
+			usage.Builds++
+			usage.OutputBytes += int64(input.BytesInOutput)
+		}
+	}
+}
+
+type popularityReport struct {
+	Since   time.Time     `json:"since"`
+	Builds  int           `json:"builds"`
+	Modules []moduleUsage `json:"modules"`
+}
+
+// report returns the most bundled modules, or libraries when byLibrary is
+// set, up to limit of them.
+func (t *popularityTracker) report(byLibrary bool, limit int) popularityReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	usages := t.modules
+	if byLibrary {
+		// A library's builds are counted as the most any one of its modules
+		// was bundled, as a build usually includes several of them.
+		usages = make(map[string]*moduleUsage)
+		for u, usage := range t.modules {
+			lib := libraryOf(u)
+			if lib == "" {
+				lib = u
+			}
+			total := usages[lib]
+			if total == nil {
+				total = &moduleUsage{URL: lib}
+				usages[lib] = total
+			}
+			if usage.Builds > total.Builds {
+				total.Builds = usage.Builds
+			}
+			total.OutputBytes += usage.OutputBytes
+		}
+	}
+
+	report := popularityReport{Since: t.since, Builds: t.builds, Modules: []moduleUsage{}}
+	for _, usage := range usages {
+		report.Modules = append(report.Modules, *usage)
+	}
+	sort.Slice(report.Modules, func(i, j int) bool {
+		a, b := report.Modules[i], report.Modules[j]
+		if a.Builds != b.Builds {
+			return a.Builds > b.Builds
+		}
+		return a.OutputBytes > b.OutputBytes
+	})
+	if limit > 0 && len(report.Modules) > limit {
+		report.Modules = report.Modules[:limit]
+	}
+	return report
+}
+
+// handlePopularity reports the most bundled modules across all tenants:
+//
+//	GET /v1/admin/popularity?by=library&limit=50
+func handlePopularity(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, popularity.report(r.URL.Query().Get("by") == "library", limit))
+}
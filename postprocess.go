@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxPostProcessedBytes limits the output a webhook step may return.
+const maxPostProcessedBytes = 64 << 20
+
+// postProcessStep is one step of the pipeline applied, in order, to the
+// output of each successful build:
+//
+//	{"type": "replace", "find": "__VERSION__", "replace": "1.2.3"}
+//	{"type": "banner", "template": "/* {{name}} built {{date}} */"}
+//	{"type": "webhook", "url": "https://obfuscator.internal/run"}
+//
+// Banner templates may use {{tenant}}, {{name}}, {{date}}, {{engine}} and
+// {{sha256}}, the hash of the output before the banner was added. Webhooks
+// are POSTed the output and respond with its replacement.
+type postProcessStep struct {
+	Type     string `json:"type"`
+	Find     string `json:"find,omitempty"`
+	Replace  string `json:"replace,omitempty"`
+	Template string `json:"template,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// postProcessRecord is the manifest's record of a step, describing the
+// output it produced.
+type postProcessRecord struct {
+	Type string `json:"type"`
+	// Output is the entry output the step produced, in builds of entries.
+	Output string `json:"output,omitempty"`
+	Bytes  int    `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// postProcessSteps is the pipeline for a tenant's builds: its own, when it
+// has one, or else the server's.
+func postProcessSteps(tenant string) []postProcessStep {
+	if t := tenantNamed(tenant); t != nil && t.PostProcess != nil {
+		return t.PostProcess
+	}
+	return cfg.PostProcess
+}
+
+// postProcess runs the pipeline over a build's output, or each JavaScript
+// output of a build of entries, recording each step in its manifest.
+func postProcess(req buildRequest, result *buildResult) error {
+	if len(result.Entries) > 0 {
+		return postProcessEntries(req, result)
+	}
+	for i, step := range postProcessSteps(req.Tenant) {
+		code, err := step.apply(req, result.Code)
+		if err != nil {
+			return fmt.Errorf("post-processing step %d (%s): %v", i+1, step.Type, err)
+		}
+		result.Code = code
+		result.Manifest.PostProcess = append(result.Manifest.PostProcess, postProcessRecord{
+			Type:   step.Type,
+			Bytes:  len(code),
+			SHA256: sha256Hex(code),
+		})
+	}
+	return nil
+}
+
+func postProcessEntries(req buildRequest, result *buildResult) error {
+	for j, out := range result.Entries {
+		if path.Ext(out.Path) != ".js" {
+			continue
+		}
+		code := []byte(out.Contents)
+		for i, step := range postProcessSteps(req.Tenant) {
+			var err error
+			if code, err = step.apply(req, code); err != nil {
+				return fmt.Errorf("post-processing step %d (%s) of %s: %v", i+1, step.Type, out.Path, err)
+			}
+			result.Manifest.PostProcess = append(result.Manifest.PostProcess, postProcessRecord{
+				Type:   step.Type,
+				Output: out.Path,
+				Bytes:  len(code),
+				SHA256: sha256Hex(code),
+			})
+		}
+		result.Entries[j].Contents = string(code)
+	}
+	return nil
+}
+
+func (s postProcessStep) apply(req buildRequest, code []byte) ([]byte, error) {
+	switch s.Type {
+	case "replace":
+		if s.Find == "" {
+			return nil, errors.New("find is required")
+		}
+		return bytes.ReplaceAll(code, []byte(s.Find), []byte(s.Replace)), nil
+	case "banner":
+		banner := strings.NewReplacer(
+			"{{tenant}}", req.Tenant,
+			"{{name}}", req.Name,
+			"{{date}}", time.Now().UTC().Format("2006-01-02"),
+			"{{engine}}", "conifer "+engine.Conifer+", esbuild "+engine.Esbuild,
+			"{{sha256}}", sha256Hex(code),
+		).Replace(s.Template)
+		return append([]byte(banner+"\n"), code...), nil
+	case "webhook":
+		return postProcessWebhook(os.ExpandEnv(s.URL), req, code)
+	default:
+		return nil, errors.New("unknown step type")
+	}
+}
+
+// postProcessWebhook sends code to url, returning what it responds with.
+func postProcessWebhook(url string, req buildRequest, code []byte) ([]byte, error) {
+	r, err := http.NewRequest("POST", url, bytes.NewReader(code))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "text/javascript;charset=UTF-8")
+	if req.Tenant != "" {
+		r.Header.Set("X-Conifer-Tenant", req.Tenant)
+	}
+	if req.Name != "" {
+		r.Header.Set("X-Conifer-Bundle", req.Name)
+	}
+	res, err := webhookClient().Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: %s", url, res.Status)
+	}
+	processed, err := io.ReadAll(io.LimitReader(res.Body, maxPostProcessedBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(processed) > maxPostProcessedBytes {
+		return nil, errors.New("the response is too large")
+	}
+	return processed, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRetryAfter is how long shed requests are asked to wait.
+const defaultRetryAfter = 30 * time.Second
+
+// shrinkInterval is how often caches may be shrunk while memory stays above
+// the soft watermark, giving the collector time to return what was freed.
+const shrinkInterval = 10 * time.Second
+
+// pressureConfig sets when the instance sheds load. Under pressure, output
+// that is already cached is still served but builds that would have to run
+// are refused, rather than the instance running out of memory.
+//
+// Before it comes to that, resident memory above a soft watermark shrinks
+// the in-memory caches and returns freed memory to the operating system,
+// which is often enough to ride out a burst on a small instance.
+type pressureConfig struct {
+	// MaxHeapBytes is the heap size above which builds are refused.
+	MaxHeapBytes uint64 `json:"maxHeapBytes"`
+	// SoftRSSBytes is the resident memory above which caches are shrunk.
+	SoftRSSBytes uint64 `json:"softRssBytes"`
+	// HardRSSBytes is the resident memory above which builds are refused.
+	HardRSSBytes uint64 `json:"hardRssBytes"`
+	// MaxBuilds is how many builds may run at once.
+	MaxBuilds int32 `json:"maxBuilds"`
+	// RetryAfter is how long refused callers are asked to wait.
+	RetryAfter duration `json:"retryAfter"`
+}
+
+var errOverloaded = errors.New("the server is under too much load to build right now")
+
+// activeBuilds is how many builds are running.
+var activeBuilds int32
+
+// pressureMonitor samples memory at most once a second, as reading memory
+// statistics briefly stops the world.
+type pressureMonitor struct {
+	mu          sync.Mutex
+	sampled     time.Time
+	heap        uint64
+	rss         uint64
+	shrunk      time.Time
+	underStress bool
+}
+
+var pressure = &pressureMonitor{}
+
+// check reports whether the instance is under pressure, and why. Entering
+// and leaving pressure are logged.
+func (m *pressureMonitor) check() (bool, string) {
+	limits := cfg.Pressure
+	if limits.MaxHeapBytes == 0 && limits.HardRSSBytes == 0 && limits.MaxBuilds == 0 {
+		return false, ""
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if (limits.MaxHeapBytes > 0 || limits.HardRSSBytes > 0) && time.Since(m.sampled) > time.Second {
+		m.sample()
+	}
+
+	reason := ""
+	if limits.MaxHeapBytes > 0 && m.heap > limits.MaxHeapBytes {
+		reason = "heap is " + strconv.FormatUint(m.heap, 10) + " bytes"
+	} else if limits.HardRSSBytes > 0 && m.rss > limits.HardRSSBytes {
+		reason = "resident memory is " + strconv.FormatUint(m.rss, 10) + " bytes"
+	} else if builds := atomic.LoadInt32(&activeBuilds); limits.MaxBuilds > 0 && builds >= limits.MaxBuilds {
+		reason = strconv.Itoa(int(builds)) + " builds are running"
+	}
+	if under := reason != ""; under != m.underStress {
+		m.underStress = under
+		if under {
+			log.Println("pressure: shedding builds,", reason)
+		} else {
+			log.Println("pressure: relieved, building again")
+		}
+	}
+	return reason != "", reason
+}
+
+// sample reads the heap and resident memory. m.mu must be held.
+func (m *pressureMonitor) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	m.heap = stats.HeapAlloc
+	m.rss = residentBytes(stats)
+	m.sampled = time.Now()
+}
+
+// residentBytes is the process's resident memory, read from /proc where
+// there is one. Elsewhere it is estimated as the memory the runtime holds
+// from the operating system.
+func residentBytes(stats runtime.MemStats) uint64 {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	return stats.Sys - stats.HeapReleased
+}
+
+// shrinker is a cache that can give back memory under pressure.
+type shrinker interface {
+	// shrink evicts part of the cache, returning how many entries it
+	// evicted.
+	shrink() int
+}
+
+// watch samples memory every second while a soft watermark is set, and
+// shrinks the in-memory caches and runs the collector whenever resident
+// memory is above it.
+func (m *pressureMonitor) watch() {
+	soft := cfg.Pressure.SoftRSSBytes
+	if soft == 0 {
+		return
+	}
+	for range time.Tick(time.Second) {
+		m.mu.Lock()
+		m.sample()
+		rss, shrink := m.rss, m.rss > soft && time.Since(m.shrunk) >= shrinkInterval
+		if shrink {
+			m.shrunk = time.Now()
+		}
+		m.mu.Unlock()
+		if !shrink {
+			continue
+		}
+
+		n := derived.shrink() + chunks.shrink()
+		if s, ok := modulesCache.(shrinker); ok {
+			n += s.shrink()
+		}
+		debug.FreeOSMemory()
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		log.Printf("pressure: resident memory was %d bytes, evicted %d cache entries, now %d bytes", rss, n, residentBytes(after))
+	}
+}
+
+// underPressure reports whether builds that aren't cached should be refused.
+func underPressure() bool {
+	under, _ := pressure.check()
+	return under
+}
+
+// writeOverloaded responds to a request refused because of pressure.
+func writeOverloaded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(overloadedRetryAfter().Seconds())))
+	http.Error(w, errOverloaded.Error(), http.StatusServiceUnavailable)
+}
+
+// overloadedRetryAfter is how long callers refused under pressure are asked
+// to wait.
+func overloadedRetryAfter() time.Duration {
+	if cfg.Pressure.RetryAfter == 0 {
+		return defaultRetryAfter
+	}
+	return time.Duration(cfg.Pressure.RetryAfter)
+}
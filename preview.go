@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// previewPath is where previews are served.
+const previewPath = "/previews/"
+
+// A preview is a build served as a site for a short while, to share what a
+// snippet or project looks like running:
+//
+//	curl --data-binary @index.html -H 'Content-Type: text/html' '.../v1/preview?base=https://example.com/'
+//
+// The body is anything /v1/build takes. An HTML page is served with its
+// built assets; anything else is served with a page loading its output.
+// Previews are only kept in memory, and removed when their TTL is up.
+
+// previewConfig limits previews.
+type previewConfig struct {
+	// TTL is how long a preview is served, 30 minutes when zero.
+	TTL duration `json:"ttl"`
+	// MaxPreviews caps how many previews are served at once, 100 when
+	// zero. Creating one more is refused until one expires.
+	MaxPreviews int `json:"maxPreviews"`
+}
+
+func (c previewConfig) ttl() time.Duration {
+	if c.TTL == 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(c.TTL)
+}
+
+func (c previewConfig) maxPreviews() int {
+	if c.MaxPreviews == 0 {
+		return 100
+	}
+	return c.MaxPreviews
+}
+
+// preview is a built site, its files keyed by path, with "index.html" the
+// page at its root.
+type preview struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+	Files   []string  `json:"files"`
+
+	files map[string][]byte
+}
+
+var errTooManyPreviews = errors.New("too many previews are being served")
+
+// previewStore keeps the previews being served, each removed by a timer
+// when it expires.
+type previewStore struct {
+	mu       sync.Mutex
+	previews map[string]*preview
+}
+
+var previews = &previewStore{previews: make(map[string]*preview)}
+
+// full reports whether another preview would be refused, and if so, how
+// long until one expires.
+func (s *previewStore) full() (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.previews) < cfg.Preview.maxPreviews() {
+		return false, 0
+	}
+	next := cfg.Preview.ttl()
+	for _, p := range s.previews {
+		if d := time.Until(p.Expires); d < next {
+			next = d
+		}
+	}
+	return true, next
+}
+
+// put serves files as a new preview until its TTL is up.
+func (s *previewStore) put(files map[string][]byte) (*preview, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.previews) >= cfg.Preview.maxPreviews() {
+		return nil, errTooManyPreviews
+	}
+	ttl := cfg.Preview.ttl()
+	id := newBuildID()
+	p := &preview{
+		ID:      id,
+		URL:     cfg.PublicURL + previewPath + id + "/",
+		Expires: time.Now().Add(ttl).UTC().Truncate(time.Second),
+		files:   files,
+	}
+	for name := range files {
+		p.Files = append(p.Files, name)
+	}
+	sort.Strings(p.Files)
+	s.previews[id] = p
+	time.AfterFunc(ttl, func() { s.remove(id) })
+	return p, nil
+}
+
+func (s *previewStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.previews, id)
+}
+
+func (s *previewStore) get(id string) (*preview, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.previews[id]
+	return p, ok
+}
+
+// handlePreview builds the body, as /v1/build would, and serves the output
+// as a preview, responding with where.
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Refusing before building saves building what can't be served.
+	if full, wait := previews.full(); full {
+		writeTooManyPreviews(w, wait)
+		return
+	}
+	files, ok := buildPreview(w, r)
+	if !ok {
+		return
+	}
+	p, err := previews.put(files)
+	if err != nil {
+		_, wait := previews.full()
+		writeTooManyPreviews(w, wait)
+		return
+	}
+	w.Header().Set("Location", p.URL)
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func writeTooManyPreviews(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, errTooManyPreviews.Error(), http.StatusServiceUnavailable)
+}
+
+// buildPreview builds the body of a preview request into the preview's
+// files. When it can't, the failure is written and false is returned.
+func buildPreview(w http.ResponseWriter, r *http.Request) (map[string][]byte, bool) {
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "text/html") {
+		page, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBuildRequestBytes))
+		if err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		req, err := parseBuildRequest(r, string(page))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		if !authorizeBuild(w, r, &req) {
+			return nil, false
+		}
+		rewritten, outputs, ok := buildPage(w, req, string(page), r.URL.Query().Get("base"), true)
+		if !ok {
+			return nil, false
+		}
+		files := map[string][]byte{"index.html": []byte(rewritten)}
+		for _, o := range outputs {
+			files["assets/"+o.name] = o.code
+		}
+		return files, true
+	}
+
+	var body *jsonBuildRequest
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		body = &jsonBuildRequest{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBuildRequestBytes)).Decode(body); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+	case strings.HasPrefix(contentType, "multipart/form-data"):
+		b, ok := readMultipartBuild(w, r)
+		if !ok {
+			return nil, false
+		}
+		body = &b
+	case isArchive(contentType):
+		b, ok := readArchiveBuild(w, r)
+		if !ok {
+			return nil, false
+		}
+		body = &b
+	}
+	var req buildRequest
+	var err error
+	if body != nil {
+		req, err = body.buildRequest()
+	} else {
+		source, ok := requestSource(w, r)
+		if !ok {
+			return nil, false
+		}
+		req, err = parseBuildRequest(r, source)
+	}
+	if err == nil && len(req.Entries) > 0 {
+		err = errors.New("a preview loads a single output, so can't be of entries")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if !authorizeBuild(w, r, &req) {
+		return nil, false
+	}
+	result, ok := runRecordedBuild(w, req)
+	if !ok {
+		return nil, false
+	}
+	files := make(map[string][]byte)
+	for _, o := range buildOutputs(req, result, false) {
+		files[o.Path] = []byte(o.Contents)
+	}
+	files["index.html"] = []byte(previewPage(req, outputName(req)))
+	return files, true
+}
+
+// previewPage is the page a preview of a build is served with, loading its
+// output.
+func previewPage(req buildRequest, output string) string {
+	var tag string
+	switch {
+	case path.Ext(output) == ".css":
+		tag = `<link rel="stylesheet" href="` + html.EscapeString(output) + `">`
+	case req.Format == "" || req.Format == "esm":
+		tag = `<script type="module" src="` + html.EscapeString(output) + `"></script>`
+	default:
+		tag = `<script src="` + html.EscapeString(output) + `"></script>`
+	}
+	return "<!doctype html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Preview</title>\n" + tag + "\n</head>\n<body>\n</body>\n</html>\n"
+}
+
+// handlePreviewFile serves the files of previews, at paths like
+// /previews/<id>/assets/app-1a2b3c4d.js.
+func handlePreviewFile(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, previewPath)
+	i := strings.IndexByte(id, '/')
+	if i < 0 {
+		// Relative URLs in the page need it served as a directory.
+		http.Redirect(w, r, previewPath+id+"/", http.StatusMovedPermanently)
+		return
+	}
+	id, name := id[:i], id[i+1:]
+	p, ok := previews.get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if name == "" {
+		name = "index.html"
+	}
+	contents, ok := p.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" || path.Ext(name) == ".js" {
+		contentType = "text/javascript;charset=UTF-8"
+	}
+	if path.Ext(name) == ".html" {
+		// Previews are anyone's code, so they run sandboxed in an origin
+		// of their own rather than conifer's.
+		w.Header().Set("Content-Security-Policy", "sandbox allow-scripts allow-forms allow-popups allow-modals")
+	}
+	// The sandboxed page's origin is opaque, so loading its modules is a
+	// cross-origin request.
+	allowCrossOrigin(w, r, false)
+	writeContent(w, r, contentType, contents, "no-store")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventStreamKeepAlive is how often a comment is sent while a build is
+// quiet, so proxies don't close the stream as idle.
+const eventStreamKeepAlive = 15 * time.Second
+
+// moduleEvent reports a module a build loaded.
+type moduleEvent struct {
+	URL   string `json:"url"`
+	Bytes int    `json:"bytes"`
+	// Cached is set when the module came from the module cache rather
+	// than being downloaded.
+	Cached bool `json:"cached"`
+}
+
+// doneEvent reports a finished build, whose output is kept with the
+// chunks at URL rather than sent in the stream.
+type doneEvent struct {
+	ID        string        `json:"id"`
+	URL       string        `json:"url"`
+	Integrity string        `json:"integrity"`
+	Artifact  string        `json:"artifact,omitempty"`
+	Manifest  buildManifest `json:"manifest"`
+}
+
+// failedEvent reports a build that failed, with the status and body it
+// would have been answered with.
+type failedEvent struct {
+	Status     int             `json:"status"`
+	Error      *buildErrorBody `json:"error"`
+	RetryAfter int             `json:"retryAfter,omitempty"`
+}
+
+// wantsEventStream reports whether a build's progress should be streamed
+// as server-sent events, as EventSource asks for.
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// eventStream writes server-sent events. Once closed, events are dropped,
+// as the response they'd be written to is over.
+type eventStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	closed  bool
+}
+
+func (s *eventStream) send(event string, data interface{}) {
+	encoded, _ := json.Marshal(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, encoded)
+	s.flusher.Flush()
+}
+
+func (s *eventStream) keepAlive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		fmt.Fprint(s.w, ": keep-alive\n\n")
+		s.flusher.Flush()
+	}
+}
+
+func (s *eventStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+// streamBuild runs an authorized build, streaming its progress as it goes:
+//
+//	event: resolve     the build started resolving imports
+//	event: module      a module was loaded, see moduleEvent
+//	event: done        the build finished, see doneEvent
+//	event: error       the build failed, see failedEvent
+//
+// The stream ends after done or error. Builds reused from the cache load
+// no modules.
+func streamBuild(w http.ResponseWriter, r *http.Request, req buildRequest) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	stream := &eventStream{w: w, flusher: flusher}
+	defer stream.close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(eventStreamKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				stream.keepAlive()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	stream.send("resolve", struct{}{})
+	req.OnModule = func(e moduleEvent) { stream.send("module", e) }
+	rec := newResponseRecorder()
+	result, ok := runRecordedBuild(rec, req)
+	if !ok {
+		stream.send("error", failedEvent{Status: rec.status, Error: rec.failure(), RetryAfter: rec.retryAfter()})
+		return
+	}
+	name, err := storeOutput(req, result.Code)
+	if err != nil {
+		stream.send("error", failedEvent{Status: http.StatusInternalServerError, Error: &buildErrorBody{
+			Code:     "build_failed",
+			Message:  "storing the output: " + err.Error(),
+			Errors:   []buildMessage{},
+			Warnings: []buildMessage{},
+		}})
+		return
+	}
+	stream.send("done", doneEvent{
+		ID:        rec.header.Get("X-Conifer-Build"),
+		URL:       cfg.PublicURL + chunkPath + name,
+		Integrity: subresourceIntegrity(result.Code),
+		Artifact:  result.Artifact,
+		Manifest:  result.Manifest,
+	})
+}
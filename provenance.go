@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+)
+
+const (
+	inTotoPayloadType   = "application/vnd.in-toto+json"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+	coniferBuildType    = "https://github.com/JavaScriptRegenerated/conifer/build/v1"
+	defaultConiferBuild = "https://github.com/JavaScriptRegenerated/conifer"
+)
+
+// provenanceConfig signs the provenance of builds, so auditors can check it
+// was issued by this service.
+type provenanceConfig struct {
+	// SigningKey is a base64 encoded Ed25519 private key or seed, and may
+	// reference an environment variable. Without it, provenance is served
+	// unsigned.
+	SigningKey string `json:"signingKey"`
+}
+
+// signingKey returns the configured key, or nil when provenance isn't
+// signed.
+func (c provenanceConfig) signingKey() (ed25519.PrivateKey, error) {
+	raw := os.ExpandEnv(c.SigningKey)
+	if raw == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, errors.New("provenance signing key isn't base64: " + err.Error())
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	default:
+		return nil, errors.New("provenance signing key must be an Ed25519 seed or private key")
+	}
+}
+
+// keyID identifies a public key by its hash.
+func keyID(public ed25519.PublicKey) string {
+	return "sha256:" + sha256Hex(public)
+}
+
+// inTotoStatement is an in-toto attestation about the output of a build.
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// slsaProvenance follows version 1 of the SLSA provenance format.
+type slsaProvenance struct {
+	BuildDefinition struct {
+		BuildType            string                   `json:"buildType"`
+		ExternalParameters   buildRequest             `json:"externalParameters"`
+		InternalParameters   map[string]string        `json:"internalParameters"`
+		ResolvedDependencies []slsaResourceDescriptor `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string    `json:"invocationId"`
+			FinishedOn   time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+type slsaResourceDescriptor struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// dsseEnvelope is a signed attestation, following the Dead Simple Signing
+// Envelope format.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// newProvenance describes how the output with outputSHA256 was built. The
+// invocation is the build record or artifact the output belongs to.
+func newProvenance(invocation string, finished time.Time, tenant string, req buildRequest, manifest buildManifest, outputSHA256 string) inTotoStatement {
+	name := "output.js"
+	if req.Name != "" {
+		name = req.Name + ".js"
+	}
+	p := slsaProvenance{}
+	p.BuildDefinition.BuildType = coniferBuildType
+	p.BuildDefinition.ExternalParameters = req
+	p.BuildDefinition.InternalParameters = map[string]string{"goVersion": runtime.Version()}
+	if tenant != "" {
+		p.BuildDefinition.InternalParameters["tenant"] = tenant
+	}
+	if region := os.Getenv("FLY_REGION"); region != "" {
+		p.BuildDefinition.InternalParameters["region"] = region
+	}
+	p.BuildDefinition.ResolvedDependencies = []slsaResourceDescriptor{}
+	for _, m := range manifest.Modules {
+		p.BuildDefinition.ResolvedDependencies = append(p.BuildDefinition.ResolvedDependencies, slsaResourceDescriptor{
+			URI:    m.URL,
+			Digest: map[string]string{"sha256": m.SHA256},
+		})
+	}
+	p.RunDetails.Builder.ID = defaultConiferBuild
+	if cfg.PublicURL != "" {
+		p.RunDetails.Builder.ID = cfg.PublicURL
+	}
+	p.RunDetails.Builder.Version = map[string]string{"conifer": manifest.Engine.Conifer, "esbuild": manifest.Engine.Esbuild}
+	p.RunDetails.Metadata.InvocationID = invocation
+	p.RunDetails.Metadata.FinishedOn = finished.UTC()
+	return inTotoStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		Subject:       []inTotoSubject{{Name: name, Digest: map[string]string{"sha256": outputSHA256}}},
+		PredicateType: slsaProvenanceType,
+		Predicate:     p,
+	}
+}
+
+// signProvenance wraps a statement in a signed envelope when there is a
+// signing key, and otherwise returns it as it is.
+func signProvenance(statement inTotoStatement) (interface{}, error) {
+	key, err := cfg.Provenance.signingKey()
+	if err != nil || key == nil {
+		return statement, err
+	}
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return nil, err
+	}
+	return dsseEnvelope{
+		PayloadType: inTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []dsseSignature{{
+			KeyID: keyID(key.Public().(ed25519.PublicKey)),
+			Sig:   base64.StdEncoding.EncodeToString(ed25519.Sign(key, dssePAE(inTotoPayloadType, payload))),
+		}},
+	}, nil
+}
+
+// dssePAE is the encoding DSSE signs, which binds the payload's type to it.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// recordProvenance returns the provenance of a recorded build.
+func recordProvenance(rec *buildRecord) (interface{}, error) {
+	return signProvenance(newProvenance(rec.ID, rec.Created, rec.Tenant, rec.Request, rec.Manifest, rec.OutputSHA256))
+}
+
+// storeProvenance keeps the provenance of a stored artifact next to it, as
+// provenance/<artifact>.json.
+func (a *artifactStore) storeProvenance(req buildRequest, result *buildResult) {
+	statement := newProvenance(result.Artifact, time.Now(), req.Tenant, req, result.Manifest, sha256Hex(result.Code))
+	signed, err := signProvenance(statement)
+	if err == nil {
+		var data []byte
+		if data, err = json.MarshalIndent(signed, "", "  "); err == nil {
+			err = a.objects.put("provenance/"+result.Artifact+".json", data, "application/json")
+		}
+	}
+	if err != nil {
+		log.Println("storing provenance:", err)
+	}
+}
+
+// handleProvenanceKey publishes the key provenance is signed with:
+//
+//	GET /v1/provenance-key
+func handleProvenanceKey(w http.ResponseWriter, r *http.Request) {
+	key, err := cfg.Provenance.signingKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if key == nil {
+		http.Error(w, "provenance isn't signed", http.StatusNotFound)
+		return
+	}
+	public := key.Public().(ed25519.PublicKey)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"keyid":     keyID(public),
+		"algorithm": "ed25519",
+		"publicKey": base64.StdEncoding.EncodeToString(public),
+	})
+}
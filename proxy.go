@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// proxyURL returns the URL the browser should load rawURL through, so it
+// goes via conifer rather than straight to a third-party CDN.
+func proxyURL(rawURL string) string {
+	return cfg.PublicURL + "/fetch?url=" + url.QueryEscape(rawURL)
+}
+
+// handleFetch serves a single remote module, with each of its imports
+// rewritten to also be loaded through /fetch.
+func handleFetch(w http.ResponseWriter, r *http.Request) {
+	rawURL := r.URL.Query().Get("url")
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, "url must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+	if !authorizeCaller(w, r) {
+		return
+	}
+	tenant, key := keyFor(r)
+	limits, _ := keyLimits(r, tenant, key)
+	if err := limits.checkUpstream(canonicalURL(rawURL)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if _, cached := modulesCache.get(canonicalURL(rawURL)); !cached && underPressure() {
+		writeOverloaded(w)
+		return
+	}
+	f := newFetcher()
+	f.limit(limits)
+	f.forTenant(tenant)
+	mod, err := f.fetch(rawURL)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	// The module may have been downloaded for another caller, which its
+	// redirects were allowed for.
+	if err := limits.checkUpstream(mod.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	code, errors := proxyModule(mod, proxyOptions{Resolve: fetchImport})
+	if len(errors) > 0 {
+		writeBuildErrors(w, errors, nil)
+		return
+	}
+
+	writeJavaScript(w, r, code, "public, max-age=300")
+}
+
+// proxyOptions controls how proxyModule converts a module.
+type proxyOptions struct {
+	// Resolve returns the URL an import of path from the module at base is
+	// loaded from.
+	Resolve func(base *url.URL, path string) (string, error)
+	Minify  bool
+	Target  api.Target
+}
+
+// fetchImport loads every import through /fetch.
+func fetchImport(base *url.URL, path string) (string, error) {
+	relative, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	return proxyURL(base.ResolveReference(relative).String()), nil
+}
+
+// proxyModule converts mod to an ES module whose imports are rewritten by
+// opts.Resolve. It is "bundled" so esbuild resolves each import, but every
+// import is external, so the output only contains mod itself.
+func proxyModule(mod *module, opts proxyOptions) ([]byte, []api.Message) {
+	base, _ := url.Parse(mod.URL)
+	result := api.Build(api.BuildOptions{
+		Stdin: &api.StdinOptions{
+			Contents:   mod.Contents,
+			Sourcefile: mod.URL,
+			Loader:     loaderFor(mod.URL),
+		},
+		Format:            api.FormatESModule,
+		Target:            opts.Target,
+		MinifyWhitespace:  opts.Minify,
+		MinifyIdentifiers: opts.Minify,
+		MinifySyntax:      opts.Minify,
+		Bundle:            true,
+		Write:             false,
+		Plugins: []api.Plugin{{
+			Name: "proxy",
+			Setup: func(build api.PluginBuild) {
+				build.OnResolve(api.OnResolveOptions{Filter: ".*"},
+					func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+						if args.Namespace == "proxy-require" {
+							return api.OnResolveResult{Path: args.Path, External: true}, nil
+						}
+						path, err := opts.Resolve(base, args.Path)
+						if err != nil {
+							return api.OnResolveResult{}, err
+						}
+						if args.Kind == api.ResolveJSRequireCall {
+							// Browsers can't require, so CommonJS gets what
+							// it requires from a module importing it.
+							return api.OnResolveResult{Path: path, Namespace: "proxy-require"}, nil
+						}
+						return api.OnResolveResult{Path: path, External: true}, nil
+					})
+				build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: "proxy-require"},
+					func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+						quoted, _ := json.Marshal(args.Path)
+						contents := "import * as m from " + string(quoted) + ";\n" +
+							"module.exports = m.default !== undefined ? m.default : m;\n"
+						return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+					})
+			},
+		}},
+	})
+	if len(result.Errors) > 0 {
+		return nil, result.Errors
+	}
+	return result.OutputFiles[0].Contents, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// purgeConfig configures a CDN in front of conifer whose cached copies of
+// a URL must be purged when what the URL serves changes.
+type purgeConfig struct {
+	// Kind is "cloudflare", "fastly", or "http" for caches like Varnish
+	// that accept a PURGE request to the URL itself.
+	Kind string `json:"kind"`
+	// ZoneID is the Cloudflare zone.
+	ZoneID string `json:"zoneId"`
+	// APIToken authenticates with Cloudflare or Fastly. It may reference
+	// an environment variable like "$CLOUDFLARE_TOKEN".
+	APIToken string `json:"apiToken"`
+}
+
+// purgeURLs asks every configured CDN to drop its cached copies of urls in
+// the background. URLs are only purgeable when conifer knows its public URL.
+func purgeURLs(urls ...string) {
+	if len(cfg.Purge) == 0 {
+		return
+	}
+	if cfg.PublicURL == "" {
+		log.Println("purge: publicUrl must be configured to purge", urls)
+		return
+	}
+	for _, purge := range cfg.Purge {
+		purge := purge
+		go func() {
+			if err := purge.purge(urls); err != nil {
+				log.Printf("purge %s: %v", purge.Kind, err)
+			}
+		}()
+	}
+}
+
+func (p purgeConfig) purge(urls []string) error {
+	token := os.ExpandEnv(p.APIToken)
+	switch p.Kind {
+	case "cloudflare":
+		body, _ := json.Marshal(map[string][]string{"files": urls})
+		req, err := http.NewRequest("POST", "https://api.cloudflare.com/client/v4/zones/"+p.ZoneID+"/purge_cache", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		return doPurge(req)
+	case "fastly":
+		for _, u := range urls {
+			target := u[strings.Index(u, "://")+len("://"):]
+			req, err := http.NewRequest("POST", "https://api.fastly.com/purge/"+target, nil)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Fastly-Key", token)
+			if err := doPurge(req); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "http":
+		for _, u := range urls {
+			req, err := http.NewRequest("PURGE", u, nil)
+			if err != nil {
+				return err
+			}
+			if err := doPurge(req); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown kind %q", p.Kind)
+	}
+}
+
+func doPurge(req *http.Request) error {
+	res, err := webhookClient().Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL, res.Status)
+	}
+	return nil
+}
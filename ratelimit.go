@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// routeRateLimit limits how often each caller, identified by its API key or
+// else its IP address, may request paths under Prefix, like "/v1/build" or
+// "/bundles/". The longest prefix matching a path applies, so builds can be
+// limited more tightly than the cached bundles they serve.
+type routeRateLimit struct {
+	Prefix            string `json:"prefix"`
+	RequestsPerMinute int    `json:"requestsPerMinute"`
+	// Burst is how many requests may be made at once after a quiet spell,
+	// RequestsPerMinute when zero.
+	Burst int `json:"burst"`
+}
+
+// maxRateBuckets is how many callers are tracked before those who have
+// been quiet long enough to be back at their burst are forgotten.
+const maxRateBuckets = 100000
+
+// rateLimiter is a token bucket for each caller, filled at the caller's
+// rate up to its burst, taking a token for each request.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will be back at its burst.
+	full time.Time
+}
+
+var rates = &rateLimiter{buckets: make(map[string]*rateBucket)}
+
+// take counts a request by caller, allowed perMinute requests a minute in
+// bursts of up to burst, or perMinute when burst is zero. When the caller
+// has none left, it reports false and how long until it has one.
+func (l *rateLimiter) take(caller string, perMinute, burst int) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+	perSecond := float64(perMinute) / 60
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[caller]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.forgetFull(now)
+		}
+		b = &rateBucket{tokens: float64(burst), updated: now}
+		l.buckets[caller] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(burst) - b.tokens) / perSecond * float64(time.Second)))
+	return true, 0
+}
+
+// forgetFull drops the buckets of callers back at their burst, who are no
+// different from callers never seen. When too few are, so many callers are
+// making requests that the tenth of them quiet longest are dropped too,
+// rather than the buckets growing without bound.
+func (l *rateLimiter) forgetFull(now time.Time) {
+	for caller, b := range l.buckets {
+		if now.After(b.full) {
+			delete(l.buckets, caller)
+		}
+	}
+	if len(l.buckets) < maxRateBuckets {
+		return
+	}
+	callers := make([]string, 0, len(l.buckets))
+	for caller := range l.buckets {
+		callers = append(callers, caller)
+	}
+	sort.Slice(callers, func(i, j int) bool {
+		return l.buckets[callers[i]].updated.Before(l.buckets[callers[j]].updated)
+	})
+	for _, caller := range callers[:len(callers)/10+1] {
+		delete(l.buckets, caller)
+	}
+}
+
+// writeRateLimited refuses a request by a caller who must wait before
+// making another.
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+// retryAfterSeconds rounds wait up to whole seconds, as Retry-After gives it.
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// clientIP is the IP address of the client making r. Behind a proxy like
+// Fly's, configured with trustProxyHeaders, that is the address the proxy
+// says it saw rather than the proxy's own.
+func clientIP(r *http.Request) string {
+	if cfg.TrustProxyHeaders {
+		if ip := strings.TrimSpace(r.Header.Get("Fly-Client-IP")); ip != "" {
+			return ip
+		}
+		// Clients can send X-Forwarded-For themselves, so only the
+		// address the proxy added last can be trusted.
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// routeRateLimitFor returns the configured limit with the longest prefix
+// of path, or nil.
+func routeRateLimitFor(path string) *routeRateLimit {
+	var match *routeRateLimit
+	for i, limit := range cfg.RateLimits {
+		if underPrefix(path, limit.Prefix) && (match == nil || len(limit.Prefix) > len(match.Prefix)) {
+			match = &cfg.RateLimits[i]
+		}
+	}
+	return match
+}
+
+// underPrefix reports whether path is prefix or under it, matching whole
+// path segments, so "/v1/build" doesn't match "/v1/builds/<id>".
+func underPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// withRateLimits serves next, refusing requests by callers who have used up
+// the rate limit of their route.
+func withRateLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := routeRateLimitFor(r.URL.Path)
+		if limit == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		caller := "ip:" + clientIP(r)
+		if _, key := keyFor(r); key != nil {
+			caller = "key:" + key.id()
+		}
+		if ok, wait := rates.take("route:"+limit.Prefix+"/"+caller, limit.RequestsPerMinute, limit.Burst); !ok {
+			writeRateLimited(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
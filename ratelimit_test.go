@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRouteRateLimitMatchesWholeSegments(t *testing.T) {
+	saved := cfg.RateLimits
+	defer func() { cfg.RateLimits = saved }()
+	cfg.RateLimits = []routeRateLimit{
+		{Prefix: "/v1/build", RequestsPerMinute: 10},
+		{Prefix: "/bundles/", RequestsPerMinute: 100},
+	}
+	for path, want := range map[string]string{
+		"/v1/build":            "/v1/build",
+		"/v1/build/":           "/v1/build",
+		"/v1/builds/abc":       "",
+		"/v1/buildx":           "",
+		"/bundles/acme/app.js": "/bundles/",
+	} {
+		got := ""
+		if limit := routeRateLimitFor(path); limit != nil {
+			got = limit.Prefix
+		}
+		if got != want {
+			t.Errorf("routeRateLimitFor(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRateLimiterForgetsQuietestWhenFull(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*rateBucket)}
+	now := time.Now()
+	for i := 0; i < maxRateBuckets; i++ {
+		// None are back at their burst.
+		l.buckets[strconv.Itoa(i)] = &rateBucket{updated: now.Add(time.Duration(i) * time.Millisecond), full: now.Add(time.Hour)}
+	}
+	l.take("new", 1, 0)
+	if len(l.buckets) >= maxRateBuckets {
+		t.Fatalf("%d buckets kept, want fewer than %d", len(l.buckets), maxRateBuckets)
+	}
+	if _, ok := l.buckets["0"]; ok {
+		t.Error("the bucket quiet longest was kept")
+	}
+	if _, ok := l.buckets[strconv.Itoa(maxRateBuckets-1)]; !ok {
+		t.Error("the most recently used bucket was dropped")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Defaults for the shared Redis cache.
+const (
+	defaultRedisPrefix = "conifer:"
+	defaultRedisTTL    = 24 * time.Hour
+	redisTimeout       = 2 * time.Second
+)
+
+// redisConfig connects instances to a shared cache, so a deployment across
+// several regions downloads each module and builds each bundle once rather
+// than once per instance.
+type redisConfig struct {
+	// URL is like "redis://:password@host:6379/0", and may reference
+	// environment variables.
+	URL string `json:"url"`
+	// Prefix is prepended to every key, so instances can share a Redis
+	// with other services.
+	Prefix string   `json:"prefix"`
+	TTL    duration `json:"ttl"`
+}
+
+// redisCache stores modules and finished builds in Redis. Redis being slow
+// or unavailable only makes builds slower, so its errors are logged and
+// treated as cache misses.
+type redisCache struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+
+	counters cacheCounters
+}
+
+func newRedisCache(c redisConfig) (*redisCache, error) {
+	opts, err := redis.ParseURL(os.ExpandEnv(c.URL))
+	if err != nil {
+		return nil, err
+	}
+	r := &redisCache{client: redis.NewClient(opts), prefix: c.Prefix, ttl: time.Duration(c.TTL)}
+	if r.prefix == "" {
+		r.prefix = defaultRedisPrefix
+	}
+	if r.ttl == 0 {
+		r.ttl = defaultRedisTTL
+	}
+	return r, nil
+}
+
+// sharedCache is set when a Redis cache is configured.
+var sharedCache *redisCache
+
+func (r *redisCache) getJSON(key string, v interface{}) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	data, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if err == redis.Nil {
+		return false
+	} else if err != nil {
+		log.Println("redis:", err)
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func (r *redisCache) putJSON(key string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := r.client.Set(ctx, r.prefix+key, data, r.ttl).Err(); err != nil {
+		log.Println("redis:", err)
+	}
+}
+
+// redisModule is how a module is stored in Redis.
+type redisModule struct {
+	// Requested is the URL the module is cached under, before redirects.
+	Requested    string    `json:"requested,omitempty"`
+	URL          string    `json:"url"`
+	Contents     string    `json:"contents"`
+	SHA256       string    `json:"sha256"`
+	Expires      time.Time `json:"expires"`
+	StaleUntil   time.Time `json:"staleUntil"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+}
+
+func (r *redisCache) get(url string) (*module, bool) {
+	var m redisModule
+	if !r.getJSON("module:"+sha256Hex([]byte(url)), &m) || sha256Hex([]byte(m.Contents)) != m.SHA256 {
+		return r.counters.lookup(nil, false)
+	}
+	return r.counters.lookup(&module{URL: m.URL, Contents: m.Contents, SHA256: m.SHA256, Expires: m.Expires, StaleUntil: m.StaleUntil, ETag: m.ETag, LastModified: m.LastModified}, true)
+}
+
+func (r *redisCache) stats() []cacheStats {
+	s := r.counters.stats("shared")
+	s.Entries = r.countEntries("module:*")
+	return []cacheStats{s}
+}
+
+func (r *redisCache) put(url string, mod *module) {
+	r.putJSON("module:"+sha256Hex([]byte(url)), redisModule{
+		Requested:    url,
+		URL:          mod.URL,
+		Contents:     mod.Contents,
+		SHA256:       mod.SHA256,
+		Expires:      mod.Expires,
+		StaleUntil:   mod.StaleUntil,
+		ETag:         mod.ETag,
+		LastModified: mod.LastModified,
+	})
+}
+
+func (r *redisCache) purge(match func(url string) bool) int {
+	return r.purgeKeys("module:*", func(data []byte) bool {
+		var m redisModule
+		return json.Unmarshal(data, &m) == nil && (match(m.Requested) || match(m.URL))
+	})
+}
+
+// purgeBuilds removes the shared builds that used a module whose URL
+// matches.
+func (r *redisCache) purgeBuilds(match func(url string) bool) int {
+	return r.purgeKeys("build:*", func(data []byte) bool {
+		var b cachedBuild
+		if json.Unmarshal(data, &b) != nil {
+			return true
+		}
+		for _, m := range b.Manifest.Modules {
+			if match(m.URL) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// purgeKeys deletes the keys matching pattern whose values remove accepts.
+func (r *redisCache) purgeKeys(pattern string, remove func(data []byte) bool) int {
+	ctx := context.Background()
+	n := 0
+	iter := r.client.Scan(ctx, 0, r.prefix+pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		data, err := r.client.Get(ctx, key).Bytes()
+		if err != nil || !remove(data) {
+			continue
+		}
+		if err := r.client.Del(ctx, key).Err(); err != nil {
+			log.Println("redis:", err)
+			continue
+		}
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		log.Println("redis:", err)
+	}
+	return n
+}
+
+// publishPurge tells every instance to purge its own caches.
+func (r *redisCache) publishPurge(p cachePurge) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := r.client.Publish(ctx, r.prefix+"purge", data).Err(); err != nil {
+		log.Println("redis:", err)
+	}
+}
+
+// subscribePurges applies purges published by other instances to the
+// caches kept by this one.
+func (r *redisCache) subscribePurges(apply func(p cachePurge)) {
+	sub := r.client.Subscribe(context.Background(), r.prefix+"purge")
+	for msg := range sub.Channel() {
+		var p cachePurge
+		if err := json.Unmarshal([]byte(msg.Payload), &p); err != nil {
+			log.Println("redis: invalid purge:", err)
+			continue
+		}
+		apply(p)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultMaxBodyBytes caps source sent as a request body, unless the config
+// sets maxBodyBytes.
+const defaultMaxBodyBytes = 1 << 20
+
+// requestSource returns the source to build from a POST body or else the
+// source query parameter. A body larger than the configured maximum is
+// refused without reading the rest of it, writing the error and returning
+// false.
+func requestSource(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method == "POST" {
+		defer r.Body.Close()
+		max := cfg.MaxBodyBytes
+		if max <= 0 {
+			max = defaultMaxBodyBytes
+		}
+		b, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+		if r.ContentLength > max || int64(len(b)) > max {
+			http.Error(w, "request body is larger than "+strconv.FormatInt(max, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return "", false
+		}
+		if err == nil && len(b) > 0 {
+			return string(b), true
+		}
+	}
+	return r.URL.Query().Get("source"), true
+}
+
+// parseBuildRequest reads the options for building source from the query
+// string.
+func parseBuildRequest(r *http.Request, source string) (buildRequest, error) {
+	q := r.URL.Query()
+	req := buildRequest{
+		Source:      source,
+		Minify:      q.Has("minify"),
+		Bundle:      q.Get("bundle") != "false",
+		KeepURLs:    splitList(q.Get("keepUrls")),
+		Name:        q.Get("name"),
+		MangleProps: q.Get("mangleProps"),
+		Splitting:   q.Get("splitting") == "true",
+		Target:      q.Get("target"),
+		Format:      q.Get("format"),
+		Sourcemap:   q.Get("sourcemap"),
+		ProxyURLs:   q.Get("proxyUrls") == "true",
+		Polyfill:    q.Get("polyfill") == "true",
+		SmokeTest:   q.Get("smokeTest") == "true",
+	}
+	if q.Get("differential") == "true" && !isModernBrowser(r.UserAgent()) {
+		req.Target = "es2017"
+		if legacy := q.Get("legacyTarget"); legacy != "" {
+			req.Target = legacy
+		}
+	}
+	if _, ok := targetsByName[req.Target]; req.Target != "" && !ok {
+		return req, errors.New("unknown target: " + req.Target)
+	}
+	if _, ok := formatsByName[req.Format]; !ok {
+		return req, errors.New("unknown format: " + req.Format)
+	}
+	// The response is the output alone, so there's nowhere for an
+	// external source map to go, except with a deploy manifest, which
+	// links to it, or in an archive next to the output.
+	if req.Sourcemap != "" && req.Sourcemap != "inline" && !(req.Sourcemap == "external" && (q.Get("output") == "manifest" || outputArchive(r) != "")) {
+		return req, errors.New("sourcemap must be inline, or external with output=manifest, output=zip or output=tar")
+	}
+	if req.Splitting && formatsByName[req.Format] != formatsByName["esm"] {
+		return req, errors.New("splitting needs the esm format")
+	}
+	if req.Name != "" && !validBundleName(req.Name) {
+		return req, errors.New("invalid bundle name")
+	}
+	if err := checkSmokeTest(req); err != nil {
+		return req, err
+	}
+	if lock := q.Get("lockfile"); lock != "" {
+		if err := json.Unmarshal([]byte(lock), &req.Lockfile); err != nil {
+			return req, errors.New("invalid lockfile: " + err.Error())
+		}
+		if err := req.Lockfile.check(); err != nil {
+			return req, err
+		}
+	}
+	stamp, err := parseStamp(q, time.Now())
+	if err != nil {
+		return req, err
+	}
+	req.Stamp = stamp
+	if raw := q.Get("tsconfigRaw"); raw != "" {
+		normalized, err := normalizeTsconfig(raw)
+		if err != nil {
+			return req, errors.New("invalid tsconfigRaw: " + err.Error())
+		}
+		req.TsconfigRaw = normalized
+	}
+	req.ImportMap = cfg.ImportMap
+	if m := q.Get("importMap"); m != "" {
+		req.ImportMap = &importMap{}
+		if err := json.Unmarshal([]byte(m), req.ImportMap); err != nil {
+			return req, errors.New("invalid import map: " + err.Error())
+		}
+	}
+	if exposes := q.Get("exposes"); exposes != "" {
+		if err := json.Unmarshal([]byte(exposes), &req.Exposes); err != nil {
+			return req, errors.New("invalid exposes: " + err.Error())
+		}
+	}
+	if remotes := q.Get("remotes"); remotes != "" {
+		if err := json.Unmarshal([]byte(remotes), &req.Remotes); err != nil {
+			return req, errors.New("invalid remotes: " + err.Error())
+		}
+	}
+	if err := checkFederation(&req); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// authorizeBuild applies the tenant's settings and the operator's script
+// to req, then asks the pre-build webhook whether it may go ahead. It
+// writes an error response and returns false when the build must not run.
+// The build is cancelled if the caller goes away before it finishes.
+func authorizeBuild(w http.ResponseWriter, r *http.Request, req *buildRequest) bool {
+	req.Context = r.Context()
+	tenant, key := keyFor(r)
+	if !checkKey(w, r, tenant, key, (req.Source != "" && !req.SourceGenerated) || len(req.Files) > 0) {
+		return false
+	}
+	if tenant != nil {
+		req.Tenant = tenant.Name
+		if r.URL.Query().Get("autoExternal") == "true" {
+			req.KeepURLs = append(req.KeepURLs, libraries.sharedKeepURLs(tenant.Name)...)
+		}
+	} else if cfg.Playground != nil {
+		req.Watermark = cfg.Playground.watermark()
+	}
+
+	// Limits are checked before the build script and webhook run, so a
+	// caller over them can't make either do work.
+	req.KeyLimits = nil
+	if key != nil {
+		req.KeyLimits = key.Limits
+	}
+	limits, caller := keyLimits(r, tenant, key)
+	if ok, wait := rates.take(caller, limits.RequestsPerMinute, 0); !ok {
+		writeRateLimited(w, wait)
+		return false
+	}
+	if limits.MaxSourceBytes > 0 && int64(req.sourceBytes()) > limits.MaxSourceBytes {
+		http.Error(w, "source is larger than "+strconv.FormatInt(limits.MaxSourceBytes, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if !quotas.take(caller, limits.BuildsPerDay) {
+		writeQuotaExceeded(w)
+		return false
+	}
+
+	if script != nil {
+		if err := script.apply(r, req.Tenant, req); err != nil {
+			log.Println("build script:", err)
+			http.Error(w, "build script failed", http.StatusInternalServerError)
+			return false
+		}
+	}
+
+	allowed, reason, err := preBuildHook(req.Tenant, *req)
+	if err != nil {
+		log.Println("pre-build webhook:", err)
+		http.Error(w, "pre-build check failed", http.StatusBadGateway)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "build refused: "+reason, http.StatusForbidden)
+		return false
+	}
+	return true
+}
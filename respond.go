@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeJavaScript responds with code under a strong ETag derived from it,
+// answering requests whose If-None-Match already has it with 304 Not
+// Modified.
+func writeJavaScript(w http.ResponseWriter, r *http.Request, code []byte, cacheControl string) {
+	writeContent(w, r, "text/javascript;charset=UTF-8", code, cacheControl)
+}
+
+// writeContent is writeJavaScript for content of any type.
+func writeContent(w http.ResponseWriter, r *http.Request, contentType string, code []byte, cacheControl string) {
+	etag := `"` + sha256Hex(code)[:32] + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Add("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(code)
+}
+
+// allowCrossOrigin lets pages on other sites load a response, which module
+// scripts and integrity checks need. A response that depends on the origin
+// asking, such as a bundle only some sites may embed, only allows that
+// origin.
+func allowCrossOrigin(w http.ResponseWriter, r *http.Request, perOrigin bool) {
+	if !perOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison RFC 7232 asks for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// buildCacheControl is how long caches may keep a build's output. Output
+// built only from pinned modules never changes, while anything else is
+// cached briefly and then revalidated by ETag. Tenants' output stays out of
+// shared caches.
+func buildCacheControl(req buildRequest, result *buildResult) string {
+	switch {
+	case req.Tenant != "":
+		return "private, no-cache"
+	case result.Manifest.Pinned:
+		return "public, max-age=31536000, immutable"
+	default:
+		return "public, max-age=300"
+	}
+}
+
+// responseRecorder is an http.ResponseWriter keeping the response, for
+// handlers serving something other than an HTTP response, like one build
+// of a batch.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (rec *responseRecorder) Header() http.Header { return rec.header }
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wrote {
+		rec.status, rec.wrote = status, true
+	}
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(p)
+}
+
+// retryAfter is the seconds of the Retry-After header, or 0.
+func (rec *responseRecorder) retryAfter() int {
+	seconds, _ := strconv.Atoi(rec.header.Get("Retry-After"))
+	return seconds
+}
+
+// failure describes the failure recorded, as a failed build describes
+// itself, or with the code "request_failed" for requests refused before
+// they were built, which explain themselves in plain text.
+func (rec *responseRecorder) failure() *buildErrorBody {
+	var failure buildErrorBody
+	if strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") && json.Unmarshal(rec.body.Bytes(), &failure) == nil {
+		return &failure
+	}
+	return &buildErrorBody{
+		Code:     "request_failed",
+		Message:  strings.TrimSpace(rec.body.String()),
+		Errors:   []buildMessage{},
+		Warnings: []buildMessage{},
+	}
+}
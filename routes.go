@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Route splitting builds a single-page app's routes at once, mapping paths
+// like "/settings" to the modules rendering them. The output is a router
+// entry whose load function imports a route's module, each of which code
+// splitting puts in its own chunk, with the code routes share, such as the
+// libraries they use, in shared chunks. The loading manifest says which
+// chunks each route needs, so a page can preload them all at once rather
+// than discovering them import by import.
+
+// routeManifestName is the name of the loading manifest in a JSON envelope.
+const routeManifestName = "routes.json"
+
+// routeManifest says which chunks each route of a build loads.
+type routeManifest struct {
+	Routes map[string]routeChunks `json:"routes"`
+	// Shared are the chunks more than one route loads.
+	Shared []string `json:"shared"`
+}
+
+type routeChunks struct {
+	// Chunk is the URL of the route's own chunk.
+	Chunk string `json:"chunk"`
+	// Imports are the URLs of the chunks Chunk imports, directly or not,
+	// which load before it runs.
+	Imports []string `json:"imports"`
+}
+
+// checkRoutes validates a build's routes. Builds of routes split them into
+// chunks.
+func checkRoutes(req *buildRequest) error {
+	if len(req.Routes) == 0 {
+		return nil
+	}
+	switch {
+	case req.Source != "" || req.Entry != "" || len(req.Files) > 0:
+		return errors.New("a build of routes has no source or entry of its own")
+	case len(req.Exposes) > 0:
+		return errors.New("routes can't be given with exposes")
+	case !req.Bundle || formatsByName[req.Format] != formatsByName["esm"]:
+		return errors.New("routes need a bundled build in the esm format")
+	case req.Sourcemap == "external":
+		return errors.New("routes can't be used with external source maps")
+	}
+	for route, specifier := range req.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("routes must be paths like /settings, not %q", route)
+		}
+		if specifier == "" {
+			return fmt.Errorf("route %s has no module", route)
+		}
+	}
+	req.Splitting = true
+	return nil
+}
+
+// routerEntry is the source of the entry of a build of routes.
+func routerEntry(routes map[string]string) string {
+	paths := make([]string, 0, len(routes))
+	for route := range routes {
+		paths = append(paths, route)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	b.WriteString("const routes = {\n")
+	for _, route := range paths {
+		fmt.Fprintf(&b, "  %s: () => import(%s),\n", jsString(route), jsString(routes[route]))
+	}
+	b.WriteString("};\n")
+	b.WriteString("export const paths = Object.keys(routes);\n")
+	b.WriteString("export function load(path) {\n")
+	b.WriteString("  const route = routes[path];\n")
+	b.WriteString("  return route ? route() : Promise.reject(new Error(\"no route \" + path));\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// routeChunkManifest finds the chunk code splitting made of each route's
+// module, and the chunks it imports.
+func routeChunkManifest(routes map[string]string, graph []importEdge, m *metafile) *routeManifest {
+	if m == nil {
+		return nil
+	}
+	chunkURL := func(output string) string {
+		return cfg.PublicURL + chunkPath + filepath.Base(output)
+	}
+	byEntryPoint := make(map[string]string)
+	for path, out := range m.Outputs {
+		if out.EntryPoint != "" && !strings.HasSuffix(path, ".map") {
+			byEntryPoint[out.EntryPoint] = path
+		}
+	}
+	// imports follows the static imports of an output, which are chunks
+	// of code it shares with other outputs.
+	var imports func(output string, seen map[string]bool)
+	imports = func(output string, seen map[string]bool) {
+		for _, imp := range m.Outputs[output].Imports {
+			if imp.Kind != "import-statement" || seen[imp.Path] {
+				continue
+			}
+			if _, ok := m.Outputs[imp.Path]; !ok {
+				// An import left in the output, not a chunk.
+				continue
+			}
+			seen[imp.Path] = true
+			imports(imp.Path, seen)
+		}
+	}
+
+	manifest := &routeManifest{Routes: make(map[string]routeChunks, len(routes)), Shared: []string{}}
+	loadedBy := make(map[string]int)
+	for route, specifier := range routes {
+		chunks := routeChunks{Imports: []string{}}
+		for _, edge := range graph {
+			if edge.Importer != "" || edge.Specifier != specifier || edge.External {
+				continue
+			}
+			output, ok := byEntryPoint["http-url:"+edge.URL]
+			if !ok {
+				continue
+			}
+			chunks.Chunk = chunkURL(output)
+			seen := make(map[string]bool)
+			imports(output, seen)
+			for imported := range seen {
+				chunks.Imports = append(chunks.Imports, chunkURL(imported))
+				loadedBy[imported]++
+			}
+			sort.Strings(chunks.Imports)
+		}
+		manifest.Routes[route] = chunks
+	}
+	for output, n := range loadedBy {
+		if n > 1 {
+			manifest.Shared = append(manifest.Shared, chunkURL(output))
+		}
+	}
+	sort.Strings(manifest.Shared)
+	return manifest
+}
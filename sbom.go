@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sbomPackage is a package whose modules a build included, or a module
+// outside of any package, which has no name.
+type sbomPackage struct {
+	name, version string
+	// url is the library's URL prefix, or the module's.
+	url  string
+	purl string
+	// licenses are those the package's package.json declares.
+	licenses []string
+	modules  []manifestModule
+}
+
+// license is the package's licenses as one SPDX expression. A package.json
+// listing several offers a choice of them.
+func (p *sbomPackage) license() string {
+	if len(p.licenses) == 1 {
+		return p.licenses[0]
+	}
+	return "(" + strings.Join(p.licenses, " OR ") + ")"
+}
+
+// npmPurl is the package URL of an npm package, or "" when the version
+// isn't an npm version, like a Deno module's "v1.2.0".
+func npmPurl(name, version string) string {
+	if _, ok := parseSemver(version); !ok {
+		return ""
+	}
+	return "pkg:npm/" + strings.Replace(name, "@", "%40", 1) + "@" + version
+}
+
+// sbomPackages groups the modules of a build by package, sorted by URL,
+// with the licenses from its license report when it was bundled.
+func sbomPackages(result *buildResult) []*sbomPackage {
+	declared := make(map[string][]string)
+	if result.Metafile != nil {
+		if report, err := cachedLicenseReport(result); err == nil {
+			for _, code := range report.Packages {
+				for _, l := range code.Licenses {
+					if strings.HasSuffix(l.Source, "/package.json") {
+						declared[code.URL] = append(declared[code.URL], l.License)
+					}
+				}
+			}
+		}
+	}
+	byURL := make(map[string]*sbomPackage)
+	var packages []*sbomPackage
+	for _, mod := range result.Manifest.Modules {
+		library := libraryOf(mod.URL)
+		key := library
+		if key == "" {
+			key = mod.URL
+		}
+		p, ok := byURL[key]
+		if !ok {
+			p = &sbomPackage{url: key, licenses: declared[key]}
+			if library != "" {
+				p.name, p.version = packageVersionOf(mod.URL)
+				p.purl = npmPurl(p.name, p.version)
+			}
+			byURL[key] = p
+			packages = append(packages, p)
+		}
+		p.modules = append(p.modules, mod)
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].url < packages[j].url })
+	return packages
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// moduleName names a module in an SBOM by its path on its host.
+func moduleName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host + u.Path
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDXReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cycloneDXLicense struct {
+	Expression string `json:"expression"`
+}
+
+type cycloneDXComponent struct {
+	Type               string               `json:"type"`
+	BOMRef             string               `json:"bom-ref"`
+	Name               string               `json:"name"`
+	Version            string               `json:"version,omitempty"`
+	Purl               string               `json:"purl,omitempty"`
+	Hashes             []cycloneDXHash      `json:"hashes,omitempty"`
+	Licenses           []cycloneDXLicense   `json:"licenses,omitempty"`
+	ExternalReferences []cycloneDXReference `json:"externalReferences,omitempty"`
+	Components         []cycloneDXComponent `json:"components,omitempty"`
+}
+
+// cycloneDXBOM is a CycloneDX 1.5 bill of materials.
+type cycloneDXBOM struct {
+	BOMFormat    string `json:"bomFormat"`
+	SpecVersion  string `json:"specVersion"`
+	SerialNumber string `json:"serialNumber"`
+	Version      int    `json:"version"`
+	Metadata     struct {
+		Timestamp string `json:"timestamp"`
+		Tools     struct {
+			Components []cycloneDXComponent `json:"components"`
+		} `json:"tools"`
+		Component cycloneDXComponent `json:"component"`
+	} `json:"metadata"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+// newCycloneDXBOM lists a build's packages as library components holding
+// their modules as file components, and modules outside of packages as
+// file components of their own.
+func newCycloneDXBOM(req buildRequest, result *buildResult, packages []*sbomPackage) cycloneDXBOM {
+	bom := cycloneDXBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Components:   []cycloneDXComponent{},
+	}
+	bom.Metadata.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	bom.Metadata.Tools.Components = []cycloneDXComponent{
+		{Type: "application", BOMRef: "conifer", Name: "conifer", Version: result.Manifest.Engine.Conifer},
+		{Type: "application", BOMRef: "esbuild", Name: "esbuild", Version: result.Manifest.Engine.Esbuild},
+	}
+	bom.Metadata.Component = cycloneDXComponent{
+		Type:   "file",
+		BOMRef: "output",
+		Name:   outputName(req),
+		Hashes: []cycloneDXHash{{Alg: "SHA-256", Content: sha256Hex(result.Code)}},
+	}
+	file := func(mod manifestModule) cycloneDXComponent {
+		return cycloneDXComponent{
+			Type:               "file",
+			BOMRef:             mod.URL,
+			Name:               moduleName(mod.URL),
+			Hashes:             []cycloneDXHash{{Alg: "SHA-256", Content: mod.SHA256}},
+			ExternalReferences: []cycloneDXReference{{Type: "distribution", URL: mod.URL}},
+		}
+	}
+	for _, p := range packages {
+		if p.name == "" {
+			bom.Components = append(bom.Components, file(p.modules[0]))
+			continue
+		}
+		c := cycloneDXComponent{
+			Type:               "library",
+			BOMRef:             p.url,
+			Name:               p.name,
+			Version:            p.version,
+			Purl:               p.purl,
+			ExternalReferences: []cycloneDXReference{{Type: "distribution", URL: p.url}},
+		}
+		if len(p.licenses) > 0 {
+			c.Licenses = []cycloneDXLicense{{Expression: p.license()}}
+		}
+		for _, mod := range p.modules {
+			c.Components = append(c.Components, file(mod))
+		}
+		bom.Components = append(bom.Components, c)
+	}
+	return bom
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxFile struct {
+	FileName         string         `json:"fileName"`
+	SPDXID           string         `json:"SPDXID"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxDocument is an SPDX 2.3 document.
+type spdxDocument struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages      []spdxPackage      `json:"packages"`
+	Files         []spdxFile         `json:"files"`
+	Relationships []spdxRelationship `json:"relationships"`
+}
+
+// newSPDXDocument describes a build's output as a package depending on the
+// packages its modules belong to, which contain the modules as files.
+// Modules outside of packages are files the output contains.
+func newSPDXDocument(req buildRequest, result *buildResult, packages []*sbomPackage) spdxDocument {
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              outputName(req),
+		DocumentNamespace: "urn:uuid:" + newUUID(),
+		Packages:          []spdxPackage{},
+		Files:             []spdxFile{},
+	}
+	doc.CreationInfo.Created = time.Now().UTC().Format(time.RFC3339)
+	doc.CreationInfo.Creators = []string{"Tool: conifer-" + result.Manifest.Engine.Conifer, "Tool: esbuild-" + result.Manifest.Engine.Esbuild}
+	doc.Packages = append(doc.Packages, spdxPackage{
+		Name:             outputName(req),
+		SPDXID:           "SPDXRef-Output",
+		DownloadLocation: "NOASSERTION",
+		Checksums:        []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: sha256Hex(result.Code)}},
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+	})
+	doc.Relationships = []spdxRelationship{{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-Output"}}
+	// SPDX IDs may only hold letters, digits, dots and dashes, so modules
+	// are identified by the hash of their URL.
+	spdxID := func(kind, rawURL string) string {
+		return "SPDXRef-" + kind + "-" + sha256Hex([]byte(rawURL))[:16]
+	}
+	for _, p := range packages {
+		container := "SPDXRef-Output"
+		if p.name != "" {
+			container = spdxID("Package", p.url)
+			pkg := spdxPackage{
+				Name:             p.name,
+				SPDXID:           container,
+				VersionInfo:      p.version,
+				DownloadLocation: p.url,
+				LicenseConcluded: "NOASSERTION",
+				LicenseDeclared:  "NOASSERTION",
+				CopyrightText:    "NOASSERTION",
+			}
+			if len(p.licenses) > 0 {
+				pkg.LicenseDeclared = p.license()
+			}
+			if p.purl != "" {
+				pkg.ExternalRefs = []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: p.purl}}
+			}
+			doc.Packages = append(doc.Packages, pkg)
+			doc.Relationships = append(doc.Relationships, spdxRelationship{SPDXElementID: "SPDXRef-Output", RelationshipType: "DEPENDS_ON", RelatedSPDXElement: container})
+		}
+		for _, mod := range p.modules {
+			id := spdxID("File", mod.URL)
+			doc.Files = append(doc.Files, spdxFile{
+				FileName:         mod.URL,
+				SPDXID:           id,
+				Checksums:        []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: mod.SHA256}},
+				LicenseConcluded: "NOASSERTION",
+				CopyrightText:    "NOASSERTION",
+			})
+			doc.Relationships = append(doc.Relationships, spdxRelationship{SPDXElementID: container, RelationshipType: "CONTAINS", RelatedSPDXElement: id})
+		}
+	}
+	return doc
+}
+
+// writeSBOM responds with a software bill of materials of a recorded build
+// instead of its output, for sbom=cyclonedx or sbom=spdx: every module it
+// downloaded, with its hash, grouped by package and version.
+func writeSBOM(w http.ResponseWriter, format string, req buildRequest, result *buildResult) {
+	packages := sbomPackages(result)
+	var doc interface{}
+	if format == "spdx" {
+		w.Header().Set("Content-Type", "application/spdx+json")
+		doc = newSPDXDocument(req, result, packages)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.cyclonedx+json; version=1.5")
+		doc = newCycloneDXBOM(req, result, packages)
+	}
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(doc)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// maxScriptSteps stops a runaway script from holding up a request.
+const maxScriptSteps = 1000000
+
+// buildScript is an operator supplied Starlark file that adjusts the options
+// of each build. It must define a function like:
+//
+//	def configure(request, options):
+//	    if request.tenant == "acme":
+//	        options["minify"] = True
+//	        options["define"]["process.env.TENANT"] = '"acme"'
+//
+// where request has the path, method, tenant, query and headers of the HTTP
+// request, and options is a dict of the build options that can be changed.
+// Changing minify overrides the kinds of minification the caller picked.
+type buildScript struct {
+	configure starlark.Callable
+}
+
+var script *buildScript
+
+func loadScript(path string) error {
+	thread := &starlark.Thread{Name: "load " + path}
+	globals, err := starlark.ExecFile(thread, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	globals.Freeze()
+	configure, ok := globals["configure"].(starlark.Callable)
+	if !ok {
+		return fmt.Errorf("%s must define a configure(request, options) function", path)
+	}
+	script = &buildScript{configure: configure}
+	return nil
+}
+
+// apply lets the script change req.
+func (s *buildScript) apply(r *http.Request, tenant string, req *buildRequest) error {
+	query := starlark.NewDict(len(r.URL.Query()))
+	for name := range r.URL.Query() {
+		query.SetKey(starlark.String(name), starlark.String(r.URL.Query().Get(name)))
+	}
+	headers := starlark.NewDict(len(r.Header))
+	for name := range r.Header {
+		headers.SetKey(starlark.String(strings.ToLower(name)), starlark.String(r.Header.Get(name)))
+	}
+	request := starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+		"path":    starlark.String(r.URL.Path),
+		"method":  starlark.String(r.Method),
+		"tenant":  starlark.String(tenant),
+		"query":   query,
+		"headers": headers,
+	})
+
+	keepURLs := make([]starlark.Value, len(req.KeepURLs))
+	for i, pattern := range req.KeepURLs {
+		keepURLs[i] = starlark.String(pattern)
+	}
+	define := starlark.NewDict(len(req.Define))
+	for name, value := range req.Define {
+		define.SetKey(starlark.String(name), starlark.String(value))
+	}
+	options := starlark.NewDict(5)
+	options.SetKey(starlark.String("source"), starlark.String(req.Source))
+	options.SetKey(starlark.String("minify"), starlark.Bool(req.Minify))
+	options.SetKey(starlark.String("bundle"), starlark.Bool(req.Bundle))
+	options.SetKey(starlark.String("keepUrls"), starlark.NewList(keepURLs))
+	options.SetKey(starlark.String("define"), define)
+
+	thread := &starlark.Thread{Name: "configure " + r.URL.Path}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	if _, err := starlark.Call(thread, s.configure, starlark.Tuple{request, options}, nil); err != nil {
+		return err
+	}
+	return readScriptOptions(options, req)
+}
+
+func readScriptOptions(options *starlark.Dict, req *buildRequest) error {
+	get := func(name string) starlark.Value {
+		v, _, _ := options.Get(starlark.String(name))
+		return v
+	}
+
+	source, ok := get("source").(starlark.String)
+	if !ok {
+		return fmt.Errorf("options[\"source\"] must be a string")
+	}
+	minify, ok := get("minify").(starlark.Bool)
+	if !ok {
+		return fmt.Errorf("options[\"minify\"] must be a bool")
+	}
+	bundle, ok := get("bundle").(starlark.Bool)
+	if !ok {
+		return fmt.Errorf("options[\"bundle\"] must be a bool")
+	}
+	keepURLs, ok := get("keepUrls").(*starlark.List)
+	if !ok {
+		return fmt.Errorf("options[\"keepUrls\"] must be a list")
+	}
+	define, ok := get("define").(*starlark.Dict)
+	if !ok {
+		return fmt.Errorf("options[\"define\"] must be a dict")
+	}
+
+	req.Source = string(source)
+	if bool(minify) != req.Minify {
+		// The caller's minifyParts would otherwise take precedence.
+		req.Minify, req.MinifyParts = bool(minify), nil
+	}
+	req.Bundle = bool(bundle)
+	req.KeepURLs = nil
+	for i := 0; i < keepURLs.Len(); i++ {
+		pattern, ok := keepURLs.Index(i).(starlark.String)
+		if !ok {
+			return fmt.Errorf("options[\"keepUrls\"] must only contain strings")
+		}
+		req.KeepURLs = append(req.KeepURLs, string(pattern))
+	}
+	req.Define = nil
+	for _, item := range define.Items() {
+		name, ok := item[0].(starlark.String)
+		value, ok2 := item[1].(starlark.String)
+		if !ok || !ok2 {
+			return fmt.Errorf("options[\"define\"] must map strings to strings")
+		}
+		if req.Define == nil {
+			req.Define = make(map[string]string)
+		}
+		req.Define[string(name)] = string(value)
+	}
+	return nil
+}
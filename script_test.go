@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+// A script turning minification on or off decides it, whatever kinds of
+// minification the caller picked.
+func TestScriptMinifyOverridesMinifyParts(t *testing.T) {
+	for _, minify := range []bool{true, false} {
+		req := buildRequest{Minify: !minify, MinifyParts: &minifyParts{Whitespace: true}}
+		options := starlark.NewDict(5)
+		options.SetKey(starlark.String("source"), starlark.String(""))
+		options.SetKey(starlark.String("minify"), starlark.Bool(minify))
+		options.SetKey(starlark.String("bundle"), starlark.Bool(false))
+		options.SetKey(starlark.String("keepUrls"), starlark.NewList(nil))
+		options.SetKey(starlark.String("define"), starlark.NewDict(0))
+		if err := readScriptOptions(options, &req); err != nil {
+			t.Fatal(err)
+		}
+		want := minifyParts{Whitespace: minify, Identifiers: minify, Syntax: minify}
+		if got := req.minify(); got != want {
+			t.Errorf("with minify = %v, the build minifies %+v, want %+v", minify, got, want)
+		}
+	}
+}
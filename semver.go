@@ -0,0 +1,304 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// semver is a version like 1.2.3-beta.1. Build metadata is dropped, as it
+// doesn't affect precedence.
+type semver struct {
+	major, minor, patch int
+	pre                 []string
+}
+
+func parseSemver(s string) (semver, bool) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "="), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	var v semver
+	core := s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		core, v.pre = s[:i], strings.Split(s[i+1:], ".")
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	for i, dst := range []*int{&v.major, &v.minor, &v.patch} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		*dst = n
+	}
+	return v, true
+}
+
+// compare returns -1, 0 or 1 as v sorts before, with or after o.
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		a, aErr := strconv.Atoi(v.pre[i])
+		b, bErr := strconv.Atoi(o.pre[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if a != b {
+				return sign(a - b)
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case v.pre[i] != o.pre[i]:
+			return sign(strings.Compare(v.pre[i], o.pre[i]))
+		}
+	}
+	return sign(len(v.pre) - len(o.pre))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// comparator is one condition of a range, like ">=1.2.3".
+type comparator struct {
+	op string
+	v  semver
+}
+
+func (c comparator) matches(v semver) bool {
+	d := v.compare(c.v)
+	switch c.op {
+	case "<":
+		return d < 0
+	case "<=":
+		return d <= 0
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	}
+	return d == 0
+}
+
+// semverRange is a range like "^1.2.0 || >=2.1 <3", as npm writes them: a
+// version matches when it matches every comparator of any of the sets.
+type semverRange [][]comparator
+
+// parseSemverRange parses the ranges package.json dependencies use: exact
+// versions, partial versions like "4" or "4.17.x", caret, tilde, hyphen
+// and comparison ranges, and "*" or "" for any version.
+func parseSemverRange(s string) (semverRange, bool) {
+	var r semverRange
+	for _, alternative := range strings.Split(s, "||") {
+		fields := strings.Fields(alternative)
+		// Operators may be separated from their versions, like ">= 1.2".
+		for i := 0; i < len(fields)-1; i++ {
+			if strings.Trim(fields[i], "<>=~^") == "" {
+				fields[i] += fields[i+1]
+				fields = append(fields[:i+1], fields[i+2:]...)
+			}
+		}
+		var set []comparator
+		if len(fields) == 3 && fields[1] == "-" {
+			low, ok := expandPartial(fields[0], ">=")
+			if !ok {
+				return nil, false
+			}
+			high, ok := expandPartial(fields[2], "<=")
+			if !ok {
+				return nil, false
+			}
+			set = append(low, high...)
+			fields = nil
+		}
+		for _, field := range fields {
+			comparators, ok := parseComparator(field)
+			if !ok {
+				return nil, false
+			}
+			set = append(set, comparators...)
+		}
+		r = append(r, set)
+	}
+	return r, true
+}
+
+// partialVersion parses a version that may leave out its minor and patch,
+// or write them as "x" or "*", returning how many parts were given.
+func partialVersion(s string) (semver, int, bool) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "="), "v")
+	if v, ok := parseSemver(s); ok {
+		return v, 3, true
+	}
+	var v semver
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return semver{}, 0, false
+	}
+	given := 0
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" || part == "" {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}, 0, false
+		}
+		*[]*int{&v.major, &v.minor, &v.patch}[i] = n
+		given++
+	}
+	return v, given, true
+}
+
+// expandPartial turns the bound of a hyphen range into comparators, a
+// partial upper bound like "2.3" allowing all of 2.3.x.
+func expandPartial(s, op string) ([]comparator, bool) {
+	v, given, ok := partialVersion(s)
+	if !ok {
+		return nil, false
+	}
+	switch {
+	case given == 0:
+		return nil, true
+	case given == 3 || op == ">=":
+		return []comparator{{op, v}}, true
+	case given == 1:
+		return []comparator{{"<", semver{major: v.major + 1, pre: []string{"0"}}}}, true
+	default:
+		return []comparator{{"<", semver{major: v.major, minor: v.minor + 1, pre: []string{"0"}}}}, true
+	}
+}
+
+func parseComparator(s string) ([]comparator, bool) {
+	op := strings.TrimRight(s[:len(s)-len(strings.TrimLeft(s, "<>=~^"))], " ")
+	v, given, ok := partialVersion(strings.TrimLeft(s, "<>=~^"))
+	if !ok {
+		return nil, false
+	}
+	// The smallest version above the given parts, below any prerelease.
+	next := func(part int) semver {
+		switch part {
+		case 0:
+			return semver{major: v.major + 1, pre: []string{"0"}}
+		case 1:
+			return semver{major: v.major, minor: v.minor + 1, pre: []string{"0"}}
+		}
+		return semver{major: v.major, minor: v.minor, patch: v.patch + 1, pre: []string{"0"}}
+	}
+	switch op {
+	case "", "=":
+		if given == 0 {
+			return nil, true
+		}
+		if given == 3 {
+			return []comparator{{"=", v}}, true
+		}
+		return []comparator{{">=", v}, {"<", next(given - 1)}}, true
+	case "^":
+		upper := 0
+		switch {
+		case v.major == 0 && given >= 2 && (v.minor != 0 || given == 2):
+			upper = 1
+		case v.major == 0 && v.minor == 0 && given == 3:
+			upper = 2
+		}
+		if given == 0 {
+			return nil, true
+		}
+		return []comparator{{">=", v}, {"<", next(upper)}}, true
+	case "~", "~>":
+		if given == 0 {
+			return nil, true
+		}
+		upper := 1
+		if given == 1 {
+			upper = 0
+		}
+		return []comparator{{">=", v}, {"<", next(upper)}}, true
+	case ">", "<=":
+		if given == 0 {
+			if op == ">" {
+				return []comparator{{"<", semver{pre: []string{"0"}}}}, true
+			}
+			return nil, true
+		}
+		if given < 3 {
+			// ">1.2" means from 1.3.0, and "<=1.2" up to all of 1.2.x.
+			bound := next(given - 1)
+			if op == ">" {
+				return []comparator{{">=", bound}}, true
+			}
+			return []comparator{{"<", bound}}, true
+		}
+		return []comparator{{op, v}}, true
+	case ">=", "<":
+		if given == 0 {
+			if op == "<" {
+				return []comparator{{"<", semver{pre: []string{"0"}}}}, true
+			}
+			return nil, true
+		}
+		return []comparator{{op, v}}, true
+	}
+	return nil, false
+}
+
+// matches reports whether v is in the range. Prereleases only match when a
+// comparator of the same set names a prerelease of the same version, as
+// with npm.
+func (r semverRange) matches(v semver) bool {
+	for _, set := range r {
+		ok := true
+		for _, c := range set {
+			ok = ok && c.matches(v)
+		}
+		if !ok {
+			continue
+		}
+		if len(v.pre) == 0 {
+			return true
+		}
+		for _, c := range set {
+			if len(c.v.pre) > 0 && c.v.major == v.major && c.v.minor == v.minor && c.v.patch == v.patch {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxSatisfying returns the highest of versions in the range.
+func (r semverRange) maxSatisfying(versions []string) (string, bool) {
+	best, bestVersion := "", semver{}
+	for _, s := range versions {
+		v, ok := parseSemver(s)
+		if !ok || !r.matches(v) {
+			continue
+		}
+		if best == "" || v.compare(bestVersion) > 0 {
+			best, bestVersion = s, v
+		}
+	}
+	return best, best != ""
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// serviceWorkerName is the name of the service worker in a JSON envelope.
+const serviceWorkerName = "sw.js"
+
+// precacheEntry is a file a service worker caches when it is installed.
+type precacheEntry struct {
+	URL      string `json:"url"`
+	Revision string `json:"revision"`
+}
+
+// serviceWorker returns a service worker precaching a build's output, or
+// the outputs of its entries, and the chunks they import, then serving them cache-first so an app deployed
+// with it keeps working offline. The output is listed relative to the
+// service worker, which is deployed next to it, and chunks by their URLs
+// here. The cache is named by a hash of every revision, so a new build
+// installs into a new cache and the old one is deleted once it activates.
+func serviceWorker(name string, result *buildResult) string {
+	entries := []precacheEntry{{URL: "./" + name, Revision: sha256Hex(result.Code)[:16]}}
+	if len(result.Entries) > 0 {
+		entries = entries[:0]
+		for _, out := range result.Entries {
+			if !strings.HasSuffix(out.Path, ".map") {
+				entries = append(entries, precacheEntry{URL: "./" + out.Path, Revision: sha256Hex([]byte(out.Contents))[:16]})
+			}
+		}
+	}
+	for _, chunk := range result.Manifest.Chunks {
+		revision := ""
+		if contents, ok := chunks.get(chunk); ok {
+			revision = sha256Hex(contents)[:16]
+		}
+		entries = append(entries, precacheEntry{URL: cfg.PublicURL + chunkPath + chunk, Revision: revision})
+	}
+	var revisions strings.Builder
+	for _, e := range entries {
+		revisions.WriteString(e.URL + " " + e.Revision + "\n")
+	}
+	precache, _ := json.MarshalIndent(entries, "", "  ")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Precaches the build's output and chunks, serving them cache-first.\n")
+	fmt.Fprintf(&b, "const CACHE = %s;\n", jsString("conifer-precache-"+sha256Hex([]byte(revisions.String()))[:16]))
+	fmt.Fprintf(&b, "const PRECACHE = %s;\n", precache)
+	b.WriteString(`const urls = new Set(PRECACHE.map((entry) => new URL(entry.url, self.location).href));
+
+self.addEventListener("install", (event) => {
+  event.waitUntil(
+    caches.open(CACHE)
+      .then((cache) => cache.addAll(PRECACHE.map((entry) => entry.url)))
+      .then(() => self.skipWaiting())
+  );
+});
+
+self.addEventListener("activate", (event) => {
+  event.waitUntil(
+    caches.keys()
+      .then((keys) => Promise.all(keys
+        .filter((key) => key.startsWith("conifer-precache-") && key !== CACHE)
+        .map((key) => caches.delete(key))))
+      .then(() => self.clients.claim())
+  );
+});
+
+self.addEventListener("fetch", (event) => {
+  if (event.request.method !== "GET" || !urls.has(event.request.url)) {
+    return;
+  }
+  event.respondWith(
+    caches.open(CACHE).then((cache) =>
+      cache.match(event.request).then((cached) =>
+        cached ||
+        fetch(event.request).then((response) => {
+          if (response.ok) {
+            cache.put(event.request, response.clone());
+          }
+          return response;
+        })
+      )
+    )
+  );
+});
+`)
+	return b.String()
+}
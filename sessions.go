@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// A build session rebuilds source each time it changes, for editors like
+// playgrounds that rebuild on every keystroke. It's a WebSocket:
+//
+//	GET /v1/sessions?target=es2018&minify
+//
+// taking the options of a build in the query string. Each message the
+// client sends, like {"id": 1, "source": "..."}, is built, and answered
+// with a sessionBuild, or a sessionFailure when the build fails. The
+// session keeps one incremental esbuild build and the modules it
+// downloaded, so a rebuild only parses what changed.
+
+const (
+	// sessionIdle is how long a session waits for a message before it is
+	// closed.
+	sessionIdle = 10 * time.Minute
+	// maxSessionMessageBytes caps messages when the caller's limits don't
+	// cap their source.
+	maxSessionMessageBytes = 1 << 20
+	// sessionNamespace is where the session's source is loaded from.
+	sessionNamespace = "session"
+)
+
+type sessionMessage struct {
+	// ID, when given, is repeated in the reply.
+	ID     json.RawMessage `json:"id,omitempty"`
+	Source string          `json:"source"`
+}
+
+type sessionBuild struct {
+	ID       json.RawMessage `json:"id,omitempty"`
+	Type     string          `json:"type"`
+	Code     string          `json:"code"`
+	Warnings []buildMessage  `json:"warnings"`
+	// Rebuild is set when the build reused the session's earlier work.
+	Rebuild    bool  `json:"rebuild"`
+	DurationMS int64 `json:"durationMs"`
+}
+
+type sessionFailure struct {
+	ID   json.RawMessage `json:"id,omitempty"`
+	Type string          `json:"type"`
+	// Status is what a build failing this way would be answered with.
+	Status int             `json:"status"`
+	Error  *buildErrorBody `json:"error"`
+	// RetryAfter is set when the build was refused, and can be sent again
+	// after that many seconds.
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// buildSession is the state of one connection.
+type buildSession struct {
+	req     buildRequest
+	options api.BuildOptions
+	graph   *importGraph
+
+	mu     sync.Mutex
+	source string
+	built  *api.BuildResult
+}
+
+// sessionRegistry tracks the open sessions, to record them in snapshots.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*buildSession]bool
+}
+
+var openSessions = &sessionRegistry{sessions: make(map[*buildSession]bool)}
+
+func (r *sessionRegistry) add(s *buildSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s] = true
+}
+
+func (r *sessionRegistry) remove(s *buildSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s)
+}
+
+// snapshot records each open session's options and the modules its last
+// build imported.
+func (r *sessionRegistry) snapshot() []sessionSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var snapshots []sessionSnapshot
+	for s := range r.sessions {
+		snapshot := sessionSnapshot{Request: s.req, Modules: []string{}}
+		for _, edge := range s.graph.sortedEdges() {
+			if !edge.External {
+				snapshot.Modules = append(snapshot.Modules, edge.URL)
+			}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+func newBuildSession(req buildRequest) *buildSession {
+	s := &buildSession{req: req, graph: &importGraph{}}
+	limits := req.limits()
+	f := newFetcher()
+	f.ctx = req.context()
+	f.limit(limits)
+	f.forTenant(tenantNamed(req.Tenant))
+	plugin := &httpPlugin{
+		fetcher:      f,
+		keepURLs:     req.KeepURLs,
+		lockfile:     req.Lockfile,
+		importMap:    req.ImportMap,
+		tsconfigRaw:  req.TsconfigRaw,
+		graph:        s.graph,
+		proxyURLs:    req.ProxyURLs,
+		allowedHosts: limits.AllowedHosts,
+		blockedURLs:  limits.BlockedURLs,
+		policy:       policyFor(req.Tenant),
+		maxModules:   limits.MaxModules,
+		remotes:      req.Remotes,
+	}
+	minify := req.minify()
+	s.options = api.BuildOptions{
+		EntryPoints:       []string{"input"},
+		Format:            formatsByName[req.Format],
+		Bundle:            true,
+		Outdir:            "out",
+		EntryNames:        "stdin",
+		Plugins:           []api.Plugin{s.plugin(), plugin.plugin()},
+		Banner:            map[string]string{"js": buildBanner(req)},
+		Target:            targetsByName[req.Target],
+		Define:            req.Stamp.defines(req.Define),
+		Sourcemap:         sourcemapsByName[req.Sourcemap],
+		Incremental:       true,
+		Write:             false,
+		MinifyWhitespace:  minify.Whitespace,
+		MinifyIdentifiers: minify.Identifiers,
+		MinifySyntax:      minify.Syntax,
+	}
+	return s
+}
+
+// plugin loads the session's source as the entry.
+func (s *buildSession) plugin() api.Plugin {
+	return api.Plugin{
+		Name: sessionNamespace,
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(api.OnResolveOptions{Filter: "^input$"},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					if args.Kind != api.ResolveEntryPoint {
+						return api.OnResolveResult{}, nil
+					}
+					return api.OnResolveResult{Path: "imaginary-file.js", Namespace: sessionNamespace}, nil
+				})
+			build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: sessionNamespace},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					source := s.source
+					loader := api.LoaderJS
+					if l, ok := loadersByName[s.req.Loader]; ok {
+						loader = l
+					}
+					return api.OnLoadResult{Contents: &source, Loader: loader, ResolveDir: "./src"}, nil
+				})
+		},
+	}
+}
+
+// build builds source, rebuilding incrementally after the first build.
+func (s *buildSession) build(source string) (*sessionBuild, *buildErrorBody, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	atomic.AddInt32(&activeBuilds, 1)
+	defer atomic.AddInt32(&activeBuilds, -1)
+	start := time.Now()
+
+	s.source = source
+	s.graph.reset()
+	var built api.BuildResult
+	rebuild := s.built != nil
+	if rebuild {
+		built = s.built.Rebuild()
+	} else {
+		built = api.Build(s.options)
+	}
+	if len(built.Errors) > 0 {
+		// A failed build can't be rebuilt, so the next one starts again,
+		// though with the modules downloaded so far.
+		s.built = nil
+		_, status := classifyBuildError(built.Errors[0])
+		return nil, newBuildErrorBody(built.Errors, built.Warnings), status
+	}
+	s.built = &built
+	result := &sessionBuild{Type: "build", Warnings: newBuildMessages(built.Warnings), Rebuild: rebuild}
+	for _, file := range built.OutputFiles {
+		if name := filepath.Base(file.Path); strings.HasPrefix(name, "stdin.") && !strings.HasSuffix(name, ".map") {
+			result.Code = string(file.Contents)
+		}
+	}
+	result.DurationMS = time.Since(start).Milliseconds()
+	return result, nil, http.StatusOK
+}
+
+// handleSession serves build sessions.
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	req, err := parseBuildRequest(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Splitting || req.MangleProps != "" || req.Name != "" {
+		http.Error(w, "sessions can't split, mangle properties or name bundles", http.StatusBadRequest)
+		return
+	}
+	if !authorizeBuild(w, r, &req) {
+		return
+	}
+	// Every message brings source.
+	tenant, key := keyFor(r)
+	if !checkKey(w, r, tenant, key, true) {
+		return
+	}
+	conn, ok := upgradeWebSocket(w, r)
+	if !ok {
+		return
+	}
+	limits, caller := keyLimits(r, tenant, key)
+	maxBytes := int64(maxSessionMessageBytes)
+	if limits.MaxSourceBytes > 0 && limits.MaxSourceBytes+1024 < maxBytes {
+		// Leaves room for the rest of the message.
+		maxBytes = limits.MaxSourceBytes + 1024
+	}
+
+	session := newBuildSession(req)
+	openSessions.add(session)
+	defer openSessions.remove(session)
+	for {
+		data, err := conn.readMessage(maxBytes, sessionIdle)
+		if err != nil {
+			var wsErr *wsError
+			var netErr net.Error
+			switch {
+			case errors.As(err, &wsErr):
+				conn.close(wsErr.code, wsErr.reason)
+			case errors.As(err, &netErr) && netErr.Timeout():
+				conn.close(wsNormalClosure, "idle")
+			default:
+				conn.conn.Close()
+			}
+			return
+		}
+		var msg sessionMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			conn.close(wsUnsupportedData, "messages must be JSON like {\"source\": \"...\"}")
+			return
+		}
+		reply, err := json.Marshal(serveSessionMessage(session, msg, caller, limits))
+		if err != nil {
+			log.Println("session:", err)
+			continue
+		}
+		if err := conn.writeText(reply); err != nil {
+			conn.conn.Close()
+			return
+		}
+	}
+}
+
+// serveSessionMessage builds the source of a message, which is limited as
+// any other build is.
+func serveSessionMessage(session *buildSession, msg sessionMessage, caller string, limits limitsConfig) interface{} {
+	refuse := func(status int, message string, retryAfter int) sessionFailure {
+		return sessionFailure{ID: msg.ID, Type: "error", Status: status, RetryAfter: retryAfter, Error: &buildErrorBody{
+			Code:     "request_failed",
+			Message:  message,
+			Errors:   []buildMessage{},
+			Warnings: []buildMessage{},
+		}}
+	}
+	allowed, wait := rates.take(caller, limits.RequestsPerMinute, 0)
+	switch {
+	case !allowed:
+		return refuse(http.StatusTooManyRequests, "too many requests", retryAfterSeconds(wait))
+	case limits.MaxSourceBytes > 0 && int64(len(msg.Source)) > limits.MaxSourceBytes:
+		return refuse(http.StatusRequestEntityTooLarge, "source is larger than "+strconv.FormatInt(limits.MaxSourceBytes, 10)+" bytes", 0)
+	case underPressure():
+		return refuse(http.StatusServiceUnavailable, errOverloaded.Error(), int(overloadedRetryAfter().Seconds()))
+	}
+	result, failure, status := session.build(msg.Source)
+	if failure != nil {
+		return sessionFailure{ID: msg.ID, Type: "error", Status: status, Error: failure}
+	}
+	result.ID = msg.ID
+	return result
+}
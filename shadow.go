@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxShadowBodyBytes is the largest request body mirrored. Larger
+	// requests are served without being mirrored.
+	maxShadowBodyBytes = 4 << 20
+	// maxShadowsInFlight bounds the mirrored requests waiting on the
+	// shadow deployment. Beyond it, requests aren't mirrored, so a slow
+	// shadow never holds up production.
+	maxShadowsInFlight = 16
+	// maxShadowDivergences is how many divergences are kept for review.
+	maxShadowDivergences = 100
+	maxShadowTargetBytes = 2000
+	// maxShadowResponseBytes is the largest response compared. Requests
+	// answered with more aren't mirrored.
+	maxShadowResponseBytes = 16 << 20
+)
+
+// shadowConfig mirrors a sample of build requests to a second deployment,
+// such as one running a newer esbuild, comparing its responses with
+// production's so an upgrade can be checked against real traffic before
+// it is rolled out. Callers only ever get production's response.
+type shadowConfig struct {
+	// URL is the origin of the shadow deployment, like
+	// "https://conifer-next.internal". Empty turns mirroring off.
+	URL string `json:"url"`
+	// Percent of build requests mirrored, from 0 to 100.
+	Percent float64 `json:"percent"`
+	// APIKey, when set, is sent to the shadow deployment in place of the
+	// caller's. It may reference an environment variable.
+	APIKey  string   `json:"apiKey"`
+	Timeout duration `json:"timeout"`
+}
+
+func (c shadowConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return time.Minute
+	}
+	return time.Duration(c.Timeout)
+}
+
+// shadowResponse is what a deployment answered a build request with.
+type shadowResponse struct {
+	Status    int   `json:"status"`
+	Bytes     int64 `json:"bytes"`
+	LatencyMS int64 `json:"latencyMs"`
+	// digest is what's compared, see shadowDigest.
+	digest string
+}
+
+// shadowDivergence is a request the shadow deployment answered
+// differently.
+type shadowDivergence struct {
+	At     time.Time `json:"at"`
+	Method string    `json:"method"`
+	// Target is the request's path and query string, cut short when long.
+	Target     string         `json:"target"`
+	Tenant     string         `json:"tenant,omitempty"`
+	Production shadowResponse `json:"production"`
+	Shadow     shadowResponse `json:"shadow"`
+	// Error is set when the shadow deployment couldn't be reached.
+	Error string `json:"error,omitempty"`
+}
+
+// shadowReport sums up the requests mirrored since startup.
+type shadowReport struct {
+	URL      string `json:"url"`
+	Mirrored int64  `json:"mirrored"`
+	Matched  int64  `json:"matched"`
+	Diverged int64  `json:"diverged"`
+	Failed   int64  `json:"failed"`
+	// Skipped counts the sampled requests not mirrored, because their
+	// response was too big to compare or too many were already waiting on
+	// the shadow deployment.
+	Skipped int64 `json:"skipped"`
+	// The mean latencies cover the requests both deployments answered.
+	ProductionMeanMS float64            `json:"productionMeanMs"`
+	ShadowMeanMS     float64            `json:"shadowMeanMs"`
+	Divergences      []shadowDivergence `json:"divergences"`
+}
+
+type shadowRecorder struct {
+	mu                                  sync.Mutex
+	mirrored, matched, diverged, failed int64
+	skipped                             int64
+	productionMS, shadowMS              int64
+	divergences                         []shadowDivergence
+	inFlight                            chan struct{}
+}
+
+var shadows = &shadowRecorder{inFlight: make(chan struct{}, maxShadowsInFlight)}
+
+func (s *shadowRecorder) record(d shadowDivergence) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mirrored++
+	switch {
+	case d.Error != "":
+		s.failed++
+	case d.Production.Status == d.Shadow.Status && d.Production.digest == d.Shadow.digest:
+		s.matched++
+		s.productionMS += d.Production.LatencyMS
+		s.shadowMS += d.Shadow.LatencyMS
+		return
+	default:
+		s.diverged++
+		s.productionMS += d.Production.LatencyMS
+		s.shadowMS += d.Shadow.LatencyMS
+	}
+	log.Printf("shadow: %s %s diverged: %d (%d bytes) against %d (%d bytes) %s", d.Method, d.Target, d.Production.Status, d.Production.Bytes, d.Shadow.Status, d.Shadow.Bytes, d.Error)
+	if len(s.divergences) >= maxShadowDivergences {
+		s.divergences = s.divergences[1:]
+	}
+	s.divergences = append(s.divergences, d)
+}
+
+// skip counts a sampled request that wasn't mirrored.
+func (s *shadowRecorder) skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped++
+}
+
+func (s *shadowRecorder) report() shadowReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := shadowReport{
+		URL:         cfg.Shadow.URL,
+		Mirrored:    s.mirrored,
+		Matched:     s.matched,
+		Diverged:    s.diverged,
+		Failed:      s.failed,
+		Skipped:     s.skipped,
+		Divergences: append([]shadowDivergence{}, s.divergences...),
+	}
+	if answered := s.matched + s.diverged; answered > 0 {
+		report.ProductionMeanMS = float64(s.productionMS) / float64(answered)
+		report.ShadowMeanMS = float64(s.shadowMS) / float64(answered)
+	}
+	return report
+}
+
+// shouldShadow reports whether a request is a build sampled for mirroring.
+// Streams and WebSockets aren't mirrored, as they aren't one response.
+func shouldShadow(r *http.Request) bool {
+	if cfg.Shadow.URL == "" || cfg.Shadow.Percent <= 0 || r.Header.Get("X-Conifer-Shadow") != "" {
+		return false
+	}
+	if r.URL.Path != "/v1/build" && r.URL.Path != "/v1/bundle" {
+		return false
+	}
+	if (r.Method != "GET" && r.Method != "POST") || wantsEventStream(r) || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if r.ContentLength > maxShadowBodyBytes {
+		return false
+	}
+	return rand.Float64()*100 < cfg.Shadow.Percent
+}
+
+// shadowDigest hashes the part of a response two deployments should
+// agree on. A JSON build names the deployment and engine that built it, so
+// only its outputs and warnings are compared.
+func shadowDigest(contentType string, body []byte) string {
+	if strings.HasPrefix(contentType, "application/json") {
+		var envelope struct {
+			Outputs  []buildOutput  `json:"outputs"`
+			Warnings []buildMessage `json:"warnings"`
+		}
+		if json.Unmarshal(body, &envelope) == nil && envelope.Outputs != nil {
+			body, _ = json.Marshal(envelope)
+		}
+	}
+	return sha256Hex(body)
+}
+
+// teeWriter passes a response through, keeping a copy of its body.
+type teeWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// overflowed is set once the body is too big to keep.
+	overflowed bool
+	bytes      int64
+}
+
+func (t *teeWriter) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	t.bytes += int64(len(p))
+	if !t.overflowed {
+		if t.body.Len()+len(p) > maxShadowResponseBytes {
+			t.overflowed = true
+			t.body = bytes.Buffer{}
+		} else {
+			t.body.Write(p)
+		}
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+// withShadow serves next, mirroring the sampled build requests to the
+// shadow deployment once production has answered them.
+func withShadow(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !shouldShadow(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, maxShadowBodyBytes+1))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(body) > maxShadowBodyBytes {
+				// Too big to keep, so it is served as it came.
+				r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		// The shadow gets the request as it arrived, before the handler
+		// reads or changes it.
+		shadow := r.Clone(r.Context())
+		tenant := ""
+		if t := tenantFor(r); t != nil {
+			tenant = t.Name
+		}
+
+		tee := &teeWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(tee, r)
+		if tee.overflowed {
+			shadows.skip()
+			return
+		}
+		production := shadowResponse{
+			Status:    tee.status,
+			Bytes:     tee.bytes,
+			LatencyMS: time.Since(start).Milliseconds(),
+			digest:    shadowDigest(w.Header().Get("Content-Type"), tee.body.Bytes()),
+		}
+
+		select {
+		case shadows.inFlight <- struct{}{}:
+		default:
+			shadows.skip()
+			return
+		}
+		go func() {
+			defer func() { <-shadows.inFlight }()
+			shadows.record(mirrorRequest(shadow, body, tenant, production))
+		}()
+	})
+}
+
+// mirrorRequest sends a request to the shadow deployment, comparing its
+// response with production's.
+func mirrorRequest(r *http.Request, body []byte, tenant string, production shadowResponse) shadowDivergence {
+	target := r.URL.RequestURI()
+	d := shadowDivergence{At: time.Now().UTC(), Method: r.Method, Tenant: tenant, Production: production}
+	if len(target) > maxShadowTargetBytes {
+		d.Target = target[:maxShadowTargetBytes] + "…"
+	} else {
+		d.Target = target
+	}
+	req, err := http.NewRequest(r.Method, strings.TrimSuffix(cfg.Shadow.URL, "/")+target, bytes.NewReader(body))
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	for _, name := range []string{"Content-Type", "Accept", "Authorization", "User-Agent", apiVersionHeader} {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	if cfg.Shadow.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+os.ExpandEnv(cfg.Shadow.APIKey))
+	}
+	req.Header.Set("X-Conifer-Shadow", "1")
+
+	start := time.Now()
+	res, err := (&http.Client{Timeout: cfg.Shadow.timeout()}).Do(req)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	defer res.Body.Close()
+	body, err = io.ReadAll(io.LimitReader(res.Body, maxShadowResponseBytes+1))
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Shadow = shadowResponse{
+		Status:    res.StatusCode,
+		Bytes:     int64(len(body)),
+		LatencyMS: time.Since(start).Milliseconds(),
+		digest:    shadowDigest(res.Header.Get("Content-Type"), body),
+	}
+	return d
+}
+
+// handleShadow reports how the shadow deployment's responses compare with
+// production's:
+//
+//	GET /v1/admin/shadow
+func handleShadow(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, shadows.report())
+}
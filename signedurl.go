@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signed URLs let a page load a build, like
+//
+//	/v1/bundle?entry=https://esm.sh/react&tenant=acme&keyId=9f86d081884c7d65&expires=1767225600&signature=...
+//
+// with the API key that signed it, without carrying the key, while anyone
+// changing the build it asks for, or using it after it expires, gets an
+// error. The key's restrictions and limits apply as if it were sent. The
+// signature is the hex HMAC-SHA256, keyed with the tenant's URL secret, of
+// the path, "?" and the rest of the query sorted by name, as Go's
+// url.Values encodes it. Only GET requests may be signed.
+
+const (
+	defaultSignedURLTTL = 24 * time.Hour
+	maxSignedURLTTL     = 366 * 24 * time.Hour
+)
+
+// urlSignature signs path and q, leaving out any signature q already has.
+func urlSignature(tenant *tenantConfig, path string, q url.Values) string {
+	unsigned := url.Values{}
+	for name, values := range q {
+		if name != "signature" {
+			unsigned[name] = values
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(os.ExpandEnv(tenant.URLSecret)))
+	mac.Write([]byte(path + "?" + unsigned.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL signs the path and query of rawURL for the tenant's key until
+// expires.
+func signURL(tenant *tenantConfig, key *apiKey, rawURL string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("tenant", tenant.Name)
+	q.Set("keyId", key.id())
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("signature", urlSignature(tenant, u.Path, q))
+	return u.Path + "?" + q.Encode(), nil
+}
+
+// signedKey returns the tenant and key that signed r, or nil when r isn't
+// signed, its signature is invalid or has expired, or its key is gone.
+func signedKey(r *http.Request) (*tenantConfig, *apiKey) {
+	q := r.URL.Query()
+	signature := q.Get("signature")
+	if signature == "" || (r.Method != "GET" && r.Method != "HEAD") {
+		return nil, nil
+	}
+	tenant := tenantNamed(q.Get("tenant"))
+	if tenant == nil || tenant.URLSecret == "" {
+		return nil, nil
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, nil
+	}
+	if !hmac.Equal([]byte(signature), []byte(urlSignature(tenant, r.URL.Path, q))) {
+		return nil, nil
+	}
+	for i, key := range tenant.APIKeys {
+		if key.id() == q.Get("keyId") {
+			return tenant, &tenant.APIKeys[i]
+		}
+	}
+	return nil, nil
+}
+
+// handleSignedURL signs a URL for an authenticated tenant, which its pages
+// can then load without its API key:
+//
+//	POST /v1/signed-urls?ttl=720h
+//	{"url": "/v1/bundle?entry=https://esm.sh/react"}
+func handleSignedURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Signed URLs can't be used to sign more, as only GETs are signed.
+	tenant, key := keyFor(r)
+	if tenant == nil {
+		http.Error(w, "an API key is required", http.StatusUnauthorized)
+		return
+	}
+	if tenant.URLSecret == "" {
+		http.Error(w, "signed URLs are not configured for this tenant", http.StatusNotFound)
+		return
+	}
+	ttl := defaultSignedURLTTL
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		parsed, err := time.ParseDuration(s)
+		if err != nil || parsed <= 0 || parsed > maxSignedURLTTL {
+			http.Error(w, "ttl must be a duration up to 8784h", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+	var body struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBuildRequestBytes)).Decode(&body); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(body.URL, "/") || strings.HasPrefix(body.URL, "//") {
+		http.Error(w, "url must be a path on this server, like /v1/build?url=...", http.StatusBadRequest)
+		return
+	}
+	expires := time.Now().Add(ttl)
+	signed, err := signURL(tenant, key, body.URL, expires)
+	if err != nil {
+		http.Error(w, "invalid url: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"url":     cfg.PublicURL + signed,
+		"expires": expires.UTC(),
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSmokeTestOutput is how much of what a smoke test prints is kept for
+// its error.
+const maxSmokeTestOutput = 8 << 10
+
+// smokeTestConfig configures the runtime builds asking for a smoke test
+// run their output in, to catch errors it throws as soon as it is loaded,
+// like bad interop between module formats or globals that don't exist.
+//
+// The output is piped to the runtime from an empty directory, with no
+// environment. Deno is given no permissions, so can't read or write files,
+// use the network or run programs. Node is refused: it has no way to turn
+// the network off, and output could connect through node:net or node:http
+// to the private addresses downloads are kept away from.
+//
+// Output that touches the DOM or imports URLs left unbundled fails, so
+// smoke tests suit builds meant to run on their own.
+type smokeTestConfig struct {
+	// Runtime is "deno". Empty turns smoke tests off.
+	Runtime string `json:"runtime"`
+	// Path is the runtime's executable, found on the PATH when empty.
+	Path string `json:"path"`
+	// Timeout is how long the output may run. Output still running when
+	// it is up, like a server or a timer, passes, as it started without
+	// throwing.
+	Timeout duration `json:"timeout"`
+	// MaxMemoryMB caps the runtime's heap, 256MB when zero.
+	MaxMemoryMB int `json:"maxMemoryMb"`
+}
+
+func (c smokeTestConfig) path() string {
+	if c.Path == "" {
+		return c.Runtime
+	}
+	return c.Path
+}
+
+func (c smokeTestConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.Timeout)
+}
+
+func (c smokeTestConfig) maxMemoryMB() int {
+	if c.MaxMemoryMB == 0 {
+		return 256
+	}
+	return c.MaxMemoryMB
+}
+
+// check returns an error when smoke tests can't be run as configured.
+func (c smokeTestConfig) check() error {
+	switch c.Runtime {
+	case "", "deno":
+		return nil
+	case "node":
+		return errors.New("node can't be kept off the network, so smoke tests need deno")
+	}
+	return fmt.Errorf("unknown smoke test runtime %q", c.Runtime)
+}
+
+// smokeTestSlots limits how many smoke tests run at once.
+var smokeTestSlots = make(chan struct{}, runtime.NumCPU())
+
+// smokeTestError is output that threw when it was run.
+type smokeTestError struct {
+	Runtime string
+	// Output is what the runtime printed, with the error and its stack.
+	Output string
+}
+
+// smokeTestErrorLine finds the line of a runtime's output naming the error
+// thrown, like "TypeError: x is not a function" or, in Deno, "error:
+// Uncaught ReferenceError: process is not defined".
+var smokeTestErrorLine = regexp.MustCompile(`(?m)^(?:error: )?(?:Uncaught (?:\(in promise\) )?)?\w*Error\b.*$`)
+
+func (e *smokeTestError) Error() string {
+	line := strings.TrimPrefix(smokeTestErrorLine.FindString(e.Output), "error: ")
+	if line == "" {
+		line = "exited with an error, printing nothing"
+		for _, l := range strings.Split(e.Output, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				line = l
+				break
+			}
+		}
+	}
+	return "smoke test in " + e.Runtime + " failed: " + line
+}
+
+// checkSmokeTest checks a build asking for a smoke test can have one.
+func checkSmokeTest(req buildRequest) error {
+	switch {
+	case !req.SmokeTest:
+		return nil
+	case cfg.SmokeTest.Runtime == "":
+		return errors.New("smoke tests aren't configured")
+	case cfg.SmokeTest.check() != nil:
+		return errors.New("smoke tests aren't available")
+	case outputName(req) == "index.css":
+		return errors.New("css can't be smoke tested")
+	case req.Splitting, len(req.Routes) > 0:
+		return errors.New("output split into chunks can't be smoke tested")
+	}
+	return nil
+}
+
+// smokeTest runs a build's output in the configured runtime, returning a
+// *smokeTestError when it throws, or another error when the runtime
+// couldn't be run.
+func smokeTest(req buildRequest, code []byte) error {
+	c := cfg.SmokeTest
+	if err := c.check(); err != nil {
+		return err
+	}
+	smokeTestSlots <- struct{}{}
+	defer func() { <-smokeTestSlots }()
+
+	dir, err := os.MkdirTemp("", "conifer-smoke-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	heap := "--max-old-space-size=" + strconv.Itoa(c.maxMemoryMB())
+	commonJS := formatsByName[req.Format] != formatsByName["esm"]
+	var args []string
+	switch c.Runtime {
+	case "deno":
+		args = []string{"run", "--no-prompt", "--no-remote", "--no-npm", "--no-config", "--no-lock", "--v8-flags=" + heap, "-"}
+		if commonJS {
+			// Deno runs everything as an ES module, which has no module
+			// for CommonJS output to export from.
+			code = append([]byte("var module = {exports: {}}, exports = module.exports;\n"), code...)
+		}
+	default:
+		return fmt.Errorf("unknown smoke test runtime %q", c.Runtime)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.path(), args...)
+	cmd.Dir = dir
+	cmd.Env = []string{"HOME=" + dir, "DENO_DIR=" + dir, "NO_COLOR=1"}
+	cmd.Stdin = bytes.NewReader(code)
+	var output cappedBuffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	err = cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return nil
+	case errors.As(err, &exit):
+		return &smokeTestError{Runtime: c.Runtime, Output: output.String()}
+	case err != nil:
+		return fmt.Errorf("running the smoke test: %v", err)
+	}
+	return nil
+}
+
+// cappedBuffer keeps the first maxSmokeTestOutput bytes written to it,
+// discarding the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := maxSmokeTestOutput - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
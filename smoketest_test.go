@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Output smoke tested on the server mustn't reach the network it runs in,
+// which Node can't be stopped from doing through node:net.
+func TestSmokeTestNodeCantConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	connected := make(chan struct{}, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+			connected <- struct{}{}
+		}
+	}()
+
+	saved := cfg.SmokeTest
+	defer func() { cfg.SmokeTest = saved }()
+	cfg.SmokeTest = smokeTestConfig{Runtime: "node", Timeout: duration(2 * time.Second)}
+
+	req := buildRequest{SmokeTest: true, Format: "esm"}
+	if err := checkSmokeTest(req); err == nil {
+		t.Error("checkSmokeTest allowed a smoke test in node")
+	}
+	code := []byte(`import net from "node:net";
+net.connect(` + portOf(ln) + `, "127.0.0.1");
+await new Promise((resolve) => setTimeout(resolve, 1000));
+`)
+	err = smokeTest(req, code)
+	if err == nil {
+		t.Error("smokeTest ran output in node")
+	}
+	if _, ok := err.(*smokeTestError); ok {
+		t.Errorf("smokeTest ran output in node, which failed: %v", err)
+	}
+	select {
+	case <-connected:
+		t.Fatal("output connected to 127.0.0.1 through node:net")
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func portOf(ln net.Listener) string {
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
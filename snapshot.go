@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSnapshotModules is how many of the most recently used modules a
+	// snapshot records.
+	maxSnapshotModules = 5000
+	// shutdownTimeout is how long requests in flight may take to finish
+	// once shutdown starts.
+	shutdownTimeout = 30 * time.Second
+)
+
+// stateSnapshot records what this instance had warmed up when it shut down,
+// so the next one can warm up the same before users ask for it. It is kept
+// in the data directory, and only describes state: modules are fetched
+// again through the module cache rather than stored with it.
+type stateSnapshot struct {
+	Taken  time.Time  `json:"taken"`
+	Engine engineInfo `json:"engine"`
+	// Modules are the URLs of the modules kept in memory, most recently
+	// used first.
+	Modules []string `json:"modules"`
+	// Sessions are the build sessions that were open.
+	Sessions []sessionSnapshot `json:"sessions,omitempty"`
+}
+
+// sessionSnapshot is what a build session had built, which its editor will
+// most likely ask to build again once it reconnects.
+type sessionSnapshot struct {
+	Request buildRequest `json:"request"`
+	// Modules are the URLs of the modules its last build imported.
+	Modules []string `json:"modules"`
+}
+
+func snapshotPath() string {
+	return filepath.Join(cfg.DataDir, "snapshot.json")
+}
+
+// takeSnapshot records this instance's state.
+func takeSnapshot() stateSnapshot {
+	s := stateSnapshot{Taken: time.Now().UTC(), Engine: engine, Modules: []string{}}
+	if layers, ok := modulesCache.(layeredCache); ok {
+		s.Modules = layers.recentURLs(maxSnapshotModules)
+	}
+	s.Sessions = openSessions.snapshot()
+	return s
+}
+
+// saveSnapshot writes this instance's state to the data directory, when
+// there is one.
+func saveSnapshot() {
+	if cfg.DataDir == "" {
+		return
+	}
+	s := takeSnapshot()
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = writeFileAtomic(snapshotPath(), data)
+	}
+	if err != nil {
+		log.Println("saving snapshot:", err)
+		return
+	}
+	log.Printf("saved snapshot of %d modules and %d sessions", len(s.Modules), len(s.Sessions))
+}
+
+// restoreSnapshot warms the modules the last instance recorded in its
+// snapshot, in the background and never while under pressure, reporting
+// how it went with the other warmed entries. The snapshot is removed, so
+// an instance that crashes doesn't restore a stale one next time.
+func restoreSnapshot() {
+	if cfg.DataDir == "" {
+		return
+	}
+	data, err := os.ReadFile(snapshotPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("reading snapshot:", err)
+		}
+		return
+	}
+	os.Remove(snapshotPath())
+	var s stateSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		log.Println("reading snapshot:", err)
+		return
+	}
+	// Sessions' modules come first, as their editors reconnect at once.
+	var urls []string
+	seen := make(map[string]bool)
+	for _, session := range s.Sessions {
+		for _, u := range session.Modules {
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	for _, u := range s.Modules {
+		if !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	layers, _ := modulesCache.(layeredCache)
+	result := warmResult{Entry: "snapshot of " + s.Taken.Format(time.RFC3339)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < warmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f := newFetcher()
+			for u := range queue {
+				for underPressure() {
+					time.Sleep(time.Second)
+				}
+				// The snapshot says the module was hot, so it needn't be
+				// looked up again to earn its place in memory.
+				layers.markHot(u)
+				if _, err := f.fetch(u); err == nil {
+					mu.Lock()
+					result.Modules++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, u := range urls {
+		queue <- u
+	}
+	close(queue)
+	wg.Wait()
+	result.Finished = time.Now().UTC()
+	warming.report(result)
+	log.Printf("restored %d of %d modules from snapshot", result.Modules, len(urls))
+}
+
+// shutdownDone is closed once shutdown has finished.
+var shutdownDone = make(chan struct{})
+
+// shutdown stops the server gracefully, letting requests in flight finish,
+// then saves a snapshot for the next instance.
+func shutdown(srv *http.Server) {
+	defer close(shutdownDone)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutting down:", err)
+	}
+	saveSnapshot()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// sourceMapUpload configures an error-tracking service that is sent the
+// external source maps of builds, so stack traces from the output are
+// symbolicated without a separate step in CI.
+type sourceMapUpload struct {
+	// Kind is "sentry", or "rollbar", for services with the same APIs.
+	Kind string `json:"kind"`
+	// URL is where the service is, https://sentry.io or
+	// https://api.rollbar.com when empty.
+	URL string `json:"url"`
+	// Org and Project are the Sentry organization and project releases
+	// are created in.
+	Org     string `json:"org"`
+	Project string `json:"project"`
+	// AuthToken is a Sentry auth token or Rollbar access token. It may
+	// reference an environment variable like "$SENTRY_AUTH_TOKEN".
+	AuthToken string `json:"authToken"`
+	// URLPrefix is where the output is served from, which stack traces
+	// name it by. It is "~/" for Sentry when empty, matching any host.
+	// Output kept in the artifact store is named by its artifact URL.
+	URLPrefix string `json:"urlPrefix"`
+}
+
+// sourceMapUploads are the tenant's own uploads, when it has them, or else
+// the server's.
+func sourceMapUploads(tenant string) []sourceMapUpload {
+	if t := tenantNamed(tenant); t != nil && t.SourceMapUploads != nil {
+		return t.SourceMapUploads
+	}
+	return cfg.SourceMapUploads
+}
+
+// sourceMapRelease names the release a build's source map is uploaded
+// under. It is derived from the build's hash, so it changes whenever the
+// output or what went into it does, prefixed with the bundle's name when
+// it has one.
+func sourceMapRelease(req buildRequest, result *buildResult) string {
+	release := "conifer-" + buildHash(result.Manifest, sha256Hex(result.Code))[:16]
+	if req.Name != "" {
+		release = req.Name + "@" + release
+	}
+	return release
+}
+
+// uploadSourceMap sends a build's external source map to each configured
+// service in the background, returning the release it is uploaded under,
+// or "" when there's nothing to upload.
+func uploadSourceMap(req buildRequest, result *buildResult) string {
+	uploads := sourceMapUploads(req.Tenant)
+	if len(uploads) == 0 || len(result.SourceMap) == 0 {
+		return ""
+	}
+	release := sourceMapRelease(req, result)
+	name := outputName(req)
+	for _, u := range uploads {
+		u := u
+		minifiedURL := u.minifiedURL(name)
+		if result.Artifact != "" {
+			minifiedURL = cfg.PublicURL + "/v1/artifacts/" + result.Artifact + ".js"
+		}
+		go func() {
+			if err := u.upload(release, minifiedURL, result.Code, result.SourceMap); err != nil {
+				log.Printf("source map upload to %s: %v", u.Kind, err)
+			}
+		}()
+	}
+	return release
+}
+
+func (u sourceMapUpload) minifiedURL(name string) string {
+	prefix := u.URLPrefix
+	if prefix == "" && u.Kind == "sentry" {
+		prefix = "~/"
+	}
+	return prefix + name
+}
+
+func (u sourceMapUpload) upload(release, minifiedURL string, code, sourceMap []byte) error {
+	switch u.Kind {
+	case "sentry":
+		return u.uploadSentry(release, minifiedURL, code, sourceMap)
+	case "rollbar":
+		return u.uploadRollbar(release, minifiedURL, sourceMap)
+	default:
+		return fmt.Errorf("unknown kind %q", u.Kind)
+	}
+}
+
+// uploadSentry creates the release, then uploads the output and its source
+// map as release files. Both are fine to repeat, as Sentry answers that
+// what already exists conflicts.
+func (u sourceMapUpload) uploadSentry(release, minifiedURL string, code, sourceMap []byte) error {
+	base := strings.TrimSuffix(u.URL, "/")
+	if base == "" {
+		base = "https://sentry.io"
+	}
+	releases := base + "/api/0/organizations/" + url.PathEscape(u.Org) + "/releases/"
+	body, _ := json.Marshal(map[string]interface{}{"version": release, "projects": []string{u.Project}})
+	req, err := http.NewRequest("POST", releases, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := u.send(req); err != nil {
+		return err
+	}
+
+	files := releases + url.PathEscape(release) + "/files/"
+	for _, f := range []struct {
+		name     string
+		contents []byte
+	}{{minifiedURL, code}, {minifiedURL + ".map", sourceMap}} {
+		req, err := newMultipartRequest(files, map[string]string{"name": f.name}, "file", f.name, f.contents)
+		if err != nil {
+			return err
+		}
+		if err := u.send(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadRollbar uploads the source map for the output at minifiedURL,
+// which Rollbar needs to be absolute.
+func (u sourceMapUpload) uploadRollbar(release, minifiedURL string, sourceMap []byte) error {
+	base := strings.TrimSuffix(u.URL, "/")
+	if base == "" {
+		base = "https://api.rollbar.com"
+	}
+	req, err := newMultipartRequest(base+"/api/1/sourcemap", map[string]string{
+		"access_token": os.ExpandEnv(u.AuthToken),
+		"version":      release,
+		"minified_url": minifiedURL,
+	}, "source_map", "index.js.map", sourceMap)
+	if err != nil {
+		return err
+	}
+	return u.send(req)
+}
+
+func newMultipartRequest(target string, fields map[string]string, fileField, fileName string, contents []byte) (*http.Request, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+	fw, err := mw.CreateFormFile(fileField, fileName)
+	if err != nil {
+		return nil, err
+	}
+	fw.Write(contents)
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", target, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req, nil
+}
+
+// send makes an authenticated request, treating a conflict as success as
+// it means what is being created already exists.
+func (u sourceMapUpload) send(req *http.Request) error {
+	if u.Kind == "sentry" {
+		req.Header.Set("Authorization", "Bearer "+os.ExpandEnv(u.AuthToken))
+	}
+	res, err := webhookClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict || (res.StatusCode >= 200 && res.StatusCode <= 299) {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	return fmt.Errorf("%s %s: %s %s", req.Method, req.URL, res.Status, strings.TrimSpace(string(detail)))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Modules are downloaded from URLs callers choose, so downloads mustn't
+// reach the network conifer runs in: its loopback interface, private and
+// shared address ranges, or link-local addresses like the cloud metadata
+// service at 169.254.169.254. Each address is checked as it is connected
+// to, after its host name is resolved, so a host resolving to a public
+// address when checked and a private one when connected to gets nowhere.
+// Hosts configured as private, like an internal registry, are exempt.
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which some
+// clouds serve their metadata services from.
+var sharedAddressSpace = mustParseCIDR("100.64.0.0/10")
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// privateAddressError is a download from a host on a private network.
+type privateAddressError struct {
+	Host string
+	IP   string
+}
+
+func (e *privateAddressError) Error() string {
+	return "downloading from " + e.Host + " is not allowed, as it is at the private address " + e.IP
+}
+
+// isPrivateIP reports whether ip is an address downloads mustn't reach.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// upstreamTransport is the transport modules are downloaded with, which
+// refuses to connect to private addresses.
+var upstreamTransport = newUpstreamTransport()
+
+func newUpstreamTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialUpstream
+	return t
+}
+
+// dialUpstream connects to addr, refusing private addresses unless its
+// host is configured as private.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if h, ok := cfg.Hosts[addr]; ok && h.Private {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if h, ok := cfg.Hosts[host]; ok && h.Private {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	dialer.Control = func(network, address string, _ syscall.RawConn) error {
+		ipHost, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(ipHost); ip == nil || isPrivateIP(ip) {
+			return &privateAddressError{Host: host, IP: ipHost}
+		}
+		return nil
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// stampDefine is the global a stamp is defined as when stampAs=define.
+const stampDefine = "__CONIFER_STAMP__"
+
+// buildStamp is metadata the caller asks to have written into the output,
+// such as a CI build number or the git commit being deployed.
+type buildStamp struct {
+	// Values are the caller's own fields, like {"gitSha": "0a1b2c"}.
+	Values map[string]string `json:"values,omitempty"`
+	// Time is when the build was requested, in RFC 3339, or empty with
+	// noTimestamps=true. It is recorded with the build so replaying it
+	// reproduces the same output.
+	Time string `json:"time,omitempty"`
+	// Define exposes the stamp as the __CONIFER_STAMP__ global rather than
+	// a banner comment.
+	Define bool `json:"define,omitempty"`
+}
+
+var stampName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// parseStamp reads the stamp options from the query string:
+//
+//	stamp=gitSha:0a1b2c,buildId:1234  the fields to stamp
+//	stampAs=define                    define __CONIFER_STAMP__ instead of a banner
+//	noTimestamps=true                 leave out the time, keeping output reproducible
+//
+// A build without a stamp parameter isn't stamped.
+func parseStamp(q url.Values, now time.Time) (*buildStamp, error) {
+	if !q.Has("stamp") {
+		return nil, nil
+	}
+	s := &buildStamp{}
+	for _, item := range splitList(q.Get("stamp")) {
+		i := strings.Index(item, ":")
+		if i < 0 {
+			return nil, errors.New("stamp fields must be name:value, not " + item)
+		}
+		name, value := item[:i], item[i+1:]
+		if !stampName.MatchString(name) || name == "time" {
+			return nil, errors.New("invalid stamp field name: " + name)
+		}
+		if s.Values == nil {
+			s.Values = make(map[string]string)
+		}
+		s.Values[name] = value
+	}
+	switch q.Get("stampAs") {
+	case "", "banner":
+	case "define":
+		s.Define = true
+	default:
+		return nil, errors.New("stampAs must be banner or define")
+	}
+	if q.Get("noTimestamps") != "true" {
+		s.Time = now.UTC().Truncate(time.Second).Format(time.RFC3339)
+	}
+	return s, nil
+}
+
+// fields returns the stamp as a JSON object, with its fields in a stable
+// order so the same stamp always gives the same output.
+func (s *buildStamp) fields() string {
+	fields := make(map[string]string, len(s.Values)+1)
+	for name, value := range s.Values {
+		fields[name] = value
+	}
+	if s.Time != "" {
+		fields["time"] = s.Time
+	}
+	// Maps are marshalled with sorted keys.
+	b, _ := json.Marshal(fields)
+	return string(b)
+}
+
+// banner returns the stamp as a comment, or "" when it is defined instead.
+func (s *buildStamp) banner() string {
+	if s == nil || s.Define {
+		return ""
+	}
+	return "/* conifer-stamp " + strings.ReplaceAll(s.fields(), "*/", `*\/`) + " */"
+}
+
+// defines returns base with the stamp added when it is defined as a global.
+func (s *buildStamp) defines(base map[string]string) map[string]string {
+	if s == nil || !s.Define {
+		return base
+	}
+	define := make(map[string]string, len(base)+1)
+	for name, value := range base {
+		define[name] = value
+	}
+	define[stampDefine] = s.fields()
+	return define
+}
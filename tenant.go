@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// apiKey is one of a tenant's API keys. In config it is the key itself, or
+// an object restricting what calls with the key may do beyond the tenant's
+// own settings, for keys used from pages where anybody can read them:
+//
+//	{"key": "pk_1a2b3c", "origins": ["https://*.example.com"], "limits": {"requestsPerMinute": 10}, "source": false}
+type apiKey struct {
+	Key string `json:"key"`
+	// Origins, when set, are the only sites, like "https://*.example.com",
+	// whose pages may build with the key.
+	Origins []string `json:"origins,omitempty"`
+	// Limits override the tenant's for builds with the key, and are
+	// counted for the key alone.
+	Limits *limitsConfig `json:"limits,omitempty"`
+	// Source, when false, only lets the key build modules by URL, refusing
+	// source sent with the request.
+	Source *bool `json:"source,omitempty"`
+}
+
+// id identifies the key without revealing it, such as in signed URLs.
+func (k *apiKey) id() string {
+	return sha256Hex([]byte(k.Key))[:16]
+}
+
+func (k *apiKey) UnmarshalJSON(data []byte) error {
+	if json.Unmarshal(data, &k.Key) == nil {
+		return nil
+	}
+	type plain apiKey
+	return json.Unmarshal(data, (*plain)(k))
+}
+
+// bearerToken is the token of r's Authorization header, or "" when it has
+// none or uses another scheme, like Basic.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[len("Bearer "):])
+}
+
+// requestKey is the API key r carries, as a bearer token or, for URLs
+// loaded where headers can't be set, a key query parameter.
+func requestKey(r *http.Request) string {
+	if key := bearerToken(r); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("key")
+}
+
+// withKnownKeys serves next, refusing requests with a key that is neither
+// a tenant's nor an admin's, rather than serving a mistyped key as if it
+// were anonymous.
+func withKnownKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestKey(r) != "" && tenantFor(r) == nil && !isAdmin(r) {
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// keyFor returns the tenant and key identified by the request's API key,
+// or nil for anonymous requests. Requests with a signed URL are those of
+// the key that signed it.
+func keyFor(r *http.Request) (*tenantConfig, *apiKey) {
+	key := requestKey(r)
+	if key == "" {
+		return signedKey(r)
+	}
+	for i := range cfg.Tenants {
+		for j, k := range cfg.Tenants[i].APIKeys {
+			if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+				return &cfg.Tenants[i], &cfg.Tenants[i].APIKeys[j]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// tenantFor returns the tenant identified by the request's API key, or nil
+// for anonymous requests.
+func tenantFor(r *http.Request) *tenantConfig {
+	tenant, _ := keyFor(r)
+	return tenant
+}
+
+// tenantNamed returns the configured tenant called name, or nil.
+func tenantNamed(name string) *tenantConfig {
+	for i := range cfg.Tenants {
+		if cfg.Tenants[i].Name == name {
+			return &cfg.Tenants[i]
+		}
+	}
+	return nil
+}
+
+// authorizeCaller refuses a caller whose key doesn't let it download
+// modules, or an anonymous one when keys are required, before anything is
+// downloaded for it, writing the error and returning false.
+func authorizeCaller(w http.ResponseWriter, r *http.Request) bool {
+	tenant, key := keyFor(r)
+	return checkKey(w, r, tenant, key, false)
+}
+
+// keyLimits returns the limits that apply to a call with key, and who they
+// are counted against: the tenant, or the key itself when it has limits of
+// its own.
+func keyLimits(r *http.Request, tenant *tenantConfig, key *apiKey) (limitsConfig, string) {
+	limits, caller := limitsFor(tenant), callerKey(r, tenant)
+	if key != nil && key.Limits != nil {
+		limits = overrideLimits(limits, key.Limits)
+		caller += "/key:" + key.id()
+	}
+	return limits, caller
+}
+
+// checkKey refuses a build the request's API key doesn't allow, or an
+// anonymous one when keys are required, writing the error and returning
+// false. withSource is whether the build brings source of its own.
+func checkKey(w http.ResponseWriter, r *http.Request, tenant *tenantConfig, key *apiKey, withSource bool) bool {
+	if tenant == nil {
+		if r.URL.Query().Get("signature") != "" {
+			http.Error(w, "the URL's signature is invalid or has expired", http.StatusForbidden)
+			return false
+		}
+		if cfg.RequireAPIKey && cfg.Playground == nil {
+			http.Error(w, "an API key is required", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	if len(key.Origins) > 0 {
+		origin := requestOrigin(r)
+		allowed := false
+		for _, pattern := range key.Origins {
+			allowed = allowed || (origin != "" && matchWildcard(pattern, origin))
+		}
+		if !allowed {
+			http.Error(w, "this API key can't be used from this site", http.StatusForbidden)
+			return false
+		}
+	}
+	if key.Source != nil && !*key.Source && withSource {
+		http.Error(w, "this API key can only build modules by URL", http.StatusForbidden)
+		return false
+	}
+	return true
+}
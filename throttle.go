@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttleChunkBytes is the most read from a download before waiting for
+// bandwidth, so throttled downloads arrive steadily rather than in bursts.
+const throttleChunkBytes = 16 << 10
+
+// bandwidthConfig caps how fast modules are downloaded, so a burst of cold
+// builds can't saturate a small instance's connection or look like abuse
+// to a CDN. Zero leaves a cap off.
+type bandwidthConfig struct {
+	// BytesPerSecond caps every download together.
+	BytesPerSecond int64 `json:"bytesPerSecond"`
+	// PerHostBytesPerSecond caps the downloads from each host, unless the
+	// host's own config sets its cap.
+	PerHostBytesPerSecond int64 `json:"perHostBytesPerSecond"`
+}
+
+// tokenBucket lets through rate bytes a second, and up to a second's worth
+// at once after being idle. A read bigger than what is available goes into
+// debt, which later reads wait out.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	return &tokenBucket{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// take takes n bytes from the bucket, returning how long to wait before
+// they may be used.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bandwidth holds the buckets of the configured caps.
+var bandwidth = struct {
+	once   sync.Once
+	global *tokenBucket
+	mu     sync.Mutex
+	hosts  map[string]*tokenBucket
+}{hosts: make(map[string]*tokenBucket)}
+
+// bandwidthBuckets returns the buckets a download from u is taken from.
+func bandwidthBuckets(u *url.URL) []*tokenBucket {
+	bandwidth.once.Do(func() {
+		if cfg.Bandwidth.BytesPerSecond > 0 {
+			bandwidth.global = newTokenBucket(cfg.Bandwidth.BytesPerSecond)
+		}
+	})
+	var buckets []*tokenBucket
+	if bandwidth.global != nil {
+		buckets = append(buckets, bandwidth.global)
+	}
+	rate := cfg.Bandwidth.PerHostBytesPerSecond
+	if host, ok := hostConfigFor(u); ok && host.BytesPerSecond > 0 {
+		rate = host.BytesPerSecond
+	}
+	if rate > 0 {
+		bandwidth.mu.Lock()
+		bucket, ok := bandwidth.hosts[u.Host]
+		if !ok {
+			bucket = newTokenBucket(rate)
+			bandwidth.hosts[u.Host] = bucket
+		}
+		bandwidth.mu.Unlock()
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+// throttledReader reads a download no faster than its buckets allow,
+// adding the time it waits to waited.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*tokenBucket
+	waited  *int64
+}
+
+// throttle wraps the body of a download from u, or returns it as it is
+// when no cap applies.
+func throttle(ctx context.Context, u *url.URL, body io.Reader, waited *int64) io.Reader {
+	buckets := bandwidthBuckets(u)
+	if len(buckets) == 0 {
+		return body
+	}
+	return &throttledReader{ctx: ctx, r: body, buckets: buckets, waited: waited}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkBytes {
+		p = p[:throttleChunkBytes]
+	}
+	n, err := t.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	var wait time.Duration
+	for _, b := range t.buckets {
+		if d := b.take(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		start := time.Now()
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			err = t.ctx.Err()
+		}
+		atomic.AddInt64(t.waited, int64(time.Since(start)))
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// handleTransform compiles a single file, such as TypeScript or JSX, to
+// JavaScript without resolving or downloading anything it imports:
+//
+//	POST /v1/transform?loader=tsx&target=es2018&minify
+//
+// The source is the request body, or the source query parameter. Imports
+// are left as they are, so this skips the fetching, caching and recording
+// builds go through, and is only rate limited.
+func handleTransform(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	source, ok := requestSource(w, r)
+	if !ok {
+		return
+	}
+	options, err := parseTransformOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tenant, key := keyFor(r)
+	if !checkKey(w, r, tenant, key, true) {
+		return
+	}
+	limits, caller := keyLimits(r, tenant, key)
+	if ok, wait := rates.take(caller, limits.RequestsPerMinute, 0); !ok {
+		writeRateLimited(w, wait)
+		return
+	}
+	if limits.MaxSourceBytes > 0 && int64(len(source)) > limits.MaxSourceBytes {
+		http.Error(w, "source is larger than "+strconv.FormatInt(limits.MaxSourceBytes, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	result := api.Transform(source, options)
+	if len(result.Errors) > 0 {
+		writeBuildErrors(w, result.Errors, result.Warnings)
+		return
+	}
+	// The output depends on nothing but the request and esbuild's version.
+	cacheControl := "public, max-age=86400"
+	if tenant != nil {
+		cacheControl = "private, no-cache"
+	}
+	w.Header().Set("X-Conifer-Engine", "esbuild/"+engine.Esbuild)
+	if options.Loader == api.LoaderCSS {
+		writeContent(w, r, "text/css; charset=utf-8", result.Code, cacheControl)
+		return
+	}
+	writeJavaScript(w, r, result.Code, cacheControl)
+}
+
+// parseTransformOptions reads the options of a transform from the query
+// string. Without a format, the source's own is kept.
+func parseTransformOptions(r *http.Request) (api.TransformOptions, error) {
+	q := r.URL.Query()
+	options := api.TransformOptions{
+		Sourcefile:        q.Get("sourcefile"),
+		Loader:            api.LoaderJS,
+		Target:            targetsByName[q.Get("target")],
+		MinifyWhitespace:  q.Has("minify"),
+		MinifyIdentifiers: q.Has("minify"),
+		MinifySyntax:      q.Has("minify"),
+	}
+	if options.Sourcefile == "" {
+		options.Sourcefile = "input"
+	}
+	if name := q.Get("loader"); name != "" {
+		loader, ok := loadersByName[name]
+		if !ok {
+			return options, errors.New("unknown loader: " + name)
+		}
+		options.Loader = loader
+	}
+	if target := q.Get("target"); target != "" {
+		if _, ok := targetsByName[target]; !ok {
+			return options, errors.New("unknown target: " + target)
+		}
+	}
+	if format := q.Get("format"); format != "" {
+		f, ok := formatsByName[format]
+		if !ok {
+			return options, errors.New("unknown format: " + format)
+		}
+		options.Format = f
+	}
+	switch q.Get("sourcemap") {
+	case "":
+	case "inline":
+		options.Sourcemap = api.SourceMapInline
+	default:
+		return options, errors.New("sourcemap must be inline")
+	}
+	if raw := q.Get("tsconfigRaw"); raw != "" {
+		normalized, err := normalizeTsconfig(raw)
+		if err != nil {
+			return options, errors.New("invalid tsconfigRaw: " + err.Error())
+		}
+		options.TsconfigRaw = normalized
+	}
+	return options, nil
+}
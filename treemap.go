@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// treemapNode is a module, or a group of them, in a treemap of a build's
+// output. Groups add up the sizes of what is in them.
+type treemapNode struct {
+	Name string `json:"name"`
+	// URL is set on remote modules.
+	URL string `json:"url,omitempty"`
+	// Bytes is the size of the modules' source. BytesInOutput is how much
+	// of it is left in the unminified output, and MinifiedBytes in the
+	// minified output, both 0 when it was tree-shaken.
+	Bytes         int            `json:"bytes"`
+	BytesInOutput int            `json:"bytesInOutput"`
+	MinifiedBytes int            `json:"minifiedBytes"`
+	Children      []*treemapNode `json:"children,omitempty"`
+}
+
+// child returns the group named name, adding it when there isn't one.
+func (n *treemapNode) child(name string) *treemapNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	c := &treemapNode{Name: name}
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// total adds the sizes of n's children to it, and sorts them by name.
+func (n *treemapNode) total() {
+	if len(n.Children) == 0 {
+		return
+	}
+	n.Bytes, n.BytesInOutput, n.MinifiedBytes = 0, 0, 0
+	sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+	for _, c := range n.Children {
+		c.total()
+		n.Bytes += c.Bytes
+		n.BytesInOutput += c.BytesInOutput
+		n.MinifiedBytes += c.MinifiedBytes
+	}
+}
+
+// treemapPath is where a metafile input goes in a treemap: under its host
+// and its package, like "cdn.jsdelivr.net", "react@17.0.2", "cjs",
+// "react.development.js", or under "source" for the source and its files.
+func treemapPath(input string) []string {
+	rawURL, ok := inputURL(input)
+	if !ok {
+		if i := strings.Index(input, ":"); i >= 0 {
+			// A namespace, like that of a build's files.
+			input = input[i+1:]
+		}
+		return append([]string{"source"}, strings.Split(strings.Trim(input, "/"), "/")...)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return []string{rawURL}
+	}
+	p := strings.TrimPrefix(u.Path, "/")
+	var path []string
+	if library := libraryOf(rawURL); library != "" {
+		pkg, version := packageVersionOf(rawURL)
+		libraryPath := strings.TrimPrefix(library, u.Scheme+"://"+u.Host+"/")
+		path = append(path, u.Host, pkg+"@"+version)
+		p = strings.TrimPrefix(strings.TrimPrefix(p, strings.TrimSuffix(libraryPath, "/")), "/")
+		if p == "" {
+			// The library's URL is the module, like a package's main
+			// file, which is kept apart from the package's other files.
+			return append(path, "(main)")
+		}
+	} else {
+		path = append(path, u.Host)
+	}
+	if u.RawQuery != "" {
+		p += "?" + u.RawQuery
+	}
+	return append(path, strings.Split(p, "/")...)
+}
+
+// newTreemap lays out the inputs of a build's unminified and minified
+// metafiles, including chunks, by treemapPath.
+func newTreemap(unminified, minified *metafile) *treemapNode {
+	root := &treemapNode{}
+	leaves := make(map[string]*treemapNode)
+	for input, in := range unminified.Inputs {
+		n := root
+		for _, name := range treemapPath(input) {
+			n = n.child(name)
+		}
+		if u, ok := inputURL(input); ok {
+			n.URL = u
+		}
+		n.Bytes = in.Bytes
+		leaves[input] = n
+	}
+	for _, out := range unminified.Outputs {
+		for input, in := range out.Inputs {
+			if n, ok := leaves[input]; ok {
+				n.BytesInOutput += in.BytesInOutput
+			}
+		}
+	}
+	for _, out := range minified.Outputs {
+		for input, in := range out.Inputs {
+			if n, ok := leaves[input]; ok {
+				n.MinifiedBytes += in.BytesInOutput
+			}
+		}
+	}
+	root.total()
+	return root
+}
+
+// writeTreemap responds with a treemap of a recorded build's output, which
+// was built unminified, instead of the output, building it again minified
+// to measure what minifying leaves of each module.
+func writeTreemap(w http.ResponseWriter, req buildRequest, result *buildResult) {
+	if result.Metafile == nil {
+		http.Error(w, "only bundled builds can be analyzed", http.StatusBadRequest)
+		return
+	}
+	req.Minify, req.MinifyParts = true, nil
+	minified, err := runCachedBuild(req)
+	if err != nil {
+		writeOverloaded(w)
+		return
+	}
+	if len(minified.Errors) > 0 {
+		writeBuildErrors(w, minified.Errors, minified.Warnings)
+		return
+	}
+	if minified.Metafile == nil {
+		http.Error(w, "the minified build has no metafile", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTreemap(result.Metafile, minified.Metafile))
+}
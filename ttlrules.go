@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// immutableTTL is how long modules matching an immutable rule are cached,
+// which is to say forever.
+const immutableTTL = 100 * 365 * 24 * time.Hour
+
+// ttlRule sets how long modules whose URLs match are reused, overriding the
+// caching headers upstream sends:
+//
+//	{"match": "raw.githubusercontent.com/*/<sha>/*", "immutable": true}
+//	{"match": "*/main/*", "ttl": "60s"}
+//
+// Patterns are like those of keepUrls, and "<sha>" also matches a git
+// commit hash.
+type ttlRule struct {
+	Match string   `json:"match"`
+	TTL   duration `json:"ttl"`
+	// Immutable caches matching modules forever, and treats builds of them
+	// as pinned.
+	Immutable bool `json:"immutable"`
+}
+
+// ttlPatterns caches the compiled form of each rule's pattern.
+var ttlPatterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+func (r ttlRule) matches(rawURL string) bool {
+	if !strings.Contains(r.Match, "<sha>") {
+		return matchURL(r.Match, rawURL)
+	}
+	if !strings.Contains(r.Match, "://") {
+		if i := strings.Index(rawURL, "://"); i >= 0 {
+			rawURL = rawURL[i+len("://"):]
+		}
+	}
+	ttlPatterns.Lock()
+	re, ok := ttlPatterns.compiled[r.Match]
+	if !ok {
+		expr := regexp.QuoteMeta(r.Match)
+		expr = strings.ReplaceAll(expr, `\*`, `.*`)
+		expr = strings.ReplaceAll(expr, "<sha>", "[0-9a-f]{40}")
+		re = regexp.MustCompile("^" + expr + "$")
+		ttlPatterns.compiled[r.Match] = re
+	}
+	ttlPatterns.Unlock()
+	return re.MatchString(rawURL)
+}
+
+func (r ttlRule) ttl() time.Duration {
+	if r.Immutable {
+		return immutableTTL
+	}
+	return time.Duration(r.TTL)
+}
+
+// ttlRuleFor returns the first of the cache's rules that rawURL matches.
+func (c cacheConfig) ttlRuleFor(rawURL string) (ttlRule, bool) {
+	for _, rule := range c.Rules {
+		if rule.matches(rawURL) {
+			return rule, true
+		}
+	}
+	return ttlRule{}, false
+}
+
+// immutableURL reports whether a rule says rawURL never changes.
+func (c cacheConfig) immutableURL(rawURL string) bool {
+	rule, ok := c.ttlRuleFor(rawURL)
+	return ok && rule.Immutable
+}
+
+// expiry works out until when a response for rawURL may be reused without
+// revalidating it, and until when it may be used stale while it is
+// revalidated. A rule matching rawURL decides, and otherwise the response's
+// headers do. It also reports whether the response must not be cached.
+func expiry(rawURL string, h http.Header, now time.Time) (expires, staleUntil time.Time, noStore bool) {
+	if rule, ok := cfg.Cache.ttlRuleFor(rawURL); ok {
+		expires = now.Add(rule.ttl())
+		return expires, expires.Add(staleWindow(http.Header{})), false
+	}
+	expires, noStore = expiresFrom(h, now)
+	return expires, expires.Add(staleWindow(h)), noStore
+}
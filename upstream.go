@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// maxTransformedBytes limits the transformed files kept in memory.
+const maxTransformedBytes = 64 << 20
+
+// upstreamConfig serves a host through conifer, like "/npm/" for
+// "https://unpkg.com/". Each file requested is downloaded, converted to an
+// ES module (compiling TypeScript and wrapping CommonJS) and served with its
+// imports pointing back under Prefix.
+type upstreamConfig struct {
+	// Prefix is the path the host is served under, ending in a slash.
+	Prefix string `json:"prefix"`
+	// Origin is the URL the rest of the path is appended to, ending in a
+	// slash.
+	Origin string `json:"origin"`
+	// Packages resolves bare imports like "react" to Origin + "react", as
+	// package CDNs serve them there. Otherwise they are left untouched for
+	// the page's import map.
+	Packages bool   `json:"packages"`
+	Minify   bool   `json:"minify"`
+	Target   string `json:"target"`
+}
+
+// transformed keeps files after they are transformed, keyed by the upstream
+// they came from and the hash of their contents, so a file changing upstream
+// is transformed again.
+var transformed = newMemoryCache(cacheConfig{MaxBytes: maxTransformedBytes})
+
+// handleUpstream serves the files of the host u describes.
+func handleUpstream(u upstreamConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rawURL := u.Origin + strings.TrimPrefix(r.URL.Path, u.Prefix)
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if loaderFor(rawURL) == api.LoaderCSS {
+			http.Error(w, "stylesheets aren't served as modules", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if !authorizeCaller(w, r) {
+			return
+		}
+		tenant, tenantKey := keyFor(r)
+		limits, _ := keyLimits(r, tenant, tenantKey)
+		if err := limits.checkUpstream(canonicalURL(rawURL)); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if _, cached := modulesCache.get(canonicalURL(rawURL)); !cached && underPressure() {
+			writeOverloaded(w)
+			return
+		}
+		f := newFetcher()
+		f.ctx = r.Context()
+		f.limit(limits)
+		f.forTenant(tenant)
+		mod, err := f.fetch(rawURL)
+		if err != nil {
+			writeFetchError(w, err)
+			return
+		}
+		// The module may have been downloaded for another caller, which its
+		// redirects were allowed for.
+		if err := limits.checkUpstream(mod.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		key := u.Prefix + "@" + mod.SHA256
+		if done, ok := transformed.get(key); ok {
+			writeJavaScript(w, r, []byte(done.Contents), "public, max-age=300")
+			return
+		}
+		code, errors := proxyModule(mod, proxyOptions{
+			Resolve: u.resolve,
+			Minify:  u.Minify,
+			Target:  targetsByName[u.Target],
+		})
+		if len(errors) > 0 {
+			writeBuildErrors(w, errors, nil)
+			return
+		}
+		transformed.put(key, &module{URL: mod.URL, Contents: string(code), SHA256: mod.SHA256})
+		writeJavaScript(w, r, code, "public, max-age=300")
+	}
+}
+
+// resolve points an import at the file under Prefix when it is on the
+// upstream host, or at /fetch when it is elsewhere.
+func (u upstreamConfig) resolve(base *url.URL, path string) (string, error) {
+	if isBareSpecifier(path) {
+		if !u.Packages {
+			return path, nil
+		}
+		path = u.Origin + path
+	}
+	relative, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	resolved := base.ResolveReference(relative).String()
+	if strings.HasPrefix(resolved, u.Origin) {
+		return cfg.PublicURL + u.Prefix + strings.TrimPrefix(resolved, u.Origin), nil
+	}
+	return proxyURL(resolved), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// modernBrowsers are the first versions of each browser supporting ES2020,
+// which is what unlowered output may use.
+var modernBrowsers = []struct {
+	pattern    *regexp.Regexp
+	minVersion int
+}{
+	// Order matters: Edge and Opera also claim to be Chrome, and Chrome
+	// claims to be Safari.
+	{regexp.MustCompile(`Edg(?:e|A|iOS)?/(\d+)`), 80},
+	{regexp.MustCompile(`OPR/(\d+)`), 67},
+	{regexp.MustCompile(`Firefox/(\d+)`), 80},
+	{regexp.MustCompile(`FxiOS/(\d+)`), 80},
+	{regexp.MustCompile(`CriOS/(\d+)`), 80},
+	{regexp.MustCompile(`Chrom(?:e|ium)/(\d+)`), 80},
+	{regexp.MustCompile(`Version/(\d+)(?:\.\d+)*.*Safari/`), 14},
+}
+
+// isModernBrowser reports whether the User-Agent belongs to an evergreen
+// browser. Anything unrecognized is treated as old, since lowered output
+// still works in new browsers but not the other way around.
+func isModernBrowser(userAgent string) bool {
+	for _, browser := range modernBrowsers {
+		match := browser.pattern.FindStringSubmatch(userAgent)
+		if match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		return err == nil && version >= browser.minVersion
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// handleVendor downloads the complete module graph of a source and returns
+// it as a gzipped tarball that works without any of the original CDNs:
+//
+//	index.js          the source, importing from vendor/
+//	vendor/<host>/... each module, importing its dependencies relatively
+//	import-map.json   maps the original URLs to their vendored copies
+func handleVendor(w http.ResponseWriter, r *http.Request) {
+	source, ok := requestSource(w, r)
+	if !ok {
+		return
+	}
+	req, err := parseBuildRequest(r, source)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Bundling is how the graph gets resolved, even though the bundle
+	// itself is thrown away.
+	req.Bundle = true
+	if !authorizeBuild(w, r, &req) {
+		return
+	}
+
+	if underPressure() {
+		writeOverloaded(w)
+		return
+	}
+	result := runBuild(req)
+	if len(result.Errors) > 0 {
+		writeBuildErrors(w, result.Errors, result.Warnings)
+		return
+	}
+
+	// Group the rewrites needed by each importing module.
+	rewrites := make(map[string]map[string]string)
+	imports := make(map[string]string)
+	for _, edge := range result.Graph {
+		if edge.External {
+			continue
+		}
+		from := "index.js"
+		if edge.Importer != "" {
+			from = vendorPath(edge.Importer)
+		}
+		if rewrites[edge.Importer] == nil {
+			rewrites[edge.Importer] = make(map[string]string)
+		}
+		rewrites[edge.Importer][edge.Specifier] = relativeImport(from, vendorPath(edge.URL))
+		if edge.Importer == "" {
+			imports[edge.Specifier] = "./" + vendorPath(edge.URL)
+		}
+	}
+	for _, mod := range result.Modules {
+		imports[mod.URL] = "./" + vendorPath(mod.URL)
+	}
+	importMapJSON, err := json.MarshalIndent(importMap{Imports: imports}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="vendor.tar.gz"`)
+	w.WriteHeader(http.StatusOK)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	writeTarFile(tw, "index.js", []byte(rewriteSpecifiers(req.Source, rewrites[""])))
+	for _, mod := range result.Modules {
+		writeTarFile(tw, vendorPath(mod.URL), []byte(rewriteSpecifiers(mod.Contents, rewrites[mod.URL])))
+	}
+	writeTarFile(tw, "import-map.json", importMapJSON)
+	tw.Close()
+	gz.Close()
+}
+
+// writeTarFile adds a file to an archive. Timestamps are fixed so the same
+// inputs always produce the same archive.
+func writeTarFile(tw *tar.Writer, name string, contents []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(contents)),
+		ModTime: time.Unix(0, 0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(contents)
+	return err
+}
+
+// vendorPath returns where the module at rawURL is placed in a vendored
+// copy, such as "vendor/cdn.jsdelivr.net/npm/react@17.0.2/index.js".
+func vendorPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		sum := sha256.Sum256([]byte(rawURL))
+		return "vendor/_/" + hex.EncodeToString(sum[:8]) + ".js"
+	}
+	p := u.Path
+	if p == "" || strings.HasSuffix(p, "/") {
+		p += "index.js"
+	}
+	if u.RawQuery != "" {
+		// Keep URLs that only differ by query string apart.
+		sum := sha256.Sum256([]byte(u.RawQuery))
+		ext := path.Ext(p)
+		p = strings.TrimSuffix(p, ext) + "_" + hex.EncodeToString(sum[:4]) + ext
+	}
+	return path.Join("vendor", strings.ReplaceAll(u.Host, ":", "_"), path.Clean("/"+p))
+}
+
+// readVendored returns the module at url from dir, where modules are laid
+// out as <host>/<path> like the vendor directory of a vendored copy.
+func readVendored(dir, url string) (*module, error) {
+	file := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(vendorPath(url), "vendor/")))
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	mod := &module{URL: url, Contents: string(data), SHA256: hex.EncodeToString(sum[:])}
+	mod.Expires, _, _ = expiry(url, http.Header{}, time.Now())
+	mod.StaleUntil = mod.Expires
+	return mod, nil
+}
+
+// relativeImport returns the specifier for importing the file at to from
+// the file at from.
+func relativeImport(from, to string) string {
+	fromParts := strings.Split(path.Dir(from), "/")
+	toParts := strings.Split(to, "/")
+	if path.Dir(from) == "." {
+		fromParts = nil
+	}
+	common := 0
+	for common < len(fromParts) && common < len(toParts)-1 && fromParts[common] == toParts[common] {
+		common++
+	}
+	rel := strings.Repeat("../", len(fromParts)-common) + strings.Join(toParts[common:], "/")
+	if !strings.HasPrefix(rel, "../") {
+		rel = "./" + rel
+	}
+	return rel
+}
+
+// rewriteSpecifiers replaces quoted import specifiers in source.
+func rewriteSpecifiers(source string, rewrites map[string]string) string {
+	for specifier, replacement := range rewrites {
+		for _, quote := range []string{`"`, `'`} {
+			source = strings.ReplaceAll(source, quote+specifier+quote, quote+replacement+quote)
+		}
+	}
+	return source
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// virtualExtensions are tried, in order, on imports between virtual files
+// that leave their extension out.
+var virtualExtensions = []string{".ts", ".tsx", ".js", ".jsx", ".mjs", ".cjs", ".mts", ".cts", ".json", ".css"}
+
+// virtualFS holds the files of a multi-file build, keyed by absolute paths
+// like "/src/index.ts". Nothing outside of it is ever read from disk.
+type virtualFS map[string]string
+
+// cleanFiles returns files keyed by cleaned absolute paths.
+func cleanFiles(files map[string]string) (virtualFS, error) {
+	fs := make(virtualFS, len(files))
+	for name, contents := range files {
+		if name == "" || strings.HasSuffix(name, "/") {
+			return nil, errors.New("invalid file name: " + name)
+		}
+		fs[path.Clean("/"+name)] = contents
+	}
+	return fs, nil
+}
+
+// defaultEntry is the file a build starts from when no entry is given: the
+// only file, or else an index file at the root.
+func (fs virtualFS) defaultEntry() (string, bool) {
+	if len(fs) == 1 {
+		for name := range fs {
+			return name, true
+		}
+	}
+	for _, ext := range virtualExtensions {
+		if _, ok := fs["/index"+ext]; ok {
+			return "/index" + ext, true
+		}
+	}
+	return "", false
+}
+
+// resolve finds the file imported as specifier by the file at importer,
+// trying the extensions and index files a bundler would.
+func (fs virtualFS) resolve(specifier, importer string) (string, bool) {
+	p := specifier
+	if !strings.HasPrefix(specifier, "/") {
+		p = path.Join(path.Dir(importer), specifier)
+	}
+	p = path.Clean(p)
+	candidates := []string{p}
+	for _, ext := range virtualExtensions {
+		candidates = append(candidates, p+ext)
+	}
+	for _, ext := range virtualExtensions {
+		candidates = append(candidates, p+"/index"+ext)
+	}
+	for _, candidate := range candidates {
+		if _, ok := fs[candidate]; ok {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// plugin resolves the entry and the relative and absolute imports between
+// the files, leaving URLs and bare imports to the http plugin.
+func (fs virtualFS) plugin() api.Plugin {
+	return api.Plugin{
+		Name: "virtual",
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(api.OnResolveOptions{Filter: `^(/|\./|\.\./)`},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					if args.Kind != api.ResolveEntryPoint && args.Namespace != "virtual" {
+						return api.OnResolveResult{}, nil
+					}
+					resolved, ok := fs.resolve(args.Path, args.Importer)
+					if !ok {
+						// Never fall through to esbuild, which would look on
+						// disk.
+						return api.OnResolveResult{Errors: []api.Message{{Text: "Could not resolve \"" + args.Path + "\" among the files given"}}}, nil
+					}
+					return api.OnResolveResult{Path: resolved, Namespace: "virtual"}, nil
+				})
+			build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: "virtual"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					contents := fs[args.Path]
+					loader, ok := loadersByExtension[path.Ext(args.Path)]
+					if !ok {
+						loader = api.LoaderJS
+					}
+					return api.OnLoadResult{Contents: &contents, Loader: loader}, nil
+				})
+		},
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPackageCDN = "https://cdn.jsdelivr.net/npm/"
+	// warmWorkers is how many entries are warmed at once, so warming never
+	// takes over from real requests.
+	warmWorkers = 2
+	// warmQueueSize is how many entries may wait to be warmed.
+	warmQueueSize = 1000
+	// recentWarmResults is how many results are kept for the status report.
+	recentWarmResults   = 100
+	maxWarmRequestBytes = 1 << 20
+)
+
+// warmConfig lists modules to download ahead of the first build needing
+// them.
+type warmConfig struct {
+	// Entries are module URLs or package specs like "react@17.0.2", warmed
+	// once the engine is ready.
+	Entries []string `json:"entries"`
+	// PackageCDN is where package specs the import map doesn't resolve are
+	// downloaded from, both here and for bare imports of modules served at
+	// /m/.
+	PackageCDN string `json:"packageCdn"`
+}
+
+func (c warmConfig) packageCDN() string {
+	if c.PackageCDN == "" {
+		return defaultPackageCDN
+	}
+	return c.PackageCDN
+}
+
+// warmResult reports how warming an entry went.
+type warmResult struct {
+	Entry    string    `json:"entry"`
+	Finished time.Time `json:"finished"`
+	Modules  int       `json:"modules"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// warmer bundles entries in the background, which fills the module cache
+// and, when there is one, the shared build cache.
+type warmer struct {
+	queue chan string
+	once  sync.Once
+
+	mu      sync.Mutex
+	results []warmResult
+}
+
+var warming = &warmer{queue: make(chan string, warmQueueSize)}
+
+// enqueue adds entries to the queue, returning how many fit.
+func (w *warmer) enqueue(entries []string) int {
+	w.once.Do(func() {
+		for i := 0; i < warmWorkers; i++ {
+			go w.work()
+		}
+	})
+	n := 0
+	for _, entry := range entries {
+		select {
+		case w.queue <- entry:
+			n++
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+func (w *warmer) work() {
+	for entry := range w.queue {
+		w.report(warmEntry(entry))
+	}
+}
+
+func (w *warmer) report(result warmResult) {
+	if result.Error != "" {
+		log.Printf("warming %s: %s", result.Entry, result.Error)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.results = append(w.results, result)
+	if len(w.results) > recentWarmResults {
+		w.results = w.results[1:]
+	}
+}
+
+func (w *warmer) recent() []warmResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]warmResult{}, w.results...)
+}
+
+// warmSource is the source of a build importing entry, which is a URL or a
+// package spec.
+func warmSource(entry string) string {
+	specifier := entry
+	if !strings.HasPrefix(entry, "https://") && !strings.HasPrefix(entry, "http://") {
+		if _, ok := cfg.ImportMap.resolve(entry, ""); !ok {
+			specifier = cfg.Warm.packageCDN() + entry
+		}
+	}
+	quoted, _ := json.Marshal(specifier)
+	return "export * from " + string(quoted) + ";"
+}
+
+func warmEntry(entry string) warmResult {
+	result := warmResult{Entry: entry}
+	for underPressure() {
+		// Warming is never worth shedding real requests for.
+		time.Sleep(time.Second)
+	}
+	built, err := runCachedBuild(buildRequest{
+		Source:    warmSource(entry),
+		Bundle:    true,
+		ImportMap: cfg.ImportMap,
+	})
+	result.Finished = time.Now().UTC()
+	if err != nil {
+		result.Error = err.Error()
+	} else if len(built.Errors) > 0 {
+		result.Error = built.Errors[0].Text
+	}
+	if built != nil {
+		result.Modules = len(built.Manifest.Modules)
+	}
+	return result
+}
+
+// handleWarm queues module URLs or package specs to be downloaded ahead of
+// time:
+//
+//	POST /v1/admin/warm  {"entries": ["react@17.0.2", "https://..."]}
+//	GET  /v1/admin/warm  the most recently warmed entries
+func handleWarm(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, warming.recent())
+	case "POST":
+		var body struct {
+			Entries []string `json:"entries"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWarmRequestBytes)).Decode(&body); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		queued := warming.enqueue(body.Entries)
+		if queued < len(body.Entries) {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "queued "+strconv.Itoa(queued)+" of "+strconv.Itoa(len(body.Entries))+" entries, the queue is full", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]int{"queued": queued})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhooksConfig names URLs that are sent a JSON POST around each build, so
+// organizations can enforce their own policies and collect build data.
+type webhooksConfig struct {
+	// PreBuild is called before building and may veto the build by
+	// responding with {"allow": false, "reason": "..."}.
+	PreBuild string `json:"preBuild"`
+	// PostBuild is called after each successful build with its manifest
+	// and stats. Its response is ignored.
+	PostBuild string   `json:"postBuild"`
+	Timeout   duration `json:"timeout"`
+}
+
+type webhookPayload struct {
+	Event    string         `json:"event"`
+	Tenant   string         `json:"tenant,omitempty"`
+	Request  buildRequest   `json:"request"`
+	Manifest *buildManifest `json:"manifest,omitempty"`
+	Stats    *buildStats    `json:"stats,omitempty"`
+}
+
+type preBuildResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+func webhookClient() *http.Client {
+	timeout := time.Duration(cfg.Webhooks.Timeout)
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &http.Client{Timeout: timeout}
+}
+
+func postWebhook(url string, payload webhookPayload) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	res, err := webhookClient().Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, fmt.Errorf("POST %s: %s", url, res.Status)
+	}
+	return res, nil
+}
+
+// preBuildHook asks the pre-build webhook whether the build may go ahead,
+// returning the reason when it may not. Builds are refused if the webhook
+// can't be reached, as it may be enforcing a policy.
+func preBuildHook(tenant string, req buildRequest) (allowed bool, reason string, err error) {
+	if cfg.Webhooks.PreBuild == "" {
+		return true, "", nil
+	}
+	res, err := postWebhook(cfg.Webhooks.PreBuild, webhookPayload{
+		Event:   "build.started",
+		Tenant:  tenant,
+		Request: req,
+	})
+	if err != nil {
+		return false, "", err
+	}
+	defer res.Body.Close()
+	var decision preBuildResponse
+	if err := json.NewDecoder(res.Body).Decode(&decision); err != nil {
+		return false, "", err
+	}
+	return decision.Allow, decision.Reason, nil
+}
+
+// postBuildHook sends the result of a build to the post-build webhook in the
+// background.
+func postBuildHook(tenant string, req buildRequest, result *buildResult) {
+	if cfg.Webhooks.PostBuild == "" {
+		return
+	}
+	payload := webhookPayload{
+		Event:    "build.finished",
+		Tenant:   tenant,
+		Request:  req,
+		Manifest: &result.Manifest,
+		Stats:    &result.Stats,
+	}
+	go func() {
+		res, err := postWebhook(cfg.Webhooks.PostBuild, payload)
+		if err != nil {
+			log.Println("post-build webhook:", err)
+			return
+		}
+		res.Body.Close()
+	}()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is the little of WebSocket (RFC 6455) build sessions need: text
+// messages, which may be fragmented, pings and closing.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Close codes.
+const (
+	wsNormalClosure   = 1000
+	wsProtocolError   = 1002
+	wsUnsupportedData = 1003
+	wsMessageTooBig   = 1009
+)
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+// wsError closes a connection with a code saying why.
+type wsError struct {
+	code   int
+	reason string
+}
+
+func (e *wsError) Error() string { return e.reason }
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	// mu serializes writes, as pongs are written while reading.
+	mu sync.Mutex
+}
+
+// upgradeWebSocket completes the opening handshake of a WebSocket, taking
+// over the connection. When it can't, it responds with an error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, bool) {
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "this endpoint only speaks WebSocket", http.StatusUpgradeRequired)
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return nil, false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, false
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket is not supported", http.StatusInternalServerError)
+		return nil, false
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return &wsConn{conn: conn, rw: rw}, true
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text message, answering pings on the way.
+// It waits at most idle for each frame, and returns errWebSocketClosed
+// once the client closes the connection.
+func (c *wsConn) readMessage(maxBytes int64, idle time.Duration) ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(idle))
+		fin, opcode, payload, err := c.readFrame(maxBytes - int64(len(message)))
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return nil, errWebSocketClosed
+		case wsBinary:
+			return nil, &wsError{wsUnsupportedData, "only text messages are understood"}
+		case wsText:
+			if started {
+				return nil, &wsError{wsProtocolError, "a new message began before the last ended"}
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, &wsError{wsProtocolError, "a continuation began no message"}
+			}
+		default:
+			return nil, &wsError{wsProtocolError, "unknown opcode"}
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame(maxBytes int64) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.rw, header[:]); err != nil {
+		return
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0F
+	if header[1]&0x80 == 0 {
+		err = &wsError{wsProtocolError, "frames from clients must be masked"}
+		return
+	}
+	length := int64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var n [2]byte
+		if _, err = io.ReadFull(c.rw, n[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(n[:]))
+	case 127:
+		var n [8]byte
+		if _, err = io.ReadFull(c.rw, n[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(n[:]))
+	}
+	if opcode >= wsClose && length > 125 {
+		err = &wsError{wsProtocolError, "control frames must be short"}
+		return
+	}
+	if length < 0 || length > maxBytes {
+		err = &wsError{wsMessageTooBig, "message is too big"}
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.rw, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	c.rw.Write(header)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+func (c *wsConn) writeText(message []byte) error {
+	return c.writeFrame(wsText, message)
+}
+
+// close sends a close frame with code and reason, then closes the
+// connection without waiting for the client's reply.
+func (c *wsConn) close(code int, reason string) {
+	payload := []byte{byte(code >> 8), byte(code)}
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	c.writeFrame(wsClose, append(payload, reason...))
+	c.conn.Close()
+}